@@ -0,0 +1,350 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnsrunner is a DNS resolution latency load runner, sending queries
+// (over udp) directly to a given resolver.
+package dnsrunner // import "istio.io/fortio/dnsrunner"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+)
+
+const (
+	// DNSURLPrefix is the prefix of the dns://[resolver]/name[?type=AAAA]
+	// targets (see ParseDNSURL).
+	DNSURLPrefix = "dns://"
+	// NoError is the RetCodes key of successful lookups. The other positive
+	// codes are the dns response code (RCODE) as is, e.g. ServFail, NXDomain.
+	NoError = 0
+	// ServFail is the server failure response code.
+	ServFail = 2
+	// NXDomain is the non existent domain response code.
+	NXDomain = 3
+	// SocketError is the RetCodes key of the send or receive errors.
+	SocketError = -1
+	// Timeout is the RetCodes key of the queries without response within
+	// the ReqTimeout.
+	Timeout = -2
+	// ReqTimeOutDefaultValue is the default time to wait for a response.
+	ReqTimeOutDefaultValue = 2 * time.Second
+	// DefaultQueryType is the type of the queries when none is specified.
+	DefaultQueryType = "A"
+	resolvConf       = "/etc/resolv.conf"
+	maxResponseSize  = 4096
+)
+
+// QueryTypes maps the supported query type names to their value.
+var QueryTypes = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+	"ANY":   255,
+}
+
+// RcodeName returns a printable name for the RetCodes keys.
+func RcodeName(code int) string {
+	switch code {
+	case NoError:
+		return "NOERROR"
+	case 1:
+		return "FORMERR"
+	case ServFail:
+		return "SERVFAIL"
+	case NXDomain:
+		return "NXDOMAIN"
+	case 4:
+		return "NOTIMP"
+	case 5:
+		return "REFUSED"
+	case SocketError:
+		return "SOCKET ERROR"
+	case Timeout:
+		return "TIMEOUT"
+	}
+	return "RCODE " + strconv.Itoa(code)
+}
+
+// DNSOptions are the options of a DNSClient.
+type DNSOptions struct {
+	// Resolver is the host:port (or host, for port 53) of the dns server to
+	// query. Defaults to the first nameserver of /etc/resolv.conf.
+	Resolver string
+	// Name to look up.
+	Name string
+	// QueryType is one of the QueryTypes names, defaults to A.
+	QueryType string
+	// ReqTimeout is how long to wait for the response.
+	ReqTimeout time.Duration
+}
+
+// ParseDNSURL sets the options from a dns://[resolver[:port]]/name[?type=T]
+// url.
+func (o *DNSOptions) ParseDNSURL(dnsURL string) error {
+	u, err := url.Parse(dnsURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme+"://" != DNSURLPrefix {
+		return fmt.Errorf("expecting %s prefix in %q", DNSURLPrefix, dnsURL)
+	}
+	o.Resolver = u.Host
+	o.Name = strings.TrimPrefix(u.Path, "/")
+	if t := u.Query().Get("type"); t != "" {
+		o.QueryType = t
+	}
+	return nil
+}
+
+// DNSClient sends the query and waits for its response, on a "connected"
+// udp socket. Responses to previous (timed out) queries are skipped.
+type DNSClient struct {
+	resolver   string
+	name       string
+	reqTimeout time.Duration
+	conn       net.Conn
+	query      []byte // the id (first 2 bytes) changes for each query
+	buffer     []byte
+}
+
+// defaultResolver returns the first nameserver of resolv.conf.
+func defaultResolver(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 2 && f[0] == "nameserver" {
+			return f[1], nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver found in %s", filename)
+}
+
+// NewDNSClient creates a client (and its socket) for the options.
+func NewDNSClient(o *DNSOptions) (*DNSClient, error) {
+	resolver := o.Resolver
+	if resolver == "" {
+		var err error
+		if resolver, err = defaultResolver(resolvConf); err != nil {
+			return nil, err
+		}
+		log.LogVf("Using default resolver %s", resolver)
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+	}
+	qtypeName := strings.ToUpper(o.QueryType)
+	if qtypeName == "" {
+		qtypeName = DefaultQueryType
+	}
+	qtype, found := QueryTypes[qtypeName]
+	if !found {
+		return nil, fmt.Errorf("unknown dns query type %q", o.QueryType)
+	}
+	query, err := buildQuery(o.Name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	c := DNSClient{
+		resolver:   resolver,
+		name:       o.Name,
+		reqTimeout: o.ReqTimeout,
+		query:      query,
+		buffer:     make([]byte, maxResponseSize),
+	}
+	if c.reqTimeout <= 0 {
+		c.reqTimeout = ReqTimeOutDefaultValue
+	}
+	if c.conn, err = net.Dial("udp", resolver); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(c.query, uint16(time.Now().UnixNano())) // initial id
+	return &c, nil
+}
+
+// buildQuery returns the dns query message (with id 0) for name and qtype.
+func buildQuery(name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, errors.New("empty dns name")
+	}
+	q := []byte{
+		0, 0, // id
+		1, 0, // flags: recursion desired
+		0, 1, // 1 question
+		0, 0, 0, 0, 0, 0, // no answer, authority nor additional records
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns name %q", name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, byte(qtype>>8), byte(qtype), 0, 1) // root, qtype, class IN
+	return q, nil
+}
+
+// Lookup sends the next query and returns the NoError, response code,
+// Timeout or SocketError code.
+func (c *DNSClient) Lookup() int {
+	id := binary.BigEndian.Uint16(c.query) + 1
+	binary.BigEndian.PutUint16(c.query, id)
+	if err := c.conn.SetDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		log.Errf("Unable to set deadline for %s : %v", c.resolver, err)
+		return SocketError
+	}
+	if _, err := c.conn.Write(c.query); err != nil {
+		log.Errf("Unable to send query to %s : %v", c.resolver, err)
+		return SocketError
+	}
+	for {
+		n, err := c.conn.Read(c.buffer)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				log.Debugf("Timeout waiting for %s response for %s", c.resolver, c.name)
+				return Timeout
+			}
+			log.Errf("Unable to receive from %s : %v", c.resolver, err)
+			return SocketError
+		}
+		if n < 12 || binary.BigEndian.Uint16(c.buffer) != id || c.buffer[2]&0x80 == 0 {
+			log.LogVf("Skipping unexpected %d bytes (late or invalid) response from %s", n, c.resolver)
+			continue
+		}
+		return int(c.buffer[3] & 0x0f) // RCODE
+	}
+}
+
+// Close closes the socket.
+func (c *DNSClient) Close() {
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("Error closing dns socket to %s : %v", c.resolver, err)
+	}
+}
+
+// DNSRunnerResults is the aggregated result of a DNS run.
+// Also is the internal type used per thread/goroutine.
+type DNSRunnerResults struct {
+	periodic.RunnerResults
+	client   *DNSClient
+	RetCodes map[int]int64
+	Resolver string
+	Name     string
+	// code of the last call, for LastCall()
+	lastCode int
+}
+
+// Run does one lookup. To be set as the Function in RunnerOptions.
+func (dnsstate *DNSRunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	code := dnsstate.client.Lookup()
+	dnsstate.RetCodes[code]++
+	dnsstate.lastCode = code
+}
+
+// LastCall returns the code and name of the last call (periodic.CallRecorder).
+func (dnsstate *DNSRunnerResults) LastCall() (int, string) {
+	return dnsstate.lastCode, dnsstate.Name
+}
+
+// DNSRunnerOptions includes the base RunnerOptions plus dns specific
+// options.
+type DNSRunnerOptions struct {
+	periodic.RunnerOptions
+	DNSOptions
+	AllowInitialErrors bool // whether initial errors (non NoError) don't cause an abort
+}
+
+// RunDNSTest runs a dns lookups test and returns the aggregated stats.
+func RunDNSTest(o *DNSRunnerOptions) (*DNSRunnerResults, error) {
+	o.RunType = "DNS"
+	log.Infof("Starting dns test for %s %s on %s with %d threads at %.1f qps",
+		o.QueryType, o.Name, o.Resolver, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := DNSRunnerResults{
+		RetCodes: make(map[int]int64),
+		Resolver: o.Resolver,
+		Name:     o.Name,
+	}
+	dnsstate := make([]DNSRunnerResults, numThreads)
+	// Close the clients created so far in case of error
+	defer func() {
+		for i := range dnsstate {
+			if dnsstate[i].client != nil {
+				dnsstate[i].client.Close()
+			}
+		}
+	}()
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &dnsstate[i]
+		// Create a client for each 'thread'
+		var err error
+		if dnsstate[i].client, err = NewDNSClient(&o.DNSOptions); err != nil {
+			return nil, err
+		}
+		if o.Exactly <= 0 {
+			code := dnsstate[i].client.Lookup()
+			if !o.AllowInitialErrors && code != NoError {
+				return nil, fmt.Errorf("error %s for %s", RcodeName(code), o.Name)
+			}
+		}
+		dnsstate[i].RetCodes = make(map[int]int64)
+		dnsstate[i].Name = total.Name
+	}
+	total.Resolver = dnsstate[0].client.resolver
+	total.RunnerResults = r.Run()
+	keys := []int{}
+	for i := 0; i < numThreads; i++ {
+		for k := range dnsstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += dnsstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	sort.Ints(keys)
+	totalCount := float64(total.DurationHistogram.Count)
+	for _, k := range keys {
+		fmt.Fprintf(out, "Code %3d %s : %d (%.1f %%)\n", k, RcodeName(k), total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+		if k != NoError {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
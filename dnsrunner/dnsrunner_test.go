@@ -0,0 +1,158 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsrunner
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubDNSServer answers A queries for known.test. with 10.1.2.3, SERVFAIL
+// for servfail.test., doesn't answer drop.test. and answers NXDOMAIN for
+// everything else. Returns the server address.
+func stubDNSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 17 {
+				continue
+			}
+			// Decode the question name:
+			var labels []string
+			i := 12
+			for i < n && buf[i] != 0 {
+				l := int(buf[i])
+				labels = append(labels, string(buf[i+1:i+1+l]))
+				i += 1 + l
+			}
+			question := buf[12 : i+5] // name, root, qtype and class
+			qtype := binary.BigEndian.Uint16(buf[i+1:])
+			var rcode byte
+			var answers []byte
+			switch strings.Join(labels, ".") {
+			case "known.test":
+				if qtype == QueryTypes["A"] {
+					answers = []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 1, 2, 3}
+				}
+			case "servfail.test":
+				rcode = ServFail
+			case "drop.test":
+				continue
+			default:
+				rcode = NXDomain
+			}
+			resp := []byte{buf[0], buf[1], 0x81, 0x80 | rcode, 0, 1, 0, 0, 0, 0, 0, 0}
+			if len(answers) > 0 {
+				resp[7] = 1
+			}
+			resp = append(resp, question...)
+			resp = append(resp, answers...)
+			conn.WriteTo(resp, addr) // nolint: errcheck
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSRunner(t *testing.T) {
+	resolver := stubDNSServer(t)
+	tests := []struct {
+		name  string
+		qtype string
+		code  int
+	}{
+		{"known.test", "", NoError},
+		{"known.test.", "aaaa", NoError}, // no answer but no error either
+		{"unknown.test", "A", NXDomain},
+		{"servfail.test", "MX", ServFail},
+	}
+	for _, tst := range tests {
+		opts := DNSRunnerOptions{DNSOptions: DNSOptions{Resolver: resolver, Name: tst.name, QueryType: tst.qtype}}
+		opts.QPS = 100
+		opts.NumThreads = 2
+		opts.Exactly = 10
+		res, err := RunDNSTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[tst.code] != 10 || res.DurationHistogram.Count != 10 {
+			t.Errorf("%+v: expected 10 %s, got %v", tst, RcodeName(tst.code), res.RetCodes)
+		}
+	}
+	// Timeout:
+	opts := DNSRunnerOptions{DNSOptions: DNSOptions{Resolver: resolver, Name: "drop.test", ReqTimeout: 50 * time.Millisecond}}
+	opts.QPS = -1
+	opts.NumThreads = 1
+	opts.Exactly = 2
+	res, err := RunDNSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Timeout] != 2 {
+		t.Errorf("expected 2 timeouts, got %v", res.RetCodes)
+	}
+	// Errors on initial (warmup) calls abort:
+	opts.Name = "unknown.test"
+	opts.Exactly = 0
+	opts.Duration = 10 * time.Millisecond
+	if _, err = RunDNSTest(&opts); err == nil {
+		t.Errorf("expected error for initial NXDOMAIN")
+	}
+}
+
+func TestDNSOptions(t *testing.T) {
+	o := DNSOptions{}
+	if err := o.ParseDNSURL("dns://1.2.3.4/www.google.com?type=AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if o.Resolver != "1.2.3.4" || o.Name != "www.google.com" || o.QueryType != "AAAA" {
+		t.Errorf("unexpected parse result %+v", o)
+	}
+	if err := o.ParseDNSURL("http://1.2.3.4/foo"); err == nil {
+		t.Errorf("expected error for non dns url")
+	}
+	o = DNSOptions{Resolver: "127.0.0.1", Name: "foo.test", QueryType: "BAD"}
+	if _, err := NewDNSClient(&o); err == nil {
+		t.Errorf("expected error for bad query type")
+	}
+	o.QueryType = "TXT"
+	o.Name = "."
+	if _, err := NewDNSClient(&o); err == nil {
+		t.Errorf("expected error for empty name")
+	}
+	f, err := ioutil.TempFile("", "fortio-resolv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	data := "# comment\nsearch foo.test\nnameserver 10.0.0.53\nnameserver 10.0.0.54\n"
+	f.WriteString(data) // nolint: errcheck
+	f.Close()           // nolint: errcheck
+	if r, err := defaultResolver(f.Name()); err != nil || r != "10.0.0.53" {
+		t.Errorf("expected first nameserver, got %q %v", r, err)
+	}
+}
@@ -16,22 +16,40 @@ package fgrpc // import "istio.io/fortio/fgrpc"
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	_ "google.golang.org/grpc/balancer/roundrobin" // registers the round_robin policy
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the gzip compressor
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	grpcstats "google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 
 	"strings"
 
 	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
 	"istio.io/fortio/periodic"
+	"istio.io/fortio/stats"
 )
 
 const (
@@ -41,36 +59,278 @@ const (
 	defaultHTTPSPort = "443"
 	prefixHTTP       = "http://"
 	prefixHTTPS      = "https://"
+	prefixUnix       = "unix://"
 )
 
+// ClientTLSOptions are the client side TLS options for DialTLS.
+type ClientTLSOptions struct {
+	CACert       string // Path to CA certificate to verify the server
+	CertOverride string // Override the cert virtual host of authority
+	ClientCert   string // Path to the client certificate (mTLS), with ClientKey
+	ClientKey    string // Path to the client key (mTLS), with ClientCert
+	// Server name sent as SNI, independent of CertOverride which, when set,
+	// is then only used for verifying the server certificate.
+	ServerName string
+	// TLS versions and cipher suites restrictions.
+	fnet.TLSOptions
+	phases *phaseRecorder // nil unless recording the connections' phases
+	// local addresses to connect from, nil unless SourceAddresses is set
+	sources *fnet.SourceAddresses
+	family  fnet.AddressFamily // of the tcp connections
+	policy  string             // load balancing policy, default is pick_first
+}
+
 // Dial dials grpc using insecure or tls transport security when serverAddr
 // has prefixHTTPS or cert is provided. If override is set to a non empty string,
-// it will override the virtual host name of authority in requests.
-func Dial(serverAddr, cacert, override string) (conn *grpc.ClientConn, err error) {
-	var opts []grpc.DialOption
+// it will override the virtual host name of authority in requests. Optional
+// extraOpts are added to the dial options.
+func Dial(serverAddr, cacert, override string, extraOpts ...grpc.DialOption) (conn *grpc.ClientConn, err error) {
+	return DialTLS(serverAddr, &ClientTLSOptions{CACert: cacert, CertOverride: override}, extraOpts...)
+}
+
+// DialTLS is like Dial with the additional TLS options, e.g. to present a
+// client certificate when both ClientCert and ClientKey are set or to set
+// the SNI ServerName.
+func DialTLS(serverAddr string, t *ClientTLSOptions, extraOpts ...grpc.DialOption) (conn *grpc.ClientConn, err error) {
+	return dialTLS(context.Background(), serverAddr, t, extraOpts...)
+}
+
+// dialTLS is DialTLS with a context, which bounds the connection
+// establishment when grpc.WithBlock() is one of the extraOpts.
+func dialTLS(ctx context.Context, serverAddr string, t *ClientTLSOptions,
+	extraOpts ...grpc.DialOption) (conn *grpc.ClientConn, err error) {
+	opts := append([]grpc.DialOption{}, extraOpts...)
+	cacert := t.CACert
+	override := t.CertOverride
+	var creds credentials.TransportCredentials
 	switch {
+	case (t.ClientCert != "" && t.ClientKey != "") || t.ServerName != "" ||
+		(t.TLSOptions.IsSet() && (cacert != "" || strings.HasPrefix(serverAddr, prefixHTTPS))):
+		creds, err = tlsCredentials(serverAddr, t)
+		if err != nil {
+			log.Errf("Invalid TLS credentials: %v\n", err)
+			return nil, err
+		}
 	case cacert != "":
-		creds, err := credentials.NewClientTLSFromFile(cacert, override)
+		creds, err = credentials.NewClientTLSFromFile(cacert, override)
 		if err != nil {
 			log.Errf("Invalid TLS credentials: %v\n", err)
 			return nil, err
 		}
 		log.Infof("Using CA certificate %v to construct TLS credentials", cacert)
-		opts = append(opts, grpc.WithTransportCredentials(creds))
 	case strings.HasPrefix(serverAddr, prefixHTTPS):
-		creds := credentials.NewTLS(nil)
-		opts = append(opts, grpc.WithTransportCredentials(creds))
-	default:
+		creds = credentials.NewTLS(nil)
+	}
+	switch {
+	case creds == nil:
 		opts = append(opts, grpc.WithInsecure())
+	case t.phases != nil:
+		opts = append(opts, grpc.WithTransportCredentials(&timedCredentials{creds, t.phases}))
+	default:
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	}
+	if t.policy != "" {
+		// grpc.WithBalancerName panics for unknown policies
+		if balancer.Get(t.policy) == nil {
+			err = fmt.Errorf("unknown load balancing policy %q", t.policy)
+			log.Errf("Unable to dial %s: %v", serverAddr, err)
+			return nil, err
+		}
+		opts = append(opts, grpc.WithBalancerName(t.policy))
 	}
 	serverAddr = grpcDestination(serverAddr)
-	conn, err = grpc.Dial(serverAddr, opts...)
+	network := "tcp"
+	if isUnixSocket(serverAddr) {
+		log.Infof("Using unix domain socket %s", serverAddr)
+		network = "unix"
+	}
+	if network == "unix" || t.phases != nil || t.sources != nil || t.family.Network(network) != network {
+		opts = append(opts, grpc.WithDialer(t.dialer(network)))
+	}
+	if t.phases != nil {
+		opts = append(opts, grpc.WithStatsHandler(t.phases))
+	}
+	conn, err = grpc.DialContext(ctx, serverAddr, opts...)
 	if err != nil {
 		log.Errf("failed to connect to %s with certificate %s and override %s: %v", serverAddr, cacert, override, err)
 	}
 	return conn, err
 }
 
+// dialer returns the grpc dialer for the network, binding the tcp connections
+// to the source addresses, restricting them to the address family and timing
+// their connect, when set.
+func (t *ClientTLSOptions) dialer(network string) func(string, time.Duration) (net.Conn, error) {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		d := &net.Dialer{Timeout: timeout}
+		if network == "tcp" {
+			d = t.sources.Dialer(timeout)
+		}
+		start := time.Now()
+		conn, err := d.Dial(t.family.Network(network), addr)
+		if err == nil && t.phases != nil {
+			t.phases.record(t.phases.phases.Connect, start)
+		}
+		return conn, err
+	}
+}
+
+// tlsCredentials returns the transport credentials presenting the (optional)
+// client certificate, sending the ServerName (SNI) and verifying the server
+// with the CACert (or the system CAs) against the CertOverride if set.
+func tlsCredentials(serverAddr string, t *ClientTLSOptions) (credentials.TransportCredentials, error) {
+	cfg := &tls.Config{ServerName: t.CertOverride}
+	if t.ClientCert != "" && t.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Using client certificate %v and key %v to construct TLS credentials", t.ClientCert, t.ClientKey)
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.CACert != "" {
+		b, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to append certificates from %s", t.CACert)
+		}
+		log.Infof("Using CA certificate %v to construct TLS credentials", t.CACert)
+	} else if !strings.HasPrefix(serverAddr, prefixHTTPS) {
+		log.Warnf("TLS options set without CA certificate or https prefix, using system CAs for %s", serverAddr)
+	}
+	if t.ServerName != "" {
+		log.Infof("Using TLS server name (SNI) %s", t.ServerName)
+		if t.CertOverride != "" && t.CertOverride != t.ServerName {
+			// tls.Config uses the same ServerName for SNI and verification so
+			// verify the certificate against CertOverride ourselves instead.
+			verifyName, roots := t.CertOverride, cfg.RootCAs
+			cfg.InsecureSkipVerify = true // nolint: gas
+			cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyServerCert(rawCerts, roots, verifyName)
+			}
+		}
+		cfg.ServerName = t.ServerName
+	}
+	if t.TLSOptions.IsSet() {
+		log.Infof("Using TLS versions %x - %x and cipher suites %v", t.MinTLSVersion, t.MaxTLSVersion, t.CipherSuites)
+		t.TLSOptions.Apply(cfg)
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// phaseRecorder records the connect, TLS handshake and first byte timings
+// of a run's connections and calls, which happen in the grpc goroutines
+// (hence the lock). It is the grpc stats handler measuring the first byte.
+type phaseRecorder struct {
+	mu     sync.Mutex
+	phases *fnet.PhaseTimings
+}
+
+// record records the duration since start in h (one of the phases).
+func (p *phaseRecorder) record(h *stats.Histogram, start time.Time) {
+	d := time.Since(start).Seconds()
+	p.mu.Lock()
+	h.Record(d)
+	p.mu.Unlock()
+}
+
+type phaseStartKey struct{}
+
+// TagRPC notes the start of the call (grpcstats.Handler).
+func (p *phaseRecorder) TagRPC(ctx context.Context, _ *grpcstats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, phaseStartKey{}, time.Now())
+}
+
+// HandleRPC records the first byte time when the response headers are
+// received (grpcstats.Handler).
+func (p *phaseRecorder) HandleRPC(ctx context.Context, s grpcstats.RPCStats) {
+	if _, ok := s.(*grpcstats.InHeader); !ok || !s.IsClient() {
+		return
+	}
+	if start, ok := ctx.Value(phaseStartKey{}).(time.Time); ok {
+		p.record(p.phases.FirstByte, start)
+	}
+}
+
+// TagConn is a no-op (grpcstats.Handler).
+func (p *phaseRecorder) TagConn(ctx context.Context, _ *grpcstats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+// HandleConn is a no-op (grpcstats.Handler).
+func (p *phaseRecorder) HandleConn(context.Context, grpcstats.ConnStats) {}
+
+// timedCredentials are TLS transport credentials timing the client handshakes.
+type timedCredentials struct {
+	credentials.TransportCredentials
+	phases *phaseRecorder
+}
+
+func (c *timedCredentials) ClientHandshake(ctx context.Context, authority string,
+	rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err == nil {
+		c.phases.record(c.phases.phases.TLSHandshake, start)
+	}
+	return conn, info, err
+}
+
+func (c *timedCredentials) Clone() credentials.TransportCredentials {
+	return &timedCredentials{c.TransportCredentials.Clone(), c.phases}
+}
+
+// verifyServerCert verifies the server certificate chain for name.
+func verifyServerCert(rawCerts [][]byte, roots *x509.CertPool, name string) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = c
+	}
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{Roots: roots, DNSName: name, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// rawCodec passes the request and response bytes straight through so
+// arbitrary unary methods can be invoked without their generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	}
+	return nil, fmt.Errorf("raw codec can't marshal %T, expecting []byte", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec can't unmarshal into %T, expecting *[]byte", v)
+	}
+	*b = append((*b)[:0], data...) // data buffer may be reused by grpc
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "raw"
+}
+
 // TODO: refactor common parts between http and grpc runners
 
 // GRPCRunnerResults is the aggregated result of an GRPCRunner.
@@ -81,36 +341,332 @@ type GRPCRunnerResults struct {
 	reqH        grpc_health_v1.HealthCheckRequest
 	clientP     PingServerClient
 	reqP        PingMessage
+	conn        *grpc.ClientConn
+	reqM        []byte
+	resM        []byte
+	methodOpts  []grpc.CallOption                      // call options of the generic Method calls
+	corpus      *fnet.PayloadCorpus                    // payloads sent in turn, nil unless PayloadCorpusFile
+	corpusRand  *rand.Rand                             // to pick the corpus payloads, when PayloadCorpusRandom
+	streamH     *stats.Histogram                       // this thread's stream duration histogram, nil unless PerStreamStats
+	serverH     *stats.Histogram                       // this thread's server timing histogram, nil unless ServerTimingTrailer
+	trailerKey  string                                 // ServerTimingTrailer
+	ctx         context.Context                        // context (with the outgoing Metadata if any) for each call
+	timeout     time.Duration                          // per call deadline (RequestTimeout), 0 for none
+	dial        func(string) (*grpc.ClientConn, error) // set in NewConnectionPerRequest mode
+	conns       []*grpc.ClientConn                     // one per destination, when not dialing per request
+	dests       []string                               // destinations to round robin on
+	next        int                                    // next dests/conns index
+	streamP     PingServer_PingStreamClient            // opened on first call in StreamingPing mode
+	serverS     PingServer_PingServerStreamClient      // opened on first call in ServerStreaming mode
+	cancel      context.CancelFunc                     // cancels streamP or serverS
+	lastCode    int                                    // RetCodes key of the last call, for LastCall()
 	RetCodes    HealthResultMap
+	Cancelled   int64 // in flight calls cancelled after the DrainTimeout, not in RetCodes
 	Destination string
 	Streams     int
 	Ping        bool
+	Method      string
+	// Ping messages are sent on a bidi stream (one per call) instead of unary calls
+	StreamingPing bool
+	// Ping messages are received from a server stream (one per call) instead
+	// of unary calls, and counted in StreamMessages. StreamMessageRate is the
+	// resulting number of messages per second over the run.
+	ServerStreaming   bool
+	StreamMessages    int64
+	StreamMessageRate float64
+	// Per stream index duration histograms (only when PerStreamStats is set)
+	StreamHistograms []*stats.Histogram
+	// Server reported processing times (only when ServerTimingTrailer is set)
+	ServerTimingHistogram *stats.Histogram
+	// Failed calls counts by class of error (non SERVING health statuses
+	// being application ones)
+	ErrorClasses map[fnet.ErrorClass]int64 `json:",omitempty"`
+	// TCP connect and TLS handshake durations of the new connections and
+	// first response byte durations of the calls (only when PhaseTimings is set)
+	PhaseTimings *fnet.PhaseTimings `json:",omitempty"`
+}
+
+// setup sets the call parameters of the options, for sequence number seq.
+func (grpcstate *GRPCRunnerResults) setup(o *GRPCRunnerOptions, ctx context.Context, dests []string,
+	methodOpts []grpc.CallOption, seq int64, ts int64) {
+	grpcstate.ctx = ctx
+	grpcstate.timeout = o.RequestTimeout
+	grpcstate.dests = dests
+	grpcstate.Destination = dests[0]
+	grpcstate.Ping = o.UsePing || o.StreamingPing || o.ServerStreaming
+	grpcstate.Method = o.Method
+	grpcstate.StreamingPing = o.StreamingPing
+	grpcstate.ServerStreaming = o.ServerStreaming
+	grpcstate.corpus = o.corpus
+	switch {
+	case o.Method != "":
+		grpcstate.reqM = o.RequestPayload
+		grpcstate.methodOpts = methodOpts
+	case grpcstate.Ping:
+		grpcstate.reqP = PingMessage{Payload: o.Payload, DelayNanos: o.Delay.Nanoseconds(), Seq: seq, Ts: ts}
+	default:
+		grpcstate.reqH = grpc_health_v1.HealthCheckRequest{Service: o.Service}
+	}
+}
+
+// setConn sets the connection to use and creates the corresponding client.
+func (grpcstate *GRPCRunnerResults) setConn(conn *grpc.ClientConn) {
+	grpcstate.conn = conn
+	switch {
+	case grpcstate.Method != "":
+		// generic invoke directly on the connection
+	case grpcstate.Ping:
+		grpcstate.clientP = NewPingServerClient(conn)
+	default:
+		grpcstate.clientH = grpc_health_v1.NewHealthClient(conn)
+	}
+}
+
+// call makes 1 grpc call (generic Method, ping or health check) and returns
+// the serving status (SERVING for non health calls), the result and error.
+func (grpcstate *GRPCRunnerResults) call() (grpc_health_v1.HealthCheckResponse_ServingStatus, interface{}, error) {
+	status := grpc_health_v1.HealthCheckResponse_SERVING
+	ctx := grpcstate.ctx
+	streaming := grpcstate.StreamingPing || grpcstate.ServerStreaming
+	if grpcstate.timeout > 0 && !streaming {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grpcstate.timeout)
+		defer cancel()
+	}
+	if grpcstate.corpus != nil {
+		grpcstate.nextPayload()
+	}
+	var opts []grpc.CallOption
+	if grpcstate.serverH != nil && !streaming {
+		var trailer metadata.MD
+		opts = []grpc.CallOption{grpc.Trailer(&trailer)}
+		defer func() { grpcstate.recordServerTiming(trailer) }()
+	}
+	switch {
+	case grpcstate.Method != "":
+		err := grpcstate.conn.Invoke(ctx, grpcstate.Method, grpcstate.reqM, &grpcstate.resM,
+			append(opts, grpcstate.methodOpts...)...)
+		return status, len(grpcstate.resM), err
+	case grpcstate.StreamingPing:
+		res, err := grpcstate.streamPing()
+		if err == nil && len(res.Payload) != len(grpcstate.reqP.Payload) {
+			err = fmt.Errorf("ping payload length mismatch: sent %d, received %d", len(grpcstate.reqP.Payload), len(res.Payload))
+		}
+		return status, res, err
+	case grpcstate.ServerStreaming:
+		res, err := grpcstate.serverStreamRecv()
+		if err == nil && len(res.Payload) != len(grpcstate.reqP.Payload) {
+			err = fmt.Errorf("ping payload length mismatch: sent %d, received %d", len(grpcstate.reqP.Payload), len(res.Payload))
+		}
+		return status, res, err
+	case grpcstate.Ping:
+		res, err := grpcstate.clientP.Ping(ctx, &grpcstate.reqP, opts...)
+		if err == nil && len(res.Payload) != len(grpcstate.reqP.Payload) {
+			err = fmt.Errorf("ping payload length mismatch: sent %d, received %d", len(grpcstate.reqP.Payload), len(res.Payload))
+		}
+		return status, res, err
+	default:
+		r, err := grpcstate.clientH.Check(ctx, &grpcstate.reqH, opts...)
+		if r != nil {
+			status = r.Status
+		}
+		return status, r, err
+	}
+}
+
+// nextPayload sets the next corpus payload as the request of the next call.
+func (grpcstate *GRPCRunnerResults) nextPayload() {
+	p := grpcstate.corpus.Next(grpcstate.corpusRand)
+	if grpcstate.Method != "" {
+		grpcstate.reqM = p
+	} else {
+		grpcstate.reqP.Payload = string(p)
+	}
+}
+
+// recordServerTiming records the duration found in the trailerKey trailer,
+// if any. Missing or unparsable values are skipped (logged at verbose level).
+func (grpcstate *GRPCRunnerResults) recordServerTiming(trailer metadata.MD) {
+	v := trailer.Get(grpcstate.trailerKey)
+	if len(v) == 0 {
+		log.LogVf("No %q server timing trailer", grpcstate.trailerKey)
+		return
+	}
+	d, err := time.ParseDuration(v[0])
+	if err != nil {
+		log.LogVf("Skipping invalid %q server timing trailer %q: %v", grpcstate.trailerKey, v[0], err)
+		return
+	}
+	grpcstate.serverH.Record(d.Seconds())
+}
+
+// streamPing sends 1 message on the ping stream (opening it first if needed)
+// and waits for the echo. Errors opening the stream aren't grpc status ones so
+// they are counted as -1. The stream is reset after any error, including the
+// echo not being received within the timeout (DeadlineExceeded).
+func (grpcstate *GRPCRunnerResults) streamPing() (*PingMessage, error) {
+	if grpcstate.streamP == nil {
+		ctx, cancel := context.WithCancel(grpcstate.ctx)
+		stream, err := grpcstate.clientP.PingStream(ctx)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("unable to open ping stream: %v", err)
+		}
+		grpcstate.streamP = stream
+		grpcstate.cancel = cancel
+	}
+	var timer *time.Timer
+	if grpcstate.timeout > 0 {
+		timer = time.AfterFunc(grpcstate.timeout, grpcstate.cancel)
+	}
+	err := grpcstate.streamP.Send(&grpcstate.reqP)
+	var res *PingMessage
+	if err == nil {
+		res, err = grpcstate.streamP.Recv()
+	}
+	if timer != nil && !timer.Stop() {
+		err = status.Errorf(codes.DeadlineExceeded, "no ping stream echo within %v", grpcstate.timeout)
+	}
+	if err != nil {
+		grpcstate.cancel()
+		grpcstate.streamP = nil
+		return nil, err
+	}
+	return res, nil
+}
+
+// serverStreamRecv receives the next message of the server stream (opening
+// it first if needed). The stream errors, including its end, aren't reported
+// as grpc status ones so they are counted as -1, except for no message being
+// received within the timeout (DeadlineExceeded). The stream is reset after
+// any error.
+func (grpcstate *GRPCRunnerResults) serverStreamRecv() (*PingMessage, error) {
+	if grpcstate.serverS == nil {
+		ctx, cancel := context.WithCancel(grpcstate.ctx)
+		stream, err := grpcstate.clientP.PingServerStream(ctx, &grpcstate.reqP)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("unable to open server stream: %v", err)
+		}
+		grpcstate.serverS = stream
+		grpcstate.cancel = cancel
+	}
+	var timer *time.Timer
+	if grpcstate.timeout > 0 {
+		timer = time.AfterFunc(grpcstate.timeout, grpcstate.cancel)
+	}
+	res, err := grpcstate.serverS.Recv()
+	if err == io.EOF {
+		err = fmt.Errorf("server stream ended")
+	} else if err != nil {
+		err = fmt.Errorf("server stream error: %v", err)
+	}
+	if timer != nil && !timer.Stop() {
+		err = status.Errorf(codes.DeadlineExceeded, "no server stream message within %v", grpcstate.timeout)
+	}
+	if err != nil {
+		grpcstate.cancel()
+		grpcstate.serverS = nil
+		return nil, err
+	}
+	return res, nil
 }
 
-// Run exercises GRPC health check or ping at the target QPS.
+// closeStream closes the ping or server stream, if any, and returns the error
+// (from the server side end of the ping stream not being clean). The server
+// stream is just cancelled.
+func (grpcstate *GRPCRunnerResults) closeStream() error {
+	if grpcstate.serverS != nil {
+		grpcstate.cancel()
+		grpcstate.serverS = nil
+	}
+	if grpcstate.streamP == nil {
+		return nil
+	}
+	defer grpcstate.cancel()
+	stream := grpcstate.streamP
+	grpcstate.streamP = nil
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		return fmt.Errorf("unexpected ping stream close result: %v", err)
+	}
+	return nil
+}
+
+// closeConn closes the current connection (NewConnectionPerRequest mode).
+func (grpcstate *GRPCRunnerResults) closeConn() {
+	if err := grpcstate.closeStream(); err != nil {
+		log.Warnf("Error closing ping stream: %v", err)
+	}
+	if err := grpcstate.conn.Close(); err != nil {
+		log.Warnf("Error closing grpc connection: %v", err)
+	}
+	grpcstate.conn = nil
+}
+
+// Run exercises GRPC health check, ping or the generic Method at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (grpcstate *GRPCRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
-	var err error
+	var start time.Time
+	if grpcstate.streamH != nil {
+		start = time.Now()
+	}
+	var status grpc_health_v1.HealthCheckResponse_ServingStatus
 	var res interface{}
-	status := grpc_health_v1.HealthCheckResponse_SERVING
-	if grpcstate.Ping {
-		res, err = grpcstate.clientP.Ping(context.Background(), &grpcstate.reqP)
-	} else {
-		var r *grpc_health_v1.HealthCheckResponse
-		r, err = grpcstate.clientH.Check(context.Background(), &grpcstate.reqH)
-		if r != nil {
-			status = r.Status
-			res = r
+	var err error
+	if len(grpcstate.dests) > 1 {
+		grpcstate.nextDestination()
+	}
+	if grpcstate.dial != nil {
+		var conn *grpc.ClientConn
+		conn, err = grpcstate.dial(grpcstate.Destination)
+		if err == nil {
+			grpcstate.setConn(conn)
+			status, res, err = grpcstate.call()
+			grpcstate.closeConn()
 		}
+	} else {
+		status, res, err = grpcstate.call()
+	}
+	if grpcstate.streamH != nil {
+		grpcstate.streamH.Record(time.Since(start).Seconds())
+	}
+	log.Debugf("For %d (ping=%v stream=%v method=%q) got %v %v", t, grpcstate.Ping, grpcstate.StreamingPing, grpcstate.Method, err, res)
+	if err != nil && grpcstate.ctx.Err() != nil {
+		log.LogVf("In flight grpc call cancelled after abort: %v", err)
+		grpcstate.Cancelled++
+		return
 	}
-	log.Debugf("For %d (ping=%v) got %v %v", t, grpcstate.Ping, err, res)
 	if err != nil {
 		log.Warnf("Error making grpc call: %v", err)
-		grpcstate.RetCodes[-1]++
-	} else {
-		grpcstate.RetCodes[status]++
+		status = ErrorKey(err)
+		grpcstate.ErrorClasses[ErrorClass(err)]++
+	} else if status != grpc_health_v1.HealthCheckResponse_SERVING {
+		grpcstate.ErrorClasses[fnet.ApplicationError]++
+	}
+	grpcstate.RetCodes[status]++
+	grpcstate.lastCode = int(status)
+	if err == nil && grpcstate.ServerStreaming {
+		grpcstate.StreamMessages++
+	}
+}
+
+// nextDestination switches to the next destination (round robin).
+func (grpcstate *GRPCRunnerResults) nextDestination() {
+	grpcstate.Destination = grpcstate.dests[grpcstate.next]
+	if grpcstate.dial == nil {
+		grpcstate.setConn(grpcstate.conns[grpcstate.next])
 	}
+	grpcstate.next = (grpcstate.next + 1) % len(grpcstate.dests)
+}
+
+// LastCall returns the RetCodes key (serving status or error key) and the
+// destination of the last call (periodic.CallRecorder).
+func (grpcstate *GRPCRunnerResults) LastCall() (int, string) {
+	return grpcstate.lastCode, grpcstate.Destination
 }
 
 // GRPCRunnerOptions includes the base RunnerOptions plus http specific
@@ -118,15 +674,361 @@ func (grpcstate *GRPCRunnerResults) Run(t int) {
 type GRPCRunnerOptions struct {
 	periodic.RunnerOptions
 	Destination        string
+	Destinations       []string      // additional destinations, calls are spread round robin across all of them
 	Service            string        // Service to be checked when using grpc health check
 	Profiler           string        // file to save profiles to. defaults to no profiling
 	Payload            string        // Payload to be sent for grpc ping service
+	PayloadLength      int           // Generate a Payload of that many bytes instead (when > 0)
 	Streams            int           // number of streams. total go routines and data streams will be streams*numthreads.
 	Delay              time.Duration // Delay to be sent when using grpc ping service
 	CACert             string        // Path to CA certificate for grpc TLS
 	CertOverride       string        // Override the cert virtual host of authority for testing
 	AllowInitialErrors bool          // whether initial errors don't cause an abort
 	UsePing            bool          // use our own Ping proto for grpc load instead of standard health check one.
+	// Send the pings as messages on a bidi stream (one stream per thread)
+	// instead of unary calls. Implies UsePing.
+	StreamingPing bool
+	// Open a server stream per thread, on which the server keeps sending
+	// the ping message (every Delay), and receive one message per call
+	// instead of unary calls. The durations are thus the inter message
+	// latencies; use max qps (QPS -1) to measure the rate at which the
+	// server pushes. Implies UsePing, exclusive with StreamingPing.
+	ServerStreaming bool
+	// Fully qualified unary method (e.g. "/pkg.Service/Method") to invoke instead
+	// of health or ping. RequestPayload is then sent as is (serialized request).
+	Method         string
+	RequestPayload []byte
+	// Record a separate duration histogram for each stream index (in addition
+	// to the aggregate one), to spot a consistently slower stream.
+	PerStreamStats bool
+	// Metadata (headers) to send with each call, e.g. "authorization".
+	Metadata map[string]string
+	// Client keepalive: ping the server after KeepAliveTime without activity
+	// and close the connection if no reply within KeepAliveTimeout. Default
+	// (0) is to not change grpc's defaults.
+	KeepAliveTime    time.Duration
+	KeepAliveTimeout time.Duration
+	// Dial a new connection for each call (and close it after) instead of
+	// reusing the connection, to include the connection setup in the timing.
+	NewConnectionPerRequest bool
+	// Number of (long lived) connections shared by all the threads, assigned
+	// round robin, instead of 1 connection per Streams threads. Default (0)
+	// is to use Streams.
+	ConnectionPoolSize int
+	// Maximum message sizes and http2 flow control window sizes, for large
+	// payloads. Default (0) is to use the grpc library defaults.
+	MaxRecvMsgSize        int
+	MaxSendMsgSize        int
+	InitialWindowSize     int32
+	InitialConnWindowSize int32
+	// How long to wait, when the run is aborted, for the in flight calls to
+	// complete normally. The ones still pending after are cancelled and only
+	// counted in Cancelled. Default (0) is to wait for them without timeout.
+	DrainTimeout time.Duration
+	// Client certificate and key to present to the server (mTLS), when both are set.
+	ClientCert string
+	ClientKey  string
+	// TLS server name (SNI) to send. CertOverride (if set) is still the name
+	// the server certificate is verified against.
+	TLSServerName string
+	// Codec to use for all the calls instead of the default (nil) proto one,
+	// e.g. to measure the serialization cost. It is registered (globally) under
+	// its Name() and used through the content subtype, so the server must know
+	// it too. For the generic Method calls it replaces the raw one and is thus
+	// passed the RequestPayload []byte and a *[]byte for the response.
+	Codec encoding.Codec
+	// Maximum time to wait for the connection(s) to be established when
+	// dialing, independently of the calls. When it expires the run fails
+	// unless AllowInitialErrors is set, in which case the connection keeps
+	// being attempted in the background and the calls error out until then.
+	// Default (0) is to not wait for the connection when dialing.
+	ConnectTimeout time.Duration
+	// Deadline for each call, after which it fails with DeadlineExceeded, so
+	// a stalled server doesn't block the threads. For StreamingPing and
+	// ServerStreaming it bounds each message echo or reception (and the stream
+	// is then reset). Default (0) is none.
+	RequestTimeout time.Duration
+	// TLS versions and cipher suites restrictions (when using TLS).
+	fnet.TLSOptions
+	// Trailer key in which the server returns its own processing time, as
+	// a Go duration (e.g. "1.5ms"), to record in ServerTimingHistogram for
+	// comparison with the client observed latency. Calls without a valid
+	// value are not recorded. Not supported with StreamingPing nor ServerStreaming.
+	ServerTimingTrailer string
+	// Record the TCP connect and TLS handshake durations of the new
+	// connections (see NewConnectionPerRequest) and the time to the first
+	// response byte (headers) of each call, in the result's PhaseTimings.
+	PhaseTimings bool
+	// Local IP addresses to bind the outgoing (tcp) connections to, one after
+	// the other for each new connection. They must be assigned to this host.
+	SourceAddresses []string
+	// IP version of the tcp connections (default is any).
+	AddressFamily fnet.AddressFamily
+	// Files to write, at the end of the run, a heap profile and a goroutine
+	// dump (with their counts per stack) to. Default (empty) is none.
+	MemProfile       string
+	GoroutineProfile string
+	// Load balancing policy across the addresses the Destination resolves
+	// to (e.g. with a dns:/// resolver scheme): "pick_first" (the default)
+	// or "round_robin".
+	LoadBalancingPolicy string
+	// Interceptors called, in order (the first one being the outermost), for
+	// each unary call (i.e. all but StreamingPing and ServerStreaming), e.g. to refresh an auth
+	// token or inject faults. They see the Metadata and RequestTimeout
+	// deadline in the context.
+	Interceptors []grpc.UnaryClientInterceptor
+	// Compressor of the messages of each call (grpc.UseCompressor), "gzip"
+	// or "snappy" (SnappyCompressor), to measure the wire compression
+	// effects. Other compressors must be registered by the program, with
+	// encoding.RegisterCompressor, and be known to the server too. Default
+	// (empty) is no compression.
+	Compressor string
+	// File of payloads, separated by PayloadDelimiter (default is one per
+	// line), sent in turn for each call (round robin across the threads) or,
+	// with PayloadCorpusRandom, picked at random (from the run's Seed): the
+	// ping payloads, or the (serialized) requests of the generic Method calls,
+	// instead of the Payload or RequestPayload. Not supported with
+	// ServerStreaming (nor health checks).
+	PayloadCorpusFile   string
+	PayloadDelimiter    string
+	PayloadCorpusRandom bool
+	corpus              *fnet.PayloadCorpus // read by RunGRPCTest (or Validate)
+}
+
+// destinations returns the Destination and Destinations to use, or an error
+// if they aren't compatible with the other options.
+func (o *GRPCRunnerOptions) destinations() ([]string, error) {
+	dests := o.Destinations
+	if o.Destination != "" {
+		dests = append([]string{o.Destination}, o.Destinations...)
+	}
+	if len(dests) == 0 {
+		dests = []string{o.Destination} // will error out when dialing
+	}
+	streaming := ""
+	switch {
+	case o.StreamingPing && o.ServerStreaming:
+		return nil, fmt.Errorf("streaming ping and server streaming are mutually exclusive")
+	case o.StreamingPing:
+		streaming = "streaming ping"
+	case o.ServerStreaming:
+		streaming = "server streaming"
+	}
+	if streaming != "" && len(dests) > 1 {
+		return nil, fmt.Errorf("%s doesn't support multiple destinations %v", streaming, dests)
+	}
+	if streaming != "" && o.ServerTimingTrailer != "" {
+		return nil, fmt.Errorf("server timing trailer isn't supported with %s", streaming)
+	}
+	if o.PayloadCorpusFile != "" && (o.ServerStreaming || (o.Method == "" && !o.UsePing && !o.StreamingPing)) {
+		return nil, fmt.Errorf("payload corpus is only supported with (unary or streaming) ping or method calls")
+	}
+	if o.Compressor != "" && encoding.GetCompressor(o.Compressor) == nil {
+		return nil, fmt.Errorf("unknown compressor %q (not registered)", o.Compressor)
+	}
+	return dests, nil
+}
+
+// tlsOptions returns the ClientTLSOptions (and source addresses) of the
+// options, or an error if the AddressFamily or the SourceAddresses aren't
+// usable.
+func (o *GRPCRunnerOptions) tlsOptions() (*ClientTLSOptions, error) {
+	if err := o.AddressFamily.Check(); err != nil {
+		return nil, err
+	}
+	sources, err := fnet.NewSourceAddresses(o.SourceAddresses)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientTLSOptions{
+		CACert:       o.CACert,
+		CertOverride: o.CertOverride,
+		ClientCert:   o.ClientCert,
+		ClientKey:    o.ClientKey,
+		ServerName:   o.TLSServerName,
+		TLSOptions:   o.TLSOptions,
+		sources:      sources,
+		family:       o.AddressFamily,
+		policy:       o.LoadBalancingPolicy,
+	}, nil
+}
+
+// DefaultValidateTimeout is the connection and call timeout of Validate()
+// when neither ConnectTimeout nor RequestTimeout are set.
+const DefaultValidateTimeout = 10 * time.Second
+
+// Validate checks the options and that each destination can be connected to
+// (including loading the TLS certificates) and answers one call of the run's
+// type, without running the load. ConnectTimeout and RequestTimeout (else
+// DefaultValidateTimeout) bound the connection and the call.
+func (o *GRPCRunnerOptions) Validate() error {
+	dests, err := o.destinations()
+	if err != nil {
+		return err
+	}
+	connectTimeout, requestTimeout := o.ConnectTimeout, o.RequestTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultValidateTimeout
+	}
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultValidateTimeout
+	}
+	vo := *o // with the actual payload and call timeout
+	if o.PayloadLength > 0 {
+		vo.Payload = generatePayload(o.PayloadLength)
+	}
+	vo.RequestTimeout = requestTimeout
+	if err = vo.readCorpus(); err != nil {
+		return err
+	}
+	var methodOpts []grpc.CallOption
+	if o.Codec == nil {
+		methodOpts = []grpc.CallOption{grpc.CallCustomCodec(rawCodec{})}
+	}
+	tlsOpts, err := o.tlsOptions()
+	if err != nil {
+		return err
+	}
+	dialOpts := append(o.dialOptions(), grpc.WithBlock())
+	for _, dest := range dests {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		conn, err := dialTLS(ctx, dest, tlsOpts, dialOpts...)
+		cancel()
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("unable to connect to %s within %v", dest, connectTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("validation of %s failed: %v", dest, err)
+		}
+		var state GRPCRunnerResults
+		ctx, cancel = context.WithCancel(outgoingContext(o.Metadata))
+		state.setup(&vo, ctx, []string{dest}, methodOpts, 0, time.Now().UnixNano())
+		state.setConn(conn)
+		st, _, err := state.call()
+		if cerr := state.closeStream(); err == nil && cerr != nil {
+			err = cerr
+		}
+		cancel()
+		conn.Close() // nolint: errcheck
+		if err != nil {
+			return fmt.Errorf("validation call to %s failed: %v", dest, err)
+		}
+		if st != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("validation call to %s: status %s", dest, KeyString(st))
+		}
+		log.Infof("Validated %s", dest)
+	}
+	return nil
+}
+
+// readCorpus reads the PayloadCorpusFile, if set.
+func (o *GRPCRunnerOptions) readCorpus() error {
+	if o.PayloadCorpusFile == "" {
+		return nil
+	}
+	corpus, err := fnet.ReadPayloadCorpus(o.PayloadCorpusFile, o.PayloadDelimiter)
+	if err != nil {
+		log.Errf("Unable to read payload corpus file %s: %v", o.PayloadCorpusFile, err)
+		return err
+	}
+	o.corpus = corpus
+	return nil
+}
+
+// dialOptions returns the extra grpc dial options corresponding to the options.
+func (o *GRPCRunnerOptions) dialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if o.KeepAliveTime > 0 || o.KeepAliveTimeout > 0 {
+		log.Infof("Using keepalive time %v and timeout %v", o.KeepAliveTime, o.KeepAliveTimeout)
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    o.KeepAliveTime,
+			Timeout: o.KeepAliveTimeout,
+		}))
+	}
+	var callOpts []grpc.CallOption
+	if o.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(o.MaxRecvMsgSize))
+	}
+	if o.MaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(o.MaxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		log.Infof("Using max receive message size %d and max send message size %d", o.MaxRecvMsgSize, o.MaxSendMsgSize)
+	}
+	if o.Codec != nil {
+		log.Infof("Using codec %s", o.Codec.Name())
+		encoding.RegisterCodec(o.Codec)
+		callOpts = append(callOpts, grpc.CallContentSubtype(o.Codec.Name()))
+	}
+	if o.Compressor != "" {
+		log.Infof("Using compressor %s", o.Compressor)
+		callOpts = append(callOpts, grpc.UseCompressor(o.Compressor))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	if o.InitialWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(o.InitialWindowSize))
+	}
+	if o.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(o.InitialConnWindowSize))
+	}
+	if len(o.Interceptors) > 0 {
+		opts = append(opts, grpc.WithUnaryInterceptor(chainUnaryInterceptors(o.Interceptors)))
+	}
+	return opts
+}
+
+// chainUnaryInterceptors returns the interceptor calling the interceptors in
+// order (grpc only supports one).
+func chainUnaryInterceptors(interceptors []grpc.UnaryClientInterceptor) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return chainedInvoker(interceptors, invoker)(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// chainedInvoker returns the invoker calling the first interceptor with the
+// invoker of the rest of the chain, ending with invoker.
+func chainedInvoker(interceptors []grpc.UnaryClientInterceptor, invoker grpc.UnaryInvoker) grpc.UnaryInvoker {
+	if len(interceptors) == 0 {
+		return invoker
+	}
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		opts ...grpc.CallOption) error {
+		return interceptors[0](ctx, method, req, reply, cc, chainedInvoker(interceptors[1:], invoker), opts...)
+	}
+}
+
+// outgoingContext returns the context to use for each call, carrying
+// the (optional) metadata.
+func outgoingContext(md map[string]string) context.Context {
+	ctx := context.Background()
+	if len(md) == 0 {
+		return ctx
+	}
+	return metadata.NewOutgoingContext(ctx, metadata.New(md))
+}
+
+// writeProfile writes the named pprof profile (e.g. "heap" or "goroutine")
+// to file, in the format selected by debug (see pprof.Profile.WriteTo).
+func writeProfile(name, file string, debug int) error {
+	f, err := os.Create(file)
+	if err != nil {
+		log.Critf("Unable to create %s profile %s: %v", name, file, err)
+		return err
+	}
+	if name == "heap" {
+		runtime.GC() // get up-to-date statistics
+	}
+	err = pprof.Lookup(name).WriteTo(f, debug)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Critf("Unable to write %s profile %s: %v", name, file, err)
+	}
+	return err
 }
 
 // RunGRPCTest runs an http test and returns the aggregated stats.
@@ -138,72 +1040,179 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		// sort of todo, this redoing some of periodic normalize (but we can't use normalize which does too much)
 		o.NumThreads = periodic.DefaultRunnerOptions.NumThreads
 	}
-	if o.UsePing {
+	if o.StreamingPing || o.ServerStreaming {
+		o.UsePing = true
+	}
+	dests, err := o.destinations()
+	if err != nil {
+		return nil, err
+	}
+	destination := strings.Join(dests, ",")
+	switch {
+	case o.Method != "":
+		o.RunType = "GRPC Method " + o.Method
+	case o.UsePing:
 		o.RunType = "GRPC Ping"
+		if o.StreamingPing {
+			o.RunType += " Stream"
+		} else if o.ServerStreaming {
+			o.RunType += " Server Stream"
+		}
 		if o.Delay > 0 {
 			o.RunType += fmt.Sprintf(" Delay=%v", o.Delay)
 		}
-	} else {
+	default:
 		o.RunType = "GRPC Health"
 	}
+	if o.PayloadLength > 0 {
+		o.Payload = generatePayload(o.PayloadLength)
+	}
+	if err = o.readCorpus(); err != nil {
+		return nil, err
+	}
 	pll := len(o.Payload)
-	if pll > 0 {
+	if o.Method != "" {
+		pll = len(o.RequestPayload)
+	}
+	if o.corpus != nil {
+		o.RunType += fmt.Sprintf(" PayloadCorpus=%d", len(o.corpus.Payloads))
+	} else if pll > 0 {
 		o.RunType += fmt.Sprintf(" PayloadLength=%d", pll)
 	}
-	log.Infof("Starting %s test for %s with %d*%d threads at %.1f qps", o.RunType, o.Destination, o.Streams, o.NumThreads, o.QPS)
+	if o.Compressor != "" {
+		o.RunType += " Compressor=" + o.Compressor
+	}
+	log.Infof("Starting %s test for %s with %d*%d threads at %.1f qps", o.RunType, destination, o.Streams, o.NumThreads, o.QPS)
 	o.NumThreads *= o.Streams
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads // may change
 	total := GRPCRunnerResults{
-		RetCodes:    make(HealthResultMap),
-		Destination: o.Destination,
-		Streams:     o.Streams,
-		Ping:        o.UsePing,
+		RetCodes:        make(HealthResultMap),
+		Destination:     destination,
+		Streams:         o.Streams,
+		Ping:            o.UsePing,
+		Method:          o.Method,
+		StreamingPing:   o.StreamingPing,
+		ServerStreaming: o.ServerStreaming,
+	}
+	if o.PerStreamStats {
+		total.StreamHistograms = make([]*stats.Histogram, o.Streams)
+		for s := range total.StreamHistograms {
+			total.StreamHistograms[s] = stats.NewHistogram(0, r.Options().Resolution)
+		}
+	}
+	if o.ServerTimingTrailer != "" {
+		total.ServerTimingHistogram = stats.NewHistogram(0, r.Options().Resolution)
 	}
 	grpcstate := make([]GRPCRunnerResults, numThreads)
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
-	var conn *grpc.ClientConn
-	var err error
+	var conns []*grpc.ClientConn
+	ctx, cancel := context.WithCancel(outgoingContext(o.Metadata))
+	defer cancel()
+	dialOpts := o.dialOptions()
+	var methodOpts []grpc.CallOption
+	if o.Codec == nil {
+		methodOpts = []grpc.CallOption{grpc.CallCustomCodec(rawCodec{})}
+	}
 	ts := time.Now().UnixNano()
-	for i := 0; i < numThreads; i++ {
-		r.Options().Runners[i] = &grpcstate[i]
-		if (i % o.Streams) == 0 {
-			conn, err = Dial(o.Destination, o.CACert, o.CertOverride)
+	tlsOpts, err := o.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	if o.PhaseTimings {
+		tlsOpts.phases = &phaseRecorder{phases: fnet.NewPhaseTimings(r.Options().Resolution)}
+		total.PhaseTimings = tlsOpts.phases.phases
+	}
+	blockingOpts := append(append([]grpc.DialOption{}, dialOpts...), grpc.WithBlock())
+	dial := func(dest string) (*grpc.ClientConn, error) {
+		if o.ConnectTimeout <= 0 {
+			return DialTLS(dest, tlsOpts, dialOpts...)
+		}
+		dctx, dcancel := context.WithTimeout(ctx, o.ConnectTimeout)
+		defer dcancel()
+		conn, err := dialTLS(dctx, dest, tlsOpts, blockingOpts...)
+		if err == context.DeadlineExceeded {
+			err = fmt.Errorf("unable to connect to %s within %v connect timeout", dest, o.ConnectTimeout)
+		}
+		return conn, err
+	}
+	// dialAll dials a connection to each destination
+	dialAll := func() ([]*grpc.ClientConn, error) {
+		res := make([]*grpc.ClientConn, len(dests))
+		for d, dest := range dests {
+			conn, err := dial(dest)
+			if err != nil && o.ConnectTimeout > 0 && o.AllowInitialErrors {
+				log.Warnf("%v, continuing (allow initial errors)", err)
+				conn, err = DialTLS(dest, tlsOpts, dialOpts...)
+			}
 			if err != nil {
-				log.Errf("Error in grpc dial for %s %v", o.Destination, err)
+				log.Errf("Error in grpc dial for %s %v", dest, err)
 				return nil, err
 			}
-		} else {
-			log.Debugf("Reusing previous client connection for %d", i)
+			res[d] = conn
 		}
-		grpcstate[i].Ping = o.UsePing
+		return res, nil
+	}
+	usePool := o.ConnectionPoolSize > 0 && !o.NewConnectionPerRequest
+	var pool [][]*grpc.ClientConn
+	if usePool {
+		pool = make([][]*grpc.ClientConn, o.ConnectionPoolSize)
+	}
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &grpcstate[i]
 		var err error
-		if o.UsePing {
-			grpcstate[i].clientP = NewPingServerClient(conn)
-			if grpcstate[i].clientP == nil {
-				return nil, fmt.Errorf("unable to create ping client %d for %s", i, o.Destination)
-			}
-			grpcstate[i].reqP = PingMessage{Payload: o.Payload, DelayNanos: o.Delay.Nanoseconds(), Seq: int64(i), Ts: ts}
-			if o.Exactly <= 0 {
-				_, err = grpcstate[i].clientP.Ping(context.Background(), &grpcstate[i].reqP)
+		switch {
+		case usePool:
+			p := i % o.ConnectionPoolSize
+			if pool[p] == nil {
+				pool[p], err = dialAll()
+			} else {
+				log.Debugf("Reusing pool client connection(s) %d for %d", p, i)
 			}
-		} else {
-			grpcstate[i].clientH = grpc_health_v1.NewHealthClient(conn)
-			if grpcstate[i].clientH == nil {
-				return nil, fmt.Errorf("unable to create health client %d for %s", i, o.Destination)
+			conns = pool[p]
+		case (i%o.Streams) == 0 || o.NewConnectionPerRequest:
+			conns, err = dialAll()
+		default:
+			log.Debugf("Reusing previous client connection(s) for %d", i)
+		}
+		if err != nil {
+			return nil, err
+		}
+		grpcstate[i].setup(o, ctx, dests, methodOpts, int64(i), ts)
+		if o.corpus != nil && o.PayloadCorpusRandom {
+			grpcstate[i].corpusRand = rand.New(rand.NewSource(r.Options().SubSeed("corpus", i))) // nolint: gas
+		}
+		for d, conn := range conns {
+			grpcstate[i].setConn(conn)
+			if o.Exactly <= 0 && err == nil {
+				_, _, err = grpcstate[i].call()
+				if err != nil {
+					log.Errf("Error in first grpc call (ping = %v, method = %q) for %s: %v", o.UsePing, o.Method, dests[d], err)
+				}
 			}
-			grpcstate[i].reqH = grpc_health_v1.HealthCheckRequest{Service: o.Service}
-			if o.Exactly <= 0 {
-				_, err = grpcstate[i].clientH.Check(context.Background(), &grpcstate[i].reqH)
+			if o.NewConnectionPerRequest {
+				grpcstate[i].closeConn()
+				grpcstate[i].dial = dial
 			}
 		}
+		if !o.NewConnectionPerRequest {
+			grpcstate[i].conns = conns
+			grpcstate[i].setConn(conns[0])
+		}
 		if !o.AllowInitialErrors && err != nil {
-			log.Errf("Error in first grpc call (ping = %v) for %s: %v", o.UsePing, o.Destination, err)
 			return nil, err
 		}
 		// Setup the stats for each 'thread'
 		grpcstate[i].RetCodes = make(HealthResultMap)
+		grpcstate[i].ErrorClasses = make(map[fnet.ErrorClass]int64)
+		if o.PerStreamStats {
+			grpcstate[i].streamH = total.StreamHistograms[i%o.Streams].Clone()
+		}
+		if total.ServerTimingHistogram != nil {
+			grpcstate[i].serverH = total.ServerTimingHistogram.Clone()
+			grpcstate[i].trailerKey = strings.ToLower(o.ServerTimingTrailer)
+		}
 	}
 
 	if o.Profiler != "" {
@@ -214,23 +1223,45 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		}
 		pprof.StartCPUProfile(fc) //nolint: gas,errcheck
 	}
+	done := make(chan struct{})
+	if o.DrainTimeout > 0 {
+		r.Options().Stop.Lock()
+		stopChan := r.Options().Stop.StopChan
+		r.Options().Stop.Unlock()
+		go drainWatcher(stopChan, done, o.DrainTimeout, cancel)
+	}
 	total.RunnerResults = r.Run()
+	close(done)
 	if o.Profiler != "" {
 		pprof.StopCPUProfile()
-		fm, err := os.Create(o.Profiler + ".mem")
-		if err != nil {
-			log.Critf("Unable to create .mem profile: %v", err)
+		if err := writeProfile("heap", o.Profiler+".mem", 0); err != nil {
 			return nil, err
 		}
-		runtime.GC()               // get up-to-date statistics
-		pprof.WriteHeapProfile(fm) // nolint:gas,errcheck
-		fm.Close()                 // nolint:gas,errcheck
 		fmt.Printf("Wrote profile data to %s.{cpu|mem}\n", o.Profiler)
 	}
+	if o.MemProfile != "" {
+		if err := writeProfile("heap", o.MemProfile, 0); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Wrote memory profile to %s\n", o.MemProfile)
+	}
+	if o.GoroutineProfile != "" {
+		if err := writeProfile("goroutine", o.GoroutineProfile, 1); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Wrote goroutine profile to %s\n", o.GoroutineProfile)
+	}
 	// Numthreads may have reduced
 	numThreads = r.Options().NumThreads
 	keys := []grpc_health_v1.HealthCheckResponse_ServingStatus{}
 	for i := 0; i < numThreads; i++ {
+		if err := grpcstate[i].closeStream(); err != nil && ctx.Err() == nil {
+			log.Warnf("Error closing ping stream %d: %v", i, err)
+			grpcstate[i].RetCodes[-1]++
+			grpcstate[i].ErrorClasses[ErrorClass(err)]++
+		}
+		total.Cancelled += grpcstate[i].Cancelled
+		total.StreamMessages += grpcstate[i].StreamMessages
 		// Q: is there some copying each time stats[i] is used?
 		for k := range grpcstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
@@ -238,18 +1269,115 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 			}
 			total.RetCodes[k] += grpcstate[i].RetCodes[k]
 		}
+		for k, v := range grpcstate[i].ErrorClasses {
+			if total.ErrorClasses == nil {
+				total.ErrorClasses = make(map[fnet.ErrorClass]int64)
+			}
+			total.ErrorClasses[k] += v
+		}
+		if o.PerStreamStats {
+			total.StreamHistograms[i%o.Streams].Transfer(grpcstate[i].streamH)
+		}
+		if total.ServerTimingHistogram != nil {
+			total.ServerTimingHistogram.Transfer(grpcstate[i].serverH)
+		}
 		// TODO: if grpc client needs 'cleanup'/Close like http one, do it on original NumThreads
 	}
 	// Cleanup state:
 	r.Options().ReleaseRunners()
 	which := "Health"
-	if o.UsePing {
+	if o.Method != "" {
+		which = o.Method
+	} else if o.UsePing {
 		which = "Ping"
 	}
 	for _, k := range keys {
-		fmt.Fprintf(out, "%s %s : %d\n", which, k.String(), total.RetCodes[k])
+		fmt.Fprintf(out, "%s %s : %d\n", which, KeyString(k), total.RetCodes[k])
+		if k != grpc_health_v1.HealthCheckResponse_SERVING {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	classes := []string{}
+	for k := range total.ErrorClasses {
+		classes = append(classes, string(k))
+	}
+	sort.Strings(classes)
+	for _, k := range classes {
+		fmt.Fprintf(out, "%s error class %s : %d\n", which, k, total.ErrorClasses[fnet.ErrorClass(k)])
+	}
+	if o.ServerStreaming && total.ActualDuration > 0 {
+		total.StreamMessageRate = float64(total.StreamMessages) / total.ActualDuration.Seconds()
+		fmt.Fprintf(out, "Server stream received %d messages (%.1f/sec)\n", total.StreamMessages, total.StreamMessageRate)
+	}
+	if total.Cancelled > 0 {
+		fmt.Fprintf(out, "%s cancelled in flight after %v drain: %d\n", which, o.DrainTimeout, total.Cancelled)
+	}
+	if total.ServerTimingHistogram != nil {
+		total.ServerTimingHistogram.Print(out, "Server reported time", r.Options().Percentiles)
 	}
-	return &total, nil
+	if tlsOpts.phases != nil {
+		tlsOpts.phases.mu.Lock() // connections may still be (re)established
+		total.PhaseTimings.Print(out, r.Options().Percentiles)
+		tlsOpts.phases.mu.Unlock()
+	}
+	if log.LogVerbose() {
+		for s, h := range total.StreamHistograms {
+			h.Print(out, fmt.Sprintf("Stream %d Function Time", s), r.Options().Percentiles)
+		}
+	}
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
+
+// drainWatcher cancels the calls (through cancel) DrainTimeout after the run
+// is aborted (stopChan closed) unless the run is done first.
+func drainWatcher(stopChan chan struct{}, done chan struct{}, timeout time.Duration, cancel context.CancelFunc) {
+	select {
+	case <-stopChan:
+	case <-done:
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		log.Infof("Cancelling in flight grpc calls after %v drain", timeout)
+		cancel()
+	case <-done:
+	}
+}
+
+// generatePayload returns a payload of n printable ascii characters (proto3
+// strings must be valid utf8).
+func generatePayload(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + i%26)
+	}
+	return string(b)
+}
+
+// isUnixSocket returns true if the (parsed) destination is a unix domain
+// socket path.
+func isUnixSocket(dest string) bool {
+	return strings.HasPrefix(dest, "/")
+}
+
+// hasResolverScheme returns true if dest starts with a "scheme://" (the
+// http, https and unix ones being checked before by grpcDestination).
+func hasResolverScheme(dest string) bool {
+	i := strings.Index(dest, "://")
+	if i <= 0 {
+		return false
+	}
+	for j, c := range dest[:i] {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case j > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 // grpcDestination parses dest and returns dest:port based on dest being
@@ -257,13 +1385,23 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 // returned if dest is an invalid hostname or invalid IP address. An http/https
 // prefix is removed from dest if one exists and the port number is set to
 // DefaultHTTPPort for http, DefaultHTTPSPort for https, or DefaultGRPCPort
-// if http, https, or :port is not specified in dest.
+// if http, https, or :port is not specified in dest. A unix:// prefix or
+// a path starting with / is a unix domain socket and the path is returned.
+// Targets with another scheme (e.g. "dns:///foo:50051" or "xds:///my-service")
+// are for the grpc name resolver registered for that scheme and are returned
+// unchanged.
 // TODO: change/fix this (NormalizePort and more)
 func grpcDestination(dest string) (parsedDest string) {
 	var port string
 	// strip any unintentional http/https scheme prefixes from dest
 	// and set the port number.
 	switch {
+	case strings.HasPrefix(dest, prefixUnix):
+		parsedDest = strings.TrimPrefix(dest, prefixUnix)
+		log.Infof("stripping unix scheme. grpc destination: %v", parsedDest)
+		return parsedDest
+	case isUnixSocket(dest):
+		return dest
 	case strings.HasPrefix(dest, prefixHTTP):
 		parsedDest = strings.TrimSuffix(strings.Replace(dest, prefixHTTP, "", 1), "/")
 		port = defaultHTTPPort
@@ -274,6 +1412,9 @@ func grpcDestination(dest string) (parsedDest string) {
 		port = defaultHTTPSPort
 		log.Infof("stripping https scheme. grpc destination: %v. grpc port: %s",
 			parsedDest, port)
+	case hasResolverScheme(dest):
+		log.LogVf("using the grpc name resolver for %s", dest)
+		return dest
 	default:
 		parsedDest = dest
 		port = DefaultGRPCPort
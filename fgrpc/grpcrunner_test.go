@@ -20,14 +20,38 @@
 package fgrpc
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
 	"istio.io/fortio/periodic"
 
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	grpcstats "google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -42,10 +66,15 @@ var (
 
 func TestGRPCRunner(t *testing.T) {
 	log.SetLogLevel(log.Info)
-	iPort := PingServer("0", "", "", "bar", 0)
+	iPort, _, iCleanup := PingServerWithHandle("0", "", "", "bar", 0)
+	defer iCleanup()
 	iDest := fmt.Sprintf("localhost:%d", iPort)
-	sPort := PingServer("0", svrCrt, svrKey, "bar", 0)
+	sPort, _, sCleanup := PingServerWithHandle("0", svrCrt, svrKey, "bar", 0)
+	defer sCleanup()
 	sDest := fmt.Sprintf("localhost:%d", sPort)
+	mPort, mCleanup := mTLSHealthServer(t)
+	defer mCleanup()
+	mDest := fmt.Sprintf("localhost:%d", mPort)
 
 	ro := periodic.RunnerOptions{
 		QPS:        10, // some internet outcalls, not too fast
@@ -80,6 +109,54 @@ func TestGRPCRunner(t *testing.T) {
 			},
 			expect: false,
 		},
+		{
+			name: "valid mTLS runner",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: mDest,
+				CACert:      caCrt,
+				ClientCert:  svrCrt,
+				ClientKey:   svrKey,
+			},
+			expect: true,
+		},
+		{
+			name: "invalid secure runner without client cert to mTLS server",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: mDest,
+				CACert:      caCrt,
+			},
+			expect: false,
+		},
+		{
+			name: "invalid client cert for mTLS runner",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: mDest,
+				CACert:      caCrt,
+				ClientCert:  failCrt,
+				ClientKey:   failKey,
+			},
+			expect: false,
+		},
+		{
+			name: "mismatched client cert and key for mTLS runner",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: mDest,
+				CACert:      caCrt,
+				ClientCert:  caCrt,
+				ClientKey:   svrKey,
+			},
+			expect: false,
+		},
+		{
+			name: "invalid CA cert for mTLS runner",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: mDest,
+				CACert:      failCrt,
+				ClientCert:  svrCrt,
+				ClientKey:   svrKey,
+			},
+			expect: false,
+		},
 		{
 			name: "valid secure runner using nil credentials to Internet https server",
 			runnerOpts: GRPCRunnerOptions{
@@ -99,117 +176,1634 @@ func TestGRPCRunner(t *testing.T) {
 			runnerOpts: GRPCRunnerOptions{
 				Destination: "fortio.istio.io:443",
 			},
-			expect: false,
+			expect: false,
+		},
+		{
+			name: "invalid secure runner using test cert to https prefix Internet server",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: "https://fortio.istio.io:443",
+				CACert:      caCrt,
+			},
+			expect: false,
+		},
+		{
+			name: "invalid secure runner using test cert to no prefix Internet server",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: "fortio.istio.io:443",
+			},
+			expect: false,
+		},
+		{
+			name: "invalid name in secure runner cert",
+			runnerOpts: GRPCRunnerOptions{
+				Destination:  sDest,
+				CACert:       caCrt,
+				CertOverride: "invalidName",
+			},
+			expect: false,
+		},
+		{
+			name: "invalid cert for secure runner",
+			runnerOpts: GRPCRunnerOptions{
+				Destination: sDest,
+				CACert:      "../missing/cert.crt",
+			},
+			expect: false,
+		},
+	}
+	for _, test := range tests {
+		test.runnerOpts.Profiler = "test.profile"
+		test.runnerOpts.RunnerOptions = ro
+		res, err := RunGRPCTest(&test.runnerOpts)
+		switch {
+		case err != nil && test.expect:
+			t.Errorf("Test case: %s failed due to unexpected error: %v", test.name, err)
+			return
+		case err == nil && !test.expect:
+			t.Errorf("Test case: %s failed due to unexpected response: %v", test.name, res)
+			return
+		case err == nil && test.expect:
+			totalReq := res.DurationHistogram.Count
+			ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+			if totalReq != ok {
+				t.Errorf("Test case: %s failed. Mismatch between requests %d and ok %v",
+					test.name, totalReq, res.RetCodes)
+			}
+		}
+	}
+}
+
+// mTLSHealthServer starts a grpc health server requiring a client certificate
+// signed by the test CA. Returns its port and the cleanup function.
+func mTLSHealthServer(t *testing.T) (int, func()) {
+	b, err := ioutil.ReadFile(caCrt)
+	if err != nil {
+		t.Fatalf("Unable to read CA cert: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(b)
+	return tlsHealthServer(t, &tls.Config{
+		// The test certs are server only (extended key usage) so we can't use
+		// RequireAndVerifyClientCert and verify the chain ourselves instead.
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			c, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			_, err = c.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+			return err
+		},
+	})
+}
+
+// sniHealthServer starts a grpc health server rejecting handshakes not
+// using serverName as SNI. Returns its port and the cleanup function.
+func sniHealthServer(t *testing.T, serverName string) (int, func()) {
+	return tlsHealthServer(t, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName != serverName {
+				return nil, fmt.Errorf("unexpected SNI %q", hello.ServerName)
+			}
+			return nil, nil
+		},
+	})
+}
+
+// tlsHealthServer starts a grpc health server with the test server
+// certificate added to cfg. Returns its port and the cleanup function.
+func tlsHealthServer(t *testing.T, cfg *tls.Config) (int, func()) {
+	cert, err := tls.LoadX509KeyPair(svrCrt, svrKey)
+	if err != nil {
+		t.Fatalf("Unable to load server cert: %v", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	socket, addr := fnet.Listen("tls grpc", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	go grpcServer.Serve(socket) // nolint: errcheck
+	return addr.Port, grpcServer.Stop
+}
+
+func TestGRPCRunnerSNI(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, cleanup := sniHealthServer(t, "sni.fortio.test")
+	defer cleanup()
+	dest := fmt.Sprintf("localhost:%d", port)
+	tests := []struct {
+		name          string
+		tlsServerName string
+		certOverride  string
+		expect        bool
+	}{
+		{"SNI and cert override", "sni.fortio.test", "localhost", true},
+		{"default SNI", "", "", false},
+		{"cert override only (is also the SNI)", "", "sni.fortio.test", false},
+		{"SNI only (is also the verified name)", "sni.fortio.test", "", false},
+		{"SNI and wrong cert override", "sni.fortio.test", "invalidName", false},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 4,
+			},
+			Destination:   dest,
+			CACert:        caCrt,
+			CertOverride:  tst.certOverride,
+			TLSServerName: tst.tlsServerName,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tst.name, err)
+			continue
+		}
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+		if (ok == 4) != tst.expect || ok+res.RetCodes.Errors() != 4 {
+			t.Errorf("%s: unexpected ret codes %v", tst.name, res.RetCodes)
+		}
+	}
+	// Without SNI override the CertOverride is still the verified name
+	sPort, _, sCleanup := PingServerWithHandle("0", svrCrt, svrKey, "", 0)
+	defer sCleanup()
+	conn, err := DialTLS(fmt.Sprintf("localhost:%d", sPort), &ClientTLSOptions{CACert: caCrt, CertOverride: "localhost"})
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if _, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Errorf("Unexpected error with cert override only: %v", err)
+	}
+}
+
+func TestGRPCRunnerTLSVersions(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, cleanup := tlsHealthServer(t, &tls.Config{MaxVersion: tls.VersionTLS12}) // nolint: gas
+	defer cleanup()
+	tests := []struct {
+		name    string
+		tlsOpts fnet.TLSOptions
+		expect  bool
+	}{
+		{"default", fnet.TLSOptions{}, true},
+		{"tls 1.2 with cipher suite", fnet.TLSOptions{MaxTLSVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, true},
+		{"tls 1.3 only", fnet.TLSOptions{MinTLSVersion: tls.VersionTLS13}, false},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 4,
+			},
+			Destination:  fmt.Sprintf("localhost:%d", port),
+			CACert:       caCrt,
+			CertOverride: "localhost",
+			TLSOptions:   tst.tlsOpts,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tst.name, err)
+			continue
+		}
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+		if (ok == 4) != tst.expect || ok+res.RetCodes.Errors() != 4 {
+			t.Errorf("%s: unexpected ret codes %v", tst.name, res.RetCodes)
+		}
+	}
+}
+
+// countingPingSrv is a ping server counting the calls it receives.
+type countingPingSrv struct {
+	pingSrv
+	count int64
+}
+
+func (s *countingPingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
+	atomic.AddInt64(&s.count, 1)
+	return s.pingSrv.Ping(c, in)
+}
+
+func TestGRPCRunnerDestinations(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	var servers [2]countingPingSrv
+	var dests []string
+	for i := range servers {
+		socket, addr := fnet.Listen(fmt.Sprintf("counting ping %d", i), "0")
+		if addr == nil {
+			t.Fatalf("Unable to listen")
+		}
+		grpcServer := grpc.NewServer()
+		RegisterPingServerServer(grpcServer, &servers[i])
+		go grpcServer.Serve(socket) // nolint: errcheck
+		defer grpcServer.Stop()
+		dests = append(dests, fmt.Sprintf("localhost:%d", addr.Port))
+	}
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        200,
+			Exactly:    96,
+			NumThreads: 2,
+		},
+		Destination:  dests[0],
+		Destinations: dests[1:],
+		UsePing:      true,
+		Streams:      2,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if ok != 96 || res.DurationHistogram.Count != 96 {
+		t.Errorf("Mismatch between requests %d and ok %v", res.DurationHistogram.Count, res.RetCodes)
+	}
+	c0 := atomic.LoadInt64(&servers[0].count)
+	c1 := atomic.LoadInt64(&servers[1].count)
+	// 24 calls in each of the 2*2 threads, alternating between the 2 destinations
+	if c0 != 48 || c1 != 48 {
+		t.Errorf("Unbalanced traffic across destinations: %d and %d", c0, c1)
+	}
+	if res.Destination != strings.Join(dests, ",") {
+		t.Errorf("Unexpected result destination %q", res.Destination)
+	}
+	// streaming isn't supported with multiple destinations
+	opts.StreamingPing = true
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected an error for streaming ping with multiple destinations")
+	}
+}
+
+func TestGRPCRunnerLoadBalancingPolicy(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	var servers [2]countingPingSrv
+	var addrs []resolver.Address
+	for i := range servers {
+		socket, addr := fnet.Listen(fmt.Sprintf("lb ping %d", i), "0")
+		if addr == nil {
+			t.Fatalf("Unable to listen")
+		}
+		grpcServer := grpc.NewServer()
+		RegisterPingServerServer(grpcServer, &servers[i])
+		go grpcServer.Serve(socket) // nolint: errcheck
+		defer grpcServer.Stop()
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("localhost:%d", addr.Port)})
+	}
+	// 1 destination resolving to the 2 servers
+	r, cleanup := manual.GenerateAndRegisterManualResolver()
+	defer cleanup()
+	r.InitialAddrs(addrs)
+	tests := []struct {
+		policy string
+		spread bool // whether both servers get calls
+	}{
+		{"", false},
+		{"pick_first", false},
+		{"round_robin", true},
+	}
+	for _, tt := range tests {
+		for i := range servers {
+			atomic.StoreInt64(&servers[i].count, 0)
+		}
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 20,
+			},
+			Destination:         r.Scheme() + ":///lb.test",
+			UsePing:             true,
+			LoadBalancingPolicy: tt.policy,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Errorf("Unexpected error for policy %q: %v", tt.policy, err)
+			continue
+		}
+		if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 20 {
+			t.Errorf("Policy %q: unexpected ret codes %v", tt.policy, res.RetCodes)
+		}
+		c0, c1 := atomic.LoadInt64(&servers[0].count), atomic.LoadInt64(&servers[1].count)
+		if c0+c1 != 20 || (c0 > 0 && c1 > 0) != tt.spread {
+			t.Errorf("Policy %q: unexpected calls spread %d and %d", tt.policy, c0, c1)
+		}
+	}
+	opts := GRPCRunnerOptions{
+		RunnerOptions:       periodic.RunnerOptions{Exactly: 1},
+		Destination:         r.Scheme() + ":///lb.test",
+		UsePing:             true,
+		LoadBalancingPolicy: "no_such_policy",
+	}
+	if _, err := RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected an error for an unknown load balancing policy")
+	}
+}
+
+func TestGRPCRunnerConnectionPool(t *testing.T) {
+	log.SetLogLevel(log.Warning)
+	// 1 stream per connection: the calls on a connection are serialized
+	port, _, cleanup := PingServerWithHandle("0", "", "", "pool", 1)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	qps := make(map[int]float64)
+	for _, size := range []int{1, 4} {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        -1,
+				Duration:   500 * time.Millisecond,
+				NumThreads: 8,
+			},
+			Destination:        destination,
+			UsePing:            true,
+			Delay:              5 * time.Millisecond,
+			ConnectionPoolSize: size,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalReq := res.DurationHistogram.Count
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+		if totalReq != ok {
+			t.Errorf("Pool %d: mismatch between requests %d and ok %v", size, totalReq, res.RetCodes)
+		}
+		qps[size] = res.ActualQPS
+	}
+	log.SetLogLevel(log.Info)
+	t.Logf("QPS with pool of 1: %g, pool of 4: %g", qps[1], qps[4])
+	if qps[4] < qps[1] {
+		t.Errorf("Pool of 4 connections slower (%g qps) than 1 (%g qps)", qps[4], qps[1])
+	}
+}
+
+func TestGRPCRunnerMessageSizes(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	const maxSize = 16 * 1024 * 1024
+	socket, addr := fnet.Listen("large ping", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(maxSize))
+	RegisterPingServerServer(grpcServer, &pingSrv{})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        10,
+			Exactly:    2,
+			NumThreads: 1,
+		},
+		Destination:   fmt.Sprintf("localhost:%d", addr.Port),
+		UsePing:       true,
+		PayloadLength: 5 * 1024 * 1024, // more than the 4Mb default
+	}
+	o := opts
+	res, err := RunGRPCTest(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := res.RetCodes[ErrorKey(status.Error(codes.ResourceExhausted, ""))]; n != 2 {
+		t.Errorf("Expected the large responses to fail by default, got %v", res.RetCodes)
+	}
+	o = opts
+	o.MaxRecvMsgSize = maxSize
+	o.MaxSendMsgSize = maxSize
+	o.InitialWindowSize = 1024 * 1024
+	o.InitialConnWindowSize = 1024 * 1024
+	res, err = RunGRPCTest(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; n != 2 {
+		t.Errorf("Expected the large responses to succeed with MaxRecvMsgSize, got %v", res.RetCodes)
+	}
+}
+
+func TestGRPCRunnerMaxStreams(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "maxstream", 10)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        100,
+			NumThreads: 1,
+		},
+		Destination: destination,
+		Streams:     10, // will be batches of 10 max
+		UsePing:     true,
+		Delay:       20 * time.Millisecond,
+	}
+	o1 := opts
+	res, err := RunGRPCTest(&o1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	totalReq := res.DurationHistogram.Count
+	avg10 := res.DurationHistogram.Avg
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq != ok {
+		t.Errorf("Mismatch1 between requests %d and ok %v", totalReq, res.RetCodes)
+	}
+	if avg10 < opts.Delay.Seconds() || avg10 > 3*opts.Delay.Seconds() {
+		t.Errorf("Ping delay not working, got %v for %v", avg10, opts.Delay)
+	}
+	o2 := opts
+	o2.Streams = 20
+	res, err = RunGRPCTest(&o2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	totalReq = res.DurationHistogram.Count
+	avg20 := res.DurationHistogram.Avg
+	ok = res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq != ok {
+		t.Errorf("Mismatch2 between requests %d and ok %v", totalReq, res.RetCodes)
+	}
+	// Half of the calls should take 2x (delayed behind maxstreams)
+	if avg20 < 1.5*opts.Delay.Seconds() {
+		t.Errorf("Expecting much slower average with 20/10 %v %v", avg20, avg10)
+	}
+}
+
+func TestGRPCRunnerPerStreamStats(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "perstream", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        200,
+			NumThreads: 2,
+			Exactly:    80,
+		},
+		Destination:    destination,
+		Streams:        4,
+		UsePing:        true,
+		PerStreamStats: true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(res.StreamHistograms) != 4 {
+		t.Fatalf("Expected 4 stream histograms, got %d", len(res.StreamHistograms))
+	}
+	var sum int64
+	for _, h := range res.StreamHistograms {
+		sum += h.Count
+	}
+	if sum != res.DurationHistogram.Count {
+		t.Errorf("Sum of per stream counts %d doesn't match total %d", sum, res.DurationHistogram.Count)
+	}
+}
+
+func TestGRPCRunnerMetadata(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "metadata", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	md := map[string]string{"authorization": "Bearer foo", "X-Tenant-ID": "tenant1"}
+	conn, err := Dial(destination, "", "")
+	if err != nil {
+		t.Fatalf("Unable to dial %s: %v", destination, err)
+	}
+	defer conn.Close() // nolint: errcheck
+	var header metadata.MD
+	_, err = NewPingServerClient(conn).Ping(outgoingContext(md), &PingMessage{}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("Unexpected ping error: %v", err)
+	}
+	for k, v := range md {
+		got := header.Get(k) // keys are lowercased by grpc
+		if len(got) != 1 || got[0] != v {
+			t.Errorf("Metadata %s: %s didn't round trip, got %v", k, v, got)
+		}
+	}
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: destination,
+		UsePing:     true,
+		Metadata:    md,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+		t.Errorf("Was expecting 10 ok calls with metadata, got %v", res.RetCodes)
+	}
+}
+
+func TestGRPCRunnerKeepAlive(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "keepalive", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:      20,
+			Duration: 1 * time.Second,
+		},
+		Destination:      destination,
+		UsePing:          true,
+		KeepAliveTime:    100 * time.Millisecond,
+		KeepAliveTimeout: 1 * time.Second,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	totalReq := res.DurationHistogram.Count
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq == 0 || totalReq != ok {
+		t.Errorf("Mismatch between requests %d and ok %v with keepalive", totalReq, res.RetCodes)
+	}
+}
+
+func TestGRPCRunnerUnixSocket(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	dir, err := ioutil.TempDir("", "fortio-grpc")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "ping.sock")
+	socket, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to listen on %s: %v", path, err)
+	}
+	grpcServer := grpc.NewServer()
+	RegisterPingServerServer(grpcServer, &pingSrv{})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	for _, dest := range []string{prefixUnix + path, path} {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 10,
+			},
+			Destination: dest,
+			UsePing:     true,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", dest, err)
+			continue
+		}
+		if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+			t.Errorf("Was expecting 10 ok calls to %s, got %v", dest, res.RetCodes)
+		}
+	}
+}
+
+// numFDs returns the number of open file descriptors or -1 if unknown.
+func numFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func TestGRPCRunnerNewConnectionPerRequest(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "perrequest", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        50,
+			NumThreads: 2,
+			Exactly:    50,
+		},
+		Destination:             destination,
+		UsePing:                 true,
+		NewConnectionPerRequest: true,
+	}
+	// Warm up round
+	o1 := opts
+	res, err := RunGRPCTest(&o1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 50 {
+		t.Errorf("Run1: was expecting 50 ok calls, got %v", res.RetCodes)
+	}
+	time.Sleep(100 * time.Millisecond) // let the server side notice the closed connections
+	ngBefore := runtime.NumGoroutine()
+	fdBefore := numFDs()
+	o2 := opts
+	res, err = RunGRPCTest(&o2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 50 {
+		t.Errorf("Run2: was expecting 50 ok calls, got %v", res.RetCodes)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ngAfter := runtime.NumGoroutine()
+	fdAfter := numFDs()
+	t.Logf("Goroutines %d -> %d, fds %d -> %d", ngBefore, ngAfter, fdBefore, fdAfter)
+	// 50 connections were made, if we leak it will show
+	if ngAfter > ngBefore+8 {
+		t.Errorf("Goroutines after test %d, expected it to stay near %d", ngAfter, ngBefore)
+	}
+	if fdAfter > fdBefore+8 {
+		t.Errorf("File descriptors after test %d, expected it to stay near %d", fdAfter, fdBefore)
+	}
+}
+
+// rateLimitedHealth fails the health check of the "ratelimited" service with
+// a ResourceExhausted status.
+type rateLimitedHealth struct {
+	*health.Server
+}
+
+func (h rateLimitedHealth) Check(ctx context.Context,
+	in *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if in.Service == "ratelimited" {
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+	return h.Server.Check(ctx, in)
+}
+
+func TestGRPCRunnerStatusCodes(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("grpc status codes", "0")
+	grpcServer := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, rateLimitedHealth{health.NewServer()})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	destination := fmt.Sprintf("localhost:%d", addr.Port)
+	tests := []struct {
+		service string
+		code    codes.Code
+	}{
+		{"ratelimited", codes.ResourceExhausted},
+		{"unknown", codes.NotFound},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 10,
+			},
+			Destination:        destination,
+			Service:            tst.service,
+			AllowInitialErrors: true,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		k := ErrorKey(status.Error(tst.code, "test"))
+		if c, ok := StatusCode(k); !ok || c != tst.code {
+			t.Errorf("Key %d should map back to %v, got %v %v", k, tst.code, c, ok)
+		}
+		if KeyString(k) != tst.code.String() {
+			t.Errorf("Key %d string should be %v, got %s", k, tst.code, KeyString(k))
+		}
+		if res.RetCodes[k] != 10 || res.RetCodes.Errors() != 10 {
+			t.Errorf("Was expecting 10 %v for service %s, got %v", tst.code, tst.service, res.RetCodes)
+		}
+	}
+	if k := ErrorKey(fmt.Errorf("not a grpc status")); k != -1 {
+		t.Errorf("Non grpc status error should map to -1, got %d", k)
+	}
+	if _, ok := StatusCode(grpc_health_v1.HealthCheckResponse_SERVING); ok {
+		t.Error("Serving status shouldn't be a grpc status code")
+	}
+}
+
+func TestGRPCRunnerPayloadLength(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "payload", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	for _, l := range []int{1024, 64 * 1024} {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 20,
+			},
+			Destination:   destination,
+			UsePing:       true,
+			PayloadLength: l,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		totalReq := res.DurationHistogram.Count
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+		if totalReq != 20 || totalReq != ok {
+			t.Errorf("Payload %d: mismatch between requests %d and ok %v", l, totalReq, res.RetCodes)
+		}
+		if !strings.Contains(res.RunType, fmt.Sprintf("PayloadLength=%d", l)) {
+			t.Errorf("Payload %d: unexpected run type %q", l, res.RunType)
+		}
+	}
+}
+
+func TestGRPCRunnerStreamingPing(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "stream", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        200,
+			Exactly:    50,
+			NumThreads: 2,
+		},
+		Destination:   destination,
+		StreamingPing: true,
+		Streams:       2,
+		Delay:         1 * time.Millisecond,
+		Payload:       "streaming",
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	totalReq := res.DurationHistogram.Count
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq != 50 || totalReq != ok {
+		t.Errorf("Mismatch between messages %d and ok %v", totalReq, res.RetCodes)
+	}
+	if res.RetCodes.Errors() != 0 {
+		t.Errorf("Unexpected stream errors %v", res.RetCodes)
+	}
+	if !strings.Contains(res.RunType, "GRPC Ping Stream") {
+		t.Errorf("Unexpected run type %q", res.RunType)
+	}
+	if res.DurationHistogram.Min < 0.001 {
+		t.Errorf("Delay not applied between messages, min %g", res.DurationHistogram.Min)
+	}
+}
+
+func TestGRPCRunnerServerStreaming(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "serverstream", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1,
+			Duration:   300 * time.Millisecond,
+			NumThreads: 2,
+		},
+		Destination:     destination,
+		ServerStreaming: true,
+		Delay:           2 * time.Millisecond,
+		Payload:         "pushed",
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes.Errors() != 0 {
+		t.Errorf("Unexpected stream errors %v", res.RetCodes)
+	}
+	if !strings.Contains(res.RunType, "GRPC Ping Server Stream") {
+		t.Errorf("Unexpected run type %q", res.RunType)
+	}
+	if res.StreamMessages != res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING] || res.StreamMessages < 20 {
+		t.Errorf("Unexpected %d messages for %v", res.StreamMessages, res.RetCodes)
+	}
+	// 2 threads each getting a message every 2ms at most (plus the buffered ones):
+	if res.StreamMessageRate <= 0 || res.StreamMessageRate > 1100 {
+		t.Errorf("Unexpected message rate %g", res.StreamMessageRate)
+	}
+	if res.DurationHistogram.Avg < 0.0015 {
+		t.Errorf("Inter message latency %g shorter than the server delay", res.DurationHistogram.Avg)
+	}
+	// Nothing listening: stream errors are -1
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Destination = closed.Addr().String()
+	closed.Close() // nolint: errcheck
+	opts.Duration = 0
+	opts.Exactly = 4
+	opts.NumThreads = 1
+	opts.AllowInitialErrors = true
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[-1] != 4 || res.StreamMessages != 0 {
+		t.Errorf("Expected 4 stream errors, got %v (%d messages)", res.RetCodes, res.StreamMessages)
+	}
+}
+
+func TestGRPCRunnerMaxQPS(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "maxqps", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1, // closed loop
+			Duration:   500 * time.Millisecond,
+			NumThreads: 2,
+		},
+		Destination: destination,
+		UsePing:     true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RequestedQPS != "max" {
+		t.Errorf("Unexpected requested qps %q for closed loop mode", res.RequestedQPS)
+	}
+	totalReq := res.DurationHistogram.Count
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq != ok {
+		t.Errorf("Mismatch between requests %d and ok %v", totalReq, res.RetCodes)
+	}
+	// Way more than the default qps (8) would do in that time
+	if totalReq < 50 || res.ActualQPS < 100 {
+		t.Errorf("Closed loop didn't saturate: %d calls, %g qps", totalReq, res.ActualQPS)
+	}
+	expected := float64(totalReq) / res.ActualDuration.Seconds()
+	if res.ActualQPS < 0.99*expected || res.ActualQPS > 1.01*expected {
+		t.Errorf("ActualQPS %g doesn't match %d calls in %v", res.ActualQPS, totalReq, res.ActualDuration)
+	}
+}
+
+func TestGRPCRunnerDrainTimeout(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "drain", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	tests := []struct {
+		drain     time.Duration
+		cancelled bool
+	}{
+		{drain: 50 * time.Millisecond, cancelled: true}, // calls still in flight get cancelled
+		{drain: 2 * time.Second, cancelled: false},      // enough time to complete normally
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        10,
+				Exactly:    100, // no warm up call
+				NumThreads: 2,
+				RunContext: ctx,
+			},
+			Destination:  destination,
+			UsePing:      true,
+			Delay:        500 * time.Millisecond,
+			DrainTimeout: test.drain,
+		}
+		res, err := RunGRPCTest(&opts)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes.Errors() != 0 {
+			t.Errorf("Drain %v: unexpected errors after abort %v", test.drain, res.RetCodes)
+		}
+		if (res.Cancelled > 0) != test.cancelled {
+			t.Errorf("Drain %v: got %d cancelled calls, expected some: %v", test.drain, res.Cancelled, test.cancelled)
+		}
+		ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+		if res.DurationHistogram.Count != ok+res.Cancelled {
+			t.Errorf("Drain %v: mismatch between calls %d and ok %d + cancelled %d",
+				test.drain, res.DurationHistogram.Count, ok, res.Cancelled)
+		}
+	}
+}
+
+func TestGRPCRunnerMethod(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "method", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	payload, err := proto.Marshal(&PingMessage{Payload: "raw test"})
+	if err != nil {
+		t.Fatalf("Unable to serialize ping message: %v", err)
+	}
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 20,
+		},
+		Destination:    destination,
+		Method:         "/fgrpc.PingServer/Ping",
+		RequestPayload: payload,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	totalReq := res.DurationHistogram.Count
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
+	if totalReq != 20 || totalReq != ok {
+		t.Errorf("Mismatch between requests %d and ok %v", totalReq, res.RetCodes)
+	}
+	if res.Method != opts.Method {
+		t.Errorf("Method not echoed back in results: %q", res.Method)
+	}
+	opts = GRPCRunnerOptions{
+		Destination:    destination,
+		Method:         "/fgrpc.PingServer/NoSuchMethod",
+		RequestPayload: payload,
+	}
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Error("Was expecting initial error when calling an unknown method")
+	}
+	opts.AllowInitialErrors = true
+	opts.RunnerOptions = periodic.RunnerOptions{QPS: 100, Exactly: 10}
+	res, err = RunGRPCTest(&opts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if res.RetCodes[ErrorKey(status.Error(codes.Unimplemented, ""))] != 10 {
+		t.Errorf("Was expecting 10 unimplemented errors for unknown method, got %v", res.RetCodes)
+	}
+}
+
+// countingCodec passes []byte through (like the raw codec of the generic
+// Method calls) and uses the proto codec otherwise (e.g. on the server side).
+type countingCodec struct {
+	marshal   int64
+	unmarshal int64
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt64(&c.marshal, 1)
+	if b, ok := v.([]byte); ok {
+		return b, nil
+	}
+	return encoding.GetCodec("proto").Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	atomic.AddInt64(&c.unmarshal, 1)
+	if b, ok := v.(*[]byte); ok {
+		*b = append((*b)[:0], data...)
+		return nil
+	}
+	return encoding.GetCodec("proto").Unmarshal(data, v)
+}
+
+func (c *countingCodec) Name() string {
+	return "fortio-counting"
+}
+
+func TestGRPCRunnerCodec(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "codec", 0)
+	defer cleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	payload, err := proto.Marshal(&PingMessage{Payload: "codec test"})
+	if err != nil {
+		t.Fatalf("Unable to serialize ping message: %v", err)
+	}
+	codec := &countingCodec{}
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination:    destination,
+		Method:         "/fgrpc.PingServer/Ping",
+		RequestPayload: payload,
+		Codec:          codec,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+		t.Errorf("Expected 10 ok method calls, got %v", res.RetCodes)
+	}
+	// client and (in process) server side of each call
+	if m, u := atomic.LoadInt64(&codec.marshal), atomic.LoadInt64(&codec.unmarshal); m != 20 || u != 20 {
+		t.Errorf("Expected codec to be used for the 10 calls, got %d marshal %d unmarshal", m, u)
+	}
+	// Also used for the ping calls
+	codec = &countingCodec{}
+	opts = GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination: destination,
+		UsePing:     true,
+		Codec:       codec,
+	}
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+		t.Errorf("Expected 10 ok pings, got %v", res.RetCodes)
+	}
+	if m := atomic.LoadInt64(&codec.marshal); m != 20 {
+		t.Errorf("Expected codec to be used for the 10 pings, got %d marshal", m)
+	}
+}
+
+// wireSizes is a server stats handler keeping the size of the last sent
+// message (the ping echo, compressed like the request), uncompressed and on
+// the wire.
+type wireSizes struct {
+	length int64
+	wire   int64
+}
+
+func (w *wireSizes) TagRPC(ctx context.Context, _ *grpcstats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (w *wireSizes) HandleRPC(_ context.Context, s grpcstats.RPCStats) {
+	if p, ok := s.(*grpcstats.OutPayload); ok {
+		atomic.StoreInt64(&w.length, int64(p.Length))
+		atomic.StoreInt64(&w.wire, int64(p.WireLength))
+	}
+}
+
+func (w *wireSizes) TagConn(ctx context.Context, _ *grpcstats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (w *wireSizes) HandleConn(context.Context, grpcstats.ConnStats) {}
+
+func TestGRPCRunnerCompressor(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("compressed ping", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	sizes := &wireSizes{}
+	grpcServer := grpc.NewServer(grpc.StatsHandler(sizes))
+	RegisterPingServerServer(grpcServer, &pingSrv{})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	const payloadLength = 512 * 1024
+	for _, compressor := range []string{"", "gzip", SnappyCompressor} {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     100,
+				Exactly: 10,
+			},
+			Destination:   fmt.Sprintf("localhost:%d", addr.Port),
+			UsePing:       true,
+			PayloadLength: payloadLength,
+			Compressor:    compressor,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatalf("%q: %v", compressor, err)
+		}
+		if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+			t.Errorf("%q: expected 10 ok large pings, got %v", compressor, res.RetCodes)
+		}
+		length, wire := atomic.LoadInt64(&sizes.length), atomic.LoadInt64(&sizes.wire)
+		if length < payloadLength {
+			t.Errorf("%q: unexpected echoed message length %d", compressor, length)
+		}
+		if compressed := wire < length/10; compressed != (compressor != "") {
+			t.Errorf("%q: unexpected wire length %d for message length %d", compressor, wire, length)
+		}
+	}
+	opts := GRPCRunnerOptions{
+		Destination: fmt.Sprintf("localhost:%d", addr.Port),
+		UsePing:     true,
+		Compressor:  "lz4", // not registered
+	}
+	if _, err := RunGRPCTest(&opts); err == nil || !strings.Contains(err.Error(), "lz4") {
+		t.Errorf("Expected an unknown compressor error, got %v", err)
+	}
+}
+
+func TestGRPCRunnerPayloadCorpus(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("corpus ping", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	var lock sync.Mutex
+	payloads := make(map[string]int)
+	record := func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		lock.Lock()
+		payloads[req.(*PingMessage).Payload]++
+		lock.Unlock()
+		return handler(ctx, req)
+	}
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(record))
+	RegisterPingServerServer(grpcServer, &pingSrv{})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	file, err := ioutil.TempFile("", "fortio-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())                             // nolint: errcheck
+	file.WriteString("first\nline--\nsecond--\nthird\n--\n") // nolint: errcheck
+	file.Close()                                             // nolint: errcheck
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1,
+			Exactly:    30,
+			NumThreads: 3,
 		},
-		{
-			name: "invalid secure runner using test cert to https prefix Internet server",
-			runnerOpts: GRPCRunnerOptions{
-				Destination: "https://fortio.istio.io:443",
-				CACert:      caCrt,
-			},
-			expect: false,
+		Destination:       fmt.Sprintf("localhost:%d", addr.Port),
+		UsePing:           true,
+		PayloadCorpusFile: file.Name(),
+		PayloadDelimiter:  "--\n",
+	}
+	o := opts
+	res, err := RunGRPCTest(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 30 {
+		t.Errorf("Expected 30 ok pings, got %v", res.RetCodes)
+	}
+	lock.Lock()
+	expected := map[string]int{"first\nline": 10, "second": 10, "third\n": 10} // round robin
+	if fmt.Sprint(payloads) != fmt.Sprint(expected) {
+		t.Errorf("Expected each corpus payload sent 10 times, got %v", payloads)
+	}
+	payloads = make(map[string]int)
+	lock.Unlock()
+	o = opts
+	o.PayloadCorpusRandom = true
+	o.Seed = 42
+	if _, err = RunGRPCTest(&o); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	if len(payloads) != 3 || payloads["first\nline"]+payloads["second"]+payloads["third\n"] != 30 {
+		t.Errorf("Expected the corpus payloads picked at random, got %v", payloads)
+	}
+	lock.Unlock()
+	o = opts
+	o.UsePing = false // health checks have no payload
+	if _, err = RunGRPCTest(&o); err == nil {
+		t.Errorf("Expected an error for a payload corpus with health checks")
+	}
+}
+
+func TestGRPCRunnerConnectTimeout(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     10,
+			Exactly: 2,
 		},
-		{
-			name: "invalid secure runner using test cert to no prefix Internet server",
-			runnerOpts: GRPCRunnerOptions{
-				Destination: "fortio.istio.io:443",
+		Destination:    "10.255.255.1:8079", // non routable, blackholed
+		ConnectTimeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err := RunGRPCTest(&opts)
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("Was expecting a connect timeout error")
+	}
+	if !strings.Contains(err.Error(), "connect timeout") {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if elapsed < opts.ConnectTimeout || elapsed > 2*time.Second {
+		t.Errorf("Dial failed after %v, expected close to the %v connect timeout", elapsed, opts.ConnectTimeout)
+	}
+	// Allowed: the run proceeds and the calls error out (to a closed port
+	// rather than blackholed so they fail fast instead of waiting to connect)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Destination = l.Addr().String()
+	l.Close()
+	opts.AllowInitialErrors = true
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatalf("Unexpected error with AllowInitialErrors: %v", err)
+	}
+	if res.DurationHistogram.Count != 2 || res.RetCodes.Errors() != 2 {
+		t.Errorf("Expected 2 errored calls, got %d calls: %v", res.DurationHistogram.Count, res.RetCodes)
+	}
+}
+
+func TestGRPCRunnerRequestTimeout(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "timeout", 0)
+	defer cleanup()
+	deadlineKey := ErrorKey(status.Error(codes.DeadlineExceeded, ""))
+	for _, streaming := range []bool{false, true} {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        -1,
+				Exactly:    4,
+				NumThreads: 2,
 			},
-			expect: false,
+			Destination:    fmt.Sprintf("localhost:%d", port),
+			UsePing:        true,
+			StreamingPing:  streaming,
+			Delay:          500 * time.Millisecond, // server side delay
+			RequestTimeout: 50 * time.Millisecond,
+		}
+		start := time.Now()
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Streaming %v: calls took %v, not bound by the %v timeout", streaming, elapsed, opts.RequestTimeout)
+		}
+		if c := res.RetCodes[deadlineKey]; c != 4 {
+			t.Errorf("Streaming %v: expected 4 DeadlineExceeded, got %v", streaming, res.RetCodes)
+		}
+		if c := res.ErrorClasses[fnet.TimeoutError]; c != 4 {
+			t.Errorf("Streaming %v: expected 4 timeout errors, got %v", streaming, res.ErrorClasses)
+		}
+	}
+}
+
+// timingPingSrv is a ping server returning its "processing time" in the
+// x-server-time trailer for 1 in 3 calls, an invalid one or none otherwise.
+type timingPingSrv struct {
+	pingSrv
+	calls int64
+}
+
+func (s *timingPingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
+	switch atomic.AddInt64(&s.calls, 1) % 3 {
+	case 1:
+		grpc.SetTrailer(c, metadata.Pairs("x-server-time", "2ms")) // nolint: errcheck
+	case 2:
+		grpc.SetTrailer(c, metadata.Pairs("x-server-time", "bogus")) // nolint: errcheck
+	}
+	return s.pingSrv.Ping(c, in)
+}
+
+func TestGRPCRunnerServerTiming(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("timing grpc", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	grpcServer := grpc.NewServer()
+	RegisterPingServerServer(grpcServer, &timingPingSrv{})
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     -1,
+			Exactly: 9,
 		},
-		{
-			name: "invalid name in secure runner cert",
-			runnerOpts: GRPCRunnerOptions{
-				Destination:  sDest,
-				CACert:       caCrt,
-				CertOverride: "invalidName",
-			},
-			expect: false,
+		Destination:         fmt.Sprintf("localhost:%d", addr.Port),
+		UsePing:             true,
+		ServerTimingTrailer: "X-Server-Time",
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 9 {
+		t.Errorf("Was expecting 9 ok calls despite missing/invalid trailers, got %v", res.RetCodes)
+	}
+	h := res.ServerTimingHistogram
+	if h == nil || h.Count != 3 || h.Min != 0.002 || h.Max != 0.002 {
+		t.Errorf("Expected 3 server timings of 2ms, got %+v", h)
+	}
+	opts.StreamingPing = true
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected an error for server timing with streaming ping")
+	}
+}
+
+func TestGRPCRunnerPhaseTimings(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", svrCrt, svrKey, "phases", 0)
+	defer cleanup()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1,
+			NumThreads: 2,
+			Exactly:    10,
 		},
-		{
-			name: "invalid cert for secure runner",
-			runnerOpts: GRPCRunnerOptions{
-				Destination: sDest,
-				CACert:      "../missing/cert.crt",
-			},
-			expect: false,
+		Destination:             fmt.Sprintf("localhost:%d", port),
+		CACert:                  caCrt,
+		UsePing:                 true,
+		NewConnectionPerRequest: true,
+		PhaseTimings:            true,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+		t.Errorf("Was expecting 10 ok calls, got %v", res.RetCodes)
+	}
+	p := res.PhaseTimings
+	if p == nil {
+		t.Fatal("Expected phase timings in the result")
+	}
+	// each call is on a new connection
+	if p.Connect.Count < 10 || p.TLSHandshake.Count < 10 || p.FirstByte.Count < 10 {
+		t.Errorf("Expected at least 10 timings of each phase, got %d connect, %d tls, %d first byte",
+			p.Connect.Count, p.TLSHandshake.Count, p.FirstByte.Count)
+	}
+	if p.TLSHandshake.Avg() <= 0 {
+		t.Errorf("Expected non zero TLS handshake durations, got %v", p.TLSHandshake.Avg())
+	}
+	opts.PhaseTimings = false
+	if res, err = RunGRPCTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.PhaseTimings != nil {
+		t.Errorf("Unexpected phase timings without the option: %+v", res.PhaseTimings)
+	}
+}
+
+// sourcesPingSrv is a ping server counting the calls per client address.
+type sourcesPingSrv struct {
+	pingSrv
+	mu      sync.Mutex
+	sources map[string]int
+}
+
+func (s *sourcesPingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
+	if p, ok := peer.FromContext(c); ok {
+		host, _, _ := net.SplitHostPort(p.Addr.String())
+		s.mu.Lock()
+		s.sources[host]++
+		s.mu.Unlock()
+	}
+	return s.pingSrv.Ping(c, in)
+}
+
+func TestGRPCRunnerSourceAddresses(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("sources grpc", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	grpcServer := grpc.NewServer()
+	srv := &sourcesPingSrv{sources: make(map[string]int)}
+	RegisterPingServerServer(grpcServer, srv)
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        -1,
+			NumThreads: 2,
+			Exactly:    8,
 		},
+		Destination:             fmt.Sprintf("127.0.0.1:%d", addr.Port),
+		UsePing:                 true,
+		NewConnectionPerRequest: true,
+		SourceAddresses:         []string{"127.0.0.2", "127.0.0.3"},
 	}
-	for _, test := range tests {
-		test.runnerOpts.Profiler = "test.profile"
-		test.runnerOpts.RunnerOptions = ro
-		res, err := RunGRPCTest(&test.runnerOpts)
-		switch {
-		case err != nil && test.expect:
-			t.Errorf("Test case: %s failed due to unexpected error: %v", test.name, err)
-			return
-		case err == nil && !test.expect:
-			t.Errorf("Test case: %s failed due to unexpected response: %v", test.name, res)
-			return
-		case err == nil && test.expect:
-			totalReq := res.DurationHistogram.Count
-			ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
-			if totalReq != ok {
-				t.Errorf("Test case: %s failed. Mismatch between requests %d and ok %v",
-					test.name, totalReq, res.RetCodes)
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 8 {
+		t.Errorf("Was expecting 8 ok calls, got %v", res.RetCodes)
+	}
+	srv.mu.Lock()
+	if len(srv.sources) != 2 || srv.sources["127.0.0.2"] != 4 || srv.sources["127.0.0.3"] != 4 {
+		t.Errorf("Expected 4 calls from each source address, got %v", srv.sources)
+	}
+	srv.mu.Unlock()
+	opts.SourceAddresses = []string{"192.0.2.1"} // TEST-NET, not assigned
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected an error for an unassigned source address")
+	}
+	if err = opts.Validate(); err == nil {
+		t.Errorf("Expected a validation error for an unassigned source address")
+	}
+}
+
+func TestGRPCRunnerAddressFamily(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("address family grpc", "0")
+	if addr == nil {
+		t.Fatalf("Unable to listen")
+	}
+	grpcServer := grpc.NewServer()
+	srv := &sourcesPingSrv{sources: make(map[string]int)}
+	RegisterPingServerServer(grpcServer, srv)
+	go grpcServer.Serve(socket) // nolint: errcheck
+	defer grpcServer.Stop()
+	tests := []struct {
+		host   string
+		family fnet.AddressFamily
+		want   string // client address seen by the server, empty for an error
+	}{
+		{"127.0.0.1", fnet.IPv4, "127.0.0.1"},
+		{"[::1]", fnet.IPv6, "::1"},
+		{"127.0.0.1", fnet.IPv6, ""},
+		{"[::1]", fnet.IPv4, ""},
+		{"127.0.0.1", "ipv5", ""},
+	}
+	for _, tt := range tests {
+		srv.mu.Lock()
+		srv.sources = make(map[string]int)
+		srv.mu.Unlock()
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:      10,
+				Duration: 100 * time.Millisecond,
+			},
+			Destination:    fmt.Sprintf("%s:%d", tt.host, addr.Port),
+			UsePing:        true,
+			AddressFamily:  tt.family,
+			ConnectTimeout: time.Second,
+		}
+		_, err := RunGRPCTest(&opts)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Expected an error for %s with %s", tt.host, tt.family)
 			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s with %s: %v", tt.host, tt.family, err)
+			continue
+		}
+		srv.mu.Lock()
+		if len(srv.sources) != 1 || srv.sources[tt.want] == 0 {
+			t.Errorf("Expected calls from %s for %s with %s, got %v", tt.want, tt.host, tt.family, srv.sources)
 		}
+		srv.mu.Unlock()
 	}
 }
 
-func TestGRPCRunnerMaxStreams(t *testing.T) {
+func TestGRPCRunnerInterceptors(t *testing.T) {
 	log.SetLogLevel(log.Info)
-	port := PingServer("0", "", "", "maxstream", 10)
-	destination := fmt.Sprintf("localhost:%d", port)
-
+	port, _, cleanup := PingServerWithHandle("0", "", "", "interceptors", 0)
+	defer cleanup()
+	var calls int64
+	var order []string
+	var lock sync.Mutex
+	counter := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			lock.Lock()
+			order = append(order, "counter")
+			lock.Unlock()
+		}
+		if md, _ := metadata.FromOutgoingContext(ctx); len(md["x-test"]) != 1 {
+			t.Errorf("Expected the x-test metadata in the interceptor context, got %v", md)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	inner := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		lock.Lock()
+		if len(order) == 1 {
+			order = append(order, "inner")
+		}
+		lock.Unlock()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
 	opts := GRPCRunnerOptions{
 		RunnerOptions: periodic.RunnerOptions{
-			QPS:        100,
-			NumThreads: 1,
+			QPS:        -1,
+			NumThreads: 2,
+			Exactly:    10,
 		},
-		Destination: destination,
-		Streams:     10, // will be batches of 10 max
-		UsePing:     true,
-		Delay:       20 * time.Millisecond,
+		Destination:  fmt.Sprintf("localhost:%d", port),
+		Service:      "interceptors",
+		Metadata:     map[string]string{"x-test": "1"},
+		Interceptors: []grpc.UnaryClientInterceptor{counter, inner},
 	}
-	o1 := opts
-	res, err := RunGRPCTest(&o1)
+	res, err := RunGRPCTest(&opts)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	totalReq := res.DurationHistogram.Count
-	avg10 := res.DurationHistogram.Avg
-	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
-	if totalReq != ok {
-		t.Errorf("Mismatch1 between requests %d and ok %v", totalReq, res.RetCodes)
+	if ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]; ok != 10 {
+		t.Errorf("Was expecting 10 ok calls, got %v", res.RetCodes)
 	}
-	if avg10 < opts.Delay.Seconds() || avg10 > 3*opts.Delay.Seconds() {
-		t.Errorf("Ping delay not working, got %v for %v", avg10, opts.Delay)
+	if c := atomic.LoadInt64(&calls); c != 10 {
+		t.Errorf("Expected the interceptor to be called for each of the 10 calls, got %d", c)
 	}
-	o2 := opts
-	o2.Streams = 20
-	res, err = RunGRPCTest(&o2)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(order) != 2 || order[0] != "counter" || order[1] != "inner" {
+		t.Errorf("Expected the interceptors to be called in order, got %v", order)
+	}
+}
+
+func TestGRPCRunnerValidate(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "validate", 0)
+	defer cleanup()
+	sPort, _, sCleanup := PingServerWithHandle("0", svrCrt, svrKey, "validate", 0)
+	defer sCleanup()
+	destination := fmt.Sprintf("localhost:%d", port)
+	tlsDestination := fmt.Sprintf("localhost:%d", sPort)
+	closed, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	totalReq = res.DurationHistogram.Count
-	avg20 := res.DurationHistogram.Avg
-	ok = res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING]
-	if totalReq != ok {
-		t.Errorf("Mismatch2 between requests %d and ok %v", totalReq, res.RetCodes)
+	closedDestination := closed.Addr().String()
+	closed.Close() // nolint: errcheck
+	tests := []struct {
+		name string
+		opts GRPCRunnerOptions
+		ok   bool
+	}{
+		{"health", GRPCRunnerOptions{Destination: destination, Service: "validate"}, true},
+		{"ping", GRPCRunnerOptions{Destination: destination, UsePing: true, PayloadLength: 100}, true},
+		{"streaming ping", GRPCRunnerOptions{Destination: destination, StreamingPing: true}, true},
+		{"server streaming", GRPCRunnerOptions{Destination: destination, ServerStreaming: true}, true},
+		{"both streaming modes", GRPCRunnerOptions{Destination: destination, StreamingPing: true,
+			ServerStreaming: true}, false},
+		{"tls", GRPCRunnerOptions{Destination: tlsDestination, CACert: caCrt, UsePing: true}, true},
+		{"unknown service", GRPCRunnerOptions{Destination: destination, Service: "unknown"}, false},
+		{"unreachable", GRPCRunnerOptions{Destination: closedDestination, ConnectTimeout: 500 * time.Millisecond}, false},
+		{"unreachable 2nd destination", GRPCRunnerOptions{Destination: destination,
+			Destinations: []string{closedDestination}, ConnectTimeout: 500 * time.Millisecond}, false},
+		{"bad cert path", GRPCRunnerOptions{Destination: tlsDestination, CACert: "/does/not/exist.crt"}, false},
+		{"bad client cert path", GRPCRunnerOptions{Destination: tlsDestination, CACert: caCrt,
+			ClientCert: "/does/not/exist.crt", ClientKey: svrKey}, false},
+		{"streaming ping and destinations", GRPCRunnerOptions{Destination: destination,
+			Destinations: []string{destination}, StreamingPing: true}, false},
 	}
-	// Half of the calls should take 2x (delayed behind maxstreams)
-	if avg20 < 1.5*opts.Delay.Seconds() {
-		t.Errorf("Expecting much slower average with 20/10 %v %v", avg20, avg10)
+	for _, tst := range tests {
+		err := tst.opts.Validate()
+		if (err == nil) != tst.ok {
+			t.Errorf("%s: unexpected validation result %v", tst.name, err)
+		}
+	}
+}
+
+func TestGRPCRunnerErrorClasses(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "classes", 0)
+	defer cleanup()
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedDestination := closed.Addr().String()
+	closed.Close() // nolint: errcheck
+	tests := []struct {
+		destination string
+		service     string
+		expected    fnet.ErrorClass
+	}{
+		{closedDestination, "", fnet.ConnectionRefusedError},
+		{fmt.Sprintf("localhost:%d", port), "unknown", fnet.ApplicationError}, // NotFound
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:     -1,
+				Exactly: 4,
+			},
+			Destination:        tst.destination,
+			Service:            tst.service,
+			AllowInitialErrors: true,
+		}
+		res, err := RunGRPCTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := res.ErrorClasses[tst.expected]; c != 4 || len(res.ErrorClasses) != 1 {
+			t.Errorf("%s: expected 4 %q errors, got %v (codes %v)", tst.destination, tst.expected, res.ErrorClasses, res.RetCodes)
+		}
 	}
 }
 
 func TestGRPCRunnerWithError(t *testing.T) {
 	log.SetLogLevel(log.Info)
-	iPort := PingServer("0", "", "", "bar", 0)
+	iPort, _, iCleanup := PingServerWithHandle("0", "", "", "bar", 0)
+	defer iCleanup()
 	iDest := fmt.Sprintf("localhost:%d", iPort)
-	sPort := PingServer("0", svrCrt, svrKey, "bar", 0)
+	sPort, _, sCleanup := PingServerWithHandle("0", svrCrt, svrKey, "bar", 0)
+	defer sCleanup()
 	sDest := fmt.Sprintf("localhost:%d", sPort)
 
 	ro := periodic.RunnerOptions{
@@ -290,7 +1884,7 @@ func TestGRPCRunnerWithError(t *testing.T) {
 			return
 		}
 		totalReq := res.DurationHistogram.Count
-		numErrors := res.RetCodes[-1]
+		numErrors := res.RetCodes.Errors()
 		if totalReq != numErrors {
 			t.Errorf("Test case: %s failed. Mismatch between requests %d and errors %v",
 				test.name, totalReq, res.RetCodes)
@@ -298,6 +1892,27 @@ func TestGRPCRunnerWithError(t *testing.T) {
 	}
 }
 
+func TestPingServerWithHandle(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := 0
+	for i := 0; i < 20; i++ {
+		// Restart on the same port each time, which only works if properly stopped.
+		p, srv, cleanup := PingServerWithHandle(fmt.Sprintf("%d", port), "", "", "restart", 0)
+		if p == -1 || srv == nil {
+			t.Fatalf("Iteration %d: unable to (re)start server on port %d", i, port)
+		}
+		port = p
+		dest := fmt.Sprintf("localhost:%d", port)
+		if r, err := GrpcHealthCheck(dest, "", "restart", 1); err != nil || (*r)[grpc_health_v1.HealthCheckResponse_SERVING] != 1 {
+			t.Errorf("Iteration %d: unexpected health check result %v, %v", i, r, err)
+		}
+		cleanup()
+	}
+	if p, srv, cleanup := PingServerWithHandle("[::1]:-1", "", "", "invalid", 0); p != -1 || srv != nil || cleanup == nil {
+		t.Errorf("Was expecting failure for invalid port, got %d %v", p, srv)
+	}
+}
+
 func TestGRPCDestination(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -374,6 +1989,31 @@ func TestGRPCDestination(t *testing.T) {
 			"https://2001:dba::1/",
 			"[2001:dba::1]:443",
 		},
+		{
+			"Unix domain socket with unix prefix",
+			"unix:///tmp/foo.sock",
+			"/tmp/foo.sock",
+		},
+		{
+			"Unix domain socket path",
+			"/tmp/foo.sock",
+			"/tmp/foo.sock",
+		},
+		{
+			"xds resolver scheme",
+			"xds:///my-service",
+			"xds:///my-service",
+		},
+		{
+			"dns resolver scheme with port",
+			"dns:///foo:50051",
+			"dns:///foo:50051",
+		},
+		{
+			"consul resolver scheme with authority",
+			"consul://127.0.0.1:8500/my-service",
+			"consul://127.0.0.1:8500/my-service",
+		},
 	}
 
 	for _, tc := range tests {
@@ -387,3 +2027,41 @@ func TestGRPCDestination(t *testing.T) {
 		}
 	}
 }
+
+func TestGRPCRunnerProfiles(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "profiles", 0)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "fortio-grpc-profiles")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:     100,
+			Exactly: 10,
+		},
+		Destination:      fmt.Sprintf("localhost:%d", port),
+		UsePing:          true,
+		MemProfile:       filepath.Join(dir, "mem.pprof"),
+		GoroutineProfile: filepath.Join(dir, "goroutine.txt"),
+	}
+	if _, err = RunGRPCTest(&opts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, f := range []string{opts.MemProfile, opts.GoroutineProfile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Errorf("Missing profile %s: %v", f, err)
+			continue
+		}
+		if fi.Size() == 0 {
+			t.Errorf("Empty profile %s", f)
+		}
+	}
+	opts.GoroutineProfile = filepath.Join(dir, "missing", "goroutine.txt")
+	if _, err = RunGRPCTest(&opts); err == nil {
+		t.Errorf("Expected an error for the profile in a missing directory")
+	}
+}
@@ -16,16 +16,22 @@
 package fgrpc
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
 	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
@@ -40,8 +46,43 @@ const (
 type pingSrv struct {
 }
 
+// echoMetadata sends back (as response headers) the custom metadata received.
+func echoMetadata(c context.Context) {
+	in, ok := metadata.FromIncomingContext(c)
+	if !ok {
+		return
+	}
+	md := metadata.MD{}
+	for k, v := range in {
+		if isReservedHeader(k) {
+			continue
+		}
+		md[k] = v
+	}
+	if len(md) == 0 {
+		return
+	}
+	if err := grpc.SetHeader(c, md); err != nil {
+		log.Warnf("Unable to echo back metadata %v: %v", md, err)
+	}
+}
+
+// isReservedHeader is true for the http2 pseudo headers and the ones
+// managed by grpc itself which can't be echoed back.
+func isReservedHeader(k string) bool {
+	if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") {
+		return true
+	}
+	switch k {
+	case "content-type", "user-agent", "te":
+		return true
+	}
+	return false
+}
+
 func (s *pingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error) {
 	log.LogVf("Ping called %+v (ctx %+v)", *in, c)
+	echoMetadata(c)
 	out := *in // copy the input including the payload etc
 	out.Ts = time.Now().UnixNano()
 	if in.DelayNanos > 0 {
@@ -52,15 +93,77 @@ func (s *pingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error)
 	return &out, nil
 }
 
+// PingStream is the bidi streaming version of Ping: each received message
+// is echoed back (after the optional delay) on the stream.
+func (s *pingSrv) PingStream(stream PingServer_PingStreamServer) error {
+	echoMetadata(stream.Context())
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.LogVf("PingStream received %+v", *in)
+		out := *in
+		out.Ts = time.Now().UnixNano()
+		if in.DelayNanos > 0 {
+			s := time.Duration(in.DelayNanos)
+			log.LogVf("GRPC ping stream: sleeping for %v", s)
+			time.Sleep(s)
+		}
+		if err := stream.Send(&out); err != nil {
+			return err
+		}
+	}
+}
+
+// PingServerStream is the server streaming version of Ping: the received
+// message is sent back, with increasing sequence numbers (from the received
+// one) and every DelayNanos, until the client cancels the stream.
+func (s *pingSrv) PingServerStream(in *PingMessage, stream PingServer_PingServerStreamServer) error {
+	log.LogVf("PingServerStream called %+v", *in)
+	echoMetadata(stream.Context())
+	out := *in
+	delay := time.Duration(in.DelayNanos)
+	for {
+		if delay > 0 {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+		out.Ts = time.Now().UnixNano()
+		if err := stream.Send(&out); err != nil {
+			if stream.Context().Err() != nil {
+				return nil // cancelled by the client
+			}
+			return err
+		}
+		out.Seq++
+	}
+}
+
 // PingServer starts a grpc ping (and health) echo server.
 // returns the port being bound (useful when passing "0" as the port to
 // get a dynamic server). Pass the healthServiceName to use for the
 // grpc service name health check (or pass DefaultHealthServiceName)
 // to be marked as SERVING. Pass maxConcurrentStreams > 0 to set that option.
 func PingServer(port, cert, key, healthServiceName string, maxConcurrentStreams uint32) int {
+	p, _, _ := PingServerWithHandle(port, cert, key, healthServiceName, maxConcurrentStreams)
+	return p
+}
+
+// PingServerWithHandle is like PingServer but also returns the grpc server
+// and a cleanup function which gracefully stops it. Returns -1, nil and a
+// no-op cleanup function in case of error.
+func PingServerWithHandle(port, cert, key, healthServiceName string,
+	maxConcurrentStreams uint32) (int, *grpc.Server, func()) {
 	socket, addr := fnet.Listen("grpc '"+healthServiceName+"'", port)
 	if addr == nil {
-		return -1
+		return -1, nil, func() {}
 	}
 	var grpcOptions []grpc.ServerOption
 	if maxConcurrentStreams > 0 {
@@ -83,11 +186,16 @@ func PingServer(port, cert, key, healthServiceName string, maxConcurrentStreams
 	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
 	RegisterPingServerServer(grpcServer, &pingSrv{})
 	go func() {
+		// Serve only returns nil after (Graceful)Stop
 		if err := grpcServer.Serve(socket); err != nil {
 			log.Fatalf("failed to start grpc server: %v", err)
 		}
 	}()
-	return addr.Port
+	cleanup := func() {
+		log.Infof("Stopping grpc '%s' server on port %d", healthServiceName, addr.Port)
+		grpcServer.GracefulStop()
+	}
+	return addr.Port, grpcServer, cleanup
 }
 
 // PingClientCall calls the ping service (presumably running as PingServer on
@@ -144,9 +252,77 @@ func PingClientCall(serverAddr, cacert string, n int, payload string, delay time
 	return rttHistogram.Avg() / 1e6, nil
 }
 
-// HealthResultMap short cut for the map of results to count. -1 for errors.
+// HealthResultMap short cut for the map of results to count. -1 for errors
+// without grpc status, see ErrorKey() for errors with a grpc status code.
 type HealthResultMap map[grpc_health_v1.HealthCheckResponse_ServingStatus]int64
 
+// StatusCodeOffset is used for the HealthResultMap key of errors with a grpc
+// status code: the key is -(StatusCodeOffset + code) so it doesn't collide
+// with the health serving statuses (>= 0) nor -1 (other errors).
+const StatusCodeOffset = 100
+
+// ErrorKey returns the HealthResultMap key to use for the (non nil) error.
+func ErrorKey(err error) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	s, ok := status.FromError(err)
+	if !ok {
+		return -1
+	}
+	return grpc_health_v1.HealthCheckResponse_ServingStatus(-(StatusCodeOffset + int32(s.Code())))
+}
+
+// ErrorClass returns the class of a (non nil) call error: from its status
+// code, refined from the message for the Unavailable (connection) errors.
+func ErrorClass(err error) fnet.ErrorClass {
+	s, ok := status.FromError(err)
+	if !ok {
+		return fnet.ClassifyError(err)
+	}
+	switch s.Code() {
+	case codes.DeadlineExceeded:
+		return fnet.TimeoutError
+	case codes.Unavailable:
+		if c := fnet.ClassifyError(errors.New(s.Message())); c != fnet.OtherError {
+			return c
+		}
+		return fnet.NetworkError
+	case codes.Unknown, codes.Internal:
+		// e.g. the errors opening or closing the ping stream
+		if c := fnet.ClassifyError(errors.New(s.Message())); c != fnet.OtherError {
+			return c
+		}
+	}
+	return fnet.ApplicationError
+}
+
+// StatusCode returns the grpc status code for a HealthResultMap key and
+// true, or false if the key isn't for a grpc status code error.
+func StatusCode(k grpc_health_v1.HealthCheckResponse_ServingStatus) (codes.Code, bool) {
+	if k > -StatusCodeOffset {
+		return codes.OK, false
+	}
+	return codes.Code(-int32(k) - StatusCodeOffset), true
+}
+
+// KeyString returns the string version of a HealthResultMap key: either the
+// health serving status or the grpc status code name.
+func KeyString(k grpc_health_v1.HealthCheckResponse_ServingStatus) string {
+	if c, ok := StatusCode(k); ok {
+		return c.String()
+	}
+	return k.String()
+}
+
+// Errors returns the total count of errors (negative keys).
+func (m HealthResultMap) Errors() int64 {
+	var n int64
+	for k, v := range m {
+		if k < 0 {
+			n += v
+		}
+	}
+	return n
+}
+
 // GrpcHealthCheck makes a grpc client call to the standard grpc health check
 // service.
 func GrpcHealthCheck(serverAddr, cacert string, svcname string, n int) (*HealthResultMap, error) {
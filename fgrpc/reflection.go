@@ -0,0 +1,116 @@
+// Copyright 2017 Istio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fgrpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"istio.io/fortio/log"
+)
+
+// ListMethods uses the server reflection service of the destination to list
+// the fully qualified methods (e.g. "/pkg.Service/Method", as expected by
+// GRPCRunnerOptions.Method) it exposes, sorted. The reflection service itself
+// is included when present. Dials using the same TLS logic as the runner.
+func ListMethods(dest string, opts ClientTLSOptions) ([]string, error) {
+	conn, err := DialTLS(dest, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint: errcheck
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		log.Errf("Unable to start reflection stream on %s: %v", dest, err)
+		return nil, err
+	}
+	res, err := reflectionRequest(stream, &grpc_reflection_v1alpha.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var methods []string
+	for _, svc := range res.GetListServicesResponse().GetService() {
+		m, err := serviceMethods(stream, svc.GetName())
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, m...)
+	}
+	sort.Strings(methods)
+	return methods, stream.CloseSend()
+}
+
+// serviceMethods returns the fully qualified methods of the service, from
+// the file descriptors containing it.
+func serviceMethods(stream grpc_reflection_v1alpha.ServerReflection_ServerReflectionInfoClient,
+	svc string) ([]string, error) {
+	res, err := reflectionRequest(stream, &grpc_reflection_v1alpha.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range res.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fd := &descriptor.FileDescriptorProto{}
+		if err := proto.Unmarshal(b, fd); err != nil {
+			log.Errf("Unable to parse file descriptor for %s: %v", svc, err)
+			return nil, err
+		}
+		for _, s := range fd.GetService() {
+			name := s.GetName()
+			if fd.GetPackage() != "" {
+				name = fd.GetPackage() + "." + name
+			}
+			if name != svc {
+				continue
+			}
+			methods := make([]string, 0, len(s.GetMethod()))
+			for _, m := range s.GetMethod() {
+				methods = append(methods, "/"+svc+"/"+m.GetName())
+			}
+			return methods, nil
+		}
+	}
+	return nil, fmt.Errorf("service %s not found in reflection file descriptors", svc)
+}
+
+// reflectionRequest sends 1 request on the reflection stream and returns
+// the response, or an error including the reflection error response.
+func reflectionRequest(stream grpc_reflection_v1alpha.ServerReflection_ServerReflectionInfoClient,
+	req *grpc_reflection_v1alpha.ServerReflectionRequest) (*grpc_reflection_v1alpha.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		log.Errf("Error sending reflection request %v: %v", req, err)
+		return nil, err
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		log.Errf("Error receiving reflection response for %v: %v", req, err)
+		return nil, err
+	}
+	if e := res.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", e.GetErrorCode(), e.GetErrorMessage())
+	}
+	return res, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Istio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fgrpc
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/fortio/log"
+)
+
+func TestListMethods(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port, _, cleanup := PingServerWithHandle("0", "", "", "reflection", 0)
+	defer cleanup()
+	methods, err := ListMethods(fmt.Sprintf("localhost:%d", port), ClientTLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/fgrpc.PingServer/Ping",
+		"/fgrpc.PingServer/PingStream",
+		"/fgrpc.PingServer/PingServerStream",
+		"/grpc.health.v1.Health/Check",
+	}
+	found := map[string]bool{}
+	for _, m := range methods {
+		found[m] = true
+	}
+	for _, e := range expected {
+		if !found[e] {
+			t.Errorf("Expected method %s not found in %v", e, methods)
+		}
+	}
+	// The result must be usable as the runner's generic Method:
+	opts := GRPCRunnerOptions{Destination: fmt.Sprintf("localhost:%d", port), Method: "/grpc.health.v1.Health/Check"}
+	opts.Exactly = 2
+	if res, err := RunGRPCTest(&opts); err != nil || res.RetCodes.Errors() != 0 {
+		t.Errorf("Unable to call discovered method: %v %v", err, res)
+	}
+	if _, err := ListMethods("localhost:1", ClientTLSOptions{}); err == nil {
+		t.Errorf("Expected error listing methods of non listening destination")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc
+
+import (
+	"io"
+
+	"github.com/golang/snappy"
+	"google.golang.org/grpc/encoding"
+)
+
+// SnappyCompressor is the name of the snappy grpc compressor, registered
+// (unless the program already did) so the Compressor option and the ping
+// server support it along with gzip.
+const SnappyCompressor = "snappy"
+
+func init() {
+	// encoding.RegisterCompressor isn't thread safe: it can only be called
+	// at init time, not when the Compressor option is used.
+	if encoding.GetCompressor(SnappyCompressor) == nil {
+		encoding.RegisterCompressor(snappyCompressor{})
+	}
+}
+
+// snappyCompressor is the encoding.Compressor of the snappy framing format
+// (github.com/golang/snappy Writer and Reader).
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return SnappyCompressor
+}
+
+func (snappyCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
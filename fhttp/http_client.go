@@ -17,19 +17,30 @@ package fhttp // import "istio.io/fortio/fhttp"
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/http2"
+
 	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+	"istio.io/fortio/stats"
 	"istio.io/fortio/version"
 )
 
@@ -43,6 +54,103 @@ type Fetcher interface {
 	Close() int
 }
 
+// ConnectionStats counts how the requests got their connection.
+type ConnectionStats struct {
+	New        int64 // requests sent on a newly opened connection
+	Reused     int64 // requests sent on an already open (keep-alive) connection
+	DNSLookups int64
+	// TLS handshakes of the new connections, full or resuming a session (see
+	// the TLSSessionCache option).
+	FullHandshakes    int64
+	ResumedHandshakes int64
+}
+
+// Add adds the counts of o to s.
+func (s *ConnectionStats) Add(o ConnectionStats) {
+	s.New += o.New
+	s.Reused += o.Reused
+	s.DNSLookups += o.DNSLookups
+	s.FullHandshakes += o.FullHandshakes
+	s.ResumedHandshakes += o.ResumedHandshakes
+}
+
+// recordHandshake counts 1 successful full or resumed TLS handshake.
+func (s *ConnectionStats) recordHandshake(cs tls.ConnectionState) {
+	if cs.DidResume {
+		s.ResumedHandshakes++
+	} else {
+		s.FullHandshakes++
+	}
+}
+
+// record counts 1 request on a new or reused connection.
+func (s *ConnectionStats) record(reused bool) {
+	if reused {
+		s.Reused++
+	} else {
+		s.New++
+	}
+}
+
+// ConnectionStatsReporter is optionally implemented by Fetchers to provide
+// the ConnectionStats of their calls so far.
+type ConnectionStatsReporter interface {
+	ConnectionStats() ConnectionStats
+}
+
+// ProtocolReporter is optionally implemented by Fetchers to provide the
+// (ALPN) protocol negotiated by the TLS handshake of their last call.
+type ProtocolReporter interface {
+	NegotiatedProtocol() string
+}
+
+// HeaderReporter is optionally implemented by Fetchers to provide the
+// headers of their last response.
+type HeaderReporter interface {
+	ResponseHeader() http.Header
+}
+
+// RedirectReporter is optionally implemented by Fetchers to provide the
+// counts, by status code, of the intermediate redirect responses they
+// followed so far.
+type RedirectReporter interface {
+	Redirects() map[int]int64
+}
+
+// PhaseReporter is optionally implemented by Fetchers to provide the
+// durations of the phases (connect, TLS handshake, first byte) of their calls.
+type PhaseReporter interface {
+	PhaseTimings() *fnet.PhaseTimings
+}
+
+// PipelineReporter is optionally implemented by Fetchers which pipeline their
+// requests (PipelineDepth) to provide the durations, in seconds, from the
+// sending of each batch of requests to each of its responses, and the number
+// of requests which got no response because the server doesn't pipeline.
+type PipelineReporter interface {
+	PipelineStats() (*stats.Histogram, int64)
+}
+
+// TransferReporter is optionally implemented by Fetchers to provide, when
+// the MeasureThroughput option is set, the times at which their last request
+// was sent and the first and last bytes of its response were received (zero
+// when not received).
+type TransferReporter interface {
+	LastTransfer() (sent, firstByte, lastByte time.Time)
+}
+
+// transferTimes are the times of the last call (TransferReporter).
+type transferTimes struct {
+	enabled           bool // MeasureThroughput
+	sent, first, last time.Time
+}
+
+// ErrorReporter is optionally implemented by Fetchers to provide the
+// transport error (connection, timeout...) of their last call, nil if none.
+type ErrorReporter interface {
+	LastError() error
+}
+
 var (
 	// BufferSizeKb size of the buffer (max data) for optimized client in kilobytes defaults to 128k.
 	BufferSizeKb = 128
@@ -52,6 +160,7 @@ var (
 	contentLengthHeader   = []byte("\r\ncontent-length:")
 	connectionCloseHeader = []byte("\r\nconnection: close")
 	chunkedHeader         = []byte("\r\nTransfer-Encoding: chunked")
+	gzipEncodingHeader    = []byte("\r\nContent-Encoding: gzip")
 )
 
 // NewHTTPOptions creates and initialize a HTTPOptions object.
@@ -70,6 +179,7 @@ func (h *HTTPOptions) Init(url string) *HTTPOptions {
 	h.initDone = true
 	h.URL = url
 	h.NumConnections = 1
+	h.seqCounter = new(int64)
 	if h.HTTPReqTimeOut <= 0 {
 		h.HTTPReqTimeOut = HTTPReqTimeOutDefaultValue
 	}
@@ -113,6 +223,8 @@ const (
 	retcodeOffset = len("HTTP/1.X ")
 	// HTTPReqTimeOutDefaultValue is the default timeout value. 15s.
 	HTTPReqTimeOutDefaultValue = 15 * time.Second
+	// DefaultMaxRedirects is the number of redirects followed when MaxRedirects isn't set.
+	DefaultMaxRedirects = 10
 )
 
 // HTTPOptions holds the common options of both http clients and the headers.
@@ -125,14 +237,215 @@ type HTTPOptions struct {
 	DisableKeepAlive  bool // so default is keep alive
 	AllowHalfClose    bool // if not keepalive, whether to half close after request
 	Insecure          bool // do not verify certs for https
-	FollowRedirects   bool // For the Std Client only: follow redirects.
-	initDone          bool
-	https             bool // whether URLSchemeCheck determined this was an https:// call or not
+	FollowRedirects   bool // follow redirects (implies the std client)
+	// Maximum number of redirects followed (when FollowRedirects), the last
+	// redirect response is then the result. Default (0) is 10.
+	MaxRedirects int
+	initDone     bool
+	https        bool // whether URLSchemeCheck determined this was an https:// call or not
 	// ExtraHeaders to be added to each request.
 	extraHeaders http.Header
 	// Host is treated specially, remember that one separately.
 	hostOverride   string
 	HTTPReqTimeOut time.Duration // timeout value for http request
+	// Method to use, defaults to GET, or POST when there is a Payload.
+	Method string
+	// Payload is the body to send, which makes the request a POST (default is GET with no body).
+	Payload []byte
+	// PayloadFile is read once (by RunHTTPTest) into Payload.
+	PayloadFile string
+	// MultipartForm is encoded once (by RunHTTPTest) into Payload and its
+	// multipart/form-data ContentType, replacing them (see http_multipart.go).
+	MultipartForm []FormPart
+	// PayloadCorpusFile is read once (by RunHTTPTest) into payloads separated
+	// by PayloadDelimiter (default is one per line), sent in turn for each
+	// request (round robin across the threads) or, with PayloadCorpusRandom,
+	// picked at random (from the run's Seed). They replace the Payload and
+	// aren't templates.
+	PayloadCorpusFile   string
+	PayloadDelimiter    string
+	PayloadCorpusRandom bool
+	corpus              *fnet.PayloadCorpus // shared by the clients of a run
+	// CompressRequest gzips the Payload, sent with Content-Encoding: gzip.
+	// (gzip responses are decoded regardless)
+	CompressRequest bool
+	// ContentType of the Payload, ignored when a Content-Type extra header is set.
+	// Defaults to application/octet-stream.
+	ContentType string
+	// URL and Payload can contain {{.Seq}}, {{.UUID}} and {{.ThreadID}}
+	// placeholders, expanded for each request (see http_template.go).
+	seqCounter *int64 // shared request sequence counter
+	threadID   int    // set by RunHTTPTest on each thread's copy
+	seed       int64  // of the uuids, set by RunHTTPTest, else from the time
+	// EnableCookieJar stores the cookies set by the responses and sends them
+	// back on the next requests of the same client (thread).
+	EnableCookieJar bool
+	jar             http.CookieJar // shared by the clients of a thread
+	// HTTP2 uses the (std client based) http2 transport: h2 for https:// urls
+	// and h2c with prior knowledge for http:// ones.
+	HTTP2 bool
+	h2    *http2.Transport // shared by all the clients of a run
+	// TLS versions and cipher suites restrictions for https.
+	fnet.TLSOptions
+	// Credentials to send in the Authorization header, either basic auth
+	// (when BasicAuthUser is set) or a bearer token. An explicit Authorization
+	// extra header takes precedence.
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+	// PhaseTimings records the TCP connect, TLS handshake (of the new
+	// connections) and first response byte durations (implies the std client).
+	PhaseTimings bool
+	resolution   float64 // of the phases histograms, set by RunHTTPTest
+	// MeasureThroughput records the time to first byte and the download rate
+	// (body bytes per second from the first to the last byte) of each
+	// response, see HTTPRunnerResults.TTFBHistogram and ThroughputHistogram.
+	MeasureThroughput bool
+	// Local IP addresses to bind the outgoing connections to, one after the
+	// other for each new connection (e.g. to test per source rate limits).
+	// They must be assigned to this host.
+	SourceAddresses []string
+	sources         *fnet.SourceAddresses // shared by the clients of a run
+	// IP version to resolve the host to and connect with (default is any).
+	AddressFamily fnet.AddressFamily
+	// HMACKey, when set, signs each request with an HMAC-SHA256 (of the method,
+	// path, body and timestamp) in the HMACHeader, see http_sign.go.
+	HMACKey    []byte
+	HMACHeader string // defaults to DefaultHMACHeader
+	// Keep-alive connections idle for longer than IdleConnTimeout are closed
+	// (default 0 is no limit, ignored with HTTP2). The std client keeps up to MaxIdleConnsPerHost
+	// (default NumConnections) idle connections per host.
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	// Number of requests the fast client sends back to back on its (keep
+	// alive) connection before reading their responses (HTTP/1.1 pipelining).
+	// Default (0 or 1) is no pipelining. It falls back to one request at a
+	// time when the server closes the connection or stops answering after the
+	// first response of a batch.
+	PipelineDepth int
+}
+
+// DefaultContentType is the Content-Type used for the Payload when none is specified.
+const DefaultContentType = "application/octet-stream"
+
+// method returns the http method to use: Method if set, else POST when there
+// is a payload, GET otherwise.
+func (h *HTTPOptions) method() string {
+	if h.Method != "" {
+		return h.Method
+	}
+	if len(h.Payload) > 0 {
+		return "POST"
+	}
+	return "GET"
+}
+
+// cookieJar returns the cookie jar to use, nil unless EnableCookieJar is set.
+func (h *HTTPOptions) cookieJar() http.CookieJar {
+	if !h.EnableCookieJar {
+		return nil
+	}
+	if h.jar == nil {
+		h.jar, _ = cookiejar.New(nil) // never returns an error
+	}
+	return h.jar
+}
+
+// http2Transport returns the http2 transport to use, creating it if needed.
+func (h *HTTPOptions) http2Transport() *http2.Transport {
+	if h.h2 != nil {
+		return h.h2
+	}
+	h.h2 = &http2.Transport{
+		DisableCompression: !h.Compression,
+	}
+	if h.https {
+		h.h2.TLSClientConfig = h.tlsConfig()
+		sources, timeout, family := h.sources, h.HTTPReqTimeOut, h.AddressFamily
+		if sources != nil || family.Network("tcp") != "tcp" {
+			h.h2.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return tls.DialWithDialer(sources.Dialer(timeout), family.Network(network), addr, cfg)
+			}
+		}
+		return h.h2
+	}
+	// h2c: plain tcp connection instead of tls
+	timeout, sources, family := h.HTTPReqTimeOut, h.sources, h.AddressFamily
+	h.h2.AllowHTTP = true
+	h.h2.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return sources.Dialer(timeout).Dial(family.Network(network), addr)
+	}
+	return h.h2
+}
+
+// initDialer checks the AddressFamily and the SourceAddresses and sets up
+// their rotation, if not already done (it is then shared by the copies of
+// the options).
+func (h *HTTPOptions) initDialer() (err error) {
+	if err = h.AddressFamily.Check(); err != nil {
+		return err
+	}
+	if h.sources == nil {
+		h.sources, err = fnet.NewSourceAddresses(h.SourceAddresses)
+	}
+	return err
+}
+
+// tlsConfig returns the https client tls config, nil for the default one.
+func (h *HTTPOptions) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if h.Insecure {
+		log.LogVf("using insecure https")
+		cfg = &tls.Config{InsecureSkipVerify: true} // nolint: gas
+	}
+	if h.TLSOptions.IsSet() {
+		log.LogVf("using tls versions %x - %x, cipher suites %v and session cache %v",
+			h.MinTLSVersion, h.MaxTLSVersion, h.CipherSuites, h.TLSSessionCache)
+		cfg = h.TLSOptions.Apply(cfg)
+	}
+	return cfg
+}
+
+// gzipRequest returns whether the payload is sent gzipped.
+func (h *HTTPOptions) gzipRequest() bool {
+	return h.CompressRequest && len(h.Payload) > 0
+}
+
+// body returns the bytes to send for the Payload (gzipped if CompressRequest).
+func (h *HTTPOptions) body() []byte {
+	if !h.gzipRequest() {
+		return h.Payload
+	}
+	return gzipBytes(nil, h.Payload)
+}
+
+// contentType returns the Content-Type header value to add for the payload,
+// empty if there is no payload or the header is already set by the user.
+func (h *HTTPOptions) contentType() string {
+	if len(h.Payload) == 0 || h.extraHeaders.Get("Content-Type") != "" {
+		return ""
+	}
+	if h.ContentType != "" {
+		return h.ContentType
+	}
+	return DefaultContentType
+}
+
+// authorization returns the Authorization header value to add for the
+// BasicAuthUser/Password or BearerToken, empty if there is none or the header
+// is already set by the user.
+func (h *HTTPOptions) authorization() string {
+	if h.extraHeaders.Get("Authorization") != "" {
+		return ""
+	}
+	if h.BasicAuthUser != "" {
+		creds := h.BasicAuthUser + ":" + h.BasicAuthPassword
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+	if h.BearerToken != "" {
+		return "Bearer " + h.BearerToken
+	}
+	return ""
 }
 
 // ResetHeaders resets all the headers, including the User-Agent one.
@@ -181,14 +494,38 @@ func (h *HTTPOptions) AddAndValidateExtraHeader(hdr string) error {
 	return nil
 }
 
-// newHttpRequest makes a new http GET request for url with User-Agent.
+// newHttpRequest makes a new http GET (or POST if there is a payload)
+// request for url with User-Agent.
 func newHTTPRequest(o *HTTPOptions) *http.Request {
-	req, err := http.NewRequest("GET", o.URL, nil)
+	return newHTTPRequestBody(o, o.body())
+}
+
+// newHTTPRequestBody is newHTTPRequest with the already computed o.body().
+func newHTTPRequestBody(o *HTTPOptions, payload []byte) *http.Request {
+	var body io.Reader
+	if len(payload) > 0 {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(o.method(), o.URL, body)
 	if err != nil {
 		log.Errf("Unable to make request for %s : %v", o.URL, err)
 		return nil
 	}
 	req.Header = o.extraHeaders
+	ct := o.contentType()
+	auth := o.authorization()
+	if ct != "" || auth != "" || o.gzipRequest() {
+		req.Header = cloneHeader(o.extraHeaders) // don't change the shared options' headers
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if o.gzipRequest() {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	if o.hostOverride != "" {
 		req.Host = o.hostOverride
 	}
@@ -204,13 +541,122 @@ func newHTTPRequest(o *HTTPOptions) *http.Request {
 	return req
 }
 
+// cloneHeader returns a copy of h.
+func cloneHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h)+1)
+	for k, v := range h {
+		res[k] = v
+	}
+	return res
+}
+
+// idleCloser is implemented by both the http and http2 transports.
+type idleCloser interface {
+	CloseIdleConnections()
+}
+
 // Client object for making repeated requests of the same URL using the same
 // http client (net/http)
 type Client struct {
 	url       string
 	req       *http.Request
 	client    *http.Client
-	transport *http.Transport
+	transport idleCloser
+	payload   []byte           // body to resend for each request
+	tmpl      *clientTemplates // nil unless the url or payload have placeholders
+	cookies   bool             // the jar adds a Cookie header to req at each call
+	gzip      bool             // gzip the expanded payload template
+	connStats ConnectionStats  // updated through the httptrace of req
+	alpn      string           // negotiated protocol of the last https response
+	header    http.Header      // headers of the last response
+	redirects map[int]int64    // intermediate redirect codes, when following redirects
+	err       error            // transport error of the last call
+	// phases durations, nil unless PhaseTimings is set
+	phases   *fnet.PhaseTimings
+	signer   *requestSigner // nil unless HMACKey is set
+	transfer transferTimes
+}
+
+// ConnectionStats returns the connections counts so far (ConnectionStatsReporter).
+func (c *Client) ConnectionStats() ConnectionStats {
+	return c.connStats
+}
+
+// NegotiatedProtocol returns the ALPN protocol (e.g. "h2") of the last https
+// response, empty if none was negotiated (ProtocolReporter).
+func (c *Client) NegotiatedProtocol() string {
+	return c.alpn
+}
+
+// LastError returns the transport error of the last call (ErrorReporter).
+func (c *Client) LastError() error {
+	return c.err
+}
+
+// Redirects returns the counts of the redirect responses followed so far
+// (RedirectReporter).
+func (c *Client) Redirects() map[int]int64 {
+	return c.redirects
+}
+
+// ResponseHeader returns the headers of the last response, nil if there
+// was none (HeaderReporter).
+func (c *Client) ResponseHeader() http.Header {
+	return c.header
+}
+
+// LastTransfer returns the times of the last call, zero unless the
+// MeasureThroughput option is set (TransferReporter).
+func (c *Client) LastTransfer() (time.Time, time.Time, time.Time) {
+	return c.transfer.sent, c.transfer.first, c.transfer.last
+}
+
+// PhaseTimings returns the phases durations recorded so far, nil unless the
+// PhaseTimings option is set (PhaseReporter).
+func (c *Client) PhaseTimings() *fnet.PhaseTimings {
+	return c.phases
+}
+
+// traceConnections sets up the httptrace updating connStats (and the phases
+// timings) on req.
+func (c *Client) traceConnections() {
+	trace := httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { c.connStats.DNSLookups++ },
+		GotConn:  func(info httptrace.GotConnInfo) { c.connStats.record(info.Reused) },
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				c.connStats.recordHandshake(cs)
+			}
+		},
+	}
+	if c.transfer.enabled {
+		trace.GotFirstResponseByte = func() { c.transfer.first = time.Now() }
+	}
+	if c.phases != nil {
+		var start, connectStart, tlsStart time.Time
+		trace.GetConn = func(string) { start = time.Now() }
+		trace.ConnectStart = func(string, string) { connectStart = time.Now() }
+		trace.ConnectDone = func(_, _ string, err error) {
+			if err == nil {
+				c.phases.Connect.Record(time.Since(connectStart).Seconds())
+			}
+		}
+		trace.TLSHandshakeStart = func() { tlsStart = time.Now() }
+		trace.TLSHandshakeDone = func(cs tls.ConnectionState, err error) {
+			if err == nil {
+				c.connStats.recordHandshake(cs)
+				c.phases.TLSHandshake.Record(time.Since(tlsStart).Seconds())
+			}
+		}
+		trace.GotFirstResponseByte = func() {
+			now := time.Now()
+			if c.transfer.enabled {
+				c.transfer.first = now
+			}
+			c.phases.FirstByte.Record(now.Sub(start).Seconds())
+		}
+	}
+	c.req = c.req.WithContext(httptrace.WithClientTrace(c.req.Context(), &trace))
 }
 
 // Close cleans up any resources used by NewStdClient
@@ -240,11 +686,51 @@ func (c *Client) ChangeURL(urlStr string) (err error) {
 // Fetch fetches the byte and code for pre created client
 func (c *Client) Fetch() (int, []byte, int) {
 	// req can't be null (client itself would be null in that case)
+	payload := c.payload
+	if c.tmpl != nil {
+		c.tmpl.next()
+		if c.tmpl.url != nil {
+			u, err := url.Parse(string(c.tmpl.url.expand(nil, c.tmpl.vars)))
+			if err != nil {
+				log.Errf("Bad expanded url for %s : %v", c.url, err)
+				return http.StatusBadRequest, []byte(err.Error()), 0
+			}
+			c.req.URL = u
+		}
+		if c.tmpl.payload != nil || c.tmpl.corpus != nil {
+			payload = c.tmpl.nextPayload(nil)
+			if c.gzip {
+				payload = gzipBytes(nil, payload)
+			}
+			c.req.ContentLength = int64(len(payload))
+		}
+	}
+	if c.cookies {
+		c.req.Header.Del("Cookie") // set again from the jar by Do()
+	}
+	if c.signer != nil {
+		sig := c.signer.appendSignature(nil, c.req.Method, []byte(c.req.URL.RequestURI()), payload, time.Now().Unix())
+		c.req.Header.Set(c.signer.header, string(sig))
+	}
+	if len(payload) > 0 {
+		// the body reader is consumed by each request
+		c.req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+	c.header = nil
+	c.err = nil
+	if c.transfer.enabled {
+		c.transfer = transferTimes{enabled: true, sent: time.Now()}
+	}
 	resp, err := c.client.Do(c.req)
 	if err != nil {
 		log.Errf("Unable to send request for %s : %v", c.url, err)
+		c.err = err
 		return http.StatusBadRequest, []byte(err.Error()), 0
 	}
+	c.header = resp.Header
+	if resp.TLS != nil {
+		c.alpn = resp.TLS.NegotiatedProtocol
+	}
 	var data []byte
 	if log.LogDebug() {
 		if data, err = httputil.DumpResponse(resp, false); err != nil {
@@ -253,10 +739,20 @@ func (c *Client) Fetch() (int, []byte, int) {
 			log.Debugf("For URL %s, received:\n%s", c.url, data)
 		}
 	}
-	data, err = ioutil.ReadAll(resp.Body)
+	body := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed {
+		// not already decoded by the transport (ie we didn't ask for it)
+		if body, err = gzip.NewReader(resp.Body); err != nil {
+			log.Errf("Bad gzip response for %s : %v", c.url, err)
+			resp.Body.Close() //nolint(errcheck)
+			return resp.StatusCode, []byte(err.Error()), 0
+		}
+	}
+	data, err = ioutil.ReadAll(body)
 	resp.Body.Close() //nolint(errcheck)
 	if err != nil {
 		log.Errf("Unable to read response for %s : %v", c.url, err)
+		c.err = err
 		code := resp.StatusCode
 		if code == http.StatusOK {
 			code = http.StatusNoContent
@@ -264,6 +760,9 @@ func (c *Client) Fetch() (int, []byte, int) {
 		}
 		return code, data, 0
 	}
+	if c.transfer.enabled {
+		c.transfer.last = time.Now()
+	}
 	code := resp.StatusCode
 	log.Debugf("Got %d : %s for %s - response is %d bytes", code, resp.Status, c.url, len(data))
 	return code, data, 0
@@ -274,7 +773,22 @@ func (c *Client) Fetch() (int, []byte, int) {
 func NewClient(o *HTTPOptions) Fetcher {
 	o.Init(o.URL)      // For completely new options
 	o.URLSchemeCheck() // For changes to options after init
+	if o.HTTP2 && !o.DisableFastClient {
+		log.LogVf("http2 requested, using the standard go client")
+		o.DisableFastClient = true
+	}
+	if o.FollowRedirects && !o.DisableFastClient {
+		log.LogVf("following redirects requested, using the standard go client")
+		o.DisableFastClient = true
+	}
+	if o.PhaseTimings && !o.DisableFastClient {
+		log.LogVf("phase timings requested, using the standard go client")
+		o.DisableFastClient = true
+	}
 	if o.DisableFastClient {
+		if o.PipelineDepth > 1 {
+			log.Warnf("Pipelining is only supported by the fast client, ignoring depth %d", o.PipelineDepth)
+		}
 		return NewStdClient(o)
 	}
 	return NewFastClient(o)
@@ -283,7 +797,8 @@ func NewClient(o *HTTPOptions) Fetcher {
 // NewStdClient creates a client object that wraps the net/http standard client.
 func NewStdClient(o *HTTPOptions) *Client {
 	o.Init(o.URL)
-	req := newHTTPRequest(o)
+	payload := o.body()
+	req := newHTTPRequestBody(o, payload)
 	if req == nil {
 		return nil
 	}
@@ -294,34 +809,102 @@ func NewStdClient(o *HTTPOptions) *Client {
 	if o.HTTPReqTimeOut <= 0 {
 		log.Warnf("Std call with client timeout %v", o.HTTPReqTimeOut)
 	}
-	tr := http.Transport{
-		MaxIdleConns:        o.NumConnections,
-		MaxIdleConnsPerHost: o.NumConnections,
-		DisableCompression:  !o.Compression,
-		DisableKeepAlives:   o.DisableKeepAlive,
-		Dial: (&net.Dialer{
-			Timeout: o.HTTPReqTimeOut,
-		}).Dial,
-		TLSHandshakeTimeout: o.HTTPReqTimeOut,
-	}
-	if o.Insecure && o.https {
-		log.LogVf("using insecure https")
-		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint: gas
+	if err := o.initDialer(); err != nil {
+		log.Errf("Bad address family or source addresses for %s : %v", o.URL, err)
+		return nil
+	}
+	var tr interface {
+		http.RoundTripper
+		idleCloser
+	}
+	if o.HTTP2 {
+		tr = o.http2Transport()
+	} else {
+		maxIdle := o.NumConnections
+		if o.MaxIdleConnsPerHost > 0 {
+			maxIdle = o.MaxIdleConnsPerHost
+		}
+		t1 := http.Transport{
+			MaxIdleConns:        maxIdle,
+			MaxIdleConnsPerHost: maxIdle,
+			IdleConnTimeout:     o.IdleConnTimeout,
+			DisableCompression:  !o.Compression,
+			DisableKeepAlives:   o.DisableKeepAlive,
+			DialContext: (&net.Dialer{
+				Timeout: o.HTTPReqTimeOut,
+			}).DialContext,
+			TLSHandshakeTimeout: o.HTTPReqTimeOut,
+		}
+		if o.https {
+			t1.TLSClientConfig = o.tlsConfig()
+		}
+		sources, timeout, family := o.sources, o.HTTPReqTimeOut, o.AddressFamily
+		if sources != nil || family.Network("tcp") != "tcp" {
+			t1.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return sources.Dialer(timeout).DialContext(ctx, family.Network(network), addr)
+			}
+		}
+		tr = &t1
 	}
 	client := Client{
 		o.URL,
 		req,
 		&http.Client{
 			Timeout:   o.HTTPReqTimeOut,
-			Transport: &tr,
+			Transport: tr,
+			Jar:       o.cookieJar(),
 		},
-		&tr,
+		tr,
+		payload,
+		nil,
+		o.EnableCookieJar,
+		o.gzipRequest(),
+		ConnectionStats{},
+		"",
+		nil,
+		nil,
+		nil,
+		nil,
+		newRequestSigner(o),
+		transferTimes{enabled: o.MeasureThroughput},
+	}
+	if o.PhaseTimings {
+		resolution := o.resolution
+		if resolution <= 0 {
+			resolution = periodic.DefaultRunnerOptions.Resolution
+		}
+		client.phases = fnet.NewPhaseTimings(resolution)
+	}
+	client.traceConnections()
+	if client.cookies || client.signer != nil {
+		// don't change the shared options' headers (nor req's, client.req being
+		// a copy with the trace context)
+		client.req.Header = cloneHeader(client.req.Header)
+	}
+	var err error
+	if client.tmpl, err = newClientTemplates(o, o.URL); err != nil {
+		log.Errf("Bad template for %s : %v", o.URL, err)
+		return nil
 	}
 	if !o.FollowRedirects {
 		// Lets us see the raw response instead of auto following redirects.
 		client.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}
+		return &client
+	}
+	maxRedirects := o.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	client.redirects = make(map[int]int64)
+	client.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			log.LogVf("Not following more than %d redirects for %s", maxRedirects, client.url)
+			return http.ErrUseLastResponse
+		}
+		client.redirects[req.Response.StatusCode]++
+		return nil
 	}
 	return &client
 }
@@ -366,6 +949,57 @@ type FastClient struct {
 	parseHeaders bool // don't bother in http/1.0
 	halfClose    bool // allow/do half close when keepAlive is false
 	reqTimeout   time.Duration
+	idleTimeout  time.Duration  // close the kept socket after that long unused
+	idleSince    time.Time      // end of the last call on the kept socket
+	jar          http.CookieJar // when EnableCookieJar is set
+	jarURL       *url.URL       // url for the jar's cookies
+	connStats    ConnectionStats
+	err          error // transport error of the last call
+	// local addresses to connect from, nil unless SourceAddresses is set
+	sources *fnet.SourceAddresses
+	signer  *requestSigner // nil unless HMACKey is set
+	// When the url or payload have placeholders, there is a cookie jar or the
+	// requests are signed, req is rebuilt for each request from the following:
+	tmpl    *clientTemplates
+	reqHead []byte // method and space
+	reqURI  string // when the url has no placeholder
+	reqMid  []byte // rest of the request line and headers, without Content-Length
+	payload []byte // when the payload has no placeholder
+	body    []byte // reused expanded payload buffer
+	gzipReq bool   // gzip the expanded payload
+	zbody   []byte // reused gzipped payload buffer
+	// When the response is gzip encoded, the headers and decoded body:
+	gzipped bool
+	decoded []byte
+	respEnd int // end of the last response in buffer, 0 if unknown
+	// Requests per batch (1 when not pipelining), durations of the responses
+	// and count of the unanswered requests when pipelining (see PipelineReporter).
+	pipelineDepth  int
+	pipeline       *stats.Histogram
+	pipelineErrors int64
+	transfer       transferTimes
+}
+
+// ConnectionStats returns the connections counts so far (ConnectionStatsReporter).
+func (c *FastClient) ConnectionStats() ConnectionStats {
+	return c.connStats
+}
+
+// LastError returns the transport error of the last call (ErrorReporter).
+func (c *FastClient) LastError() error {
+	return c.err
+}
+
+// LastTransfer returns the times of the last call, zero unless the
+// MeasureThroughput option is set (TransferReporter).
+func (c *FastClient) LastTransfer() (time.Time, time.Time, time.Time) {
+	return c.transfer.sent, c.transfer.first, c.transfer.last
+}
+
+// PipelineStats returns the durations of the pipelined responses and the
+// count of unanswered requests so far, nil when not pipelining (PipelineReporter).
+func (c *FastClient) PipelineStats() (*stats.Histogram, int64) {
+	return c.pipeline, c.pipelineErrors
 }
 
 // Close cleans up any resources used by FastClient
@@ -399,27 +1033,56 @@ func NewFastClient(o *HTTPOptions) Fetcher {
 		log.Errf("Only http is supported with the optimized client, use -stdclient for url %s", o.URL)
 		return nil
 	}
+	if err = o.initDialer(); err != nil {
+		log.Errf("Bad address family or source addresses for %s : %v", o.URL, err)
+		return nil
+	}
 	// note: Host includes the port
 	bc := FastClient{url: o.URL, host: url.Host, hostname: url.Hostname(), port: url.Port(),
-		http10: o.HTTP10, halfClose: o.AllowHalfClose}
+		http10: o.HTTP10, halfClose: o.AllowHalfClose, jar: o.cookieJar(), jarURL: url, sources: o.sources}
 	bc.buffer = make([]byte, BufferSizeKb*1024)
 	if bc.port == "" {
 		bc.port = url.Scheme // ie http which turns into 80 later
 		log.LogVf("No port specified, using %s", bc.port)
 	}
-	addr := fnet.Resolve(bc.hostname, bc.port)
+	addr := fnet.ResolveFamily(bc.hostname, bc.port, o.AddressFamily)
 	if addr == nil {
 		// Error already logged
 		return nil
 	}
 	bc.dest = *addr
+	if net.ParseIP(bc.hostname) == nil {
+		bc.connStats.DNSLookups++ // by fnet.Resolve
+	}
 	// Create the bytes for the request:
 	host := bc.host
 	if o.hostOverride != "" {
 		host = o.hostOverride
 	}
+	requestURI := url.RequestURI()
+	if strings.Contains(o.URL, "{{") {
+		// use the raw, unescaped, uri for the template
+		requestURI = o.URL[strings.Index(o.URL, "://")+3+len(url.Host):]
+		if requestURI == "" {
+			requestURI = "/"
+		}
+	}
+	if bc.tmpl, err = newClientTemplates(o, requestURI); err != nil {
+		log.Errf("Bad template for %s : %v", o.URL, err)
+		return nil
+	}
+	bc.signer = newRequestSigner(o)
+	payload := o.body()
 	var buf bytes.Buffer
-	buf.WriteString("GET " + url.RequestURI() + " HTTP/" + proto + "\r\n")
+	if bc.dynamic() {
+		bc.reqHead = []byte(o.method() + " ")
+		bc.reqURI = requestURI
+		bc.payload = payload
+		bc.gzipReq = o.gzipRequest()
+		buf.WriteString(" HTTP/" + proto + "\r\n")
+	} else {
+		buf.WriteString(o.method() + " " + requestURI + " HTTP/" + proto + "\r\n")
+	}
 	if !bc.http10 {
 		buf.WriteString("Host: " + host + "\r\n")
 		bc.parseHeaders = true
@@ -434,27 +1097,141 @@ func NewFastClient(o *HTTPOptions) Fetcher {
 		o.HTTPReqTimeOut = HTTPReqTimeOutDefaultValue
 	}
 	bc.reqTimeout = o.HTTPReqTimeOut
+	bc.idleTimeout = o.IdleConnTimeout
+	bc.transfer.enabled = o.MeasureThroughput
+	bc.pipelineDepth = 1
+	if o.PipelineDepth > 1 {
+		if bc.keepAlive {
+			bc.pipelineDepth = o.PipelineDepth
+			bc.pipeline = stats.NewHistogram(0, 0.0001) // 100us precision, like the runner's
+		} else {
+			log.Warnf("Pipelining needs http 1.1 keep alive, ignoring depth %d", o.PipelineDepth)
+		}
+	}
 	w := bufio.NewWriter(&buf)
 	// This writes multiple valued headers properly (unlike calling Get() to do it ourselves)
 	o.extraHeaders.Write(w) // nolint: errcheck,gas
 	w.Flush()               // nolint: errcheck,gas
+	if ct := o.contentType(); ct != "" {
+		buf.WriteString("Content-Type: " + ct + "\r\n")
+	}
+	if auth := o.authorization(); auth != "" {
+		buf.WriteString("Authorization: " + auth + "\r\n")
+	}
+	if o.gzipRequest() {
+		buf.WriteString("Content-Encoding: gzip\r\n")
+	}
+	if bc.dynamic() {
+		// Cookie, signature, Content-Length, end of headers and payload are added by buildRequest
+		bc.reqMid = buf.Bytes()
+		log.Debugf("Created templated client:\n%+v\n%s%s%s", bc.dest, bc.reqHead, bc.reqURI, bc.reqMid)
+		return &bc
+	}
+	if len(payload) > 0 {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(payload)) + "\r\n")
+	}
 	buf.WriteString("\r\n")
-	bc.req = buf.Bytes()
+	buf.Write(payload) // sent as is, once per request
+	bc.req = bytes.Repeat(buf.Bytes(), bc.pipelineDepth)
 	log.Debugf("Created client:\n%+v\n%s", bc.dest, bc.req)
 	return &bc
 }
 
+// dynamic returns whether the request must be rebuilt for each request.
+func (c *FastClient) dynamic() bool {
+	return c.tmpl != nil || c.jar != nil || c.signer != nil
+}
+
+// buildRequest expands the templates and adds the cookies and signature into
+// req, from start (after the previous requests of a pipelined batch), for the
+// next request.
+func (c *FastClient) buildRequest(start int) {
+	if c.tmpl != nil {
+		c.tmpl.next()
+	}
+	req := append(c.req[:start], c.reqHead...)
+	if c.tmpl != nil && c.tmpl.url != nil {
+		req = c.tmpl.url.expand(req, c.tmpl.vars)
+	} else {
+		req = append(req, c.reqURI...)
+	}
+	uriEnd := len(req)
+	req = append(req, c.reqMid...)
+	if c.jar != nil {
+		if cookies := c.jar.Cookies(c.jarURL); len(cookies) > 0 {
+			req = append(req, "Cookie: "...)
+			for i, cookie := range cookies {
+				if i > 0 {
+					req = append(req, "; "...)
+				}
+				req = append(req, cookie.String()...)
+			}
+			req = append(req, "\r\n"...)
+		}
+	}
+	body := c.payload
+	if c.tmpl != nil && (c.tmpl.payload != nil || c.tmpl.corpus != nil) {
+		c.body = c.tmpl.nextPayload(c.body[:0])
+		body = c.body
+		if c.gzipReq {
+			c.zbody = gzipBytes(c.zbody, c.body)
+			body = c.zbody
+		}
+	}
+	if c.signer != nil {
+		method := string(c.reqHead[:len(c.reqHead)-1]) // without the space
+		req = append(req, c.signer.header+": "...)
+		req = c.signer.appendSignature(req, method, req[start+len(c.reqHead):uriEnd], body, time.Now().Unix())
+		req = append(req, "\r\n"...)
+	}
+	if len(body) > 0 {
+		req = append(req, "Content-Length: "...)
+		req = strconv.AppendInt(req, int64(len(body)), 10)
+		req = append(req, "\r\n"...)
+	}
+	req = append(req, "\r\n"...)
+	c.req = append(req, body...)
+}
+
 // return the result from the state.
 func (c *FastClient) returnRes() (int, []byte, int) {
+	if c.gzipped {
+		return c.code, c.decoded, c.headerLen
+	}
 	return c.code, c.buffer[:c.size], c.headerLen
 }
 
+// gunzip decodes the gzip encoded body of the response into decoded.
+func (c *FastClient) gunzip(chunked bool) {
+	end := c.size
+	if c.respEnd > 0 && c.respEnd < end {
+		end = c.respEnd // followed by the next pipelined response
+	}
+	body := c.buffer[c.headerLen:end]
+	if chunked {
+		body = dechunk(body)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		log.Errf("Bad gzip response for %s : %v", c.url, err)
+		return
+	}
+	buf := bytes.NewBuffer(append(c.decoded[:0], c.buffer[:c.headerLen]...))
+	if _, err = buf.ReadFrom(zr); err != nil {
+		log.Errf("Unable to decode gzip response for %s : %v", c.url, err)
+		return
+	}
+	c.decoded = buf.Bytes()
+	c.gzipped = true
+}
+
 // connect to destination.
 func (c *FastClient) connect() *net.TCPConn {
 	c.socketCount++
-	socket, err := net.DialTCP("tcp", nil, &c.dest)
+	socket, err := net.DialTCP("tcp", c.sources.Next(), &c.dest)
 	if err != nil {
 		log.Errf("Unable to connect to %v : %v", c.dest, err)
+		c.err = err
 		return nil
 	}
 	// For now those errors are not critical/breaking
@@ -476,15 +1253,42 @@ const (
 	SocketError = -1
 	// RetryOnce is used internally as an error code to allow 1 retry for bad socket reuse.
 	RetryOnce = -2
+	// ValidationError is recorded by the runner instead of the response code
+	// when the response fails the ResponseHeaderChecks.
+	ValidationError = -3
+	// BodyMismatch is recorded by the runner instead of the response code when
+	// the response body doesn't match the ExpectBodyContains/ExpectBodyRegex.
+	BodyMismatch = -4
 )
 
 // Fetch fetches the url content. Returns http code, data, offset of body.
+// When pipelining, of the last response of the batch or the first failed one.
 func (c *FastClient) Fetch() (int, []byte, int) {
+	if c.dynamic() {
+		c.req = c.req[:0]
+		for i := 0; i < c.pipelineDepth; i++ {
+			c.buildRequest(len(c.req))
+		}
+	}
+	return c.fetch()
+}
+
+// fetch sends the current request (retrying once on dead reused socket).
+func (c *FastClient) fetch() (int, []byte, int) {
 	c.code = SocketError
+	c.err = nil
 	c.size = 0
 	c.headerLen = 0
+	c.gzipped = false
+	c.respEnd = 0
+	c.transfer = transferTimes{enabled: c.transfer.enabled}
 	// Connect or reuse existing socket:
 	conn := c.socket
+	if conn != nil && c.idleTimeout > 0 && time.Since(c.idleSince) > c.idleTimeout {
+		log.Debugf("Closing idle socket %v", *conn)
+		conn.Close() // nolint: errcheck,gas
+		conn = nil
+	}
 	reuse := (conn != nil)
 	if !reuse {
 		conn = c.connect()
@@ -504,18 +1308,27 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 			log.Infof("Closing dead socket %v (%v)", *conn, err)
 			conn.Close() // nolint: errcheck,gas
 			c.errorCount++
-			return c.Fetch() // recurse once
+			return c.fetch() // recurse once
 		}
 		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
+		if err == nil {
+			err = conErr
+		}
+		c.err = err
 		return c.returnRes()
 	}
 	if n != len(c.req) {
 		log.Errf("Short write to %v %v : %d instead of %d", conn, c.dest, n, len(c.req))
 		return c.returnRes()
 	}
+	sent := time.Now()
+	if c.transfer.enabled {
+		c.transfer.sent = sent
+	}
 	if !c.keepAlive && c.halfClose {
 		if err = conn.CloseWrite(); err != nil {
 			log.Errf("Unable to close write to %v %v : %v", conn, c.dest, err)
+			c.err = err
 			return c.returnRes()
 		} // else:
 		log.Debugf("Half closed ok after sending request %v %v", conn, c.dest)
@@ -524,12 +1337,96 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 	c.readResponse(conn, reuse)
 	if c.code == RetryOnce {
 		// Special "eof on reused socket" code
-		return c.Fetch() // recurse once
+		return c.fetch() // recurse once
+	}
+	c.connStats.record(reuse)
+	if c.pipelineDepth > 1 {
+		c.readPipelined(conn, sent)
+	}
+	if c.transfer.enabled && c.code == http.StatusOK {
+		c.transfer.last = time.Now()
 	}
 	// Return the result:
 	return c.returnRes()
 }
 
+// readPipelined records the duration of the first response of the batch,
+// sent at sent, and reads and records the following ones. A server which
+// closes the connection or stops answering after a response makes the
+// client fall back to one request at a time, the unanswered requests being
+// counted as pipeline errors.
+func (c *FastClient) readPipelined(conn *net.TCPConn, sent time.Time) {
+	for i := 1; ; i++ {
+		if c.code != http.StatusOK {
+			if c.code == SocketError && i > 1 {
+				c.pipelineFallback(c.pipelineDepth - i + 1)
+			}
+			return // the connection is closed, the remaining requests are lost
+		}
+		c.pipeline.Record(time.Since(sent).Seconds())
+		if i == c.pipelineDepth {
+			return
+		}
+		if c.socket == nil || c.respEnd == 0 || c.respEnd > c.size {
+			c.pipelineFallback(c.pipelineDepth - i)
+			return
+		}
+		// The start of the next response(s) may have been read already:
+		c.size = copy(c.buffer, c.buffer[c.respEnd:c.size])
+		c.socket = nil
+		c.err = nil
+		c.headerLen = 0
+		c.gzipped = false
+		c.respEnd = 0
+		c.readResponse(conn, false)
+	}
+}
+
+// pipelineFallback counts the lost requests of a batch and stops pipelining.
+func (c *FastClient) pipelineFallback(lost int) {
+	log.Warnf("%d pipelined requests to %s got no response, no longer pipelining", lost, c.url)
+	if c.socket != nil {
+		c.socket.Close() // nolint: errcheck,gas
+		c.socket = nil
+	}
+	c.pipelineErrors += int64(lost)
+	if !c.dynamic() {
+		c.req = c.req[:len(c.req)/c.pipelineDepth]
+	}
+	c.pipelineDepth = 1
+}
+
+// ResponseHeader parses and returns the headers of the last response, nil
+// if there was none or they can't be parsed, e.g. in http 1.0 mode
+// (HeaderReporter).
+func (c *FastClient) ResponseHeader() http.Header {
+	if c.headerLen == 0 {
+		return nil
+	}
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(c.buffer[:c.headerLen])))
+	if _, err := tp.ReadLine(); err != nil { // status line
+		return nil
+	}
+	hdrs, err := tp.ReadMIMEHeader()
+	if err != nil {
+		log.Warnf("Unable to parse response headers: %v", err)
+		return nil
+	}
+	return http.Header(hdrs)
+}
+
+// storeCookies saves the Set-Cookie of the response headers into the jar.
+func (c *FastClient) storeCookies() {
+	hdrs := c.ResponseHeader()
+	if hdrs == nil {
+		return
+	}
+	resp := http.Response{Header: hdrs}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		c.jar.SetCookies(c.jarURL, cookies)
+	}
+}
+
 // Response reading:
 // TODO: refactor - unwiedly/ugly atm
 func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
@@ -541,7 +1438,8 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 	keepAlive := c.keepAlive
 	chunkedMode := false
 	checkConnectionClosedHeader := CheckConnectionClosedHeader
-	skipRead := false
+	skipRead := c.size > 0 // start of a pipelined response already read
+	gzipped := false
 	for {
 		// Ugly way to cover the case where we get more than 1 chunk at the end
 		// TODO: need automated tests
@@ -564,10 +1462,14 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 					break
 				}
 				log.Errf("Read error %v %v %d : %v", conn, c.dest, c.size, err)
+				c.err = err
 				c.code = SocketError
 				break
 			}
 			c.size += n
+			if c.transfer.enabled && c.transfer.first.IsZero() {
+				c.transfer.first = time.Now()
+			}
 			if log.LogDebug() {
 				log.Debugf("Read ok %d total %d so far (-%d headers = %d data) %s",
 					n, c.size, c.headerLen, c.size-c.headerLen, DebugSummary(c.buffer[c.size-n:c.size], 256))
@@ -608,6 +1510,10 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 				if log.LogDebug() {
 					log.Debugf("headers are %d: %s", c.headerLen, c.buffer[:idx])
 				}
+				if c.jar != nil {
+					c.storeCookies()
+				}
+				gzipped, _ = FoldFind(c.buffer[:c.headerLen], gzipEncodingHeader)
 				// Find the content length or chunked mode
 				if keepAlive {
 					var contentLength int
@@ -667,6 +1573,7 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 			}
 		} // end of big if parse header
 		if c.size >= max {
+			c.respEnd = max
 			if !keepAlive {
 				log.Errf("More data is available but stopping after %d, increase -httpbufferkb", max)
 			}
@@ -686,7 +1593,9 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 					continue
 				} else if nextChunkLen == 0 {
 					log.Debugf("Found last chunk %d %d", max+dataStart, c.size)
-					if c.size != max+dataStart+2 || string(c.buffer[c.size-2:c.size]) != "\r\n" {
+					c.respEnd = max + dataStart + 2
+					if c.size < c.respEnd || (c.size > c.respEnd && c.pipelineDepth == 1) ||
+						string(c.buffer[c.respEnd-2:c.respEnd]) != "\r\n" {
 						log.Errf("Unexpected mismatch at the end sz=%d expected %d; end of buffer %q", c.size, max+dataStart+2, c.buffer[max:c.size])
 					}
 				} else {
@@ -706,9 +1615,13 @@ func (c *FastClient) readResponse(conn *net.TCPConn, reusedSocket bool) {
 			break // we're done!
 		}
 	} // end of big for loop
+	if gzipped && c.code == http.StatusOK {
+		c.gunzip(chunkedMode)
+	}
 	// Figure out whether to keep or close the socket:
 	if keepAlive && c.code == http.StatusOK {
 		c.socket = conn // keep the open socket
+		c.idleSince = time.Now()
 	} else {
 		if err := conn.Close(); err != nil {
 			log.Errf("Close error %v %v %d : %v", conn, c.dest, c.size, err)
@@ -0,0 +1,177 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+// Weighted mix of URLs for a single http run (HTTPRunnerOptions.URLMix).
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/fortio/stats"
+)
+
+// WeightedURL is one entry of a URLMix: each request of the run picks one of
+// the entries at random, with a probability proportional to its Weight.
+type WeightedURL struct {
+	URL    string
+	Weight int    // relative weight, must be > 0
+	Method string // defaults to GET, or POST when there is a Payload
+	// Payload is the body to send for this URL (the run's Payload isn't used).
+	Payload     []byte
+	ContentType string
+	// Headers are extra "Key: Value" headers added to the run's ones.
+	Headers []string
+	// MaxQPS caps the rate of this entry's requests (over all the threads):
+	// the ones which would exceed it are delayed, the wait not being part of
+	// their duration. Default (0) is no cap.
+	MaxQPS float64
+}
+
+// URLStats is the per URLMix entry breakdown of the results (when
+// PerURLStats is set).
+type URLStats struct {
+	URL               string
+	Method            string
+	Weight            int
+	RetCodes          map[int]int64
+	DurationHistogram *stats.HistogramData
+	durations         *stats.Histogram
+}
+
+// options returns a copy of the base options for this entry.
+func (w *WeightedURL) options(base *HTTPOptions) (*HTTPOptions, error) {
+	if w.Weight <= 0 {
+		return nil, fmt.Errorf("invalid weight %d for %s, must be > 0", w.Weight, w.URL)
+	}
+	o := *base
+	o.URL = w.URL
+	o.Method = w.Method
+	o.Payload = w.Payload
+	o.PayloadFile = ""
+	o.PayloadCorpusFile = ""
+	o.corpus = nil
+	o.ContentType = w.ContentType
+	o.extraHeaders = cloneHeader(base.extraHeaders) // don't change the shared headers
+	for _, h := range w.Headers {
+		if err := o.AddAndValidateExtraHeader(h); err != nil {
+			return nil, err
+		}
+	}
+	o.URLSchemeCheck()
+	return &o, nil
+}
+
+// newURLStats makes the initial stats for the entry, with durations recorded
+// at the given resolution.
+func (w *WeightedURL) newURLStats(o *HTTPOptions, resolution float64) *URLStats {
+	return &URLStats{
+		URL:       o.URL,
+		Method:    o.method(),
+		Weight:    w.Weight,
+		RetCodes:  make(map[int]int64),
+		durations: stats.NewHistogram(0, resolution),
+	}
+}
+
+// clone makes an empty per thread copy of the stats.
+func (s *URLStats) clone() *URLStats {
+	return &URLStats{
+		URL:       s.URL,
+		Method:    s.Method,
+		Weight:    s.Weight,
+		RetCodes:  make(map[int]int64),
+		durations: s.durations.Clone(),
+	}
+}
+
+// record adds the result of 1 call started at start.
+func (s *URLStats) record(code int, start time.Time) {
+	s.RetCodes[code]++
+	s.durations.Record(time.Since(start).Seconds())
+}
+
+// transfer moves the thread's stats from src into s.
+func (s *URLStats) transfer(src *URLStats) {
+	for k, v := range src.RetCodes {
+		s.RetCodes[k] += v
+	}
+	s.durations.Transfer(src.durations)
+}
+
+// rateLimiter spaces the calls (of all the threads sharing it) to at most
+// qps per second.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time // earliest start of the next call
+}
+
+// newRateLimiter returns the limiter for the entry, nil when it isn't capped.
+func (w *WeightedURL) newRateLimiter() *rateLimiter {
+	if w.MaxQPS <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / w.MaxQPS)}
+}
+
+// wait blocks until the next call is allowed and returns how long it waited.
+func (l *rateLimiter) wait() time.Duration {
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+	d := start.Sub(now)
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return d
+}
+
+// urlPicker picks URLMix entries indexes according to their weights.
+type urlPicker struct {
+	cumulative []int    // running sum of the weights
+	urls       []string // the entries' URL, for LastCall()
+	rand       *rand.Rand
+}
+
+// newURLPicker makes a (per thread) picker for the mix, with the given seed.
+func newURLPicker(mix []WeightedURL, seed int64) *urlPicker {
+	p := urlPicker{
+		cumulative: make([]int, len(mix)),
+		urls:       make([]string, len(mix)),
+		rand:       rand.New(rand.NewSource(seed)), // nolint: gas
+	}
+	sum := 0
+	for i, w := range mix {
+		sum += w.Weight
+		p.cumulative[i] = sum
+		p.urls[i] = w.URL
+	}
+	return &p
+}
+
+// pick returns the index of the entry to use for the next request.
+func (p *urlPicker) pick() int {
+	n := p.rand.Intn(p.cumulative[len(p.cumulative)-1])
+	return sort.Search(len(p.cumulative), func(i int) bool { return p.cumulative[i] > n })
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Istio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fhttp
+
+// Multipart form uploads (HTTPOptions.MultipartForm). The parts are encoded
+// once, before the run, as a multipart/form-data body with a random boundary
+// which is then sent as the Payload of each request, its Content-Type
+// carrying the boundary. The file parts are read at that time too.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// FormPart is one part of a MultipartForm: a form field, or a file when
+// Filename is set.
+type FormPart struct {
+	Name     string // form field name
+	Filename string // file name, makes the part a file
+	// Content of the part, or File the path to read it from.
+	Content []byte
+	File    string
+	// ContentType of the file parts, defaults to application/octet-stream.
+	ContentType string
+}
+
+// encodeMultipartForm returns the multipart/form-data body of the parts and
+// the corresponding Content-Type.
+func encodeMultipartForm(parts []FormPart) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for i, p := range parts {
+		if p.Name == "" {
+			return nil, "", fmt.Errorf("form part %d without a name", i)
+		}
+		content := p.Content
+		if p.File != "" {
+			if len(p.Content) > 0 {
+				return nil, "", fmt.Errorf("form part %s has both a content and a file", p.Name)
+			}
+			data, err := ioutil.ReadFile(p.File)
+			if err != nil {
+				return nil, "", err
+			}
+			content = data
+		}
+		h := make(textproto.MIMEHeader)
+		disposition := `form-data; name="` + escapeQuotes(p.Name) + `"`
+		if p.Filename != "" {
+			disposition += `; filename="` + escapeQuotes(p.Filename) + `"`
+			ct := p.ContentType
+			if ct == "" {
+				ct = DefaultContentType
+			}
+			h.Set("Content-Type", ct)
+		}
+		h.Set("Content-Disposition", disposition)
+		pw, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+		pw.Write(content) // nolint: errcheck,gas
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// escapeQuotes escapes the backslashes and double quotes of a disposition
+// parameter, like mime/multipart does.
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
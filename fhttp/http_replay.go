@@ -0,0 +1,199 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+// Replay of the requests of an access log (HTTPRunnerOptions.ReplayFile).
+// Each line of the log is
+//   <timestamp> <method> <url>
+// separated by spaces or tabs, the timestamp being either RFC3339 (e.g.
+// 2018-05-01T10:00:00.250Z) or unix seconds (e.g. 1525168800.25). Urls
+// starting with / are appended to the run's URL. Empty lines and the ones
+// starting with # are ignored, the other lines which don't parse are skipped
+// and counted (HTTPRunnerResults.ReplaySkipped).
+// The requests are made in the log's order, each one at its recorded time
+// (from the first one) divided by the ReplaySpeed, by the first available of
+// the NumThreads threads (so late when they are all busy).
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"istio.io/fortio/log"
+)
+
+// ReplayEntry is one request of an access log.
+type ReplayEntry struct {
+	Time   time.Time
+	Method string
+	URL    string
+}
+
+// ReadAccessLog parses the access log from r (see http_replay.go for the
+// format) and returns its entries and the number of malformed lines skipped.
+func ReadAccessLog(r io.Reader) ([]ReplayEntry, int, error) {
+	var entries []ReplayEntry
+	skipped := 0
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseReplayLine(line)
+		if err != nil {
+			log.Warnf("Skipping malformed access log line %d %q: %v", lineNum, line, err)
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, skipped, scanner.Err()
+}
+
+// parseReplayLine parses a (non empty) access log line.
+func parseReplayLine(line string) (ReplayEntry, error) {
+	var e ReplayEntry
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return e, fmt.Errorf("%d fields instead of 3", len(fields))
+	}
+	t, err := parseReplayTime(fields[0])
+	if err != nil {
+		return e, err
+	}
+	for _, c := range fields[1] {
+		if c < 'A' || c > 'Z' {
+			return e, fmt.Errorf("invalid method %q", fields[1])
+		}
+	}
+	u := fields[2]
+	if !strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return e, fmt.Errorf("invalid url %q", u)
+	}
+	e.Time, e.Method, e.URL = t, fields[1], u
+	return e, nil
+}
+
+// parseReplayTime parses an RFC3339 or unix seconds timestamp.
+func parseReplayTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// replaySchedule hands out the requests to replay, in order and at their
+// time, to the threads of the run.
+type replaySchedule struct {
+	offsets []time.Duration // from the start, at the replay speed
+	indexes []int           // URLMix entry of each request
+	count   int64           // requests handed out so far
+	once    sync.Once
+	start   time.Time // of the first request
+}
+
+// prepareReplay reads the ReplayFile and sets up the run to replay it: one
+// URLMix entry per distinct method and url (weighted by its count), and
+// as many calls as requests, as fast as their schedule allows.
+func (o *HTTPRunnerOptions) prepareReplay() (*replaySchedule, int, error) {
+	if len(o.URLMix) > 0 {
+		return nil, 0, fmt.Errorf("ReplayFile and URLMix are mutually exclusive")
+	}
+	if o.ReplaySpeed < 0 {
+		return nil, 0, fmt.Errorf("invalid replay speed %g, must be > 0", o.ReplaySpeed)
+	}
+	speed := o.ReplaySpeed
+	if speed == 0 {
+		speed = 1
+	}
+	f, err := os.Open(o.ReplayFile)
+	if err != nil {
+		log.Errf("Unable to open replay file %s: %v", o.ReplayFile, err)
+		return nil, 0, err
+	}
+	entries, skipped, err := ReadAccessLog(f)
+	f.Close() // nolint: errcheck,gas
+	if err != nil {
+		log.Errf("Unable to read replay file %s: %v", o.ReplayFile, err)
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, skipped, fmt.Errorf("no request to replay in %s (%d malformed lines)", o.ReplayFile, skipped)
+	}
+	s := replaySchedule{
+		offsets: make([]time.Duration, len(entries)),
+		indexes: make([]int, len(entries)),
+	}
+	mix := make(map[string]int) // index of each method and url
+	for i, e := range entries {
+		u := e.URL
+		if strings.HasPrefix(u, "/") {
+			if o.URL == "" {
+				return nil, skipped, fmt.Errorf("url %s of the replay file needs a base URL", u)
+			}
+			u = strings.TrimSuffix(o.URL, "/") + u
+		}
+		key := e.Method + " " + u
+		idx, found := mix[key]
+		if !found {
+			idx = len(o.URLMix)
+			mix[key] = idx
+			o.URLMix = append(o.URLMix, WeightedURL{URL: u, Method: e.Method})
+		}
+		o.URLMix[idx].Weight++
+		s.indexes[i] = idx
+		offset := time.Duration(float64(e.Time.Sub(entries[0].Time)) / speed)
+		if i > 0 && offset < s.offsets[i-1] {
+			offset = s.offsets[i-1] // out of order line: right after the previous one
+		}
+		s.offsets[i] = offset
+	}
+	log.Infof("Replaying %d requests (%d distinct) over %v from %s at speed %g, skipped %d malformed lines",
+		len(entries), len(o.URLMix), s.offsets[len(entries)-1], o.ReplayFile, speed, skipped)
+	o.QPS = -1
+	o.Exactly = int64(len(entries))
+	return &s, skipped, nil
+}
+
+// next waits for the time of the next request and returns its URLMix
+// entry index and how long it waited.
+func (s *replaySchedule) next() (int, time.Duration) {
+	s.once.Do(func() { s.start = time.Now() })
+	i := int(atomic.AddInt64(&s.count, 1) - 1)
+	if i >= len(s.indexes) {
+		i = len(s.indexes) - 1 // can't happen as the run makes Exactly that many calls
+	}
+	wait := time.Until(s.start.Add(s.offsets[i]))
+	if wait <= 0 {
+		return s.indexes[i], 0
+	}
+	time.Sleep(wait)
+	return s.indexes[i], wait
+}
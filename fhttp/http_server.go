@@ -101,8 +101,8 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		writePayload(w, status, size)
 		return
 	}
-	// echo back the Content-Type and Content-Length in the response
-	for _, k := range []string{"Content-Type", "Content-Length"} {
+	// echo back the Content-Type, Content-Length and Content-Encoding in the response
+	for _, k := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
 		if v := r.Header.Get(k); v != "" {
 			w.Header().Set(k, v)
 		}
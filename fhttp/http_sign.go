@@ -0,0 +1,80 @@
+// Copyright 2017 Istio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fhttp
+
+// Per request HMAC signature. When HMACKey is set each request gets a
+// header (HMACHeader, DefaultHMACHeader by default) of value
+//   t=<timestamp>,sig=<signature>
+// where timestamp is the unix time in seconds at which the request is sent
+// and signature is the hex encoded HMAC-SHA256, keyed by HMACKey, of
+//   method "\n" path "\n" body "\n" timestamp
+// path being the request URI (path and query) and body the payload as sent
+// (i.e. gzipped when CompressRequest is set), both after the placeholders
+// expansion.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+)
+
+// DefaultHMACHeader is the header of the request signature when HMACKey is
+// set and HMACHeader isn't.
+const DefaultHMACHeader = "X-Fortio-Signature"
+
+// requestSigner computes the signature header of each request of a client.
+type requestSigner struct {
+	header string
+	mac    hash.Hash
+	sum    []byte // reused hmac sum buffer
+}
+
+// newRequestSigner returns the signer for the options, nil unless HMACKey is set.
+func newRequestSigner(o *HTTPOptions) *requestSigner {
+	if len(o.HMACKey) == 0 {
+		return nil
+	}
+	header := o.HMACHeader
+	if header == "" {
+		header = DefaultHMACHeader
+	}
+	return &requestSigner{header: http.CanonicalHeaderKey(header), mac: hmac.New(sha256.New, o.HMACKey)}
+}
+
+// appendSignature appends to buf the signature header value of the request
+// sent at timestamp (unix seconds).
+func (s *requestSigner) appendSignature(buf []byte, method string, path, body []byte, timestamp int64) []byte {
+	ts := strconv.AppendInt(nil, timestamp, 10)
+	s.mac.Reset()
+	s.mac.Write([]byte(method)) // nolint: errcheck,gas
+	s.mac.Write([]byte{'\n'})   // nolint: errcheck,gas
+	s.mac.Write(path)           // nolint: errcheck,gas
+	s.mac.Write([]byte{'\n'})   // nolint: errcheck,gas
+	s.mac.Write(body)           // nolint: errcheck,gas
+	s.mac.Write([]byte{'\n'})   // nolint: errcheck,gas
+	s.mac.Write(ts)             // nolint: errcheck,gas
+	s.sum = s.mac.Sum(s.sum[:0])
+	buf = append(buf, "t="...)
+	buf = append(buf, ts...)
+	buf = append(buf, ",sig="...)
+	start := len(buf)
+	buf = append(buf, make([]byte, hex.EncodedLen(len(s.sum)))...)
+	hex.Encode(buf[start:], s.sum)
+	return buf
+}
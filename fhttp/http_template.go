@@ -0,0 +1,198 @@
+// Copyright 2017 Istio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package fhttp
+
+// Per request templating of the URL and Payload. The supported placeholders
+// are {{.Seq}} (sequence number of the request, unique across the threads of
+// a run and starting at 1), {{.UUID}} (random version 4 UUID) and
+// {{.ThreadID}} (the runner thread/goroutine id).
+// Templates are compiled once when creating the client and requests without
+// placeholders are sent as before, without any extra work.
+// The payloads of a PayloadCorpusFile are also picked here, for each request,
+// instead of the Payload template.
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"istio.io/fortio/fnet"
+)
+
+type templateVar int
+
+const (
+	templateSeq templateVar = iota
+	templateUUID
+	templateThreadID
+)
+
+var templateVars = map[string]templateVar{
+	".Seq":      templateSeq,
+	".UUID":     templateUUID,
+	".ThreadID": templateThreadID,
+}
+
+// requestTemplate is a compiled template: literals[i] is followed by the
+// value of vars[i] and the last literal ends it.
+type requestTemplate struct {
+	literals []string
+	vars     []templateVar
+	hasUUID  bool
+}
+
+// compileTemplate parses the placeholders in s. Returns nil (and no error)
+// when s has no placeholder.
+func compileTemplate(s string) (*requestTemplate, error) {
+	if !strings.Contains(s, "{{") {
+		return nil, nil
+	}
+	t := requestTemplate{}
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", s)
+		}
+		name := strings.TrimSpace(s[start+2 : start+end])
+		v, ok := templateVars[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {{%s}}, expecting {{.Seq}}, {{.UUID}} or {{.ThreadID}}", name)
+		}
+		t.literals = append(t.literals, s[:start])
+		t.vars = append(t.vars, v)
+		t.hasUUID = t.hasUUID || v == templateUUID
+		s = s[start+end+2:]
+	}
+	t.literals = append(t.literals, s)
+	return &t, nil
+}
+
+// expand appends to buf the template with the current values of vars.
+func (t *requestTemplate) expand(buf []byte, vars *requestVars) []byte {
+	for i, v := range t.vars {
+		buf = append(buf, t.literals[i]...)
+		switch v {
+		case templateSeq:
+			buf = strconv.AppendInt(buf, vars.seq, 10)
+		case templateUUID:
+			buf = append(buf, vars.uuid[:]...)
+		case templateThreadID:
+			buf = strconv.AppendInt(buf, int64(vars.threadID), 10)
+		}
+	}
+	return append(buf, t.literals[len(t.literals)-1]...)
+}
+
+// requestVars holds the per client (thread) values for the templates.
+type requestVars struct {
+	counter  *int64 // shared by all the clients of a run
+	threadID int
+	rand     *rand.Rand
+	seq      int64    // current sequence number
+	uuid     [36]byte // current uuid
+}
+
+// newRequestVars makes the per client template values state.
+func newRequestVars(o *HTTPOptions) *requestVars {
+	if o.seqCounter == nil {
+		o.seqCounter = new(int64)
+	}
+	seed := o.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano() + int64(o.threadID)
+	}
+	return &requestVars{
+		counter:  o.seqCounter,
+		threadID: o.threadID,
+		rand:     rand.New(rand.NewSource(seed)), // nolint: gas
+	}
+}
+
+// next updates the values for the next request, the uuid only if needed.
+func (v *requestVars) next(needUUID bool) {
+	v.seq = atomic.AddInt64(v.counter, 1)
+	if !needUUID {
+		return
+	}
+	var b [16]byte
+	v.rand.Read(b[:])           // nolint: errcheck,gas
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	const hexDigits = "0123456789abcdef"
+	j := 0
+	for i, c := range b {
+		if i == 4 || i == 6 || i == 8 || i == 10 {
+			v.uuid[j] = '-'
+			j++
+		}
+		v.uuid[j] = hexDigits[c>>4]
+		v.uuid[j+1] = hexDigits[c&0x0f]
+		j += 2
+	}
+}
+
+// clientTemplates holds the compiled url and payload templates of a client.
+type clientTemplates struct {
+	url, payload *requestTemplate
+	vars         *requestVars
+	corpus       *fnet.PayloadCorpus // replaces the payload template when set
+	random       bool                // pick the corpus payloads with vars.rand
+}
+
+// newClientTemplates compiles the url and payload templates. Returns nil
+// (and no error) when neither has placeholders and there is no corpus.
+func newClientTemplates(o *HTTPOptions, rawURL string) (*clientTemplates, error) {
+	u, err := compileTemplate(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var p *requestTemplate
+	if o.corpus == nil {
+		if p, err = compileTemplate(string(o.Payload)); err != nil {
+			return nil, err
+		}
+	}
+	if u == nil && p == nil && o.corpus == nil {
+		return nil, nil
+	}
+	return &clientTemplates{url: u, payload: p, vars: newRequestVars(o), corpus: o.corpus,
+		random: o.PayloadCorpusRandom}, nil
+}
+
+// nextPayload appends to buf the payload of the current request: the next
+// corpus one or the expanded payload template.
+func (t *clientTemplates) nextPayload(buf []byte) []byte {
+	if t.corpus == nil {
+		return t.payload.expand(buf, t.vars)
+	}
+	var rng *rand.Rand
+	if t.random {
+		rng = t.vars.rand
+	}
+	return append(buf, t.corpus.Next(rng)...)
+}
+
+// next updates the values for the next request.
+func (t *clientTemplates) next() {
+	t.vars.next((t.url != nil && t.url.hasUUID) || (t.payload != nil && t.payload.hasUUID))
+}
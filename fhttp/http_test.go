@@ -16,10 +16,12 @@ package fhttp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
@@ -27,6 +29,7 @@ import (
 	"testing"
 	"time"
 
+	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
 )
 
@@ -88,6 +91,47 @@ func TestNewHTTPRequest(t *testing.T) {
 	}
 }
 
+func TestCompileTemplate(t *testing.T) {
+	vars := requestVars{seq: 42, threadID: 3}
+	copy(vars.uuid[:], "01234567-89ab-4cde-8f01-23456789abcd")
+	var tests = []struct {
+		in       string // input
+		expected string // expanded result, "" for nil template
+		err      bool   // whether compile should fail
+	}{
+		{"http://a.b/no/placeholder", "", false},
+		{"/x?id={{.Seq}}", "/x?id=42", false},
+		{"{{ .ThreadID }}-{{.Seq}}-{{.UUID}}.", "3-42-01234567-89ab-4cde-8f01-23456789abcd.", false},
+		{"{{.Seq}}{{.Seq}}", "4242", false},
+		{"/x?id={{.Foo}}", "", true},
+		{"/x?id={{.Seq", "", true},
+	}
+	for _, tst := range tests {
+		tmpl, err := compileTemplate(tst.in)
+		if (err != nil) != tst.err {
+			t.Errorf("Got err %v for %q, expecting error %v", err, tst.in, tst.err)
+			continue
+		}
+		if tmpl == nil {
+			if tst.expected != "" {
+				t.Errorf("Got nil template for %q, expecting %q", tst.in, tst.expected)
+			}
+			continue
+		}
+		if actual := string(tmpl.expand([]byte("prefix:"), &vars)); actual != "prefix:"+tst.expected {
+			t.Errorf("Got %q for %q, expecting %q", actual, tst.in, "prefix:"+tst.expected)
+		}
+	}
+	o := NewHTTPOptions("http://localhost/")
+	v := newRequestVars(o)
+	v.next(true)
+	u1 := string(v.uuid[:])
+	v.next(true)
+	if v.seq != 2 || string(v.uuid[:]) == u1 || u1[14] != '4' || u1[8] != '-' || len(u1) != 36 {
+		t.Errorf("Unexpected seq %d or uuids %s %s", v.seq, u1, v.uuid)
+	}
+}
+
 func TestMultiInitAndEscape(t *testing.T) {
 	// 2 escaped already
 	o := NewHTTPOptions("localhost%3A8080/?delay=10ms:10,0.5s:15%25,0.25s:5")
@@ -611,6 +655,39 @@ func TestDefaultPort(t *testing.T) {
 	cli.Close()
 }
 
+func TestTLSVersions(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12} // nolint: gas
+	srv.StartTLS()
+	defer srv.Close()
+	tests := []struct {
+		name     string
+		tlsOpts  fnet.TLSOptions
+		http2    bool
+		expected int
+	}{
+		{"default", fnet.TLSOptions{}, false, http.StatusOK},
+		{"tls 1.2 with cipher suite", fnet.TLSOptions{MaxTLSVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, false, http.StatusOK},
+		{"tls 1.3 only", fnet.TLSOptions{MinTLSVersion: tls.VersionTLS13}, false, http.StatusBadRequest},
+		{"tls 1.3 only http2", fnet.TLSOptions{MinTLSVersion: tls.VersionTLS13}, true, http.StatusBadRequest},
+	}
+	for _, tst := range tests {
+		opts := NewHTTPOptions(srv.URL)
+		opts.Insecure = true // self signed test server
+		opts.HTTP2 = tst.http2
+		opts.TLSOptions = tst.tlsOpts
+		cli := NewClient(opts)
+		code, _, _ := cli.Fetch()
+		if code != tst.expected {
+			t.Errorf("%s: got code %d, expected %d", tst.name, code, tst.expected)
+		}
+		cli.Close()
+	}
+}
+
 // Test for bug #127
 
 var testBody = "delayedChunkedSize-body"
@@ -15,6 +15,8 @@
 package fhttp // import "istio.io/fortio/fhttp"
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"html/template"
 	"io"
@@ -126,6 +128,31 @@ func ParseDecimal(inp []byte) int {
 	return res
 }
 
+// dechunk returns the data of a chunked encoded body.
+func dechunk(inp []byte) []byte {
+	var res []byte
+	for {
+		off, size := ParseChunkSize(inp)
+		if size <= 0 || off+size > len(inp) {
+			return res
+		}
+		res = append(res, inp[off:off+size]...)
+		inp = inp[off+size:]
+		if len(inp) >= 2 {
+			inp = inp[2:] // CRLF after the data
+		}
+	}
+}
+
+// gzipBytes returns the gzip compressed data, reusing dst's storage.
+func gzipBytes(dst []byte, data []byte) []byte {
+	buf := bytes.NewBuffer(dst[:0])
+	zw := gzip.NewWriter(buf)
+	zw.Write(data) // nolint: errcheck,gas
+	zw.Close()     // nolint: errcheck,gas
+	return buf.Bytes()
+}
+
 // ParseChunkSize extracts the chunk size and consumes the line.
 // Returns the offset of the data and the size of the chunk,
 // 0, -1 when not found.
@@ -15,13 +15,18 @@
 package fhttp
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"time"
 
+	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
 	"istio.io/fortio/periodic"
 	"istio.io/fortio/stats"
@@ -35,36 +40,273 @@ import (
 type HTTPRunnerResults struct {
 	periodic.RunnerResults
 	client   Fetcher
+	clients  []Fetcher       // all the clients of the thread, one per URLMix entry
+	mix      *urlPicker      // nil unless there is a URLMix
+	replay   *replaySchedule // nil unless there is a ReplayFile
 	RetCodes map[int]int64
+	// Failed calls counts by class of error (transport errors, http errors and
+	// failed response checks being application ones)
+	ErrorClasses map[fnet.ErrorClass]int64 `json:",omitempty"`
 	// internal type/data
 	sizes       *stats.Histogram
 	headerSizes *stats.Histogram
+	bodySizes   *stats.Histogram
 	// exported result
 	Sizes       *stats.HistogramData
 	HeaderSizes *stats.HistogramData
-	URL         string
-	SocketCount int
+	// SizeHistogram is the response body sizes in bytes (the bytes read, which
+	// are all of them for http 1.0 fast client as the headers aren't parsed)
+	SizeHistogram *stats.HistogramData
+	URL           string
+	SocketCount   int
+	// ConnectionStats of the clients that report them
+	ConnectionStats ConnectionStats
 	// http code to abort the run on (-1 for connection or other socket error)
 	AbortOn int
 	aborter *periodic.Aborter
+	// code and url of the last call, for LastCall()
+	lastCode int
+	lastURL  string
+	checks   *responseChecks // nil unless there are response checks
+	limiters []*rateLimiter  // per URLMix entry, nil if none is capped
+	lastWait time.Duration   // time the last call waited on its limiter
+	// Per URLMix entry breakdown (only when PerURLStats is set)
+	URLStats []*URLStats `json:",omitempty"`
+	// ALPN protocol negotiated by the TLS handshake (e.g. "h2" or "http/1.1"),
+	// empty for http:// urls or when none was negotiated.
+	NegotiatedProtocol string `json:",omitempty"`
+	// Counts of the intermediate redirect response codes (only when
+	// FollowRedirects and CountRedirects are set)
+	RedirectCodes map[int]int64 `json:",omitempty"`
+	// TCP connect, TLS handshake and first byte durations (only when the
+	// PhaseTimings option is set), the first two only for the new connections.
+	PhaseTimings *fnet.PhaseTimings `json:",omitempty"`
+	// Number of malformed lines of the ReplayFile which were skipped.
+	ReplaySkipped int `json:",omitempty"`
+	// Durations, in seconds, from the sending of each batch of pipelined
+	// requests to each of its responses (only when PipelineDepth > 1) and
+	// number of requests which got no response.
+	PipelineHistogram *stats.HistogramData `json:",omitempty"`
+	PipelineErrors    int64                `json:",omitempty"`
+	// Time to first byte, in seconds, and download rate, in MB/s (10^6 bytes
+	// per second of body from the first to the last byte, or from the request
+	// when it all came at once), of the ok responses (only when
+	// MeasureThroughput is set).
+	TTFBHistogram       *stats.HistogramData `json:",omitempty"`
+	ThroughputHistogram *stats.HistogramData `json:",omitempty"`
+	ttfb                *stats.Histogram
+	throughput          *stats.Histogram
 }
 
 // Run tests http request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (httpstate *HTTPRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
-	code, body, headerSize := httpstate.client.Fetch()
+	client, idx := httpstate.client, 0
+	httpstate.lastWait = 0
+	if httpstate.replay != nil {
+		idx, httpstate.lastWait = httpstate.replay.next()
+		client = httpstate.clients[idx]
+	} else if httpstate.mix != nil {
+		idx = httpstate.mix.pick()
+		client = httpstate.clients[idx]
+	}
+	if httpstate.limiters != nil && httpstate.limiters[idx] != nil {
+		httpstate.lastWait += httpstate.limiters[idx].wait()
+	}
+	var start time.Time
+	if httpstate.URLStats != nil {
+		start = time.Now()
+	}
+	code, body, headerSize := client.Fetch()
 	size := len(body)
+	if httpstate.checks != nil && code > 0 {
+		code = httpstate.checks.check(client, code, body[headerSize:])
+	}
+	if code != http.StatusOK {
+		if class := errorClass(client, code); class != "" {
+			httpstate.ErrorClasses[class]++
+		}
+	}
 	log.Debugf("Got in %3d hsz %d sz %d - will abort on %d", code, headerSize, size, httpstate.AbortOn)
 	httpstate.RetCodes[code]++
+	httpstate.lastCode = code
+	if httpstate.mix != nil {
+		httpstate.lastURL = httpstate.mix.urls[idx]
+	}
+	if httpstate.URLStats != nil {
+		httpstate.URLStats[idx].record(code, start)
+	}
+	if httpstate.ttfb != nil && code == http.StatusOK {
+		httpstate.recordTransfer(client, size-headerSize)
+	}
 	httpstate.sizes.Record(float64(size))
 	httpstate.headerSizes.Record(float64(headerSize))
+	httpstate.bodySizes.Record(float64(size - headerSize))
 	if httpstate.AbortOn == code {
 		httpstate.aborter.Abort()
 		log.Infof("Aborted run because of code %d - data %s", code, DebugSummary(body, 1024))
 	}
 }
 
+// recordTransfer records the time to first byte and download rate of the
+// last (ok) response of client, of bodySize bytes.
+func (httpstate *HTTPRunnerResults) recordTransfer(client Fetcher, bodySize int) {
+	tr, ok := client.(TransferReporter)
+	if !ok {
+		return
+	}
+	sent, first, last := tr.LastTransfer()
+	if first.IsZero() || last.IsZero() {
+		return
+	}
+	httpstate.ttfb.Record(first.Sub(sent).Seconds())
+	d := last.Sub(first)
+	if d <= 0 {
+		d = last.Sub(sent)
+	}
+	httpstate.throughput.Record(float64(bodySize) / 1e6 / d.Seconds())
+}
+
+// HeaderCheck is a response header validation: the header must be present
+// and, when ValueRegexp is set, one of its values must match it.
+type HeaderCheck struct {
+	Name        string
+	ValueRegexp string
+}
+
+// headerCheck is the compiled version of a HeaderCheck.
+type headerCheck struct {
+	name string
+	re   *regexp.Regexp // nil for presence only
+}
+
+// compileHeaderChecks validates and compiles the checks.
+func compileHeaderChecks(checks []HeaderCheck) ([]headerCheck, error) {
+	res := make([]headerCheck, 0, len(checks))
+	for _, c := range checks {
+		if c.Name == "" {
+			return nil, fmt.Errorf("empty header name in response header check %+v", c)
+		}
+		hc := headerCheck{name: c.Name}
+		if c.ValueRegexp != "" {
+			re, err := regexp.Compile(c.ValueRegexp)
+			if err != nil {
+				return nil, fmt.Errorf("bad response header %s check regexp: %v", c.Name, err)
+			}
+			hc.re = re
+		}
+		res = append(res, hc)
+	}
+	return res, nil
+}
+
+// checkHeaders returns an error for the first of the checks failed by the
+// last response of the client.
+func checkHeaders(client Fetcher, checks []headerCheck) error {
+	hr, ok := client.(HeaderReporter)
+	if !ok {
+		return fmt.Errorf("client doesn't report response headers")
+	}
+	h := hr.ResponseHeader()
+	for _, c := range checks {
+		values := h[http.CanonicalHeaderKey(c.name)]
+		if len(values) == 0 {
+			return fmt.Errorf("missing header %s", c.name)
+		}
+		if c.re == nil {
+			continue
+		}
+		matched := false
+		for _, v := range values {
+			if c.re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("header %s: %q doesn't match %q", c.name, values, c.re)
+		}
+	}
+	return nil
+}
+
+// responseChecks are the compiled ResponseHeaderChecks, ExpectBodyContains
+// and ExpectBodyRegex.
+type responseChecks struct {
+	headers []headerCheck
+	bodyStr []byte         // nil for no substring check
+	bodyRe  *regexp.Regexp // nil for no regexp check
+}
+
+// responseChecks compiles the response checks, returns nil if there are none.
+func (o *HTTPRunnerOptions) responseChecks() (*responseChecks, error) {
+	headers, err := compileHeaderChecks(o.ResponseHeaderChecks)
+	if err != nil {
+		return nil, err
+	}
+	c := responseChecks{headers: headers}
+	if o.ExpectBodyContains != "" {
+		c.bodyStr = []byte(o.ExpectBodyContains)
+	}
+	if o.ExpectBodyRegex != "" {
+		if c.bodyRe, err = regexp.Compile(o.ExpectBodyRegex); err != nil {
+			return nil, fmt.Errorf("bad expected body regexp %q: %v", o.ExpectBodyRegex, err)
+		}
+	}
+	if len(c.headers) == 0 && c.bodyStr == nil && c.bodyRe == nil {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// check returns the code to record for the last response of the client:
+// ValidationError or BodyMismatch if it fails the checks, code otherwise.
+func (c *responseChecks) check(client Fetcher, code int, body []byte) int {
+	if len(c.headers) > 0 {
+		if err := checkHeaders(client, c.headers); err != nil {
+			log.LogVf("Response validation failed for code %d: %v", code, err)
+			return ValidationError
+		}
+	}
+	if (c.bodyStr != nil && !bytes.Contains(body, c.bodyStr)) || (c.bodyRe != nil && !c.bodyRe.Match(body)) {
+		log.LogVf("Response body mismatch for code %d: %s", code, DebugSummary(body, 256))
+		return BodyMismatch
+	}
+	return code
+}
+
+// errorClass returns the class of the error of the last call of the client,
+// which returned code, empty if it didn't fail.
+func errorClass(client Fetcher, code int) fnet.ErrorClass {
+	if er, ok := client.(ErrorReporter); ok {
+		if err := er.LastError(); err != nil {
+			return fnet.ClassifyError(err)
+		}
+	}
+	switch {
+	case code == SocketError:
+		return fnet.NetworkError
+	case code < 0 || code >= http.StatusBadRequest:
+		return fnet.ApplicationError
+	}
+	return ""
+}
+
+// LastWait returns how long the last call waited for its URLMix entry's
+// MaxQPS or for its ReplayFile time (periodic.WaitReporter).
+func (httpstate *HTTPRunnerResults) LastWait() time.Duration {
+	return httpstate.lastWait
+}
+
+// LastCall returns the http code and url of the last call (periodic.CallRecorder).
+func (httpstate *HTTPRunnerResults) LastCall() (int, string) {
+	if httpstate.mix != nil {
+		return httpstate.lastCode, httpstate.lastURL
+	}
+	return httpstate.lastCode, httpstate.URL
+}
+
 // HTTPRunnerOptions includes the base RunnerOptions plus http specific
 // options.
 type HTTPRunnerOptions struct {
@@ -74,48 +316,239 @@ type HTTPRunnerOptions struct {
 	AllowInitialErrors bool   // whether initial errors don't cause an abort
 	// Which status code cause an abort of the run (default 0 = don't abort; reminder -1 is returned for socket errors)
 	AbortOn int
+	// URLMix, when set, makes each request go to one of its URLs picked at
+	// random according to the weights (URL is then only used as label).
+	URLMix []WeightedURL
+	// PerURLStats adds the per URLMix entry RetCodes and durations (URLStats).
+	PerURLStats bool
+	// ExpectALPN makes the run fail when any client negotiated another
+	// protocol than this one (e.g. "h2"). Default (empty) is no check.
+	ExpectALPN string
+	// ResponseHeaderChecks that every response (which isn't a socket error)
+	// must pass, else it is counted with the ValidationError code instead of
+	// its own status code.
+	ResponseHeaderChecks []HeaderCheck
+	// Expected response body substring and/or regexp: responses (which
+	// aren't socket errors) that don't match are counted with the
+	// BodyMismatch code instead of their own status code.
+	ExpectBodyContains string
+	ExpectBodyRegex    string
+	// CountRedirects reports, in RedirectCodes, the codes of the intermediate
+	// redirect responses followed (with FollowRedirects). The RetCodes and
+	// durations are always the ones of the final response (and all the hops).
+	CountRedirects bool
+	// ReplayFile, when set, is an access log whose requests are replayed at
+	// their recorded pace (see http_replay.go) instead of running at QPS.
+	// Their method and urls are then the URLMix, which must not be set.
+	ReplayFile  string
+	ReplaySpeed float64 // replay speed up factor, default (0) is 1
+}
+
+// prepare initializes the options, reads the PayloadFile, encodes the
+// MultipartForm or reads the PayloadCorpusFile, and returns the URLMix entries' options and the compiled
+// response checks.
+func (o *HTTPRunnerOptions) prepare() ([]*HTTPOptions, *responseChecks, error) {
+	o.HTTPOptions.Init(o.URL)
+	if o.PayloadFile != "" {
+		data, err := ioutil.ReadFile(o.PayloadFile)
+		if err != nil {
+			log.Errf("Unable to read payload file %s: %v", o.PayloadFile, err)
+			return nil, nil, err
+		}
+		log.Infof("Read %d bytes payload from %s", len(data), o.PayloadFile)
+		o.Payload = data
+	}
+	if len(o.MultipartForm) > 0 {
+		data, contentType, err := encodeMultipartForm(o.MultipartForm)
+		if err != nil {
+			log.Errf("Unable to encode the multipart form: %v", err)
+			return nil, nil, err
+		}
+		log.Infof("Encoded %d parts multipart form of %d bytes", len(o.MultipartForm), len(data))
+		o.Payload = data
+		o.ContentType = contentType
+	}
+	if o.PayloadCorpusFile != "" {
+		corpus, err := fnet.ReadPayloadCorpus(o.PayloadCorpusFile, o.PayloadDelimiter)
+		if err != nil {
+			log.Errf("Unable to read payload corpus file %s: %v", o.PayloadCorpusFile, err)
+			return nil, nil, err
+		}
+		o.corpus = corpus
+		o.Payload = corpus.Payloads[0] // for the method, headers, etc... of a payload
+	}
+	if err := o.initDialer(); err != nil {
+		log.Errf("Bad address family or source addresses: %v", err)
+		return nil, nil, err
+	}
+	o.InitSessionCache() // shared by the clients of the run
+	mixOpts := make([]*HTTPOptions, len(o.URLMix))
+	for i := range o.URLMix {
+		mo, err := o.URLMix[i].options(&o.HTTPOptions)
+		if err != nil {
+			log.Errf("Bad url mix entry %d: %v", i, err)
+			return nil, nil, err
+		}
+		mixOpts[i] = mo
+	}
+	checks, err := o.responseChecks()
+	if err != nil {
+		log.Errf("Bad response checks: %v", err)
+		return nil, nil, err
+	}
+	return mixOpts, checks, nil
+}
+
+// Validate checks the options (payload file, URLMix entries, response checks)
+// and that the URL, or each URLMix entry, answers one request with a 200 (and
+// passes the response checks), without running the load.
+func (o *HTTPRunnerOptions) Validate() error {
+	vo := *o // not changing the options
+	if vo.URL == "" && len(vo.URLMix) > 0 {
+		vo.URL = vo.URLMix[0].URL
+	}
+	if vo.URL == "" {
+		return fmt.Errorf("no url to validate")
+	}
+	mixOpts, checks, err := vo.prepare()
+	if err != nil {
+		return err
+	}
+	probes := mixOpts
+	if len(probes) == 0 {
+		probes = []*HTTPOptions{&vo.HTTPOptions}
+	}
+	for _, po := range probes {
+		ho := *po
+		client := NewClient(&ho)
+		if client == nil {
+			return fmt.Errorf("unable to create client for %s", ho.URL)
+		}
+		code, data, headerSize := client.Fetch()
+		if code == http.StatusOK && checks != nil {
+			code = checks.check(client, code, data[headerSize:])
+		}
+		client.Close()
+		if code != http.StatusOK {
+			return fmt.Errorf("validation request to %s failed with code %d: %s", ho.URL, code, DebugSummary(data, 256))
+		}
+		log.Infof("Validated %s", ho.URL)
+	}
+	return nil
 }
 
 // RunHTTPTest runs an http test and returns the aggregated stats.
 func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	o.RunType = "HTTP"
+	var replay *replaySchedule
+	replaySkipped := 0
+	if o.ReplayFile != "" {
+		var err error
+		if replay, replaySkipped, err = o.prepareReplay(); err != nil {
+			return nil, err
+		}
+	}
+	if o.URL == "" && len(o.URLMix) > 0 {
+		o.URL = o.URLMix[0].URL
+	}
 	log.Infof("Starting http test for %s with %d threads at %.1f qps", o.URL, o.NumThreads, o.QPS)
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads
-	o.HTTPOptions.Init(o.URL)
+	mixOpts, checks, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+	var limiters []*rateLimiter
+	for i := range o.URLMix {
+		if l := o.URLMix[i].newRateLimiter(); l != nil {
+			if limiters == nil {
+				limiters = make([]*rateLimiter, len(o.URLMix))
+			}
+			limiters[i] = l
+		}
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	total := HTTPRunnerResults{
-		RetCodes:    make(map[int]int64),
-		sizes:       stats.NewHistogram(0, 100),
-		headerSizes: stats.NewHistogram(0, 5),
-		URL:         o.URL,
-		AbortOn:     o.AbortOn,
-		aborter:     r.Options().Stop,
+		RetCodes:      make(map[int]int64),
+		sizes:         stats.NewHistogram(0, 100),
+		headerSizes:   stats.NewHistogram(0, 5),
+		bodySizes:     stats.NewHistogram(0, 100),
+		URL:           o.URL,
+		AbortOn:       o.AbortOn,
+		aborter:       r.Options().Stop,
+		ReplaySkipped: replaySkipped,
+	}
+	if o.MeasureThroughput {
+		total.ttfb = stats.NewHistogram(0, r.Options().Resolution)
+		total.throughput = stats.NewHistogram(0, 0.01)
+	}
+	if o.PerURLStats {
+		for i := range o.URLMix {
+			total.URLStats = append(total.URLStats, o.URLMix[i].newURLStats(mixOpts[i], r.Options().Resolution))
+		}
+	}
+	if o.HTTP2 {
+		// All the threads' requests are concurrent streams on the same connection
+		o.http2Transport()
+		for _, mo := range mixOpts {
+			mo.h2 = o.h2
+		}
 	}
 	httpstate := make([]HTTPRunnerResults, numThreads)
 	for i := 0; i < numThreads; i++ {
 		r.Options().Runners[i] = &httpstate[i]
 		// Create a client (and transport) and connect once for each 'thread'
-		httpstate[i].client = NewClient(&o.HTTPOptions)
-		if httpstate[i].client == nil {
-			return nil, fmt.Errorf("unable to create client %d for %s", i, o.URL)
-		}
-		if o.Exactly <= 0 {
-			code, data, headerSize := httpstate[i].client.Fetch()
-			if !o.AllowInitialErrors && code != http.StatusOK {
-				return nil, fmt.Errorf("error %d for %s: %q", code, o.URL, string(data))
+		// (and each URLMix entry)
+		threadOpts := []*HTTPOptions{&o.HTTPOptions}
+		if len(mixOpts) > 0 {
+			threadOpts = mixOpts
+			httpstate[i].mix = newURLPicker(o.URLMix, r.Options().SubSeed("mix", i))
+			httpstate[i].replay = replay
+		}
+		httpstate[i].clients = make([]Fetcher, len(threadOpts))
+		var jar http.CookieJar // the thread's clients share one (when enabled)
+		for j, to := range threadOpts {
+			ho := *to // copy so each thread's templates get its own ThreadID
+			ho.threadID = i
+			ho.seed = r.Options().SubSeed("template", i*len(threadOpts)+j)
+			ho.jar = jar
+			ho.resolution = r.Options().Resolution
+			jar = ho.cookieJar()
+			client := NewClient(&ho)
+			if client == nil {
+				return nil, fmt.Errorf("unable to create client %d for %s", i, ho.URL)
 			}
-			if i == 0 && log.LogVerbose() {
-				log.LogVf("first hit of url %s: status %03d, headers %d, total %d\n%s\n", o.URL, code, headerSize, len(data), data)
+			httpstate[i].clients[j] = client
+			if o.Exactly <= 0 {
+				code, data, headerSize := client.Fetch()
+				if !o.AllowInitialErrors && code != http.StatusOK {
+					return nil, fmt.Errorf("error %d for %s: %q", code, ho.URL, string(data))
+				}
+				if i == 0 && log.LogVerbose() {
+					log.LogVf("first hit of url %s: status %03d, headers %d, total %d\n%s\n", ho.URL, code, headerSize, len(data), data)
+				}
 			}
 		}
+		httpstate[i].client = httpstate[i].clients[0]
 		// Setup the stats for each 'thread'
 		httpstate[i].sizes = total.sizes.Clone()
 		httpstate[i].headerSizes = total.headerSizes.Clone()
+		httpstate[i].bodySizes = total.bodySizes.Clone()
+		if total.ttfb != nil {
+			httpstate[i].ttfb = total.ttfb.Clone()
+			httpstate[i].throughput = total.throughput.Clone()
+		}
 		httpstate[i].RetCodes = make(map[int]int64)
+		httpstate[i].ErrorClasses = make(map[fnet.ErrorClass]int64)
+		httpstate[i].URL = total.URL
 		httpstate[i].AbortOn = total.AbortOn
 		httpstate[i].aborter = total.aborter
+		httpstate[i].checks = checks
+		httpstate[i].limiters = limiters
+		for _, us := range total.URLStats {
+			httpstate[i].URLStats = append(httpstate[i].URLStats, us.clone())
+		}
 	}
 
 	if o.Profiler != "" {
@@ -142,8 +575,47 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	// Numthreads may have reduced but it should be ok to accumulate 0s from
 	// unused ones. We also must cleanup all the created clients.
 	keys := []int{}
+	var alpnErr error
+	var pipeline *stats.Histogram // of all the clients, when pipelining
 	for i := 0; i < numThreads; i++ {
-		total.SocketCount += httpstate[i].client.Close()
+		for _, client := range httpstate[i].clients {
+			if cs, ok := client.(ConnectionStatsReporter); ok {
+				total.ConnectionStats.Add(cs.ConnectionStats())
+			}
+			if rr, ok := client.(RedirectReporter); ok && o.CountRedirects {
+				for k, v := range rr.Redirects() {
+					if total.RedirectCodes == nil {
+						total.RedirectCodes = make(map[int]int64)
+					}
+					total.RedirectCodes[k] += v
+				}
+			}
+			if pr, ok := client.(PhaseReporter); ok && pr.PhaseTimings() != nil {
+				if total.PhaseTimings == nil {
+					total.PhaseTimings = pr.PhaseTimings().Clone()
+				}
+				total.PhaseTimings.Transfer(pr.PhaseTimings())
+			}
+			if pr, ok := client.(PipelineReporter); ok {
+				if h, errs := pr.PipelineStats(); h != nil {
+					if pipeline == nil {
+						pipeline = stats.NewHistogram(h.Offset, h.Divider)
+					}
+					pipeline.Transfer(h)
+					total.PipelineErrors += errs
+				}
+			}
+			if pr, ok := client.(ProtocolReporter); ok {
+				p := pr.NegotiatedProtocol()
+				if total.NegotiatedProtocol == "" {
+					total.NegotiatedProtocol = p
+				}
+				if o.ExpectALPN != "" && p != o.ExpectALPN && alpnErr == nil {
+					alpnErr = fmt.Errorf("negotiated protocol %q for %s instead of the expected %q", p, o.URL, o.ExpectALPN)
+				}
+			}
+			total.SocketCount += client.Close()
+		}
 		// Q: is there some copying each time stats[i] is used?
 		for k := range httpstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
@@ -151,25 +623,125 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 			}
 			total.RetCodes[k] += httpstate[i].RetCodes[k]
 		}
+		for k, v := range httpstate[i].ErrorClasses {
+			if total.ErrorClasses == nil {
+				total.ErrorClasses = make(map[fnet.ErrorClass]int64)
+			}
+			total.ErrorClasses[k] += v
+		}
 		total.sizes.Transfer(httpstate[i].sizes)
 		total.headerSizes.Transfer(httpstate[i].headerSizes)
+		total.bodySizes.Transfer(httpstate[i].bodySizes)
+		if total.ttfb != nil {
+			total.ttfb.Transfer(httpstate[i].ttfb)
+			total.throughput.Transfer(httpstate[i].throughput)
+		}
+		for j, us := range httpstate[i].URLStats {
+			total.URLStats[j].transfer(us)
+		}
 	}
 	// Cleanup state:
 	r.Options().ReleaseRunners()
 	sort.Ints(keys)
 	totalCount := float64(total.DurationHistogram.Count)
 	fmt.Fprintf(out, "Sockets used: %d (for perfect keepalive, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	cs := total.ConnectionStats
+	fmt.Fprintf(out, "Connections: %d new, %d reused, %d dns lookups\n", cs.New, cs.Reused, cs.DNSLookups)
+	if cs.FullHandshakes+cs.ResumedHandshakes > 0 {
+		fmt.Fprintf(out, "TLS handshakes: %d full, %d resumed\n", cs.FullHandshakes, cs.ResumedHandshakes)
+	}
+	if total.ReplaySkipped > 0 {
+		fmt.Fprintf(out, "Replay skipped %d malformed lines of %s\n", total.ReplaySkipped, o.ReplayFile)
+	}
+	if total.NegotiatedProtocol != "" {
+		fmt.Fprintf(out, "Negotiated protocol (ALPN): %s\n", total.NegotiatedProtocol)
+	}
 	for _, k := range keys {
 		fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+		if k != http.StatusOK {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	if total.ErrorCount > 0 && total.ErrorCount == total.DurationHistogram.Count {
+		fmt.Fprintf(out, "WARNING 0 successful calls, all %d failed\n", total.ErrorCount)
+	}
+	classes := []string{}
+	for k := range total.ErrorClasses {
+		classes = append(classes, string(k))
+	}
+	sort.Strings(classes)
+	for _, k := range classes {
+		fmt.Fprintf(out, "Error class %s : %d\n", k, total.ErrorClasses[fnet.ErrorClass(k)])
+	}
+	redirectCodes := []int{}
+	for k := range total.RedirectCodes {
+		redirectCodes = append(redirectCodes, k)
+	}
+	sort.Ints(redirectCodes)
+	for _, k := range redirectCodes {
+		fmt.Fprintf(out, "Redirect code %3d : %d\n", k, total.RedirectCodes[k])
+	}
+	for _, us := range total.URLStats {
+		us.DurationHistogram = us.durations.Export()
+		us.DurationHistogram.CalcPercentiles(r.Options().Percentiles)
+		codes := []int{}
+		for k := range us.RetCodes {
+			codes = append(codes, k)
+		}
+		sort.Ints(codes)
+		for _, k := range codes {
+			fmt.Fprintf(out, "%s %s (weight %d) code %3d : %d\n", us.Method, us.URL, us.Weight, k, us.RetCodes[k])
+		}
+		if log.LogVerbose() {
+			us.DurationHistogram.Print(out, us.Method+" "+us.URL+" Function Time")
+		}
+	}
+	if total.PhaseTimings != nil {
+		total.PhaseTimings.Print(out, r.Options().Percentiles)
+	}
+	if pipeline != nil {
+		total.PipelineHistogram = pipeline.Export().CalcPercentiles(r.Options().Percentiles)
+		fmt.Fprintf(out, "Pipelined %d requests per batch, %d responses, %d unanswered requests\n",
+			o.PipelineDepth, total.PipelineHistogram.Count, total.PipelineErrors)
+		if log.LogVerbose() {
+			total.PipelineHistogram.Print(out, "Pipelined Response Time")
+		}
+	}
+	if total.ttfb != nil {
+		total.TTFBHistogram = total.ttfb.Export().CalcPercentiles(r.Options().Percentiles)
+		total.TTFBHistogram.Print(out, "Time to first byte")
+		total.ThroughputHistogram = total.throughput.Export().CalcPercentiles(r.Options().Percentiles)
+		total.ThroughputHistogram.Print(out, "Download throughput (MB/s)")
 	}
 	total.HeaderSizes = total.headerSizes.Export()
 	total.Sizes = total.sizes.Export()
+	total.SizeHistogram = total.bodySizes.Export()
 	if log.LogVerbose() {
 		total.HeaderSizes.Print(out, "Response Header Sizes Histogram")
 		total.Sizes.Print(out, "Response Body/Total Sizes Histogram")
+		total.SizeHistogram.Print(out, "Response Body Sizes Histogram")
 	} else if log.Log(log.Warning) {
 		total.headerSizes.Counter.Print(out, "Response Header Sizes")
 		total.sizes.Counter.Print(out, "Response Body/Total Sizes")
+		total.bodySizes.Counter.Print(out, "Response Body Sizes")
+	}
+	if alpnErr != nil {
+		log.Errf("ALPN mismatch: %v", alpnErr)
+		return nil, alpnErr
 	}
-	return &total, nil
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
+
+// CalibrateHTTP finds the highest QPS the target of o sustains (see
+// periodic.Calibrate), running each probe with a copy of o.
+func CalibrateHTTP(o *HTTPRunnerOptions, co *periodic.CalibrationOptions) (*periodic.CalibrationResults, error) {
+	return periodic.Calibrate(co, func(qps float64, duration time.Duration) (*periodic.RunnerResults, error) {
+		po := *o
+		po.QPS, po.Duration, po.Exactly = qps, duration, 0
+		res, err := RunHTTPTest(&po)
+		if res == nil {
+			return nil, err
+		}
+		return &res.RunnerResults, err // e.g. an *periodic.ErrorRateError
+	})
 }
@@ -20,14 +20,32 @@
 package fhttp
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/http2"
+
+	"istio.io/fortio/fnet"
 	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+	"istio.io/fortio/stats"
 )
 
 func TestHTTPRunner(t *testing.T) {
@@ -76,6 +94,31 @@ func TestHTTPRunner(t *testing.T) {
 	}
 }
 
+func TestHTTPRunnerCaptureSlowest(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-slowest/", EchoHandler)
+	URL := fmt.Sprintf("http://localhost:%d/echo-slowest/?status=503:50", addr.Port)
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 20
+	opts.NumThreads = 2
+	opts.CaptureSlowest = 5
+	opts.URL = URL
+	opts.AllowInitialErrors = true
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.SlowestSamples) != 5 {
+		t.Fatalf("Expected 5 slowest samples, got %+v", res.SlowestSamples)
+	}
+	for _, s := range res.SlowestSamples {
+		if s.Target != URL || (s.Code != http.StatusOK && s.Code != http.StatusServiceUnavailable) {
+			t.Errorf("Unexpected slowest sample %+v", s)
+		}
+	}
+}
+
 func testHTTPNotLeaking(t *testing.T, opts *HTTPRunnerOptions) {
 	ngBefore1 := runtime.NumGoroutine()
 	t.Logf("Number go routine before test %d", ngBefore1)
@@ -126,6 +169,1123 @@ func testHTTPNotLeaking(t *testing.T, opts *HTTPRunnerOptions) {
 	}
 }
 
+func TestHTTPRunnerPayloadFile(t *testing.T) {
+	var received, requests int64
+	var contentType atomic.Value
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/post/", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Method != "POST" {
+			http.Error(w, fmt.Sprintf("unexpected %s request: %v", r.Method, err), http.StatusBadRequest)
+			return
+		}
+		contentType.Store(r.Header.Get("Content-Type"))
+		atomic.AddInt64(&received, int64(len(data)))
+		atomic.AddInt64(&requests, 1)
+	})
+	f, err := ioutil.TempFile("", "fortio-payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	payload := []byte(strings.Repeat("0123456789abcdef", 1000))
+	if _, err = f.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	f.Close() // nolint: errcheck
+	for _, std := range []bool{false, true} {
+		atomic.StoreInt64(&received, 0)
+		atomic.StoreInt64(&requests, 0)
+		opts := HTTPRunnerOptions{}
+		opts.Init(fmt.Sprintf("http://localhost:%d/post/", addr.Port))
+		opts.DisableFastClient = std
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.PayloadFile = f.Name()
+		if std {
+			// user provided header takes precedence over ContentType
+			opts.ContentType = "text/plain"
+			if err = opts.AddAndValidateExtraHeader("Content-Type: application/json"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := atomic.LoadInt64(&requests)
+		if res.RetCodes[http.StatusOK] != n || n != 10 {
+			t.Errorf("std %v: expected 10 ok posts, got %d %v", std, n, res.RetCodes)
+		}
+		if r := atomic.LoadInt64(&received); r != n*int64(len(payload)) {
+			t.Errorf("std %v: server received %d bytes for %d requests, expected %d each", std, r, n, len(payload))
+		}
+		expected := DefaultContentType
+		if std {
+			expected = "application/json"
+		}
+		if ct := contentType.Load(); ct != expected {
+			t.Errorf("std %v: got content type %v, expected %s", std, ct, expected)
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/post/", addr.Port)
+	opts.PayloadFile = "/does/not/exist"
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for missing payload file")
+	}
+}
+
+func TestHTTPRunnerSizeHistogram(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/size/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.URL = fmt.Sprintf("http://localhost:%d/size/?size=1024", addr.Port)
+		opts.DisableFastClient = std
+		opts.QPS = -1
+		opts.NumThreads = 2
+		opts.Exactly = 20
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := res.SizeHistogram; h.Count != 20 || h.Avg != 1024 || h.Min != 1024 || h.Max != 1024 {
+			t.Errorf("std %v: expected 20 bodies of 1024 bytes, got %+v", std, h)
+		}
+	}
+}
+
+func TestHTTPRunnerGzip(t *testing.T) {
+	payload := bytes.Repeat([]byte("fortio gzip "), 1000)
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/gzecho/", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Encoding") != "gzip" || len(data) >= len(payload) {
+			http.Error(w, fmt.Sprintf("expected smaller gzip body, got %d %v %v", len(data), r.Header, err), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		EchoHandler(w, r) // echoes the gzip body and Content-Encoding back
+	})
+	mux.HandleFunc("/gzchunked/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		for i := 0; i < 4; i++ {
+			zw.Write(payload[:len(payload)/4]) // nolint: errcheck
+			zw.Flush()                         // nolint: errcheck
+			w.(http.Flusher).Flush()           // forces chunked encoding
+		}
+		zw.Close() // nolint: errcheck
+	})
+	for _, std := range []bool{false, true} {
+		for _, path := range []string{"gzecho", "gzchunked"} {
+			opts := HTTPRunnerOptions{}
+			opts.URL = fmt.Sprintf("http://localhost:%d/%s/", addr.Port, path)
+			opts.DisableFastClient = std
+			opts.QPS = -1
+			opts.Exactly = 10
+			if path == "gzecho" {
+				opts.Payload = payload
+				opts.CompressRequest = true
+			}
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[http.StatusOK] != 10 {
+				t.Errorf("std %v %s: expected 10 ok, got %v", std, path, res.RetCodes)
+			}
+			if h := res.SizeHistogram; h.Min != float64(len(payload)) || h.Max != float64(len(payload)) {
+				t.Errorf("std %v %s: expected decoded size %d, got %+v", std, path, len(payload), h)
+			}
+		}
+	}
+}
+
+func TestHTTPRunnerConnectionStats(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/conns/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		for _, closing := range []bool{false, true} {
+			opts := HTTPRunnerOptions{}
+			opts.URL = fmt.Sprintf("http://localhost:%d/conns/", addr.Port)
+			if closing {
+				opts.URL += "?close=true" // server sends Connection: close
+			}
+			opts.DisableFastClient = std
+			opts.QPS = -1
+			opts.NumThreads = 2
+			opts.Exactly = 10
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := ConnectionStats{New: 2, Reused: 8, DNSLookups: 2}
+			if closing {
+				expected = ConnectionStats{New: 10, DNSLookups: 2}
+			}
+			if std {
+				expected.DNSLookups = expected.New // one per dial
+			}
+			if res.ConnectionStats != expected {
+				t.Errorf("std %v close %v: got %+v, expected %+v", std, closing, res.ConnectionStats, expected)
+			}
+		}
+	}
+}
+
+func TestHTTPRunnerURLMix(t *testing.T) {
+	var countA, countB int64
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "expected GET for /a, got "+r.Method, http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(&countA, 1)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Method != "PUT" || string(data) != "bbb" || r.Header.Get("X-Mix") != "b" {
+			http.Error(w, fmt.Sprintf("unexpected %s %q %v request: %v", r.Method, data, r.Header, err), http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(&countB, 1)
+	})
+	baseURL := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	numCalls := 400
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.NumThreads = 4
+	opts.Exactly = int64(numCalls)
+	opts.PerURLStats = true
+	opts.URLMix = []WeightedURL{
+		{URL: baseURL + "a", Weight: 1},
+		{URL: baseURL + "b", Weight: 1, Method: "PUT", Payload: []byte("bbb"), Headers: []string{"X-Mix: b"}},
+	}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := atomic.LoadInt64(&countA), atomic.LoadInt64(&countB)
+	if a+b != int64(numCalls) || res.RetCodes[http.StatusOK] != int64(numCalls) {
+		t.Errorf("Expected %d ok calls, got %d + %d, %v", numCalls, a, b, res.RetCodes)
+	}
+	// ~half each: fails less than once in a million runs
+	if a < 150 || b < 150 {
+		t.Errorf("Unexpected split for 50/50 mix: %d /a and %d /b", a, b)
+	}
+	if len(res.URLStats) != 2 {
+		t.Fatalf("Expected 2 per url stats, got %+v", res.URLStats)
+	}
+	for i, expected := range []int64{a, b} {
+		us := res.URLStats[i]
+		if us.RetCodes[http.StatusOK] != expected || us.DurationHistogram.Count != expected {
+			t.Errorf("Per url stats %d mismatch, expected %d: %v %d", i, expected, us.RetCodes, us.DurationHistogram.Count)
+		}
+	}
+	if res.URLStats[1].Method != "PUT" {
+		t.Errorf("Expected PUT method for second url, got %s", res.URLStats[1].Method)
+	}
+	opts.URLMix[1].Weight = 0
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for 0 weight")
+	}
+}
+
+func TestHTTPRunnerMultipartForm(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := r.FormValue("description"); v != "fortio upload" {
+			http.Error(w, "unexpected description "+v, http.StatusBadRequest)
+			return
+		}
+		f, h, err := r.FormFile("data")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close() // nolint: errcheck
+		if err != nil || h.Filename != "data.txt" || h.Header.Get("Content-Type") != "text/plain" ||
+			string(data) != "file content\n" {
+			http.Error(w, fmt.Sprintf("unexpected file %s %v %q: %v", h.Filename, h.Header, data, err), http.StatusBadRequest)
+			return
+		}
+	})
+	file, err := ioutil.TempFile("", "fortio-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())       // nolint: errcheck
+	file.WriteString("file content\n") // nolint: errcheck
+	file.Close()                       // nolint: errcheck
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.Init(fmt.Sprintf("http://localhost:%d/upload", addr.Port))
+		opts.DisableFastClient = std
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.NumThreads = 2
+		opts.MultipartForm = []FormPart{
+			{Name: "description", Content: []byte("fortio upload")},
+			{Name: "data", Filename: "data.txt", File: file.Name(), ContentType: "text/plain"},
+		}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 {
+			t.Errorf("std %v: expected 10 parsed uploads, got %v", std, res.RetCodes)
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/upload", addr.Port)
+	opts.MultipartForm = []FormPart{{Name: "data", Filename: "x", File: "/does/not/exist"}}
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for missing form file")
+	}
+}
+
+func TestHTTPRunnerPayloadCorpus(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var lock sync.Mutex
+	bodies := make(map[string]int)
+	mux.HandleFunc("/corpus", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Method != "POST" {
+			http.Error(w, fmt.Sprintf("unexpected %s body %q: %v", r.Method, data, err), http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		bodies[string(data)]++
+		lock.Unlock()
+	})
+	file, err := ioutil.TempFile("", "fortio-corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())                                               // nolint: errcheck
+	file.WriteString("{\"id\": 1}\n{\"id\": 2, \"x\": \"{{.Seq}}\"}\nthird\n") // nolint: errcheck
+	file.Close()                                                               // nolint: errcheck
+	expected := []string{"{\"id\": 1}", "{\"id\": 2, \"x\": \"{{.Seq}}\"}", "third"}
+	for _, std := range []bool{false, true} {
+		for _, random := range []bool{false, true} {
+			lock.Lock()
+			bodies = make(map[string]int)
+			lock.Unlock()
+			opts := HTTPRunnerOptions{}
+			opts.Init(fmt.Sprintf("http://localhost:%d/corpus", addr.Port))
+			opts.DisableFastClient = std
+			opts.QPS = -1
+			opts.Exactly = 30
+			opts.NumThreads = 3
+			opts.Seed = 42
+			opts.PayloadCorpusFile = file.Name()
+			opts.PayloadCorpusRandom = random
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[http.StatusOK] != 30 {
+				t.Errorf("std %v random %v: expected 30 ok posts, got %v", std, random, res.RetCodes)
+			}
+			lock.Lock()
+			for _, b := range expected {
+				// round robin across the threads: each exactly a third of the time
+				if n := bodies[b]; n == 0 || (!random && n != 10) {
+					t.Errorf("std %v random %v: body %q sent %d times: %v", std, random, b, n, bodies)
+				}
+			}
+			if len(bodies) != len(expected) {
+				t.Errorf("std %v random %v: unexpected bodies %v", std, random, bodies)
+			}
+			lock.Unlock()
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/corpus", addr.Port)
+	opts.PayloadCorpusFile = "/does/not/exist"
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for missing corpus file")
+	}
+}
+
+func TestHTTPRunnerMaxErrorRate(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-rate/", EchoHandler)
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/echo-rate/?status=503:50", addr.Port)
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 200
+	opts.MaxErrorRate = 0.1
+	res, err := RunHTTPTest(&opts)
+	if res == nil {
+		t.Fatalf("Expected the results along with the error rate error, got %v", err)
+	}
+	rateErr, ok := err.(*periodic.ErrorRateError)
+	if !ok {
+		t.Fatalf("Expected an error rate error, got %v (%v)", err, res.RetCodes)
+	}
+	expected := float64(res.ErrorCount) / float64(res.DurationHistogram.Count)
+	if rateErr.Rate != expected || rateErr.MaxRate != 0.1 || rateErr.Rate < 0.3 || rateErr.Rate > 0.7 {
+		t.Errorf("Unexpected error rate %+v for %v", rateErr, res.RetCodes)
+	}
+	opts.MaxErrorRate = 0.9
+	if _, err = RunHTTPTest(&opts); err != nil {
+		t.Errorf("Unexpected error below the max error rate: %v", err)
+	}
+}
+
+func TestHTTPRunnerSeed(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/seed/", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		requests = append(requests, r.URL.Path+" "+string(data))
+		lock.Unlock()
+	})
+	baseURL := fmt.Sprintf("http://localhost:%d/seed/", addr.Port)
+	run := func(seed int64) []string {
+		requests = nil
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.NumThreads = 1
+		opts.Exactly = 30
+		opts.Seed = seed
+		opts.URLMix = []WeightedURL{
+			{URL: baseURL + "a", Weight: 1, Method: "POST", Payload: []byte("a {{.UUID}}")},
+			{URL: baseURL + "b", Weight: 2, Method: "POST", Payload: []byte("b {{.UUID}}")},
+			{URL: baseURL + "c", Weight: 1},
+		}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Seed != seed {
+			t.Errorf("Expected seed %d in the results, got %d", seed, res.Seed)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if len(requests) != 30 {
+			t.Fatalf("Expected 30 requests, got %d", len(requests))
+		}
+		return requests
+	}
+	first := run(42)
+	second := run(42)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("Request %d differs with the same seed: %q vs %q", i, first[i], second[i])
+		}
+	}
+	other := run(43)
+	same := 0
+	for i := range first {
+		if first[i] == other[i] {
+			same++
+		}
+	}
+	if same == len(first) {
+		t.Errorf("Same requests with a different seed: %v", other)
+	}
+}
+
+func TestHTTPRunnerCookieJar(t *testing.T) {
+	var lock sync.Mutex
+	var cookies []string
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/cookie/", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		lock.Unlock()
+		EchoHandler(w, r)
+	})
+	url := fmt.Sprintf("http://localhost:%d/cookie/?header=Set-Cookie:session=abc123", addr.Port)
+	for _, std := range []bool{false, true} {
+		for _, enabled := range []bool{false, true} {
+			cookies = nil
+			opts := HTTPRunnerOptions{}
+			opts.URL = url
+			opts.DisableFastClient = std
+			opts.EnableCookieJar = enabled
+			opts.QPS = -1
+			opts.NumThreads = 1
+			opts.Exactly = 3
+			if _, err := RunHTTPTest(&opts); err != nil {
+				t.Fatal(err)
+			}
+			expected := []string{"", "", ""}
+			if enabled {
+				expected = []string{"", "session=abc123", "session=abc123"}
+			}
+			if fmt.Sprint(cookies) != fmt.Sprint(expected) {
+				t.Errorf("std %v jar %v: got cookies %q, expected %q", std, enabled, cookies, expected)
+			}
+		}
+	}
+}
+
+// h2cServer starts an http2 with prior knowledge (no tls) server for handler
+// and returns its url and a pointer to the count of accepted connections.
+func h2cServer(t *testing.T, handler http.Handler) (string, *int64) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&conns, 1)
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+	return fmt.Sprintf("http://%s/", listener.Addr()), &conns
+}
+
+func TestHTTPRunnerHTTP2(t *testing.T) {
+	var inFlight, maxInFlight int64
+	var lock sync.Mutex
+	url, conns := h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected http2, got "+r.Proto, http.StatusBadRequest)
+			return
+		}
+		n := atomic.AddInt64(&inFlight, 1)
+		lock.Lock()
+		if n > maxInFlight {
+			maxInFlight = n
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt64(&inFlight, -1)
+	}))
+	opts := HTTPRunnerOptions{}
+	opts.URL = url + "h2c"
+	opts.HTTP2 = true
+	opts.QPS = -1
+	opts.NumThreads = 4
+	opts.Exactly = 20
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusOK] != 20 {
+		t.Errorf("Expected 20 ok http2 calls, got %v", res.RetCodes)
+	}
+	if c := atomic.LoadInt64(conns); c != 1 {
+		t.Errorf("Expected all the streams on 1 connection, got %d", c)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if maxInFlight < 2 {
+		t.Errorf("Expected concurrent streams, got at most %d in flight", maxInFlight)
+	}
+}
+
+func TestHTTPRunnerALPN(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto)) // nolint: errcheck
+	}))
+	srv.EnableHTTP2 = true // offers h2 and http/1.1
+	srv.StartTLS()
+	defer srv.Close()
+	opts := HTTPRunnerOptions{}
+	opts.URL = srv.URL
+	opts.Insecure = true // self signed test server
+	opts.HTTP2 = true
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 4
+	opts.ExpectALPN = "h2"
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NegotiatedProtocol != "h2" {
+		t.Errorf("Expected h2 to be negotiated, got %q", res.NegotiatedProtocol)
+	}
+	if res.RetCodes[http.StatusOK] != 4 {
+		t.Errorf("Expected 4 ok calls, got %v", res.RetCodes)
+	}
+	// http 1.1 client: mismatch
+	opts.HTTP2 = false
+	if _, err = RunHTTPTest(&opts); err == nil {
+		t.Error("Expected an error for the ALPN mismatch with the http 1.1 client")
+	}
+	opts.ExpectALPN = ""
+	if res, err = RunHTTPTest(&opts); err != nil {
+		t.Errorf("Unexpected error without ALPN expectation: %v", err)
+	} else if res.NegotiatedProtocol == "h2" {
+		t.Errorf("Unexpected h2 negotiated by the http 1.1 client")
+	}
+}
+
+func TestHTTPRunnerHeaderChecks(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-checks/", EchoHandler)
+	baseURL := fmt.Sprintf("http://localhost:%d/echo-checks/?header=X-Cache:HIT", addr.Port)
+	tests := []struct {
+		checks []HeaderCheck
+		code   int
+	}{
+		{[]HeaderCheck{{Name: "x-cache"}}, http.StatusOK},
+		{[]HeaderCheck{{Name: "X-Cache", ValueRegexp: "^HIT$"}}, http.StatusOK},
+		{[]HeaderCheck{{Name: "X-Cache", ValueRegexp: "^MISS$"}}, ValidationError},
+		{[]HeaderCheck{{Name: "X-Cache"}, {Name: "X-Absent"}}, ValidationError},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tst := range tests {
+			opts := HTTPRunnerOptions{}
+			opts.Init(baseURL)
+			opts.DisableFastClient = stdClient
+			opts.QPS = -1
+			opts.Exactly = 5
+			opts.ResponseHeaderChecks = tst.checks
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[tst.code] != 5 {
+				t.Errorf("std client %v, checks %+v: expected 5 code %d, got %v", stdClient, tst.checks, tst.code, res.RetCodes)
+			}
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.Init(baseURL)
+	opts.ResponseHeaderChecks = []HeaderCheck{{Name: "X-Cache", ValueRegexp: "("}}
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Error("Expected an error for an invalid check regexp")
+	}
+}
+
+func TestHTTPRunnerBodyChecks(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-body/", EchoHandler)
+	url := fmt.Sprintf("http://localhost:%d/echo-body/", addr.Port)
+	tests := []struct {
+		contains string
+		regex    string
+		code     int
+	}{
+		{"", "", http.StatusOK},
+		{"good", "", http.StatusOK},
+		{"", `^all \w+$`, http.StatusOK},
+		{"good", "^all", http.StatusOK},
+		{"error page", "", BodyMismatch},
+		{"", "^error", BodyMismatch},
+		{"good", "^error", BodyMismatch},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tst := range tests {
+			opts := HTTPRunnerOptions{}
+			opts.Init(url)
+			opts.Payload = []byte("all good") // echoed back
+			opts.DisableFastClient = stdClient
+			opts.QPS = -1
+			opts.Exactly = 5
+			opts.ExpectBodyContains = tst.contains
+			opts.ExpectBodyRegex = tst.regex
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[tst.code] != 5 {
+				t.Errorf("std client %v, contains %q regex %q: expected 5 code %d, got %v",
+					stdClient, tst.contains, tst.regex, tst.code, res.RetCodes)
+			}
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.Init(url)
+	opts.ExpectBodyRegex = "("
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Error("Expected an error for an invalid body regexp")
+	}
+}
+
+func TestHTTPRunnerRedirects(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	// /redir/N redirects to /redir/N-1, until /redir/0 which echoes
+	mux.HandleFunc("/redir/", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redir/"))
+		if err != nil || n <= 0 {
+			EchoHandler(w, r)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redir/%d", n-1), http.StatusFound)
+	})
+	url := fmt.Sprintf("http://localhost:%d/redir/3", addr.Port)
+	tests := []struct {
+		follow    bool
+		max       int
+		code      int
+		redirects int64
+	}{
+		{false, 0, http.StatusFound, 0},
+		{true, 0, http.StatusOK, 3 * 5},
+		{true, 3, http.StatusOK, 3 * 5},
+		{true, 2, http.StatusFound, 2 * 5},
+	}
+	for _, tst := range tests {
+		opts := HTTPRunnerOptions{}
+		opts.Init(url)
+		opts.QPS = -1
+		opts.Exactly = 5
+		opts.FollowRedirects = tst.follow
+		opts.MaxRedirects = tst.max
+		opts.CountRedirects = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[tst.code] != 5 {
+			t.Errorf("follow %v max %d: expected 5 code %d, got %v", tst.follow, tst.max, tst.code, res.RetCodes)
+		}
+		if res.RedirectCodes[http.StatusFound] != tst.redirects {
+			t.Errorf("follow %v max %d: expected %d redirects, got %v", tst.follow, tst.max, tst.redirects, res.RedirectCodes)
+		}
+	}
+}
+
+func TestHTTPRunnerAuth(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); ok && (user != "user" || pass != "p@ss:word") {
+			http.Error(w, "bad credentials "+user+" "+pass, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(strings.Join(r.Header["Authorization"], ","))) // nolint: errcheck
+	})
+	url := fmt.Sprintf("http://localhost:%d/auth", addr.Port)
+	tests := []struct {
+		user     string
+		password string
+		token    string
+		header   string
+		expected string
+	}{
+		{"user", "p@ss:word", "", "", "Basic dXNlcjpwQHNzOndvcmQ="},
+		{"", "", "tok123", "", "Bearer tok123"},
+		{"user", "p@ss:word", "", "Authorization: Custom xyz", "Custom xyz"}, // explicit header wins
+		{"", "", "tok123", "Authorization: Custom xyz", "Custom xyz"},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tst := range tests {
+			opts := HTTPRunnerOptions{}
+			opts.Init(url)
+			if tst.header != "" {
+				if err := opts.AddAndValidateExtraHeader(tst.header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts.DisableFastClient = stdClient
+			opts.QPS = -1
+			opts.Exactly = 4
+			opts.BasicAuthUser = tst.user
+			opts.BasicAuthPassword = tst.password
+			opts.BearerToken = tst.token
+			opts.ExpectBodyRegex = "^" + tst.expected + "$"
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[http.StatusOK] != 4 {
+				t.Errorf("std client %v, %+v: expected 4 ok, got %v", stdClient, tst, res.RetCodes)
+			}
+		}
+	}
+}
+
+func TestHTTPRunnerURLMixMaxQPS(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/main", EchoHandler)
+	mux.HandleFunc("/fragile", EchoHandler)
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1 // closed loop: as fast as possible
+	opts.NumThreads = 4
+	opts.Duration = time.Second
+	opts.URLMix = []WeightedURL{
+		{URL: fmt.Sprintf("http://localhost:%d/main", addr.Port), Weight: 1},
+		{URL: fmt.Sprintf("http://localhost:%d/fragile", addr.Port), Weight: 1, MaxQPS: 20},
+	}
+	opts.PerURLStats = true
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, fragile := res.URLStats[0].RetCodes[http.StatusOK], res.URLStats[1].RetCodes[http.StatusOK]
+	fragileQPS := float64(fragile) / res.ActualDuration.Seconds()
+	t.Logf("main %d, fragile %d (%.1f qps) calls in %v", main, fragile, fragileQPS, res.ActualDuration)
+	if fragile == 0 || fragileQPS > 20*1.1+1 {
+		t.Errorf("Capped entry rate %.1f (%d calls) not within the 20 qps cap", fragileQPS, fragile)
+	}
+	if main == 0 {
+		t.Errorf("No call to the uncapped entry")
+	}
+	// the waits aren't part of the calls' durations
+	if d := res.URLStats[1].DurationHistogram.Max; d > 0.04 {
+		t.Errorf("Capped entry max duration %g includes the rate limit wait", d)
+	}
+	if d := res.DurationHistogram.Max; d > 0.04 {
+		t.Errorf("Max duration %g includes the rate limit wait", d)
+	}
+}
+
+func TestHTTPRunnerValidate(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-validate/", EchoHandler)
+	okURL := fmt.Sprintf("http://localhost:%d/echo-validate/", addr.Port)
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := fmt.Sprintf("http://%s/", closed.Addr())
+	closed.Close() // nolint: errcheck
+	tests := []struct {
+		name string
+		opts HTTPRunnerOptions
+		ok   bool
+	}{
+		{"ok", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: okURL}}, true},
+		{"std client ok", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: okURL, DisableFastClient: true}}, true},
+		{"unreachable", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: closedURL}}, false},
+		{"error code", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: okURL + "?status=503"}}, false},
+		{"bad payload file", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: okURL, PayloadFile: "/does/not/exist"}}, false},
+		{"body mismatch", HTTPRunnerOptions{HTTPOptions: HTTPOptions{URL: okURL}, ExpectBodyContains: "foo"}, false},
+		{"url mix", HTTPRunnerOptions{URLMix: []WeightedURL{{URL: okURL, Weight: 1}, {URL: closedURL, Weight: 1}}}, false},
+		{"no url", HTTPRunnerOptions{}, false},
+	}
+	for _, tst := range tests {
+		err := tst.opts.Validate()
+		if (err == nil) != tst.ok {
+			t.Errorf("%s: unexpected validation result %v", tst.name, err)
+		}
+	}
+}
+
+func TestHTTPRunnerErrorClasses(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/echo-classes/", EchoHandler)
+	baseURL := fmt.Sprintf("http://localhost:%d/echo-classes/", addr.Port)
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := fmt.Sprintf("http://%s/", closed.Addr())
+	closed.Close() // nolint: errcheck
+	tests := []struct {
+		url      string
+		timeout  time.Duration
+		expected fnet.ErrorClass
+	}{
+		{closedURL, 0, fnet.ConnectionRefusedError},
+		{baseURL + "?delay=500ms", 50 * time.Millisecond, fnet.TimeoutError},
+		{baseURL + "?status=503", 0, fnet.ApplicationError},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tst := range tests {
+			opts := HTTPRunnerOptions{}
+			opts.Init(tst.url)
+			opts.DisableFastClient = stdClient
+			opts.HTTPReqTimeOut = tst.timeout
+			opts.QPS = -1
+			opts.Exactly = 4
+			opts.NumThreads = 2
+			opts.AllowInitialErrors = true
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := res.ErrorClasses[tst.expected]; c != 4 || len(res.ErrorClasses) != 1 {
+				t.Errorf("std client %v, %s: expected 4 %q errors, got %v (codes %v)",
+					stdClient, tst.url, tst.expected, res.ErrorClasses, res.RetCodes)
+			}
+		}
+	}
+	opts := HTTPRunnerOptions{}
+	opts.Init(baseURL)
+	opts.QPS = -1
+	opts.Exactly = 4
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ErrorClasses) != 0 {
+		t.Errorf("Unexpected error classes for ok calls: %v", res.ErrorClasses)
+	}
+}
+
+func TestHTTPRunnerPhaseTimings(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+	defer srv.Close()
+	opts := HTTPRunnerOptions{}
+	opts.URL = srv.URL
+	opts.Insecure = true         // self signed test server
+	opts.DisableKeepAlive = true // new connection for each call
+	opts.PhaseTimings = true
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 4
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := res.PhaseTimings
+	if p == nil {
+		t.Fatal("Expected phase timings in the result")
+	}
+	// no initial calls with Exactly: 4 calls on new connections
+	for name, h := range map[string]*stats.Histogram{"connect": p.Connect, "tls": p.TLSHandshake, "first byte": p.FirstByte} {
+		if h.Count != 4 {
+			t.Errorf("Expected 4 %s timings, got %d", name, h.Count)
+		}
+	}
+	if p.TLSHandshake.Avg() <= 0 {
+		t.Errorf("Expected non zero TLS handshake durations, got %v", p.TLSHandshake.Avg())
+	}
+	opts.PhaseTimings = false
+	if res, err = RunHTTPTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.PhaseTimings != nil {
+		t.Errorf("Unexpected phase timings without the option: %+v", res.PhaseTimings)
+	}
+}
+
+func TestHTTPRunnerTLSSessionCache(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) // nolint: errcheck
+	}))
+	defer srv.Close()
+	for _, cache := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.URL = srv.URL
+		opts.Insecure = true         // self signed test server
+		opts.DisableKeepAlive = true // new connection (and handshake) for each call
+		opts.TLSSessionCache = cache
+		opts.QPS = -1
+		opts.NumThreads = 2
+		opts.Exactly = 10
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs := res.ConnectionStats
+		if cs.FullHandshakes+cs.ResumedHandshakes != 10 {
+			t.Errorf("cache %v: expected 10 handshakes, got %+v", cache, cs)
+		}
+		if cache && (cs.ResumedHandshakes == 0 || cs.FullHandshakes > 2) {
+			t.Errorf("Expected resumed handshakes after the first ones with the cache, got %+v", cs)
+		}
+		if !cache && cs.ResumedHandshakes != 0 {
+			t.Errorf("Unexpected resumed handshakes without the cache: %+v", cs)
+		}
+	}
+}
+
+func TestHTTPRunnerSourceAddresses(t *testing.T) {
+	var lock sync.Mutex
+	sources := make(map[string]int)
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/sources/", func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		lock.Lock()
+		sources[host]++
+		lock.Unlock()
+	})
+	url := fmt.Sprintf("http://127.0.0.1:%d/sources/", addr.Port)
+	for _, stdClient := range []bool{false, true} {
+		sources = make(map[string]int)
+		opts := HTTPRunnerOptions{}
+		opts.Init(url)
+		opts.DisableFastClient = stdClient
+		opts.DisableKeepAlive = true // new connection for each call
+		opts.SourceAddresses = []string{"127.0.0.2", "127.0.0.3"}
+		opts.QPS = -1
+		opts.NumThreads = 2
+		opts.Exactly = 8
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 8 {
+			t.Errorf("std client %v: expected 8 ok calls, got %v", stdClient, res.RetCodes)
+		}
+		lock.Lock()
+		if len(sources) != 2 || sources["127.0.0.2"] != 4 || sources["127.0.0.3"] != 4 {
+			t.Errorf("std client %v: expected 4 connections from each source address, got %v", stdClient, sources)
+		}
+		lock.Unlock()
+	}
+	for _, bad := range []string{"not-an-ip", "192.0.2.1"} { // 192.0.2.1: TEST-NET, not assigned
+		opts := HTTPRunnerOptions{}
+		opts.Init(url)
+		opts.SourceAddresses = []string{"127.0.0.1", bad}
+		opts.QPS = -1
+		opts.Exactly = 4
+		if _, err := RunHTTPTest(&opts); err == nil {
+			t.Errorf("Expected an error for source address %q", bad)
+		}
+	}
+}
+
+func TestHTTPRunnerTemplate(t *testing.T) {
+	var lock sync.Mutex
+	urls := make(map[string]int)
+	bodies := make(map[string]int)
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/tmpl/", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		urls[r.URL.RequestURI()]++
+		if len(data) > 0 {
+			bodies[string(data)]++
+		}
+		lock.Unlock()
+	})
+	for _, std := range []bool{false, true} {
+		urls = make(map[string]int)
+		bodies = make(map[string]int)
+		opts := HTTPRunnerOptions{}
+		opts.Init(fmt.Sprintf("http://localhost:%d/tmpl/{{.ThreadID}}?seq={{.Seq}}", addr.Port))
+		opts.DisableFastClient = std
+		opts.QPS = 100
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.Payload = []byte(`{"id": "{{.UUID}}"}`)
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 20 {
+			t.Errorf("std %v: expected 20 ok, got %v", std, res.RetCodes)
+		}
+		lock.Lock()
+		if len(urls) != 20 {
+			t.Errorf("std %v: expected 20 distinct urls, got %d: %v", std, len(urls), urls)
+		}
+		if len(bodies) != 20 {
+			t.Errorf("std %v: expected 20 distinct bodies, got %d: %v", std, len(bodies), bodies)
+		}
+		for u := range urls {
+			if !strings.HasPrefix(u, "/tmpl/0?seq=") && !strings.HasPrefix(u, "/tmpl/1?seq=") {
+				t.Errorf("std %v: unexpected url %s", std, u)
+			}
+		}
+		lock.Unlock()
+	}
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/tmpl/{{.Bad}}", addr.Port)
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error for bad template")
+	}
+}
+
+// verifyHMAC checks the signature header value for the request (see http_sign.go).
+func verifyHMAC(key []byte, value string, r *http.Request, body []byte) error {
+	var ts int64
+	var sig string
+	if n, err := fmt.Sscanf(value, "t=%d,sig=%s", &ts, &sig); n != 2 || err != nil {
+		return fmt.Errorf("bad signature header %q: %v", value, err)
+	}
+	if d := time.Now().Unix() - ts; d < 0 || d > 5 {
+		return fmt.Errorf("stale signature timestamp %d", ts)
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", r.Method, r.URL.RequestURI(), body, ts)
+	if expected := hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(sig), []byte(expected)) {
+		return fmt.Errorf("signature %s doesn't match expected %s", sig, expected)
+	}
+	return nil
+}
+
+func TestHTTPRunnerHMAC(t *testing.T) {
+	var lock sync.Mutex
+	signatures := make(map[string]int)
+	key := []byte("s3cr3t")
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/signed/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		header := r.URL.Query().Get("header")
+		value := r.Header.Get(header)
+		if err := verifyHMAC(key, value, r, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		signatures[value]++
+		lock.Unlock()
+	})
+	tests := []struct {
+		header  string // HMACHeader option
+		sent    string // header name the server expects
+		payload string
+	}{
+		{"", DefaultHMACHeader, ""},
+		{"x-api-signature", "X-Api-Signature", `{"id": "{{.UUID}}", "seq": {{.Seq}}}`},
+		{"X-Sig", "X-Sig", "static payload"},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tst := range tests {
+			signatures = make(map[string]int)
+			opts := HTTPRunnerOptions{}
+			opts.Init(fmt.Sprintf("http://localhost:%d/signed/{{.Seq}}?header=%s", addr.Port, tst.sent))
+			opts.DisableFastClient = stdClient
+			opts.HMACKey = key
+			opts.HMACHeader = tst.header
+			opts.Payload = []byte(tst.payload)
+			opts.QPS = -1
+			opts.NumThreads = 2
+			opts.Exactly = 10
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.RetCodes[http.StatusOK] != 10 {
+				t.Errorf("std client %v, %+v: expected 10 verified calls, got %v", stdClient, tst, res.RetCodes)
+			}
+			lock.Lock()
+			if len(signatures) != 10 {
+				t.Errorf("std client %v, %+v: expected 10 distinct signatures, got %v", stdClient, tst, signatures)
+			}
+			lock.Unlock()
+		}
+	}
+	// Wrong key: the server rejects all the calls
+	opts := HTTPRunnerOptions{}
+	opts.Init(fmt.Sprintf("http://localhost:%d/signed/?header=%s", addr.Port, DefaultHMACHeader))
+	opts.HMACKey = []byte("wrong")
+	opts.QPS = -1
+	opts.NumThreads = 1
+	opts.Exactly = 2
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusUnauthorized] != 2 {
+		t.Errorf("Expected 2 unauthorized calls with the wrong key, got %v", res.RetCodes)
+	}
+}
+
 func TestHttpNotLeakingFastClient(t *testing.T) {
 	testHTTPNotLeaking(t, &HTTPRunnerOptions{})
 }
@@ -263,3 +1423,372 @@ func TestAbortOn(t *testing.T) {
 		t.Errorf("Abort2 not working, did %d requests expecting ideally 1 and <= %d", count, o.NumThreads)
 	}
 }
+
+func TestHTTPRunnerAddressFamily(t *testing.T) {
+	var lock sync.Mutex
+	var remote string
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/family/", func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		lock.Lock()
+		remote = host
+		lock.Unlock()
+	})
+	tests := []struct {
+		host   string
+		family fnet.AddressFamily
+		want   string // remote address seen by the server, empty for an error
+	}{
+		{"127.0.0.1", fnet.IPv4, "127.0.0.1"},
+		{"[::1]", fnet.IPv6, "::1"},
+		{"[::1]", fnet.AutoFamily, "::1"},
+		{"127.0.0.1", fnet.IPv6, ""},
+		{"[::1]", fnet.IPv4, ""},
+		{"127.0.0.1", "ipv5", ""},
+	}
+	for _, stdClient := range []bool{false, true} {
+		for _, tt := range tests {
+			remote = ""
+			opts := HTTPRunnerOptions{}
+			opts.Init(fmt.Sprintf("http://%s:%d/family/", tt.host, addr.Port))
+			opts.DisableFastClient = stdClient
+			opts.AddressFamily = tt.family
+			opts.QPS = 20
+			opts.Duration = 100 * time.Millisecond // not Exactly, to error out on the warm up call
+			_, err := RunHTTPTest(&opts)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("std client %v: expected an error for %s with %s", stdClient, tt.host, tt.family)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("std client %v: unexpected error for %s with %s: %v", stdClient, tt.host, tt.family, err)
+				continue
+			}
+			lock.Lock()
+			if remote != tt.want {
+				t.Errorf("std client %v: connected from %q for %s with %s, expected %s", stdClient, remote, tt.host, tt.family, tt.want)
+			}
+			lock.Unlock()
+		}
+	}
+}
+
+func TestCalibrateHTTP(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/calibrate/", EchoHandler)
+	opts := HTTPRunnerOptions{}
+	opts.Init(fmt.Sprintf("http://localhost:%d/calibrate/", addr.Port))
+	opts.NumThreads = 2
+	co := periodic.CalibrationOptions{MinQPS: 20, MaxQPS: 40, ProbeDuration: 300 * time.Millisecond, MaxP99: time.Second}
+	res, err := CalibrateHTTP(&opts, &co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MaxQPS != 40 || len(res.Probes) != 2 {
+		t.Errorf("Expected 40 qps sustained after 2 probes, got %+v", res)
+	}
+	// Errors on every call (after the warm up ones): even the min qps isn't sustainable
+	var calls int64
+	mux.HandleFunc("/calibrate-errors/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	opts = HTTPRunnerOptions{}
+	opts.Init(fmt.Sprintf("http://localhost:%d/calibrate-errors/", addr.Port))
+	opts.NumThreads = 2
+	opts.MaxErrorRate = 0.5 // the probe's *ErrorRateError doesn't end the calibration
+	res, err = CalibrateHTTP(&opts, &co)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MaxQPS != 0 || len(res.Probes) != 1 || res.Probes[0].ErrorRate != 1 {
+		t.Errorf("Expected no sustainable qps, got %+v", res)
+	}
+}
+
+func TestHTTPRunnerClosedPort(t *testing.T) {
+	l, addr := fnet.Listen("closed port", "0")
+	l.Close() // nolint: errcheck
+	var out bytes.Buffer
+	opts := HTTPRunnerOptions{}
+	opts.Init(fmt.Sprintf("http://localhost:%d/", addr.Port))
+	opts.AllowInitialErrors = true
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 10
+	opts.Out = &out
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ErrorCount != 10 || res.RetCodes[-1] != 10 || res.ErrorClasses[fnet.ConnectionRefusedError] != 10 {
+		t.Errorf("Expected 10 connection errors, got %d: %v %v", res.ErrorCount, res.RetCodes, res.ErrorClasses)
+	}
+	if !strings.Contains(out.String(), "WARNING 0 successful calls, all 10 failed\n") {
+		t.Errorf("Summary should show no successful calls: %s", out.String())
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("Unable to serialize the results: %v", err)
+	}
+	loaded, err := periodic.LoadResults(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	loaded.Render(&out, []float64{99})
+	if !strings.Contains(out.String(), "WARNING 0 successful calls, all 10 failed\n") {
+		t.Errorf("Rendered summary should show no successful calls: %s", out.String())
+	}
+}
+
+func TestHTTPRunnerIdleConnTimeout(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/idle/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		for _, idle := range []time.Duration{0, 20 * time.Millisecond} {
+			opts := HTTPRunnerOptions{}
+			opts.URL = fmt.Sprintf("http://localhost:%d/idle/", addr.Port)
+			opts.DisableFastClient = std
+			opts.QPS = 10 // 100ms pauses between calls
+			opts.NumThreads = 1
+			opts.Exactly = 4
+			opts.IdleConnTimeout = idle
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := int64(1)
+			if idle > 0 {
+				expected = 4 // reconnects after each pause
+			}
+			if res.ConnectionStats.New != expected || res.ConnectionStats.New+res.ConnectionStats.Reused != 4 {
+				t.Errorf("std %v idle %v: got %+v, expected %d new connections", std, idle, res.ConnectionStats, expected)
+			}
+		}
+	}
+}
+
+func TestHTTPRunnerReplay(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	var times []time.Time
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/replay/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, r.Method+" "+r.URL.RequestURI())
+		times = append(times, time.Now())
+		mu.Unlock()
+	})
+	accessLog := `# synthetic access log
+2018-05-01T10:00:00Z GET /replay/a
+2018-05-01T10:00:00.2Z POST /replay/b
+not a valid line
+1525168800.6 GET /replay/c?x=1
+2018-05-01T10:00:00.8Z GET
+yesterday GET /replay/d
+2018-05-01T10:00:01Z GET /replay/a
+`
+	f, err := ioutil.TempFile("", "fortio-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err = f.WriteString(accessLog); err != nil {
+		t.Fatal(err)
+	}
+	f.Close() // nolint: errcheck
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.ReplayFile = f.Name()
+	opts.ReplaySpeed = 2
+	opts.NumThreads = 2
+	opts.PerURLStats = true
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ReplaySkipped != 3 {
+		t.Errorf("expected 3 skipped malformed lines, got %d", res.ReplaySkipped)
+	}
+	if res.RetCodes[http.StatusOK] != 4 || res.DurationHistogram.Count != 4 {
+		t.Errorf("expected 4 ok calls, got %+v (%d)", res.RetCodes, res.DurationHistogram.Count)
+	}
+	if len(res.URLStats) != 3 || res.URLStats[0].Weight != 2 || res.URLStats[1].Method != "POST" {
+		t.Errorf("unexpected per url stats %+v", res.URLStats)
+	}
+	expected := []string{"GET /replay/a", "POST /replay/b", "GET /replay/c?x=1", "GET /replay/a"}
+	offsets := []time.Duration{0, 100 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond} // at 2x
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != len(expected) {
+		t.Fatalf("got calls %v, expected %v", calls, expected)
+	}
+	for i, c := range calls {
+		if c != expected[i] {
+			t.Errorf("call %d: got %q, expected %q", i, c, expected[i])
+		}
+		d := times[i].Sub(times[0])
+		if d < offsets[i]-10*time.Millisecond || d > offsets[i]+80*time.Millisecond {
+			t.Errorf("call %d %s at %v, expected around %v", i, c, d, offsets[i])
+		}
+	}
+}
+
+func TestHTTPRunnerPerRetCodeHistograms(t *testing.T) {
+	var count int64
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/codes/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&count, 1)%3 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable) // fast failure
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/codes/", addr.Port)
+	opts.QPS = -1
+	opts.NumThreads = 1
+	opts.Exactly = 12
+	opts.AllowInitialErrors = true
+	opts.PerRetCodeHistograms = true
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, unavailable := res.RetCodeHistograms[http.StatusOK], res.RetCodeHistograms[http.StatusServiceUnavailable]
+	if len(res.RetCodeHistograms) != 2 || ok == nil || unavailable == nil {
+		t.Fatalf("Unexpected per code histograms %+v", res.RetCodeHistograms)
+	}
+	if ok.Count != 8 || unavailable.Count != 4 || ok.Count+unavailable.Count != res.DurationHistogram.Count {
+		t.Errorf("Mismatch between the per code counts %d + %d and the total %d", ok.Count, unavailable.Count,
+			res.DurationHistogram.Count)
+	}
+	if ok.Avg < 0.02 || unavailable.Avg > ok.Avg/2 {
+		t.Errorf("Expected fast 503s (avg %g) and slow 200s (avg %g)", unavailable.Avg, ok.Avg)
+	}
+	opts.PerRetCodeHistograms = false
+	if res, err = RunHTTPTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodeHistograms != nil {
+		t.Errorf("Unexpected per code histograms without the option: %+v", res.RetCodeHistograms)
+	}
+}
+
+func TestHTTPRunnerPipelining(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/pipeline/", EchoHandler)
+	mux.HandleFunc("/pipeline-chunked/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("abc"))   // nolint: errcheck
+		w.(http.Flusher).Flush() // forces chunked encoding
+		w.Write([]byte("def"))   // nolint: errcheck
+	})
+	for _, path := range []string{"/pipeline/?size=1000", "/pipeline-chunked/", "/pipeline/{{.Seq}}"} {
+		opts := HTTPRunnerOptions{}
+		opts.URL = fmt.Sprintf("http://localhost:%d%s", addr.Port, path)
+		opts.QPS = -1
+		opts.NumThreads = 2
+		opts.Exactly = 10
+		opts.PipelineDepth = 4
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 || res.SocketCount != 2 {
+			t.Errorf("%s: expected 10 ok batches on 2 sockets, got %v %d", path, res.RetCodes, res.SocketCount)
+		}
+		if res.PipelineHistogram == nil || res.PipelineHistogram.Count != 40 || res.PipelineErrors != 0 {
+			t.Errorf("%s: expected 40 pipelined responses, got %+v, %d errors", path, res.PipelineHistogram, res.PipelineErrors)
+		}
+	}
+	// Server which only answers the first request of each connection:
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint: errcheck
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 4096)
+				conn.Read(buf)                                                       // nolint: errcheck
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")) // nolint: errcheck
+				conn.Close()                                                         // nolint: errcheck
+			}()
+		}
+	}()
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://%s/", listener.Addr())
+	opts.QPS = -1
+	opts.NumThreads = 1
+	opts.Exactly = 5
+	opts.PipelineDepth = 4
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// first batch fails after its first response, then one request at a time:
+	if res.PipelineErrors != 3 || res.PipelineHistogram.Count != 1 {
+		t.Errorf("expected 1 pipelined response and 3 errors, got %d, %d", res.PipelineHistogram.Count, res.PipelineErrors)
+	}
+	if res.RetCodes[SocketError] != 1 || res.RetCodes[http.StatusOK] != 4 {
+		t.Errorf("expected 1 socket error then 4 ok, got %v", res.RetCodes)
+	}
+}
+
+func TestHTTPRunnerMeasureThroughput(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	chunk := bytes.Repeat([]byte("0123456789"), 100)
+	mux.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ { // 10000 bytes in 10 chunks, over ~45ms
+			if i > 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			w.Write(chunk) // nolint: errcheck
+			w.(http.Flusher).Flush()
+		}
+	})
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.URL = fmt.Sprintf("http://localhost:%d/stream/", addr.Port)
+		opts.DisableFastClient = std
+		opts.QPS = -1
+		opts.NumThreads = 1
+		opts.Exactly = 4
+		opts.MeasureThroughput = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttfb, rate := res.TTFBHistogram, res.ThroughputHistogram
+		if ttfb == nil || ttfb.Count != 4 || rate == nil || rate.Count != 4 {
+			t.Fatalf("std %v: expected 4 ttfb and throughput values, got %+v %+v", std, ttfb, rate)
+		}
+		if ttfb.Max > 0.03 {
+			t.Errorf("std %v: unexpected time to first byte %g for the first chunk sent right away", std, ttfb.Max)
+		}
+		// at most 0.01MB in 45ms, i.e. 0.22MB/s (plus the chunks framing)
+		if rate.Min <= 0.05 || rate.Max > 0.23 {
+			t.Errorf("std %v: unexpected throughput min %g max %g MB/s", std, rate.Min, rate.Max)
+		}
+	}
+	// Not set:
+	opts := HTTPRunnerOptions{}
+	opts.URL = fmt.Sprintf("http://localhost:%d/stream/", addr.Port)
+	opts.Exactly = 2
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TTFBHistogram != nil || res.ThroughputHistogram != nil {
+		t.Errorf("expected no throughput histograms without MeasureThroughput, got %+v %+v", res.TTFBHistogram, res.ThroughputHistogram)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fnet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+
+	"istio.io/fortio/log"
+)
+
+// DefaultPayloadDelimiter separates the payloads of a corpus file by default:
+// one per line.
+const DefaultPayloadDelimiter = "\n"
+
+// PayloadCorpus is the list of payloads (request bodies) read from a corpus
+// file, to send a different one for each request.
+type PayloadCorpus struct {
+	Payloads [][]byte
+	next     int64 // round robin position, shared by all the threads
+}
+
+// ReadPayloadCorpus reads the payloads of file, separated by delimiter
+// (DefaultPayloadDelimiter when empty). Empty payloads (e.g. after the last
+// new line) are skipped. Returns an error if the file can't be read or has
+// no payload.
+func ReadPayloadCorpus(file, delimiter string) (*PayloadCorpus, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if delimiter == "" {
+		delimiter = DefaultPayloadDelimiter
+	}
+	c := PayloadCorpus{}
+	for _, p := range bytes.Split(data, []byte(delimiter)) {
+		if len(p) > 0 {
+			c.Payloads = append(c.Payloads, p)
+		}
+	}
+	if len(c.Payloads) == 0 {
+		return nil, fmt.Errorf("no payload in corpus file %s", file)
+	}
+	log.Infof("Read %d payloads corpus (%d bytes) from %s", len(c.Payloads), len(data), file)
+	return &c, nil
+}
+
+// Next returns the payload for the next request: picked with rng when not
+// nil, else the next one in turn across all the callers (round robin).
+func (c *PayloadCorpus) Next(rng *rand.Rand) []byte {
+	if rng != nil {
+		return c.Payloads[rng.Intn(len(c.Payloads))]
+	}
+	n := atomic.AddInt64(&c.next, 1) - 1
+	return c.Payloads[n%int64(len(c.Payloads))]
+}
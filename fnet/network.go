@@ -15,13 +15,21 @@
 package fnet // import "istio.io/fortio/fnet"
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"istio.io/fortio/log"
+	"istio.io/fortio/stats"
 	"istio.io/fortio/version"
 )
 
@@ -69,6 +77,12 @@ func ResolveDestination(dest string) *net.TCPAddr {
 // Resolve returns the TCP address of the host,port suitable for net.Dial.
 // nil in case of errors.
 func Resolve(host string, port string) *net.TCPAddr {
+	return ResolveFamily(host, port, AutoFamily)
+}
+
+// ResolveFamily is Resolve restricted to the addresses of the family.
+// nil in case of errors, including when host has no address of the family.
+func ResolveFamily(host string, port string, family AddressFamily) *net.TCPAddr {
 	dest := &net.TCPAddr{}
 	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
 		log.Debugf("host %s looks like an IPv6, stripping []", host)
@@ -77,6 +91,10 @@ func Resolve(host string, port string) *net.TCPAddr {
 	isAddr := net.ParseIP(host)
 	var err error
 	if isAddr != nil {
+		if !family.matches(isAddr) {
+			log.Errf("Address %s isn't an %s address", host, family)
+			return nil
+		}
 		log.Debugf("Host already an IP, will go to %s", isAddr)
 		dest.IP = isAddr
 	} else {
@@ -86,11 +104,20 @@ func Resolve(host string, port string) *net.TCPAddr {
 			log.Errf("Unable to lookup '%s' : %v", host, err)
 			return nil
 		}
+		for _, a := range addrs {
+			if family.matches(a) {
+				dest.IP = a
+				break
+			}
+		}
+		if dest.IP == nil {
+			log.Errf("No %s address for '%s' : %v", family, host, addrs)
+			return nil
+		}
 		if len(addrs) > 1 && log.LogDebug() {
-			log.Debugf("Using only the first of the addresses for %s : %v", host, addrs)
+			log.Debugf("Using only the first (%s) of the addresses for %s : %v", family, host, addrs)
 		}
-		log.Debugf("Will go to %s", addrs[0])
-		dest.IP = addrs[0]
+		log.Debugf("Will go to %s", dest.IP)
 	}
 	dest.Port, err = net.LookupPort("tcp", port)
 	if err != nil {
@@ -100,6 +127,57 @@ func Resolve(host string, port string) *net.TCPAddr {
 	return dest
 }
 
+// AddressFamily restricts the IP version of the addresses the destinations
+// are resolved to and connected to, e.g. to isolate path issues of dual
+// stack endpoints.
+type AddressFamily string
+
+// AddressFamily values, the empty one is the same as AutoFamily.
+const (
+	// AutoFamily is any of the addresses, IPv4 or IPv6.
+	AutoFamily AddressFamily = "auto"
+	// IPv4 only.
+	IPv4 AddressFamily = "ipv4"
+	// IPv6 only.
+	IPv6 AddressFamily = "ipv6"
+)
+
+// Check returns an error if f isn't one of the AddressFamily values.
+func (f AddressFamily) Check() error {
+	switch f {
+	case "", AutoFamily, IPv4, IPv6:
+		return nil
+	}
+	return fmt.Errorf("invalid address family %q, should be one of %s, %s or %s", string(f), AutoFamily, IPv4, IPv6)
+}
+
+// Network returns the network to dial for the family: "tcp4" or "tcp6"
+// instead of "tcp" when restricted to IPv4 or IPv6. Other networks (e.g.
+// "unix") are returned unchanged.
+func (f AddressFamily) Network(network string) string {
+	if network != "tcp" {
+		return network
+	}
+	switch f {
+	case IPv4:
+		return "tcp4"
+	case IPv6:
+		return "tcp6"
+	}
+	return network
+}
+
+// matches returns whether ip is of the family.
+func (f AddressFamily) matches(ip net.IP) bool {
+	switch f {
+	case IPv4:
+		return ip.To4() != nil
+	case IPv6:
+		return ip.To4() == nil
+	}
+	return true
+}
+
 func transfer(wg *sync.WaitGroup, dst *net.TCPConn, src *net.TCPConn) {
 	n, oErr := io.Copy(dst, src) // keep original error for logs below
 	log.LogVf("Proxy: transferred %d bytes from %v to %v (err=%v)", n, src.RemoteAddr(), dst.RemoteAddr(), oErr)
@@ -160,3 +238,241 @@ func Proxy(port string, dest *net.TCPAddr) *net.TCPAddr {
 func ProxyToDestination(listenPort string, destination string) *net.TCPAddr {
 	return Proxy(listenPort, ResolveDestination(destination))
 }
+
+// TLSOptions are the TLS protocol restrictions of the (grpc and http) clients,
+// e.g. to check a server's behavior with only TLS 1.3 or some cipher suites.
+type TLSOptions struct {
+	// Minimum and maximum TLS versions (e.g. tls.VersionTLS13) to negotiate.
+	// Default (0) is the go default.
+	MinTLSVersion uint16
+	MaxTLSVersion uint16
+	// Cipher suites allowed, default (nil) is the go default. Like in go's
+	// tls.Config they don't apply to TLS 1.3 which has its own fixed ones.
+	CipherSuites []uint16
+	// TLSSessionCache shares a client session cache between the connections
+	// so their handshakes can resume the TLS session of a previous one.
+	// Default is a full handshake for each new connection.
+	TLSSessionCache bool
+	sessionCache    tls.ClientSessionCache
+}
+
+// IsSet returns whether any of the TLS options is set.
+func (t *TLSOptions) IsSet() bool {
+	return t.MinTLSVersion != 0 || t.MaxTLSVersion != 0 || len(t.CipherSuites) > 0 || t.TLSSessionCache
+}
+
+// InitSessionCache creates, when TLSSessionCache is set, the session cache
+// shared by the configs of the next Apply() calls, including on the copies
+// of t made afterwards. Apply() calls it if needed.
+func (t *TLSOptions) InitSessionCache() {
+	if t.TLSSessionCache && t.sessionCache == nil {
+		t.sessionCache = tls.NewLRUClientSessionCache(0)
+	}
+}
+
+// Apply sets the options on cfg, creating it if nil, and returns it.
+func (t *TLSOptions) Apply(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{} // nolint: gas
+	}
+	if t.MinTLSVersion != 0 {
+		cfg.MinVersion = t.MinTLSVersion
+	}
+	if t.MaxTLSVersion != 0 {
+		cfg.MaxVersion = t.MaxTLSVersion
+	}
+	if len(t.CipherSuites) > 0 {
+		cfg.CipherSuites = t.CipherSuites
+	}
+	if t.TLSSessionCache {
+		t.InitSessionCache()
+		cfg.ClientSessionCache = t.sessionCache
+	}
+	return cfg
+}
+
+// ErrorClass is the category of the error of a failed call, to tell apart
+// the network, timeout and application failures.
+type ErrorClass string
+
+// Error classes, see ClassifyError.
+const (
+	// TimeoutError is for calls not completed in time (deadline, i/o timeout).
+	TimeoutError ErrorClass = "timeout"
+	// ConnectionRefusedError is for connections refused by the destination.
+	ConnectionRefusedError ErrorClass = "connection refused"
+	// ConnectionResetError is for connections reset or closed mid call.
+	ConnectionResetError ErrorClass = "connection reset"
+	// TLSError is for TLS handshake and certificate errors.
+	TLSError ErrorClass = "tls"
+	// DNSError is for name resolution errors.
+	DNSError ErrorClass = "dns"
+	// NetworkError is for the other network errors.
+	NetworkError ErrorClass = "network"
+	// ApplicationError is for errors returned by the server (e.g. http 5xx).
+	ApplicationError ErrorClass = "application"
+	// OtherError is for the errors which couldn't be classified.
+	OtherError ErrorClass = "other"
+)
+
+// ClassifyError returns the class of a (network, net/http, tls...) error. The
+// errors which aren't of a known type are classified from their message.
+func ClassifyError(err error) ErrorClass {
+	network := false // seen a network error wrapper
+	for err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return TimeoutError
+		}
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			network = true
+			err = e.Err
+		case *os.SyscallError:
+			network = true
+			err = e.Err
+		case *net.DNSError:
+			return DNSError
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED:
+				return ConnectionRefusedError
+			case syscall.ECONNRESET, syscall.EPIPE:
+				return ConnectionResetError
+			}
+			return NetworkError
+		case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return TLSError
+		default:
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ConnectionResetError
+			}
+			if c := classifyMessage(err.Error()); c != OtherError || !network {
+				return c
+			}
+			return NetworkError
+		}
+	}
+	return OtherError
+}
+
+// classifyMessage returns the class of an error from its message.
+func classifyMessage(msg string) ErrorClass {
+	msg = strings.ToLower(msg)
+	for _, m := range []struct {
+		substrings []string
+		class      ErrorClass
+	}{
+		{[]string{"deadline exceeded", "timeout", "timed out"}, TimeoutError},
+		{[]string{"connection refused"}, ConnectionRefusedError},
+		{[]string{"connection reset", "broken pipe", "eof"}, ConnectionResetError},
+		{[]string{"tls", "x509", "certificate", "handshake"}, TLSError},
+		{[]string{"no such host", "lookup "}, DNSError},
+	} {
+		for _, s := range m.substrings {
+			if strings.Contains(msg, s) {
+				return m.class
+			}
+		}
+	}
+	return OtherError
+}
+
+// PhaseTimings are the durations of the phases of the calls, recorded when
+// the runners' PhaseTimings option is set, to break down the cost of the
+// new connections.
+type PhaseTimings struct {
+	Connect      *stats.Histogram // TCP connect of the new connections
+	TLSHandshake *stats.Histogram // TLS handshake of the new connections
+	FirstByte    *stats.Histogram // from the start of each call to its first response byte
+}
+
+// NewPhaseTimings returns empty PhaseTimings recording at the resolution
+// (in seconds).
+func NewPhaseTimings(resolution float64) *PhaseTimings {
+	return &PhaseTimings{
+		Connect:      stats.NewHistogram(0, resolution),
+		TLSHandshake: stats.NewHistogram(0, resolution),
+		FirstByte:    stats.NewHistogram(0, resolution),
+	}
+}
+
+// Clone returns an empty copy of the PhaseTimings (same resolution).
+func (p *PhaseTimings) Clone() *PhaseTimings {
+	return NewPhaseTimings(p.Connect.Divider)
+}
+
+// Transfer moves the timings of src into p.
+func (p *PhaseTimings) Transfer(src *PhaseTimings) {
+	p.Connect.Transfer(src.Connect)
+	p.TLSHandshake.Transfer(src.TLSHandshake)
+	p.FirstByte.Transfer(src.FirstByte)
+}
+
+// Print prints the (non empty) phases' histograms.
+func (p *PhaseTimings) Print(out io.Writer, percentiles []float64) {
+	for _, h := range []struct {
+		name string
+		h    *stats.Histogram
+	}{
+		{"TCP connect", p.Connect},
+		{"TLS handshake", p.TLSHandshake},
+		{"First byte", p.FirstByte},
+	} {
+		if h.h.Count > 0 {
+			h.h.Print(out, h.name+" time", percentiles)
+		}
+	}
+}
+
+// SourceAddresses are the local addresses to bind the outgoing connections
+// to, used one after the other (round robin) for each new connection.
+type SourceAddresses struct {
+	addrs []*net.TCPAddr
+	next  uint32
+}
+
+// NewSourceAddresses checks that the (IP) addresses are valid and assigned
+// to this host, and returns their rotation. Returns nil (the default source
+// address) for an empty list.
+func NewSourceAddresses(addrs []string) (*SourceAddresses, error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	s := &SourceAddresses{}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q", a)
+		}
+		addr := &net.TCPAddr{IP: ip}
+		l, err := net.ListenTCP("tcp", addr) // fails if not a local address
+		if err != nil {
+			return nil, fmt.Errorf("unusable source address %s: %v", a, err)
+		}
+		l.Close() // nolint: errcheck
+		s.addrs = append(s.addrs, addr)
+	}
+	log.Infof("Using source addresses %v", addrs)
+	return s, nil
+}
+
+// Next returns the local address for the next connection, nil if s is nil.
+func (s *SourceAddresses) Next() *net.TCPAddr {
+	if s == nil {
+		return nil
+	}
+	n := atomic.AddUint32(&s.next, 1) - 1
+	return s.addrs[n%uint32(len(s.addrs))]
+}
+
+// Dialer returns a dialer with the timeout, bound to the next local address
+// (if s isn't nil).
+func (s *SourceAddresses) Dialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if s != nil {
+		d.LocalAddr = s.Next()
+	}
+	return d
+}
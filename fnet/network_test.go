@@ -15,10 +15,17 @@
 package fnet
 
 import (
+	"crypto/x509"
+	"errors"
+	"io"
 	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"istio.io/fortio/log"
 	"istio.io/fortio/version"
@@ -174,3 +181,112 @@ func TestResolveIpV6(t *testing.T) {
 func init() {
 	log.SetLogLevel(log.Debug)
 }
+
+func TestClassifyError(t *testing.T) {
+	// real errors: connection refused and read timeout
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)) // nolint: errcheck
+	_, timeoutErr := conn.Read(make([]byte, 1))
+	conn.Close() // nolint: errcheck
+	l.Close()    // nolint: errcheck
+	_, refusedErr := net.Dial("tcp", addr)
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{timeoutErr, TimeoutError},
+		{refusedErr, ConnectionRefusedError},
+		{&url.Error{Op: "Get", URL: "http://" + addr, Err: refusedErr}, ConnectionRefusedError},
+		{&url.Error{Op: "Get", URL: "http://" + addr, Err: timeoutErr}, TimeoutError},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, ConnectionResetError},
+		{&net.OpError{Op: "read", Err: errors.New("something odd")}, NetworkError},
+		{&net.DNSError{Err: "no such host", Name: "foo.invalid"}, DNSError},
+		{io.EOF, ConnectionResetError},
+		{x509.UnknownAuthorityError{}, TLSError},
+		{errors.New("rpc error: code = Unavailable desc = connection refused"), ConnectionRefusedError},
+		{errors.New("transport: authentication handshake failed: x509: certificate signed by unknown authority"), TLSError},
+		{errors.New("context deadline exceeded"), TimeoutError},
+		{errors.New("something else"), OtherError},
+		{nil, OtherError},
+	}
+	for _, tst := range tests {
+		if c := ClassifyError(tst.err); c != tst.expected {
+			t.Errorf("ClassifyError(%#v: %v) = %q, expected %q", tst.err, tst.err, c, tst.expected)
+		}
+	}
+}
+
+func TestSourceAddresses(t *testing.T) {
+	s, err := NewSourceAddresses(nil)
+	if s != nil || err != nil {
+		t.Errorf("Expected nil source addresses without error for an empty list, got %v %v", s, err)
+	}
+	if a := s.Next(); a != nil {
+		t.Errorf("Expected no local address from nil source addresses, got %v", a)
+	}
+	for _, bad := range []string{"", "localhost", "127.0.0.1:8080", "192.0.2.1"} {
+		if _, err = NewSourceAddresses([]string{"127.0.0.1", bad}); err == nil {
+			t.Errorf("Expected an error for source address %q", bad)
+		}
+	}
+	s, err = NewSourceAddresses([]string{"127.0.0.1", "127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"} {
+		if a := s.Dialer(time.Second).LocalAddr.String(); a != expected+":0" {
+			t.Errorf("Source address %d is %s, expected %s", i, a, expected)
+		}
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	for _, f := range []AddressFamily{"", AutoFamily, IPv4, IPv6} {
+		if err := f.Check(); err != nil {
+			t.Errorf("Unexpected error for %q: %v", f, err)
+		}
+	}
+	if err := AddressFamily("ipv5").Check(); err == nil {
+		t.Errorf("Expected error for an invalid address family")
+	}
+	networks := map[AddressFamily]string{"": "tcp", AutoFamily: "tcp", IPv4: "tcp4", IPv6: "tcp6"}
+	for f, expected := range networks {
+		if n := f.Network("tcp"); n != expected {
+			t.Errorf("Network of %q is %s, expected %s", f, n, expected)
+		}
+		if n := f.Network("unix"); n != "unix" {
+			t.Errorf("Network of %q shouldn't change unix, got %s", f, n)
+		}
+	}
+	tests := []struct {
+		host   string
+		family AddressFamily
+		want   string
+	}{
+		{"127.0.0.1", AutoFamily, "127.0.0.1:80"},
+		{"127.0.0.1", IPv4, "127.0.0.1:80"},
+		{"127.0.0.1", IPv6, ""},
+		{"[::1]", IPv6, "[::1]:80"},
+		{"::1", "", "[::1]:80"},
+		{"[::1]", IPv4, ""},
+		{"localhost", IPv4, "127.0.0.1:80"},
+	}
+	for _, tt := range tests {
+		got := ResolveFamily(tt.host, "80", tt.family)
+		gotStr := ""
+		if got != nil {
+			gotStr = got.String()
+		}
+		if gotStr != tt.want {
+			t.Errorf("ResolveFamily(%s, %s) = %v, want %s", tt.host, tt.family, got, tt.want)
+		}
+	}
+}
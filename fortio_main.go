@@ -27,6 +27,7 @@ import (
 	"time"
 
 	"istio.io/fortio/bincommon"
+	"istio.io/fortio/dnsrunner"
 	"istio.io/fortio/fnet"
 
 	"istio.io/fortio/fgrpc"
@@ -34,8 +35,11 @@ import (
 	"istio.io/fortio/log"
 	"istio.io/fortio/periodic"
 	"istio.io/fortio/stats"
+	"istio.io/fortio/tcprunner"
+	"istio.io/fortio/udprunner"
 	"istio.io/fortio/ui"
 	"istio.io/fortio/version"
+	"istio.io/fortio/wsrunner"
 )
 
 // -- Support for multiple proxies (-P) flags on cmd line:
@@ -55,13 +59,15 @@ func (f *proxiesFlagList) Set(value string) error {
 // Prints usage
 func usage(msgs ...interface{}) {
 	// nolint: gas
-	fmt.Fprintf(os.Stderr, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n",
+	fmt.Fprintf(os.Stderr, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n%s\n%s\n",
 		version.Short(),
 		os.Args[0],
 		"where command is one of: load (load testing), server (starts grpc ping and",
 		"http echo/ui/redirect/proxy servers), grpcping (grpc client), report (report only UI",
 		"server), redirect (redirect only server), or curl (single URL debug).",
-		"where target is a url (http load tests) or host:port (grpc health test).")
+		"where target is a url (http load tests), tcp:// or udp://host:port (tcp, udp load tests),",
+		"ws:// or wss://host/path (websocket echo load tests),",
+		"dns://[resolver]/name[?type=AAAA] (dns lookups) or host:port (grpc health test).")
 	bincommon.FlagsUsage(msgs...)
 }
 
@@ -108,11 +114,13 @@ var (
 
 	allowInitialErrorsFlag = flag.Bool("allow-initial-errors", false, "Allow and don't abort on initial warmup errors")
 	abortOnFlag            = flag.Int("abort-on", 0, "Http code that if encountered aborts the run. e.g. 503 or -1 for socket errors.")
+	maxP99Flag             = flag.Duration("max-p99", 0, "Maximum p99 duration, exit with an error if exceeded (default 0 is no check)")
 	autoSaveFlag           = flag.Bool("a", false, "Automatically save JSON result with filename based on labels & timestamp")
 	redirectFlag           = flag.String("redirect-port", "8081", "Redirect all incoming traffic to https URL"+
 		" (need ingress to work properly). Can be in the form of host:port, ip:port, port or \""+disabled+"\" to disable the feature.")
 	exactlyFlag = flag.Int64("n", 0,
 		"Run for exactly this number of calls instead of duration. Default (0) is to use duration (-t). "+
+			"When -t is also explicitly set, stops at whichever limit is reached first. "+
 			"Default is 1 when used as grpc ping count.")
 	syncFlag         = flag.String("sync", "", "index.tsv or s3/gcs bucket xml URL to fetch at startup for server modes.")
 	syncIntervalFlag = flag.Duration("sync-interval", 0, "Refresh the url every given interval (default, no refresh)")
@@ -236,6 +244,9 @@ func fortioLoad(justCurl bool, percList []float64) {
 	fmt.Fprintf(out, "Fortio %s running at %g queries per second, %d->%d procs",
 		version.Short(), qps, prevGoMaxProcs, runtime.GOMAXPROCS(0))
 	if *exactlyFlag > 0 {
+		if !isFlagSet("t") {
+			*durationFlag = 0 // no time limit unless -t is also passed
+		}
 		fmt.Fprintf(out, ", for %d calls: %s\n", *exactlyFlag, url)
 	} else {
 		if *durationFlag <= 0 {
@@ -253,7 +264,8 @@ func fortioLoad(justCurl bool, percList []float64) {
 	if labels == "" {
 		hname, _ := os.Hostname()
 		shortURL := url
-		for _, p := range []string{"https://", "http://"} {
+		for _, p := range []string{"https://", "http://", tcprunner.TCPURLPrefix, udprunner.UDPURLPrefix, dnsrunner.DNSURLPrefix,
+			wsrunner.WSURLPrefix, wsrunner.WSSURLPrefix} {
 			if strings.HasPrefix(url, p) {
 				shortURL = url[len(p):]
 				break
@@ -272,6 +284,9 @@ func fortioLoad(justCurl bool, percList []float64) {
 		Labels:      labels,
 		Exactly:     *exactlyFlag,
 	}
+	if *maxP99Flag > 0 {
+		ro.PercentileThresholds = map[float64]time.Duration{99: *maxP99Flag}
+	}
 	var res periodic.HasRunnerResult
 	var err error
 	if *grpcFlag {
@@ -287,6 +302,49 @@ func fortioLoad(justCurl bool, percList []float64) {
 			UsePing:            *doPingLoadFlag,
 		}
 		res, err = fgrpc.RunGRPCTest(&o)
+	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
+		o := tcprunner.TCPRunnerOptions{
+			RunnerOptions: ro,
+			TCPOptions: tcprunner.TCPOptions{
+				Destination: url,
+				Payload:     []byte(*payloadFlag),
+				ReqTimeout:  httpOpts.HTTPReqTimeOut,
+			},
+			AllowInitialErrors: *allowInitialErrorsFlag,
+		}
+		res, err = tcprunner.RunTCPTest(&o)
+	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
+		o := udprunner.UDPRunnerOptions{
+			RunnerOptions: ro,
+			UDPOptions: udprunner.UDPOptions{
+				Destination: url,
+				Payload:     []byte(*payloadFlag),
+				ReqTimeout:  httpOpts.HTTPReqTimeOut,
+			},
+			AllowInitialErrors: *allowInitialErrorsFlag,
+		}
+		res, err = udprunner.RunUDPTest(&o)
+	} else if strings.HasPrefix(url, wsrunner.WSURLPrefix) || strings.HasPrefix(url, wsrunner.WSSURLPrefix) {
+		o := wsrunner.WSRunnerOptions{
+			RunnerOptions: ro,
+			WSOptions: wsrunner.WSOptions{
+				URL:        url,
+				Message:    []byte(*payloadFlag),
+				ReqTimeout: httpOpts.HTTPReqTimeOut,
+				Insecure:   httpOpts.Insecure,
+			},
+			AllowInitialErrors: *allowInitialErrorsFlag,
+		}
+		res, err = wsrunner.RunWSTest(&o)
+	} else if strings.HasPrefix(url, dnsrunner.DNSURLPrefix) {
+		o := dnsrunner.DNSRunnerOptions{
+			RunnerOptions:      ro,
+			AllowInitialErrors: *allowInitialErrorsFlag,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		if err = o.ParseDNSURL(url); err == nil {
+			res, err = dnsrunner.RunDNSTest(&o)
+		}
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpOpts,
@@ -343,6 +401,10 @@ func fortioLoad(justCurl bool, percList []float64) {
 		}
 		fmt.Fprintf(out, "Successfully wrote %d bytes of Json data to %s\n", n, jsonFileName)
 	}
+	if !rr.SLOMet {
+		fmt.Fprintf(out, "Exiting with error because the p99 exceeded %v\n", *maxP99Flag)
+		os.Exit(1)
+	}
 }
 
 func grpcClient() {
@@ -366,3 +428,14 @@ func grpcClient() {
 		os.Exit(1)
 	}
 }
+
+// isFlagSet returns true if the flag of that name was passed on the command line.
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
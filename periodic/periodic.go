@@ -23,12 +23,26 @@
 package periodic // import "istio.io/fortio/periodic"
 
 import (
+	"bufio"
+	"container/heap"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"istio.io/fortio/log"
@@ -48,6 +62,26 @@ var DefaultRunnerOptions = RunnerOptions{
 	Resolution:  0.001, // milliseconds
 }
 
+// Distribution of the calls start times in QPS mode.
+type Distribution int
+
+const (
+	// Uniform is the default: calls are evenly spaced at the target QPS.
+	Uniform Distribution = iota
+	// Exponential spacing (Poisson arrivals) averaging to the target QPS.
+	Exponential
+)
+
+func (d Distribution) String() string {
+	switch d {
+	case Uniform:
+		return "uniform"
+	case Exponential:
+		return "exponential"
+	}
+	return fmt.Sprintf("Distribution(%d)", int(d))
+}
+
 // Runnable are the function to run periodically.
 type Runnable interface {
 	Run(tid int)
@@ -105,6 +139,9 @@ type RunnerOptions struct {
 	// Array of objects to run in each thread (use MakeRunners() to clone the same one)
 	Runners []Runnable
 	// At which (target) rate to run the Runners across NumThreads.
+	// Negative (-1) is the closed loop / max qps mode: each thread makes the
+	// next call as soon as the previous one completes. The achieved rate is
+	// in the results' ActualQPS for all modes.
 	QPS float64
 	// How long to run the test for. Unless Exactly is specified.
 	Duration time.Duration
@@ -114,18 +151,183 @@ type RunnerOptions struct {
 	NumThreads  int
 	Percentiles []float64
 	Resolution  float64
+	// Choose the Resolution of the duration histograms from the durations of
+	// the first calls (see resolution.go), instead of using the one set. The
+	// data of those calls is re-recorded in the chosen layout and Options()'s
+	// Resolution updated to it at the end of the run.
+	AutoResolution bool
 	// Where to write the textual version of the results, defaults to stdout
 	Out io.Writer
 	// Extra data to be copied back to the results (to be saved/JSON serialized)
 	Labels string
+	// Key/value labels (e.g. git sha, environment, build number) copied to
+	// the results' Annotations, and added to the samples of their Prometheus
+	// export (the names must then be valid Prometheus label names).
+	Annotations map[string]string
+	// Unique identifier of the run, copied to the results' RunID, e.g. to
+	// correlate them with logs or traces. Default (empty) is a random UUID
+	// (or the one of the Resume() checkpoint).
+	RunID string
 	// Aborter to interrupt a run. Will be created if not set/left nil. Or you
 	// can pass your own. It is very important this is a pointer and not a field
 	// as RunnerOptions themselves get copied while the channel and lock must
 	// stay unique (per run).
 	Stop *Aborter
 	// Mode where an exact number of iterations is requested. Default (0) is
-	// to not use that mode. If specified Duration is not used.
+	// to not use that mode. If a Duration is also specified the run stops
+	// at whichever limit is reached first (see the results' StopReason).
 	Exactly int64
+	// Optional ramp up: the target QPS increases linearly from RampUpStartQPS
+	// to QPS during the first RampUpDuration of the run (QPS mode only).
+	RampUpDuration time.Duration
+	RampUpStartQPS float64
+	// Whether to leave the calls made during the ramp up out of the
+	// DurationHistogram (they are then only reported as a counter).
+	ExcludeRampUp bool
+	// Optional warmup: the first WarmupRequests calls of the run (over all
+	// the threads) and the ones started during its first WarmupDuration are
+	// left out of the DurationHistogram (and the other per call histograms),
+	// e.g. to not skew the percentiles with the connections setup. They are
+	// reported separately in the results' WarmupHistogram.
+	WarmupRequests int64
+	WarmupDuration time.Duration
+	// Optional context: canceling it stops the run (like Abort()) and the
+	// partial results are returned. Combines with Duration/Exactly limits.
+	RunContext context.Context
+	// Optional maximum duration for percentiles (e.g. 99: 100*time.Millisecond).
+	// The percentiles are added to Percentiles and the results' SLOMet is
+	// false if any exceeds its threshold.
+	PercentileThresholds map[float64]time.Duration
+	// Maximum fraction (e.g. 0.1 for 10%) of the calls which can fail: when
+	// the results' ErrorCount over the number of calls exceeds it, the
+	// runners return an *ErrorRateError along with the results (e.g. to fail
+	// a CI pipeline). Default (0) is no check.
+	MaxErrorRate float64
+	// Number of slowest calls to capture in the results' SlowestSamples.
+	// Default (0) is to not capture any (no overhead).
+	CaptureSlowest int
+	// Whether to also record the function durations by status code (as
+	// returned by the Runnables implementing CallRecorder) in the results'
+	// RetCodeHistograms.
+	PerRetCodeHistograms bool
+	// Optional callback called every ProgressInterval (default 1s) during
+	// the run, from a separate go routine, with a snapshot of the results so far.
+	ProgressCallback func(PartialResult)
+	ProgressInterval time.Duration
+	// Optional sliding window regression detection, for long (soak) runs:
+	// every WindowDuration (default 10s) the p99 of the window's calls is
+	// compared to the baseline, the average p99 of the previous
+	// DegradationBaselineWindows (default 5) windows, and the
+	// DegradationCallback called, from a separate go routine, when it
+	// exceeds DegradationFactor (default 1.5) times the baseline.
+	WindowDuration             time.Duration
+	DegradationFactor          float64
+	DegradationBaselineWindows int
+	DegradationCallback        func(DegradationEvent)
+	// Whether to record, in the results' JitterHistogram, how late each call
+	// started compared to its scheduled start time (QPS mode only).
+	RecordJitter bool
+	// Whether to also record, in the results' CorrectedDurationHistogram,
+	// the durations corrected for coordinated omission (QPS mode only): a
+	// call taking longer than the interval between the thread's scheduled
+	// calls delays the next ones, whose durations, as if they had been made
+	// on schedule, are backfilled.
+	CorrectCoordinatedOmission bool
+	// Distribution of the calls around the target QPS (QPS mode only).
+	Distribution Distribution
+	// Seed of all the random behaviors of the run (the Exponential
+	// distribution spacing and, through SubSeed, the runners' own ones like
+	// the URL mix choices or the templates' uuids), for reproducible runs.
+	// Default (0) is to seed from the current time. The seed used is in the
+	// results.
+	Seed int64
+	// Optional writer for 1 JSON line (RequestRecord) per call. The lines are
+	// written (buffered) from a separate go routine, and flushed at the end
+	// of the run, so the calls don't wait on it.
+	PerRequestOutput io.Writer
+	// Optional StatsD (udp host:port) to send, for each call, its duration
+	// (StatsDPrefix.duration timing) and code (StatsDPrefix.code.<code>
+	// counter) to. Like for PerRequestOutput the metrics are sent from a
+	// separate go routine and dropped if it can't keep up.
+	StatsDAddress string
+	StatsDPrefix  string // defaults to DefaultStatsDPrefix
+	// Maximum number of calls in flight across all the threads, like a
+	// client with a bounded connection pool: when reached, the threads wait
+	// for one of the calls to complete before making theirs (counted in the
+	// results' BackpressureEvents). Default (0) is no limit besides NumThreads.
+	MaxInFlight int
+	// Experimental: pin each thread's OS thread to a distinct CPU (of the ones
+	// the process is allowed to run on, round robin when there are more threads
+	// than CPUs) for lower jitter benchmarking. Linux only, no-op elsewhere.
+	PinThreads bool
+	// Optional connection ramp: the threads (and thus their connections) start
+	// one after the other, evenly spaced over the ConnectionRampDuration, instead
+	// of all at once (max qps mode only).
+	ConnectionRampDuration time.Duration
+	// Checkpoint to continue from, set by Resume().
+	resume *Checkpoint
+}
+
+// Checkpoint is the (JSON serializable) state of a stopped run, to be
+// continued later using RunnerOptions.Resume().
+type Checkpoint struct {
+	QPS        float64
+	Duration   time.Duration
+	Exactly    int64
+	Resolution float64
+	StartTime  time.Time
+	Elapsed    time.Duration // so far, across all the resumed runs
+	Count      int64         // calls made so far (including excluded ramp up calls)
+	// Function duration of the calls so far.
+	DurationHistogram *stats.Histogram
+	RunID             string
+}
+
+// Resume sets the run to continue from the checkpoint: only the remaining
+// calls (or duration) are made and the results include the checkpointed
+// ones. Returns an error if the checkpoint doesn't match these options
+// (qps, limits and resolution) or has nothing left to run.
+func (r *RunnerOptions) Resume(cp *Checkpoint) error {
+	if cp == nil || cp.DurationHistogram == nil {
+		return errors.New("invalid checkpoint without histogram")
+	}
+	o := *r // check against the normalized values without modifying r
+	o.Runners = []Runnable{}
+	o.Stop = &Aborter{} // not nil to not start a watcher
+	o.Normalize()
+	if cp.QPS != o.QPS || cp.Duration != o.Duration || cp.Exactly != o.Exactly {
+		return fmt.Errorf("checkpoint of qps %g duration %v exactly %d doesn't match options qps %g duration %v exactly %d",
+			cp.QPS, cp.Duration, cp.Exactly, o.QPS, o.Duration, o.Exactly)
+	}
+	h := cp.DurationHistogram
+	if cp.Resolution != o.Resolution || h.Divider != o.Resolution || h.Offset != 0 ||
+		len(h.Hdata) != len(stats.NewHistogram(0, o.Resolution).Hdata) {
+		return fmt.Errorf("checkpoint resolution %g (histogram offset %g divider %g) doesn't match %g",
+			cp.Resolution, h.Offset, h.Divider, o.Resolution)
+	}
+	if (o.Exactly > 0 && cp.Count >= o.Exactly) || (o.Duration > 0 && cp.Elapsed >= o.Duration) {
+		return fmt.Errorf("checkpoint after %d calls in %v has nothing left to run", cp.Count, cp.Elapsed)
+	}
+	r.resume = cp
+	return nil
+}
+
+// PartialResult is the snapshot of a run in progress passed to the
+// ProgressCallback.
+type PartialResult struct {
+	Elapsed           time.Duration
+	Count             int64
+	ActualQPS         float64
+	DurationHistogram *stats.HistogramData
+	// Number of threads started so far (see ConnectionRampDuration)
+	ActiveThreads int
+}
+
+// ConnectionRampStep is the start of one more thread during the
+// ConnectionRampDuration.
+type ConnectionRampStep struct {
+	Elapsed       time.Duration // since the start of the run
+	ActiveThreads int
 }
 
 // RunnerResults encapsulates the actual QPS observed and duration histogram.
@@ -141,6 +343,272 @@ type RunnerResults struct {
 	Version           string
 	DurationHistogram *stats.HistogramData
 	Exactly           int64 // Echo back the requested count
+	SLOMet            bool  // false if a PercentileThresholds was exceeded
+	// Slowest calls, longest first (only when CaptureSlowest is set)
+	SlowestSamples []RequestRecord `json:",omitempty"`
+	// Delay between the scheduled and actual start of the calls, in seconds
+	// (only when RecordJitter is set)
+	JitterHistogram *stats.HistogramData `json:",omitempty"`
+	// Which limit ended the run: StopExactly, StopDuration or StopInterrupted
+	StopReason string
+	// Numerical version of RequestedQPS (-1 for max) and ActualQPS over it
+	// (0 in max qps mode).
+	TargetQPS float64
+	QPSRatio  float64
+	// Whether the calls consistently started late compared to the schedule,
+	// i.e. the client (or the target) couldn't keep up with the QPS.
+	FellBehind bool
+	// Number of calls which failed (e.g. not a 200 http code), set by the
+	// runners which know their RetCodes.
+	ErrorCount int64
+	// Number of calls which had to wait for another one to complete because
+	// MaxInFlight calls were already in flight.
+	BackpressureEvents int64
+	// Copy of the options' Annotations
+	Annotations map[string]string `json:",omitempty"`
+	// Copy of the options' RunID (or the generated one)
+	RunID string
+	// Wall clock time the run ended. Same as StartTime + ActualDuration
+	// except for resumed runs, where ActualDuration excludes the time
+	// between the runs.
+	EndTime time.Time
+	// Function duration including the calls delayed by slower ones (only
+	// when CorrectCoordinatedOmission is set).
+	CorrectedDurationHistogram *stats.HistogramData `json:",omitempty"`
+	// Function duration by status code (only when PerRetCodeHistograms is
+	// set and the Runnables implement CallRecorder), of the same calls as the
+	// DurationHistogram except the ones of a resumed Checkpoint.
+	RetCodeHistograms map[int]*stats.HistogramData `json:",omitempty"`
+	// Number of active threads (connections) over time, one step per thread
+	// start (only when ConnectionRampDuration is set).
+	ConnectionRamp []ConnectionRampStep `json:",omitempty"`
+	// Seed of the random behaviors (RunnerOptions.Seed), to reproduce the run.
+	Seed int64
+	// Function duration of the warmup calls, excluded from the
+	// DurationHistogram (only when WarmupRequests or WarmupDuration is set).
+	WarmupHistogram *stats.HistogramData `json:",omitempty"`
+}
+
+// StopReason values.
+const (
+	// StopExactly is when the Exactly number of calls was made.
+	StopExactly = "exactly"
+	// StopDuration is when the Duration elapsed.
+	StopDuration = "duration"
+	// StopInterrupted is when the run was aborted (or its RunContext done).
+	StopInterrupted = "interrupted"
+)
+
+// RequestRecord is the information captured about 1 call (for the
+// slowest ones when CaptureSlowest is set).
+type RequestRecord struct {
+	Duration  time.Duration
+	StartTime time.Time
+	ThreadID  int
+	Code      int    // status of the call, when the Runnable is a CallRecorder
+	Target    string // e.g. URL or destination, when the Runnable is a CallRecorder
+}
+
+// Exemplars returns the SlowestSamples as (OpenMetrics) stats.Exemplar of
+// the DurationHistogram, labeled with their thread and code.
+func (r *RunnerResults) Exemplars() []stats.Exemplar {
+	res := make([]stats.Exemplar, len(r.SlowestSamples))
+	for i, rec := range r.SlowestSamples {
+		res[i] = stats.Exemplar{
+			Value:     rec.Duration.Seconds(),
+			Labels:    map[string]string{"thread": strconv.Itoa(rec.ThreadID), "code": strconv.Itoa(rec.Code)},
+			Timestamp: rec.StartTime.Add(rec.Duration),
+		}
+	}
+	return res
+}
+
+// WritePrometheus writes the DurationHistogram and the optional count per
+// result code (e.g. the runner's RetCodes) in the Prometheus text format,
+// with the Annotations as labels (see stats.WritePrometheusWithLabels).
+func (r *RunnerResults) WritePrometheus(w io.Writer, codes map[string]int64, prefix string) error {
+	return stats.WritePrometheusWithLabels(w, r.DurationHistogram, codes, prefix, r.Annotations)
+}
+
+// WriteOpenMetrics is WritePrometheus in the OpenMetrics text format, with
+// the SlowestSamples as exemplars when exemplars is true.
+func (r *RunnerResults) WriteOpenMetrics(w io.Writer, codes map[string]int64, prefix string, exemplars bool) error {
+	return stats.WriteOpenMetricsWithLabels(w, r.DurationHistogram, codes, prefix, r.Annotations, exemplars, r.Exemplars())
+}
+
+// WriteInfluxLine writes the results as one InfluxDB line protocol point of
+// the measurement (see stats.WriteInfluxLine), at the EndTime, with the qps,
+// error_rate (ErrorCount over the number of calls) and duration (seconds)
+// fields, and the Labels (as "labels") and Annotations as tags.
+func (r *RunnerResults) WriteInfluxLine(w io.Writer, measurement string) error {
+	tags := map[string]string{"labels": r.Labels}
+	for k, v := range r.Annotations {
+		tags[k] = v
+	}
+	errorRate := 0.
+	if r.DurationHistogram.Count > 0 {
+		errorRate = float64(r.ErrorCount) / float64(r.DurationHistogram.Count)
+	}
+	fields := map[string]float64{
+		"qps":        r.ActualQPS,
+		"error_rate": errorRate,
+		"duration":   r.ActualDuration.Seconds(),
+	}
+	return stats.WriteInfluxLine(w, measurement, r.DurationHistogram, tags, fields, r.EndTime)
+}
+
+// CallRecorder is optionally implemented by Runnables to provide the status
+// code and target of the last call made by Run() (for RequestRecord).
+type CallRecorder interface {
+	LastCall() (code int, target string)
+}
+
+// WaitReporter is optionally implemented by Runnables which can wait, inside
+// Run(), before making their call (e.g. to respect a per target rate limit):
+// that wait of the last Run() is excluded from its recorded duration.
+type WaitReporter interface {
+	LastWait() time.Duration
+}
+
+// slowestRecords keeps the k slowest RequestRecord as a min heap on Duration.
+type slowestRecords struct {
+	k       int
+	records []RequestRecord
+}
+
+func (s *slowestRecords) Len() int           { return len(s.records) }
+func (s *slowestRecords) Less(i, j int) bool { return s.records[i].Duration < s.records[j].Duration }
+func (s *slowestRecords) Swap(i, j int)      { s.records[i], s.records[j] = s.records[j], s.records[i] }
+
+// Push and Pop are for container/heap, use add() instead.
+func (s *slowestRecords) Push(x interface{}) { s.records = append(s.records, x.(RequestRecord)) }
+func (s *slowestRecords) Pop() interface{} {
+	n := len(s.records) - 1
+	x := s.records[n]
+	s.records = s.records[:n]
+	return x
+}
+
+// isSlower returns true if d should be captured.
+func (s *slowestRecords) isSlower(d time.Duration) bool {
+	return len(s.records) < s.k || d > s.records[0].Duration
+}
+
+// add captures rec, evicting the fastest one when already full.
+func (s *slowestRecords) add(rec RequestRecord) {
+	if len(s.records) < s.k {
+		heap.Push(s, rec)
+		return
+	}
+	s.records[0] = rec
+	heap.Fix(s, 0)
+}
+
+// sorted returns the records, slowest first.
+func (s *slowestRecords) sorted() []RequestRecord {
+	res := make([]RequestRecord, len(s.records))
+	copy(res, s.records)
+	sort.Slice(res, func(i, j int) bool { return res[i].Duration > res[j].Duration })
+	return res
+}
+
+// DefaultStatsDPrefix is the default prefix of the StatsD metric names.
+const DefaultStatsDPrefix = "fortio"
+
+// recordQueueSize is how many RequestRecord can be pending in a recordQueue
+// before the next ones are dropped.
+const recordQueueSize = 16384
+
+// recordQueue passes the RequestRecord of each call to its consume function
+// from its own go routine, so the calls don't wait on it (e.g. on the
+// PerRequestOutput writer).
+type recordQueue struct {
+	name    string // for the dropped records warning
+	records chan RequestRecord
+	done    chan struct{}
+	dropped int64
+}
+
+// newRecordQueue starts the go routine calling consume for each record and
+// then finish once closed.
+func newRecordQueue(name string, consume func(RequestRecord), finish func()) *recordQueue {
+	q := &recordQueue{name: name, records: make(chan RequestRecord, recordQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(q.done)
+		for rec := range q.records {
+			consume(rec)
+		}
+		finish()
+	}()
+	return q
+}
+
+// add queues rec without blocking: it is dropped if the consumer is too far behind.
+func (q *recordQueue) add(rec RequestRecord) {
+	select {
+	case q.records <- rec:
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+	}
+}
+
+// close waits for the pending records to be consumed and returns how many
+// were dropped.
+func (q *recordQueue) close() int64 {
+	close(q.records)
+	<-q.done
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// newRequestWriter returns the queue writing the records as JSON lines to w,
+// flushed at the end.
+func newRequestWriter(w io.Writer) *recordQueue {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var err error
+	return newRecordQueue("per request output", func(rec RequestRecord) {
+		if err == nil {
+			err = enc.Encode(rec)
+		}
+	}, func() {
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			log.Errf("Error writing the per request output: %v", err)
+		}
+	})
+}
+
+// newStatsDEmitter returns the queue sending, for each record, a prefix.duration
+// timing (in milliseconds) and a prefix.code.<code> counter increment in 1
+// StatsD udp packet to address.
+func newStatsDEmitter(address, prefix string) (*recordQueue, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	var sendErrors int64
+	return newRecordQueue("statsd", func(rec RequestRecord) {
+		buf = append(buf[:0], prefix...)
+		buf = append(buf, ".duration:"...)
+		buf = strconv.AppendFloat(buf, rec.Duration.Seconds()*1000., 'f', -1, 64)
+		buf = append(buf, "|ms\n"...)
+		buf = append(buf, prefix...)
+		buf = append(buf, ".code."...)
+		buf = strconv.AppendInt(buf, int64(rec.Code), 10)
+		buf = append(buf, ":1|c"...)
+		if _, err := conn.Write(buf); err != nil {
+			sendErrors++
+			log.LogVf("Error sending statsd metrics to %s: %v", address, err)
+		}
+	}, func() {
+		if sendErrors > 0 {
+			log.Warnf("%d errors sending statsd metrics to %s", sendErrors, address)
+		}
+		conn.Close() // nolint: errcheck,gas
+	}), nil
 }
 
 // HasRunnerResult is the interface implictly implemented by HTTPRunnerResults
@@ -163,11 +631,31 @@ type PeriodicRunner interface { // nolint: golint
 	// Returns the options normalized by constructor - do not mutate
 	// (where is const when you need it...)
 	Options() *RunnerOptions
+	// Returns the state at the end of the last Run() (e.g. after Abort()),
+	// to continue it later. Nil before Run().
+	Checkpoint() *Checkpoint
 }
 
 // Unexposed implementation details for PeriodicRunner.
 type periodicRunner struct {
 	RunnerOptions
+	checkpoint *Checkpoint
+	queues     []*recordQueue // for the PerRequestOutput and StatsD, during Run()
+	// slots of the MaxInFlight calls, nil when not limiting, during Run()
+	inFlight     chan struct{}
+	backpressure int64 // atomic count of waits for an inFlight slot
+	pinCPUs      []int // CPUs to pin the threads to, nil when not pinning, during Run()
+	// started threads and when, during Run()
+	rampLock      sync.Mutex
+	activeThreads int
+	rampSteps     []ConnectionRampStep
+	sampler       *resolutionSampler // AutoResolution's, during Run()
+	// per thread histograms of the current window, when detecting degradations
+	windows []*stats.Histogram
+	// per thread histograms of the warmup calls and count of the calls
+	// (atomic, up to WarmupRequests), when warming up, during Run()
+	warmups     []*stats.Histogram
+	warmupCalls int64
 }
 
 var (
@@ -200,15 +688,70 @@ func (r *RunnerOptions) Normalize() {
 		r.Percentiles = make([]float64, len(DefaultRunnerOptions.Percentiles))
 		copy(r.Percentiles, DefaultRunnerOptions.Percentiles)
 	}
+	for _, p := range sortedPercentiles(r.PercentileThresholds) {
+		if !hasPercentile(r.Percentiles, p) {
+			r.Percentiles = append(r.Percentiles, p)
+		}
+	}
 	if r.Resolution <= 0 {
 		r.Resolution = DefaultRunnerOptions.Resolution
 	}
-	if r.Duration == 0 {
+	if r.Duration == 0 && r.Exactly <= 0 {
 		r.Duration = DefaultRunnerOptions.Duration
 	}
 	if r.Runners == nil {
 		r.Runners = make([]Runnable, r.NumThreads)
 	}
+	if r.ProgressCallback != nil && r.ProgressInterval <= 0 {
+		r.ProgressInterval = 1 * time.Second
+	}
+	if r.DegradationCallback != nil {
+		if r.WindowDuration <= 0 {
+			r.WindowDuration = DefaultWindowDuration
+		}
+		if r.DegradationFactor <= 0 {
+			r.DegradationFactor = DefaultDegradationFactor
+		}
+		if r.DegradationBaselineWindows <= 0 {
+			r.DegradationBaselineWindows = DefaultDegradationBaselineWindows
+		}
+	}
+	if r.RampUpDuration < 0 {
+		r.RampUpDuration = 0
+	}
+	if r.WarmupRequests < 0 {
+		r.WarmupRequests = 0
+	}
+	if r.WarmupDuration < 0 {
+		r.WarmupDuration = 0
+	}
+	if r.RampUpDuration > 0 && r.QPS <= 0 {
+		log.Warnf("Ramp up %v is ignored in max qps mode", r.RampUpDuration)
+		r.RampUpDuration = 0
+	}
+	if r.ConnectionRampDuration < 0 {
+		r.ConnectionRampDuration = 0
+	}
+	if r.ConnectionRampDuration > 0 && r.QPS > 0 {
+		log.Warnf("Connection ramp %v is ignored in qps mode", r.ConnectionRampDuration)
+		r.ConnectionRampDuration = 0
+	}
+	if r.Distribution != Uniform && r.QPS <= 0 {
+		log.Warnf("%v distribution is ignored in max qps mode", r.Distribution)
+		r.Distribution = Uniform
+	}
+	if r.Seed == 0 {
+		r.Seed = time.Now().UnixNano()
+	}
+	if r.RampUpStartQPS < 0 {
+		r.RampUpStartQPS = 0
+	}
+	if r.MaxInFlight < 0 {
+		r.MaxInFlight = 0
+	}
+	if r.RampUpStartQPS > r.QPS && r.QPS > 0 {
+		r.RampUpStartQPS = r.QPS
+	}
 	if r.Stop == nil {
 		r.Stop = NewAborter()
 		runnerChan := r.Stop.StopChan // need a copy to not race with assignement to nil
@@ -268,7 +811,7 @@ func (r *RunnerOptions) Abort() {
 
 // internal version, returning the concrete implementation. logical std::move
 func newPeriodicRunner(opts *RunnerOptions) *periodicRunner {
-	r := &periodicRunner{*opts} // by default just copy the input params
+	r := &periodicRunner{RunnerOptions: *opts} // by default just copy the input params
 	opts.ReleaseRunners()
 	opts.Stop = nil
 	r.Normalize()
@@ -288,15 +831,49 @@ func (r *periodicRunner) Options() *RunnerOptions {
 	return &r.RunnerOptions // sort of returning this here
 }
 
+// Checkpoint returns the state of the last run.
+func (r *periodicRunner) Checkpoint() *Checkpoint {
+	return r.checkpoint
+}
+
 // Run starts the runner.
 func (r *periodicRunner) Run() RunnerResults {
 	r.Stop.Lock()
 	runnerChan := r.Stop.StopChan // need a copy to not race with assignement to nil
 	r.Stop.Unlock()
+	if r.RunContext != nil {
+		go func(ctx context.Context) {
+			select {
+			case <-ctx.Done():
+				log.LogVf("RUNNER context done (%v), aborting", ctx.Err())
+				r.Abort()
+			case <-runnerChan:
+				// run ended (or aborted) first, nothing to do
+			}
+		}(r.RunContext)
+	}
+	runID := r.RunID
+	if runID == "" && r.resume != nil {
+		runID = r.resume.RunID
+	}
+	if runID == "" {
+		runID = newRunID()
+	}
+	exactly, duration := r.Exactly, r.Duration
+	if r.resume != nil {
+		// Only run what is left, the original limits are restored at the end
+		if r.Exactly > 0 {
+			r.Exactly -= r.resume.Count
+		}
+		if r.Duration > 0 {
+			r.Duration -= r.resume.Elapsed
+		}
+		log.Infof("Resuming run after %d calls in %v: exactly %d duration %v left", r.resume.Count, r.resume.Elapsed, r.Exactly, r.Duration)
+	}
 	useQPS := (r.QPS > 0)
 	// r.Duration will be 0 if endless flag has been provided. Otherwise it will have the provided duration time.
 	hasDuration := (r.Duration > 0)
-	// r.Exactly is > 0 if we use Exactly iterations instead of the duration.
+	// r.Exactly is > 0 if we use Exactly iterations (also capped by the duration if set).
 	useExactly := (r.Exactly > 0)
 	var numCalls int64
 	var leftOver int64 // left over from r.Exactly / numThreads
@@ -306,10 +883,10 @@ func (r *periodicRunner) Run() RunnerResults {
 		requestedQPS = fmt.Sprintf("%.9g", r.QPS)
 		if hasDuration || useExactly {
 			requestedDuration = fmt.Sprint(r.Duration)
-			numCalls = int64(r.QPS * r.Duration.Seconds())
+			numCalls = int64(r.rampCalls(r.Duration.Seconds(), r.QPS, r.RampUpStartQPS))
 			if useExactly {
 				numCalls = r.Exactly
-				requestedDuration = fmt.Sprintf("exactly %d calls", numCalls)
+				requestedDuration = exactlyDuration(r.Exactly, r.Duration)
 			}
 			if numCalls < 2 {
 				log.Warnf("Increasing the number of calls to the minimum of 2 with 1 thread. total duration will increase")
@@ -357,7 +934,7 @@ func (r *periodicRunner) Run() RunnerResults {
 					r.NumThreads, runtime.GOMAXPROCS(0))
 			}
 			if useExactly {
-				requestedDuration = fmt.Sprintf("exactly %d calls", r.Exactly)
+				requestedDuration = exactlyDuration(r.Exactly, r.Duration)
 				numCalls = r.Exactly / int64(r.NumThreads)
 				leftOver = r.Exactly % int64(r.NumThreads)
 				if log.Log(log.Warning) {
@@ -373,6 +950,14 @@ func (r *periodicRunner) Run() RunnerResults {
 			}
 		}
 	}
+	if r.Distribution == Exponential && log.Log(log.Warning) {
+		// nolint: gas
+		fmt.Fprintf(r.Out, "Using exponential distribution of the calls (seed %d)\n", r.Seed)
+	}
+	if useQPS && r.RampUpDuration > 0 && log.Log(log.Warning) {
+		// nolint: gas
+		fmt.Fprintf(r.Out, "Ramping up from %g to %g qps over %v\n", r.RampUpStartQPS, r.QPS, r.RampUpDuration)
+	}
 	runnersLen := len(r.Runners)
 	if runnersLen == 0 {
 		log.Fatalf("Empty runners array !")
@@ -386,47 +971,232 @@ func (r *periodicRunner) Run() RunnerResults {
 	functionDuration := stats.NewHistogram(0, r.Resolution)
 	// Histogram and stats for Sleep time (negative offset to capture <0 sleep in their own bucket):
 	sleepTime := stats.NewHistogram(-0.001, 0.001)
+	// Function duration of the ramp up calls when excluded from functionDuration
+	rampUpDuration := stats.NewHistogram(0, r.Resolution)
+	// Function duration of the warmup calls, and per thread ones, when warming up
+	var warmup *stats.Histogram
+	r.warmups, r.warmupCalls = nil, 0
+	if r.WarmupRequests > 0 || r.WarmupDuration > 0 {
+		warmup = stats.NewHistogram(0, r.Resolution)
+		for t := 0; t < r.NumThreads; t++ {
+			r.warmups = append(r.warmups, warmup.Clone())
+		}
+	}
+	// Histogram of the call start delays (scheduling jitter) - 100us precision
+	var jitter *stats.Histogram
+	if r.RecordJitter && useQPS {
+		jitter = stats.NewHistogram(0, 0.0001)
+	}
+	// Function duration with the coordinated omission correction
+	var corrected *stats.Histogram
+	if r.CorrectCoordinatedOmission && useQPS {
+		corrected = stats.NewHistogram(0, r.Resolution)
+	}
+	// Function duration by status code
+	var codeTimes map[int]*stats.Histogram
+	if r.PerRetCodeHistograms {
+		codeTimes = make(map[int]*stats.Histogram)
+	}
+	var slowest *slowestRecords
+	if r.CaptureSlowest > 0 {
+		slowest = &slowestRecords{k: r.CaptureSlowest}
+	}
+	if r.PerRequestOutput != nil {
+		r.queues = append(r.queues, newRequestWriter(r.PerRequestOutput))
+	}
+	if r.StatsDAddress != "" {
+		prefix := r.StatsDPrefix
+		if prefix == "" {
+			prefix = DefaultStatsDPrefix
+		}
+		if q, err := newStatsDEmitter(r.StatsDAddress, prefix); err != nil {
+			log.Errf("Unable to emit statsd metrics to %s: %v", r.StatsDAddress, err)
+		} else {
+			r.queues = append(r.queues, q)
+		}
+	}
+	r.inFlight, r.backpressure = nil, 0
+	r.activeThreads, r.rampSteps = 0, nil
+	if r.ConnectionRampDuration > 0 && r.NumThreads > 1 && log.Log(log.Warning) {
+		fmt.Fprintf(r.Out, "Ramping up %d connections over %v\n", r.NumThreads, r.ConnectionRampDuration) // nolint: gas
+	}
+	if r.MaxInFlight > 0 && r.MaxInFlight < r.NumThreads {
+		if log.Log(log.Warning) {
+			fmt.Fprintf(r.Out, "Limiting to %d calls in flight\n", r.MaxInFlight) // nolint: gas
+		}
+		r.inFlight = make(chan struct{}, r.MaxInFlight)
+	}
+	r.sampler = nil
+	if r.AutoResolution {
+		r.sampler = &resolutionSampler{fallback: r.Resolution}
+	}
+	r.pinCPUs = nil
+	if r.PinThreads {
+		cpus, err := allowedCPUs()
+		if err != nil {
+			log.Errf("Unable to get the cpu affinity, not pinning threads: %v", err)
+		} else if cpus == nil {
+			log.Warnf("PinThreads is only supported on linux, not pinning threads")
+		} else {
+			log.Infof("Pinning %d threads to %d cpus", r.NumThreads, len(cpus))
+			r.pinCPUs = cpus
+		}
+	}
+	// Locks for the function duration (and window) histograms, only when
+	// reporting progress or detecting degradations
+	var locks []sync.Mutex
+	if r.ProgressCallback != nil || r.DegradationCallback != nil {
+		locks = make([]sync.Mutex, r.NumThreads)
+	}
+	r.windows = nil
+	if r.DegradationCallback != nil {
+		for t := 0; t < r.NumThreads; t++ {
+			r.windows = append(r.windows, stats.NewHistogram(0, r.Resolution))
+		}
+	}
+	stopWindows := r.startWindows(start, locks)
 	if r.NumThreads <= 1 {
 		log.LogVf("Running single threaded")
-		runOne(0, runnerChan, functionDuration, sleepTime, numCalls+leftOver, start, r)
+		stopProgress := r.startProgress(start, []*stats.Histogram{functionDuration}, locks)
+		runOne(0, runnerChan, functionDuration, sleepTime, rampUpDuration, jitter, corrected, codeTimes, slowest,
+			threadLock(locks, 0), numCalls+leftOver, start, r)
+		stopProgress()
+		stopWindows()
 	} else {
 		var wg sync.WaitGroup
 		var fDs []*stats.Histogram
 		var sDs []*stats.Histogram
+		var rDs []*stats.Histogram
+		var jDs []*stats.Histogram
+		var cDs []*stats.Histogram
+		var codeDs []map[int]*stats.Histogram
+		var slowestP []*slowestRecords
 		for t := 0; t < r.NumThreads; t++ {
 			durP := functionDuration.Clone()
 			sleepP := sleepTime.Clone()
+			rampP := rampUpDuration.Clone()
 			fDs = append(fDs, durP)
 			sDs = append(sDs, sleepP)
+			rDs = append(rDs, rampP)
+			var jitterP *stats.Histogram
+			if jitter != nil {
+				jitterP = jitter.Clone()
+				jDs = append(jDs, jitterP)
+			}
+			var correctedP *stats.Histogram
+			if corrected != nil {
+				correctedP = corrected.Clone()
+				cDs = append(cDs, correctedP)
+			}
+			var codeP map[int]*stats.Histogram
+			if codeTimes != nil {
+				codeP = make(map[int]*stats.Histogram)
+				codeDs = append(codeDs, codeP)
+			}
+			var slowP *slowestRecords
+			if slowest != nil {
+				slowP = &slowestRecords{k: slowest.k}
+				slowestP = append(slowestP, slowP)
+			}
 			wg.Add(1)
 			thisNumCalls := numCalls
 			if (leftOver > 0) && (t == 0) {
 				// The first thread gets to do the additional work
 				thisNumCalls += leftOver
 			}
-			go func(t int, durP *stats.Histogram, sleepP *stats.Histogram) {
-				runOne(t, runnerChan, durP, sleepP, thisNumCalls, start, r)
+			go func(t int, durP *stats.Histogram, sleepP *stats.Histogram, rampP *stats.Histogram, jitterP *stats.Histogram,
+				correctedP *stats.Histogram, codeP map[int]*stats.Histogram, slowP *slowestRecords) {
+				runOne(t, runnerChan, durP, sleepP, rampP, jitterP, correctedP, codeP, slowP, threadLock(locks, t), thisNumCalls, start, r)
 				wg.Done()
-			}(t, durP, sleepP)
+			}(t, durP, sleepP, rampP, jitterP, correctedP, codeP, slowP)
 		}
+		stopProgress := r.startProgress(start, fDs, locks)
 		wg.Wait()
+		stopProgress()
+		stopWindows()
+		if r.sampler != nil {
+			// so the aggregates are in the chosen layout and each bucket only moved once
+			res := r.finishSampling()
+			rebucket(functionDuration, res)
+			rebucket(corrected, res)
+			for _, codeP := range codeDs {
+				for _, h := range codeP {
+					rebucket(h, res)
+				}
+			}
+		}
 		for t := 0; t < r.NumThreads; t++ {
 			functionDuration.Transfer(fDs[t])
 			sleepTime.Transfer(sDs[t])
+			rampUpDuration.Transfer(rDs[t])
+		}
+		for _, jitterP := range jDs {
+			jitter.Transfer(jitterP)
+		}
+		for _, correctedP := range cDs {
+			corrected.Transfer(correctedP)
+		}
+		for _, codeP := range codeDs {
+			for k, h := range codeP {
+				if codeTimes[k] == nil {
+					codeTimes[k] = h
+					continue
+				}
+				codeTimes[k].Transfer(h)
+			}
+		}
+		for _, slowP := range slowestP {
+			for _, rec := range slowP.records {
+				if slowest.isSlower(rec.Duration) {
+					slowest.add(rec)
+				}
+			}
+		}
+	}
+	for _, w := range r.warmups {
+		warmup.Transfer(w)
+	}
+	r.warmups = nil
+	if r.sampler != nil {
+		res := r.finishSampling()
+		rebucket(functionDuration, res)
+		rebucket(corrected, res)
+		rebucket(warmup, res)
+		for _, h := range codeTimes {
+			rebucket(h, res)
 		}
 	}
 	elapsed := time.Since(start)
-	actualQPS := float64(functionDuration.Count) / elapsed.Seconds()
+	end := start.Add(elapsed)
+	for _, q := range r.queues {
+		if dropped := q.close(); dropped > 0 {
+			fmt.Fprintf(r.Out, "WARNING %d %s records dropped (too slow)\n", dropped, q.name) // nolint: gas
+		}
+	}
+	r.queues = nil
+	totalCount := functionDuration.Count + rampUpDuration.Count
+	if warmup != nil {
+		totalCount += warmup.Count
+	}
+	actualQPS := float64(totalCount) / elapsed.Seconds()
 	if log.Log(log.Warning) {
 		// nolint: gas
-		fmt.Fprintf(r.Out, "Ended after %v : %d calls. qps=%.5g\n", elapsed, functionDuration.Count, actualQPS)
+		fmt.Fprintf(r.Out, "Ended after %v : %d calls. qps=%.5g\n", elapsed, totalCount, actualQPS)
+	}
+	if rampUpDuration.Count > 0 {
+		rampUpDuration.Counter.Print(r.Out, "Excluded Ramp Up Function Time")
 	}
+	if warmup != nil && warmup.Count > 0 {
+		warmup.Counter.Print(r.Out, "Excluded Warmup Function Time")
+	}
+	fellBehind := false
 	if useQPS {
 		percentNegative := 100. * float64(sleepTime.Hdata[0]) / float64(sleepTime.Count)
 		// Somewhat arbitrary percentage of time the sleep was behind so we
 		// may want to know more about the distribution of sleep time and warn the
 		// user.
 		if percentNegative > 5 {
+			fellBehind = true
 			sleepTime.Print(r.Out, "Aggregated Sleep Time", []float64{50})
 			fmt.Fprintf(r.Out, "WARNING %.2f%% of sleep were falling behind\n", percentNegative) // nolint: gas
 		} else {
@@ -437,12 +1207,102 @@ func (r *periodicRunner) Run() RunnerResults {
 			}
 		}
 	}
-	actualCount := functionDuration.Count
+	if r.resume != nil {
+		requestedDuration += fmt.Sprintf(", resumed after %d calls", r.resume.Count)
+		totalCount += r.resume.Count
+		functionDuration.Transfer(r.resume.DurationHistogram.Clone())
+		start = r.resume.StartTime
+		elapsed += r.resume.Elapsed
+		actualQPS = float64(totalCount) / elapsed.Seconds()
+		r.Exactly, r.Duration = exactly, duration
+	}
+	r.checkpoint = &Checkpoint{
+		QPS:               r.QPS,
+		Duration:          r.Duration,
+		Exactly:           r.Exactly,
+		Resolution:        r.Resolution,
+		StartTime:         start,
+		Elapsed:           elapsed,
+		Count:             totalCount,
+		DurationHistogram: functionDuration.Clone(),
+		RunID:             runID,
+	}
+	actualCount := totalCount
 	if useExactly && actualCount != r.Exactly {
 		requestedDuration += fmt.Sprintf(", interrupted after %d", actualCount)
 	}
-	result := RunnerResults{r.RunType, r.Labels, start, requestedQPS, requestedDuration,
-		actualQPS, elapsed, r.NumThreads, version.Short(), functionDuration.Export().CalcPercentiles(r.Percentiles), r.Exactly}
+	result := RunnerResults{
+		RunType:            r.RunType,
+		Labels:             r.Labels,
+		StartTime:          start,
+		RequestedQPS:       requestedQPS,
+		RequestedDuration:  requestedDuration,
+		ActualQPS:          actualQPS,
+		ActualDuration:     elapsed,
+		NumThreads:         r.NumThreads,
+		Version:            version.Short(),
+		DurationHistogram:  functionDuration.Export().CalcPercentiles(r.Percentiles),
+		Exactly:            r.Exactly,
+		SLOMet:             true,
+		StopReason:         StopDuration,
+		TargetQPS:          r.QPS,
+		FellBehind:         fellBehind,
+		BackpressureEvents: atomic.LoadInt64(&r.backpressure),
+		RunID:              runID,
+		EndTime:            end,
+		ConnectionRamp:     r.rampSteps,
+		Seed:               r.Seed,
+	}
+	if len(r.Annotations) > 0 {
+		result.Annotations = make(map[string]string, len(r.Annotations))
+		for k, v := range r.Annotations {
+			result.Annotations[k] = v
+		}
+	}
+	r.inFlight = nil
+	if result.BackpressureEvents > 0 {
+		fmt.Fprintf(r.Out, "Backpressure: %d calls waited for one of the %d in flight\n", // nolint: gas
+			result.BackpressureEvents, r.MaxInFlight)
+	}
+	if useQPS {
+		result.QPSRatio = actualQPS / r.QPS
+	}
+	if useExactly && actualCount >= r.Exactly {
+		result.StopReason = StopExactly
+	}
+	result.SLOMet = CheckThresholds(result.DurationHistogram, r.PercentileThresholds, r.Out)
+	if slowest != nil {
+		result.SlowestSamples = slowest.sorted()
+	}
+	if warmup != nil {
+		result.WarmupHistogram = warmup.Export().CalcPercentiles(r.Percentiles)
+	}
+	if jitter != nil {
+		result.JitterHistogram = jitter.Export().CalcPercentiles(r.Percentiles)
+		if log.Log(log.Warning) {
+			result.JitterHistogram.Print(r.Out, "Aggregated Start Jitter")
+		}
+	}
+	if len(codeTimes) > 0 {
+		result.RetCodeHistograms = make(map[int]*stats.HistogramData, len(codeTimes))
+		codes := make([]int, 0, len(codeTimes))
+		for k, h := range codeTimes {
+			result.RetCodeHistograms[k] = h.Export().CalcPercentiles(r.Percentiles)
+			codes = append(codes, k)
+		}
+		sort.Ints(codes)
+		if log.LogVerbose() {
+			for _, k := range codes {
+				result.RetCodeHistograms[k].Print(r.Out, fmt.Sprintf("Code %d Function Time", k))
+			}
+		}
+	}
+	if corrected != nil {
+		result.CorrectedDurationHistogram = corrected.Export().CalcPercentiles(r.Percentiles)
+		if log.Log(log.Warning) {
+			result.CorrectedDurationHistogram.Print(r.Out, "Aggregated Corrected Function Time")
+		}
+	}
 	if log.Log(log.Warning) {
 		result.DurationHistogram.Print(r.Out, "Aggregated Function Time")
 	} else {
@@ -452,8 +1312,9 @@ func (r *periodicRunner) Run() RunnerResults {
 		}
 	}
 	select {
-	case <-runnerChan: // nothing
+	case <-runnerChan:
 		log.LogVf("RUNNER r.Stop already closed")
+		result.StopReason = StopInterrupted
 	default:
 		log.LogVf("RUNNER r.Stop not already closed, closing")
 		r.Abort()
@@ -461,26 +1322,155 @@ func (r *periodicRunner) Run() RunnerResults {
 	return result
 }
 
+// SubSeed returns the seed, derived from the Seed, of the random behavior
+// named subsystem (e.g. "mix") of thread id: each one thus gets its own
+// sequence, reproducible by using the same Seed.
+func (r *RunnerOptions) SubSeed(subsystem string, id int) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(subsystem)) // nolint: errcheck,gas
+	return (r.Seed ^ int64(h.Sum64())) + int64(id)
+}
+
+// newRunID returns a random (version 4) UUID.
+func newRunID() string {
+	var b [16]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		log.Errf("Unable to read random bytes for the run id: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// exactlyDuration returns the RequestedDuration for Exactly calls, with the
+// optional duration cap.
+func exactlyDuration(exactly int64, duration time.Duration) string {
+	if duration > 0 {
+		return fmt.Sprintf("exactly %d calls, max %v", exactly, duration)
+	}
+	return fmt.Sprintf("exactly %d calls", exactly)
+}
+
+// threadLock returns the lock for thread t or nil when not reporting progress
+// nor detecting degradations.
+func threadLock(locks []sync.Mutex, t int) *sync.Mutex {
+	if locks == nil {
+		return nil
+	}
+	return &locks[t]
+}
+
+// startProgress starts the go routine calling the ProgressCallback, if any,
+// every ProgressInterval with a snapshot of the threads' histograms. Returns
+// the function to call to stop it (once the threads are done).
+func (r *periodicRunner) startProgress(start time.Time, hists []*stats.Histogram, locks []sync.Mutex) func() {
+	if r.ProgressCallback == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(r.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			snapshot := stats.NewHistogram(0, r.Resolution)
+			for t, h := range hists {
+				locks[t].Lock()
+				c := h.Clone()
+				locks[t].Unlock()
+				snapshot.Transfer(c)
+			}
+			elapsed := time.Since(start)
+			r.rampLock.Lock()
+			active := r.activeThreads
+			r.rampLock.Unlock()
+			r.ProgressCallback(PartialResult{
+				Elapsed:           elapsed,
+				Count:             snapshot.Count,
+				ActualQPS:         float64(snapshot.Count) / elapsed.Seconds(),
+				DurationHistogram: snapshot.Export().CalcPercentiles(r.Percentiles),
+				ActiveThreads:     active,
+			})
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// isWarmup returns whether the call starting at fStart is one of the
+// WarmupRequests first ones or starts before the end of the WarmupDuration.
+func (r *periodicRunner) isWarmup(fStart, warmupEnd time.Time) bool {
+	// counting the calls only until there are enough
+	warm := r.WarmupRequests > 0 && atomic.LoadInt64(&r.warmupCalls) < r.WarmupRequests &&
+		atomic.AddInt64(&r.warmupCalls, 1) <= r.WarmupRequests
+	return warm || fStart.Before(warmupEnd)
+}
+
 // runOne runs in 1 go routine.
-func runOne(id int, runnerChan chan struct{},
-	funcTimes *stats.Histogram, sleepTimes *stats.Histogram, numCalls int64, start time.Time, r *periodicRunner) {
+func runOne(id int, runnerChan chan struct{}, funcTimes *stats.Histogram, sleepTimes *stats.Histogram,
+	rampTimes *stats.Histogram, jitterTimes *stats.Histogram, correctedTimes *stats.Histogram,
+	codeTimes map[int]*stats.Histogram, slowest *slowestRecords, lock *sync.Mutex, numCalls int64, start time.Time,
+	r *periodicRunner) {
 	var i int64
 	endTime := start.Add(r.Duration)
+	rampEndTime := start.Add(r.RampUpDuration)
+	warmupEndTime := start.Add(r.WarmupDuration)
 	tIDStr := fmt.Sprintf("T%03d", id)
 	perThreadQPS := r.QPS / float64(r.NumThreads)
+	perThreadStartQPS := r.RampUpStartQPS / float64(r.NumThreads)
 	useQPS := (perThreadQPS > 0)
 	hasDuration := (r.Duration > 0)
 	useExactly := (r.Exactly > 0)
 	f := r.Runners[id]
+	recorder, _ := f.(CallRecorder)
+	waiter, _ := f.(WaitReporter)
+	scheduledStart := start // of the next call, in QPS mode
+	// Position of the next call in the schedule: the call number for the
+	// Uniform distribution, sum of exponential random spacings otherwise.
+	var position float64
+	var rng *rand.Rand
+	if r.Distribution == Exponential {
+		rng = rand.New(rand.NewSource(r.Seed + int64(id))) // nolint: gas
+	}
+	if !r.startThread(id, runnerChan, start) {
+		log.LogVf("%s not started before the end of the run", tIDStr)
+		return
+	}
+	if r.pinCPUs != nil {
+		cpu := r.pinCPUs[id%len(r.pinCPUs)]
+		if unpin, err := pinThread(cpu, r.pinCPUs); err != nil {
+			log.Errf("[%d] Unable to pin to cpu %d: %v", id, cpu, err)
+		} else {
+			defer unpin()
+		}
+	}
 
 MainLoop:
 	for {
 		fStart := time.Now()
-		if !useExactly && (hasDuration && fStart.After(endTime)) {
+		if jitterTimes != nil {
+			jitterTimes.Record(fStart.Sub(scheduledStart).Seconds())
+		}
+		if hasDuration && fStart.After(endTime) {
 			if !useQPS {
 				// max speed test reached end:
 				break
 			}
+			if useExactly || rng != nil {
+				// duration cap reached before the Exactly count or the random
+				// spacings added up to more than the duration
+				log.LogVf("%s did %d out of %d calls before reaching %v", tIDStr, i, numCalls, r.Duration)
+				break
+			}
 			// QPS mode:
 			// Do least 2 iterations, and the last one before bailing because of time
 			if (i >= 2) && (i != numCalls-1) {
@@ -488,8 +1478,77 @@ MainLoop:
 				break
 			}
 		}
+		if r.inFlight != nil {
+			if !r.acquireInFlight(runnerChan) {
+				break
+			}
+			fStart = time.Now() // the wait isn't part of the call
+		}
+		warmup := r.warmups != nil && r.isWarmup(fStart, warmupEndTime)
 		f.Run(id)
-		funcTimes.Record(time.Since(fStart).Seconds())
+		fDuration := time.Since(fStart)
+		if r.inFlight != nil {
+			<-r.inFlight
+		}
+		if waiter != nil {
+			fDuration -= waiter.LastWait()
+		}
+		if r.sampler != nil {
+			if res := r.sampler.observe(fDuration.Seconds()); res > 0 && res != funcTimes.Divider {
+				if lock != nil {
+					lock.Lock()
+				}
+				rebucket(funcTimes, res)
+				if lock != nil {
+					lock.Unlock()
+				}
+				rebucket(correctedTimes, res)
+				for _, h := range codeTimes {
+					rebucket(h, res)
+				}
+			}
+		}
+		if r.ExcludeRampUp && fStart.Before(rampEndTime) {
+			rampTimes.Record(fDuration.Seconds())
+		} else if warmup {
+			r.warmups[id].Record(fDuration.Seconds())
+		} else {
+			if lock != nil {
+				lock.Lock()
+			}
+			funcTimes.Record(fDuration.Seconds())
+			if r.windows != nil {
+				r.windows[id].Record(fDuration.Seconds())
+			}
+			if lock != nil {
+				lock.Unlock()
+			}
+			if correctedTimes != nil {
+				correctedTimes.RecordCorrected(fDuration.Seconds(), 1/perThreadQPS)
+			}
+			if codeTimes != nil && recorder != nil {
+				code, _ := recorder.LastCall()
+				h := codeTimes[code]
+				if h == nil {
+					h = stats.NewHistogram(0, funcTimes.Divider) // the AutoResolution one if chosen
+					codeTimes[code] = h
+				}
+				h.Record(fDuration.Seconds())
+			}
+		}
+		captureSlowest := slowest != nil && slowest.isSlower(fDuration)
+		if captureSlowest || len(r.queues) > 0 {
+			rec := RequestRecord{Duration: fDuration, StartTime: fStart, ThreadID: id}
+			if recorder != nil {
+				rec.Code, rec.Target = recorder.LastCall()
+			}
+			if captureSlowest {
+				slowest.add(rec)
+			}
+			for _, q := range r.queues {
+				q.add(rec)
+			}
+		}
 		i++
 		// if using QPS / pre calc expected call # mode:
 		if useQPS {
@@ -497,19 +1556,36 @@ MainLoop:
 				break // expected exit for that mode
 			}
 			elapsed := time.Since(start)
+			if rng != nil {
+				position += rng.ExpFloat64() // mean of 1 call
+			} else {
+				position = float64(i)
+			}
 			var targetElapsedInSec float64
-			if hasDuration {
+			if hasDuration || useExactly {
 				// This next line is tricky - such as for 2s duration and 1qps there is 1
 				// sleep of 2s between the 2 calls and for 3qps in 1sec 2 sleep of 1/2s etc
-				targetElapsedInSec = (float64(i) + float64(i)/float64(numCalls-1)) / perThreadQPS
+				targetElapsedInSec = r.rampElapsed(position+position/float64(numCalls-1), perThreadQPS, perThreadStartQPS)
 			} else {
 				// Calculate the target elapsed when in endless execution
-				targetElapsedInSec = float64(i) / perThreadQPS
+				targetElapsedInSec = r.rampElapsed(position, perThreadQPS, perThreadStartQPS)
 			}
 			targetElapsedDuration := time.Duration(int64(targetElapsedInSec * 1e9))
+			if useExactly && hasDuration && targetElapsedDuration > r.Duration {
+				log.LogVf("%s next call would be after the %v cap, stopping at %d out of %d calls", tIDStr, r.Duration, i, numCalls)
+				break
+			}
 			sleepDuration := targetElapsedDuration - elapsed
+			scheduledStart = start.Add(targetElapsedDuration)
 			log.Debugf("%s target next dur %v - sleep %v", tIDStr, targetElapsedDuration, sleepDuration)
 			sleepTimes.Record(sleepDuration.Seconds())
+			// Check for abort first: when falling behind the sleep is already
+			// expired and select would otherwise pick randomly.
+			select {
+			case <-runnerChan:
+				break MainLoop
+			default:
+			}
 			select {
 			case <-runnerChan:
 				break MainLoop
@@ -541,6 +1617,135 @@ MainLoop:
 	}
 }
 
+// finishSampling returns the AutoResolution resolution, chosen now if the run
+// ended during the sampling phase, and updates the Resolution to it.
+func (r *periodicRunner) finishSampling() float64 {
+	res := r.sampler.finish()
+	if res <= 0 {
+		res = r.Resolution // no call
+	}
+	if res != r.Resolution && log.Log(log.Warning) {
+		// nolint: gas
+		fmt.Fprintf(r.Out, "Auto selected resolution %g for the sampled durations from %g to %g\n", res,
+			r.sampler.sampled.Min, r.sampler.sampled.Max)
+	}
+	r.Resolution = res
+	return res
+}
+
+// startThread waits, during the ConnectionRampDuration, for the start time of
+// thread id: the i-th of NumThreads starting at i/(NumThreads-1) of the ramp.
+// Returns false if the run was aborted or reached its Duration before that.
+func (r *periodicRunner) startThread(id int, runnerChan chan struct{}, start time.Time) bool {
+	if r.ConnectionRampDuration > 0 && id > 0 {
+		delay := time.Duration(int64(r.ConnectionRampDuration) * int64(id) / int64(r.NumThreads-1))
+		if r.Duration > 0 && delay >= r.Duration {
+			return false
+		}
+		select {
+		case <-runnerChan:
+			return false
+		case <-time.After(time.Until(start.Add(delay))):
+		}
+	}
+	r.rampLock.Lock()
+	r.activeThreads++
+	if r.ConnectionRampDuration > 0 {
+		r.rampSteps = append(r.rampSteps, ConnectionRampStep{time.Since(start), r.activeThreads})
+	}
+	r.rampLock.Unlock()
+	return true
+}
+
+// acquireInFlight takes one of the MaxInFlight slots, waiting (and counting
+// that backpressure) for a call to complete if they are all in use. Returns
+// false if the run was aborted while waiting.
+func (r *periodicRunner) acquireInFlight(runnerChan chan struct{}) bool {
+	select {
+	case r.inFlight <- struct{}{}:
+		return true
+	default:
+	}
+	atomic.AddInt64(&r.backpressure, 1)
+	select {
+	case r.inFlight <- struct{}{}:
+		return true
+	case <-runnerChan:
+		return false
+	}
+}
+
+// CheckThresholds returns true if none of the percentiles of h exceed their
+// threshold. Failures are reported to out (if not nil).
+func CheckThresholds(h *stats.HistogramData, thresholds map[float64]time.Duration, out io.Writer) bool {
+	ok := true
+	if h.Count == 0 {
+		return ok
+	}
+	for _, p := range sortedPercentiles(thresholds) {
+		v := h.CalcPercentile(p)
+		max := thresholds[p].Seconds()
+		if v > max {
+			ok = false
+			if out != nil {
+				fmt.Fprintf(out, "SLO not met: p%g %.6g > %.6g\n", p, v, max) // nolint: gas
+			}
+		}
+	}
+	return ok
+}
+
+// sortedPercentiles returns the percentiles (keys) of thresholds in order.
+func sortedPercentiles(thresholds map[float64]time.Duration) []float64 {
+	res := make([]float64, 0, len(thresholds))
+	for p := range thresholds {
+		res = append(res, p)
+	}
+	sort.Float64s(res)
+	return res
+}
+
+func hasPercentile(percentiles []float64, p float64) bool {
+	for _, v := range percentiles {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// rampCalls returns how many calls are expected in the first d seconds at
+// qps, taking the (linear from startQPS) ramp up into account.
+func (r *RunnerOptions) rampCalls(d, qps, startQPS float64) float64 {
+	ramp := r.RampUpDuration.Seconds()
+	if ramp <= 0 {
+		return qps * d
+	}
+	if d < ramp {
+		return startQPS*d + (qps-startQPS)*d*d/(2*ramp)
+	}
+	return (startQPS+qps)*ramp/2 + qps*(d-ramp)
+}
+
+// rampElapsed is the inverse of rampCalls: it returns the target elapsed
+// time in seconds for the n-th call.
+func (r *RunnerOptions) rampElapsed(n, qps, startQPS float64) float64 {
+	ramp := r.RampUpDuration.Seconds()
+	if ramp <= 0 {
+		return n / qps
+	}
+	rampCalls := (startQPS + qps) * ramp / 2
+	if n >= rampCalls {
+		return ramp + (n-rampCalls)/qps
+	}
+	a := (qps - startQPS) / (2 * ramp)
+	if a == 0 {
+		return n / qps
+	}
+	// solve a*t^2 + startQPS*t - n = 0
+	return (math.Sqrt(startQPS*startQPS+4*a*n) - startQPS) / (2 * a)
+}
+
 func formatDate(d *time.Time) string {
 	return fmt.Sprintf("%d-%02d-%02d-%02d%02d%02d", d.Year(), d.Month(), d.Day(),
 		d.Hour(), d.Minute(), d.Second())
@@ -575,3 +1780,275 @@ func (r *RunnerResults) ID() string {
 	}
 	return base
 }
+
+// LoadResults reads back the JSON of a saved result (e.g. by fortio's -json,
+// the runner specific fields are ignored), to Render it again.
+func LoadResults(r io.Reader) (*RunnerResults, error) {
+	var res RunnerResults
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.DurationHistogram == nil {
+		return nil, errors.New("invalid result without DurationHistogram")
+	}
+	return &res, nil
+}
+
+// Render writes the summary of the results to out, like at the end of the
+// run, with the percentiles recalculated when not nil (e.g. for a different
+// set than the run's). r itself is left unchanged.
+func (r *RunnerResults) Render(out io.Writer, percentiles []float64) {
+	fmt.Fprintf(out, "%s %s for %s at %s qps, %d thread(s)\n", r.RunType, r.StartTime.Format(time.RFC3339), // nolint: gas
+		r.RequestedDuration, r.RequestedQPS, r.NumThreads)
+	fmt.Fprintf(out, "Ended after %v : %d calls. qps=%.5g\n", r.ActualDuration, r.DurationHistogram.Count, r.ActualQPS) // nolint: gas
+	if r.RunID != "" {
+		fmt.Fprintf(out, "Run id %s\n", r.RunID) // nolint: gas
+	}
+	if r.ErrorCount > 0 && r.ErrorCount == r.DurationHistogram.Count {
+		fmt.Fprintf(out, "WARNING 0 successful calls, all %d failed\n", r.ErrorCount) // nolint: gas
+	}
+	if len(r.Annotations) > 0 {
+		keys := make([]string, 0, len(r.Annotations))
+		for k := range r.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			keys[i] = k + "=" + r.Annotations[k]
+		}
+		fmt.Fprintf(out, "Annotations: %s\n", strings.Join(keys, " ")) // nolint: gas
+	}
+	render := func(h *stats.HistogramData, msg string) {
+		c := *h
+		if percentiles != nil {
+			c.Percentiles = nil
+			c.CalcPercentiles(percentiles)
+		}
+		c.Print(out, msg)
+	}
+	if r.JitterHistogram != nil {
+		render(r.JitterHistogram, "Aggregated Start Jitter")
+	}
+	render(r.DurationHistogram, "Aggregated Function Time")
+	if r.CorrectedDurationHistogram != nil {
+		render(r.CorrectedDurationHistogram, "Aggregated Corrected Function Time")
+	}
+}
+
+// CompareThresholds are the regressions tolerated by Compare. The default
+// (0) for each is to not tolerate any degradation.
+type CompareThresholds struct {
+	// Maximum increase of the p50, p90 and p99 durations, in percent of the baseline.
+	MaxLatencyIncreasePct float64
+	// Maximum decrease of the ActualQPS, in percent of the baseline.
+	MaxQPSDecreasePct float64
+	// Maximum increase of the error rate, in percentage points.
+	MaxErrorRateIncrease float64
+}
+
+// MetricDelta is the comparison of 1 metric in a CompareReport.
+type MetricDelta struct {
+	Name      string
+	Baseline  float64
+	Current   float64
+	Delta     float64 // Current - Baseline
+	DeltaPct  float64 // Delta in percent of the Baseline (0 when Baseline is 0)
+	Regressed bool    // degraded beyond the threshold
+}
+
+// CompareReport is the (JSON serializable) result of Compare.
+type CompareReport struct {
+	Metrics   []MetricDelta // p50, p90, p99 (in seconds), qps and error rate (in percent)
+	Regressed bool          // if any of the Metrics did
+}
+
+// Compare compares the current results to the baseline ones (e.g. loaded
+// using LoadResults) to detect performance regressions beyond thresholds.
+func Compare(baseline, current *RunnerResults, thresholds CompareThresholds) CompareReport {
+	var report CompareReport
+	add := func(name string, b, c float64, regressed func(d MetricDelta) bool) {
+		d := MetricDelta{Name: name, Baseline: b, Current: c, Delta: c - b}
+		if b != 0 {
+			d.DeltaPct = 100. * d.Delta / b
+		}
+		d.Regressed = regressed(d)
+		report.Regressed = report.Regressed || d.Regressed
+		report.Metrics = append(report.Metrics, d)
+	}
+	for _, p := range []float64{50, 90, 99} {
+		add(fmt.Sprintf("p%g", p), resultPercentile(baseline, p), resultPercentile(current, p), func(d MetricDelta) bool {
+			return d.Delta > 0 && (d.Baseline == 0 || d.DeltaPct > thresholds.MaxLatencyIncreasePct)
+		})
+	}
+	add("qps", baseline.ActualQPS, current.ActualQPS, func(d MetricDelta) bool {
+		return d.Delta < 0 && -d.DeltaPct > thresholds.MaxQPSDecreasePct
+	})
+	add("error rate", 100.*errorRate(baseline), 100.*errorRate(current), func(d MetricDelta) bool {
+		return d.Delta > thresholds.MaxErrorRateIncrease
+	})
+	return report
+}
+
+// resultPercentile returns the percentile of the DurationHistogram, 0 when empty.
+func resultPercentile(r *RunnerResults, p float64) float64 {
+	if r.DurationHistogram == nil || r.DurationHistogram.Count == 0 {
+		return 0
+	}
+	return r.DurationHistogram.CalcPercentile(p)
+}
+
+// ErrorRateError is the error returned, with the results, by the runners
+// when the error rate of the run exceeds the RunnerOptions' MaxErrorRate.
+type ErrorRateError struct {
+	Rate    float64 // ErrorCount over the number of calls
+	MaxRate float64
+}
+
+func (e *ErrorRateError) Error() string {
+	return fmt.Sprintf("error rate %.4g exceeds the maximum %.4g", e.Rate, e.MaxRate)
+}
+
+// CheckErrorRate returns an *ErrorRateError when the fraction of the calls
+// which failed exceeds maxRate (if > 0), nil otherwise.
+func (r *RunnerResults) CheckErrorRate(maxRate float64) error {
+	if maxRate <= 0 {
+		return nil
+	}
+	rate := errorRate(r)
+	if rate <= maxRate {
+		return nil
+	}
+	return &ErrorRateError{Rate: rate, MaxRate: maxRate}
+}
+
+// errorRate returns the ErrorCount as a fraction of the calls.
+func errorRate(r *RunnerResults) float64 {
+	if r.DurationHistogram == nil || r.DurationHistogram.Count == 0 {
+		return 0
+	}
+	return float64(r.ErrorCount) / float64(r.DurationHistogram.Count)
+}
+
+// CalibrationOptions are the search range and the limits of Calibrate.
+type CalibrationOptions struct {
+	// QPS range to search, MinQPS defaults to 1 and MaxQPS is required.
+	MinQPS float64
+	MaxQPS float64
+	// Duration of each probe run, defaults to 5s.
+	ProbeDuration time.Duration
+	// Maximum p99 duration for a probe to be sustainable (required).
+	MaxP99 time.Duration
+	// Maximum error rate, as a fraction of the calls (e.g. 0.01 for 1%) like
+	// the RunnerOptions' MaxErrorRate (default 0).
+	MaxErrorRate float64
+	// Minimum ActualQPS, as a fraction of the probe's target, defaults to 0.9.
+	MinQPSRatio float64
+	// The search stops when the sustainable and unsustainable QPS are within
+	// Precision (fraction of the latter, defaults to 0.05) of each other.
+	Precision float64
+	// Maximum number of probes, defaults to 20.
+	MaxProbes int
+	// Where to write the progress of the search, defaults to stdout.
+	Out io.Writer
+}
+
+// CalibrationProbe is the outcome of 1 probe run of Calibrate.
+type CalibrationProbe struct {
+	QPS         float64 // target
+	ActualQPS   float64
+	P99         float64 // in seconds
+	ErrorRate   float64 // fraction of the calls
+	Sustainable bool
+}
+
+// CalibrationResults is the (JSON serializable) result of Calibrate.
+type CalibrationResults struct {
+	// Highest sustainable QPS found, 0 if even MinQPS isn't.
+	MaxQPS float64
+	Probes []CalibrationProbe
+}
+
+// ProbeFunc runs 1 calibration probe at the qps for the duration, using
+// any of the runners (e.g. fhttp.RunHTTPTest), and returns its results. An
+// *ErrorRateError (when the probe's options set a MaxErrorRate) along with
+// the results makes the probe unsustainable, any other error ends the
+// calibration.
+type ProbeFunc func(qps float64, duration time.Duration) (*RunnerResults, error)
+
+// Calibrate searches for the highest QPS the target sustains: with a p99
+// under MaxP99, an error rate under MaxErrorRate and the actual QPS at least
+// MinQPSRatio of the target. The QPS doubles from MinQPS until a probe isn't
+// sustainable (or MaxQPS is reached), and is then binary searched.
+func Calibrate(o *CalibrationOptions, probe ProbeFunc) (*CalibrationResults, error) {
+	c := *o
+	if c.MinQPS <= 0 {
+		c.MinQPS = 1
+	}
+	if c.MaxQPS < c.MinQPS {
+		return nil, fmt.Errorf("invalid calibration max qps %g (min %g)", c.MaxQPS, c.MinQPS)
+	}
+	if c.MaxP99 <= 0 {
+		return nil, errors.New("calibration requires a max p99")
+	}
+	if c.ProbeDuration <= 0 {
+		c.ProbeDuration = 5 * time.Second
+	}
+	if c.MinQPSRatio <= 0 {
+		c.MinQPSRatio = 0.9
+	}
+	if c.Precision <= 0 {
+		c.Precision = 0.05
+	}
+	if c.MaxProbes <= 0 {
+		c.MaxProbes = 20
+	}
+	if c.Out == nil {
+		c.Out = os.Stdout
+	}
+	res := &CalibrationResults{}
+	run := func(qps float64) (bool, error) {
+		r, err := probe(qps, c.ProbeDuration)
+		if err != nil {
+			if _, tooManyErrors := err.(*ErrorRateError); !tooManyErrors || r == nil {
+				return false, err
+			}
+		}
+		p := CalibrationProbe{QPS: qps, ActualQPS: r.ActualQPS, P99: resultPercentile(r, 99), ErrorRate: errorRate(r)}
+		p.Sustainable = err == nil && r.DurationHistogram != nil && r.DurationHistogram.Count > 0 &&
+			p.P99 <= c.MaxP99.Seconds() && p.ErrorRate <= c.MaxErrorRate && p.ActualQPS >= c.MinQPSRatio*qps
+		fmt.Fprintf(c.Out, "Calibration probe at %.5g qps: actual %.5g qps, p99 %.6g, error rate %.3g%% : sustainable %v\n", // nolint: gas
+			qps, p.ActualQPS, p.P99, 100.*p.ErrorRate, p.Sustainable)
+		res.Probes = append(res.Probes, p)
+		return p.Sustainable, nil
+	}
+	low, high := 0., 0. // highest sustainable and lowest unsustainable qps so far
+	for qps := c.MinQPS; len(res.Probes) < c.MaxProbes; qps = math.Min(2*qps, c.MaxQPS) {
+		ok, err := run(qps)
+		if err != nil {
+			return res, err
+		}
+		if !ok {
+			high = qps
+			break
+		}
+		low = qps
+		if qps >= c.MaxQPS {
+			break
+		}
+	}
+	for low > 0 && high > 0 && high-low > c.Precision*high && len(res.Probes) < c.MaxProbes {
+		qps := (low + high) / 2
+		ok, err := run(qps)
+		if err != nil {
+			return res, err
+		}
+		if ok {
+			low = qps
+		} else {
+			high = qps
+		}
+	}
+	res.MaxQPS = low
+	fmt.Fprintf(c.Out, "Calibration: max sustainable qps %.5g after %d probes\n", low, len(res.Probes)) // nolint: gas
+	return res, nil
+}
@@ -15,13 +15,24 @@
 package periodic
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"istio.io/fortio/log"
+	"istio.io/fortio/stats"
 )
 
 type Noop struct{}
@@ -151,7 +162,7 @@ func TestExactlyLargeDur(t *testing.T) {
 	o := RunnerOptions{
 		QPS:        3,
 		NumThreads: 4,
-		Duration:   100 * time.Hour, // will not be used, large to catch if it would
+		Duration:   100 * time.Hour, // will not be reached, large to catch if it would
 		Exactly:    9,               // exactly 9 times, so 2 per thread + 1
 	}
 	r := NewPeriodicRunner(&o)
@@ -167,6 +178,9 @@ func TestExactlyLargeDur(t *testing.T) {
 	if count != expected {
 		t.Errorf("Exact count executed unexpected number of times %d instead %d", count, expected)
 	}
+	if res.StopReason != StopExactly {
+		t.Errorf("Unexpected stop reason %q", res.StopReason)
+	}
 	r.Options().ReleaseRunners()
 }
 
@@ -174,26 +188,54 @@ func TestExactlySmallDur(t *testing.T) {
 	var count int64
 	var lock sync.Mutex
 	c := TestCount{&count, &lock}
-	expected := int64(11)
 	o := RunnerOptions{
 		QPS:        3,
 		NumThreads: 4,
-		Duration:   1 * time.Second, // would do only 3 calls without Exactly
-		Exactly:    expected,        // exactly 11 times, so 2 per thread + 3
+		Duration:   1 * time.Second, // reached first: only the first call of each thread
+		Exactly:    11,              // would be 2 per thread + 3
 	}
 	r := NewPeriodicRunner(&o)
 	r.Options().MakeRunners(&c)
 	count = 0
 	res := r.Run()
-	// Check the count both from the histogram and from our own test counter:
-	actual := res.DurationHistogram.Count
-	if actual != expected {
-		t.Errorf("Exact count executed unexpected number of times %d instead %d", actual, expected)
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 4 || count != 4 {
+		t.Errorf("Expected 4 calls before the duration cap, got %d (%d)", res.DurationHistogram.Count, count)
 	}
-	if count != expected {
-		t.Errorf("Exact count executed unexpected number of times %d instead %d", count, expected)
+	if res.StopReason != StopDuration {
+		t.Errorf("Unexpected stop reason %q", res.StopReason)
 	}
+	if res.ActualDuration > 2*time.Second {
+		t.Errorf("Run took %v, should have stopped after ~1s", res.ActualDuration)
+	}
+}
+
+func TestExactlyAndDuration(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	o := RunnerOptions{
+		QPS:        100,
+		NumThreads: 4,
+		Duration:   100 * time.Second,
+		Exactly:    500, // reached first, after ~5s
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
 	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 500 || count != 500 {
+		t.Errorf("Expected 500 calls, got %d (%d)", res.DurationHistogram.Count, count)
+	}
+	if res.StopReason != StopExactly {
+		t.Errorf("Unexpected stop reason %q", res.StopReason)
+	}
+	if res.ActualDuration > 10*time.Second {
+		t.Errorf("Run took %v, should have stopped after ~5s", res.ActualDuration)
+	}
+	if res.RequestedDuration != "exactly 500 calls, max 1m40s" {
+		t.Errorf("Unexpected requested duration %q", res.RequestedDuration)
+	}
 }
 
 func TestExactlyMaxQps(t *testing.T) {
@@ -222,6 +264,40 @@ func TestExactlyMaxQps(t *testing.T) {
 	r.Options().ReleaseRunners()
 }
 
+func TestRunIDAndEndTime(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	o := RunnerOptions{QPS: 50, NumThreads: 2, Exactly: 10}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	uuidRE := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	if !uuidRE.MatchString(res.RunID) {
+		t.Errorf("Expected a generated uuid run id, got %q", res.RunID)
+	}
+	if d := res.EndTime.Sub(res.StartTime) - res.ActualDuration; d < -time.Millisecond || d > time.Millisecond {
+		t.Errorf("End %v - start %v doesn't match the duration %v", res.EndTime, res.StartTime, res.ActualDuration)
+	}
+	o = RunnerOptions{QPS: 50, NumThreads: 2, Exactly: 10}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	other := r.Run()
+	r.Options().ReleaseRunners()
+	if other.RunID == res.RunID {
+		t.Errorf("Expected different run ids, got %q twice", res.RunID)
+	}
+	o = RunnerOptions{QPS: 50, NumThreads: 2, Exactly: 10, RunID: "build-42"}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.RunID != "build-42" {
+		t.Errorf("Expected the user provided run id, got %q", res.RunID)
+	}
+}
+
 func TestID(t *testing.T) {
 	var tests = []struct {
 		labels string // input
@@ -317,6 +393,978 @@ func TestExactlyAndAbort(t *testing.T) {
 	if !strings.Contains(res.RequestedDuration, "exactly 100 calls, interrupted after") {
 		t.Errorf("Got '%s' and didn't find expected aborted", res.RequestedDuration)
 	}
+	if res.StopReason != StopInterrupted {
+		t.Errorf("Unexpected stop reason %q", res.StopReason)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := RunnerOptions{
+		QPS:        10,
+		NumThreads: 2,
+		Duration:   10 * time.Second,
+		RunContext: ctx,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	elapsed := time.Since(start)
+	if elapsed > 2*time.Second {
+		t.Errorf("Canceling the context didn't stop the run, took %v", elapsed)
+	}
+	actual := res.DurationHistogram.Count
+	if actual < 2 || actual > 10 {
+		t.Errorf("Unexpected partial count %d after cancel", actual)
+	}
+	if count != actual {
+		t.Errorf("Canceled run internal counter %d doesn't match histogram %d", count, actual)
+	}
+	if len(res.DurationHistogram.Percentiles) != 1 || res.DurationHistogram.Min < 0.05 {
+		t.Errorf("Invalid partial histogram %+v", res.DurationHistogram)
+	}
+}
+
+func TestRunContextExactlyFirst(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	o := RunnerOptions{
+		QPS:        10,
+		NumThreads: 1,
+		Exactly:    3,
+		RunContext: ctx,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 3 {
+		t.Errorf("Exactly should have completed before the context timeout, got %d", res.DurationHistogram.Count)
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	h := stats.NewHistogram(0, 0.001)
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i) / 1000.) // 1ms to 100ms
+	}
+	hd := h.Export()
+	var tests = []struct {
+		thresholds map[float64]time.Duration
+		expected   bool
+	}{
+		{nil, true},
+		{map[float64]time.Duration{99: 100 * time.Millisecond}, true},
+		{map[float64]time.Duration{99: 50 * time.Millisecond}, false},
+		{map[float64]time.Duration{50: 60 * time.Millisecond, 99.9: 101 * time.Millisecond}, true},
+		{map[float64]time.Duration{50: 40 * time.Millisecond, 99.9: 101 * time.Millisecond}, false},
+	}
+	for _, tst := range tests {
+		var b bytes.Buffer
+		if actual := CheckThresholds(hd, tst.thresholds, &b); actual != tst.expected {
+			t.Errorf("CheckThresholds(%v) got %v instead of %v (%s)", tst.thresholds, actual, tst.expected, b.String())
+		}
+		if !tst.expected && !strings.Contains(b.String(), "SLO not met") {
+			t.Errorf("Missing SLO failure output for %v: %q", tst.thresholds, b.String())
+		}
+	}
+	// no data: nothing exceeds
+	if !CheckThresholds(stats.NewHistogram(0, 1).Export(), map[float64]time.Duration{99: 1}, nil) {
+		t.Errorf("Empty histogram should meet the SLO")
+	}
+}
+
+func TestRunPercentileThresholds(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	for _, tst := range []struct {
+		max      time.Duration
+		expected bool
+	}{
+		{1 * time.Millisecond, false}, // calls take 50ms
+		{1 * time.Second, true},
+	} {
+		o := RunnerOptions{
+			QPS:                  -1,
+			NumThreads:           1,
+			Exactly:              4,
+			Percentiles:          []float64{50},
+			PercentileThresholds: map[float64]time.Duration{99: tst.max},
+		}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		if res.SLOMet != tst.expected {
+			t.Errorf("SLOMet for p99 < %v got %v instead of %v", tst.max, res.SLOMet, tst.expected)
+		}
+		if len(res.DurationHistogram.Percentiles) != 2 || res.DurationHistogram.Percentiles[1].Percentile != 99 {
+			t.Errorf("Threshold percentile not computed: %+v", res.DurationHistogram.Percentiles)
+		}
+	}
+}
+
+type TestVariableDuration struct {
+	count *int64
+	lock  *sync.Mutex
+	last  int
+}
+
+func (c *TestVariableDuration) Run(i int) {
+	c.lock.Lock()
+	n := int((*c.count * 7) % 20) // all 20 values (for 20 calls) distinct
+	(*c.count)++
+	c.lock.Unlock()
+	c.last = n
+	time.Sleep(time.Duration(10*n) * time.Millisecond) // spaced enough to keep their order under load
+}
+
+func (c *TestVariableDuration) LastCall() (int, string) {
+	return c.last, "test"
+}
+
+func TestCaptureSlowest(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	o := RunnerOptions{
+		QPS:            -1,
+		NumThreads:     2,
+		Exactly:        20,
+		CaptureSlowest: 3,
+	}
+	r := NewPeriodicRunner(&o)
+	for i := range r.Options().Runners {
+		r.Options().Runners[i] = &TestVariableDuration{count: &count, lock: &lock}
+	}
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if len(res.SlowestSamples) != 3 {
+		t.Fatalf("Expected 3 slowest samples, got %+v", res.SlowestSamples)
+	}
+	for i, s := range res.SlowestSamples {
+		expected := 19 - i
+		if s.Code != expected || s.Target != "test" {
+			t.Errorf("Slowest sample %d is %+v, expected code %d", i, s, expected)
+		}
+		if s.Duration < time.Duration(10*expected)*time.Millisecond {
+			t.Errorf("Slowest sample %d duration %v too short", i, s.Duration)
+		}
+		if i > 0 && s.Duration > res.SlowestSamples[i-1].Duration {
+			t.Errorf("Slowest samples not sorted: %+v", res.SlowestSamples)
+		}
+	}
+	if d := res.DurationHistogram.Max - res.SlowestSamples[0].Duration.Seconds(); d > 1e-6 || d < -1e-6 {
+		t.Errorf("Slowest sample %v doesn't match histogram max %g", res.SlowestSamples[0].Duration, res.DurationHistogram.Max)
+	}
+	exemplars := res.Exemplars()
+	if len(exemplars) != 3 {
+		t.Fatalf("Expected 3 exemplars, got %+v", exemplars)
+	}
+	for i, e := range exemplars {
+		s := res.SlowestSamples[i]
+		if e.Value != s.Duration.Seconds() || e.Labels["code"] != strconv.Itoa(s.Code) || !e.Timestamp.After(s.StartTime) {
+			t.Errorf("Exemplar %+v doesn't match slowest sample %+v", e, s)
+		}
+	}
+	// Default is to not capture
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 2}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.SlowestSamples != nil {
+		t.Errorf("Unexpected slowest samples %+v", res.SlowestSamples)
+	}
+}
+
+func TestPerRequestOutput(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	var out bytes.Buffer
+	o := RunnerOptions{
+		QPS:              -1,
+		NumThreads:       2,
+		Exactly:          20,
+		PerRequestOutput: &out,
+	}
+	r := NewPeriodicRunner(&o)
+	for i := range r.Options().Runners {
+		r.Options().Runners[i] = &TestVariableDuration{count: &count, lock: &lock}
+	}
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if int64(len(lines)) != res.DurationHistogram.Count || len(lines) != 20 {
+		t.Fatalf("Expected 20 lines, got %d for %d calls: %q", len(lines), res.DurationHistogram.Count, out.String())
+	}
+	codes := make(map[int]bool)
+	for _, l := range lines {
+		var rec RequestRecord
+		if err := json.Unmarshal([]byte(l), &rec); err != nil {
+			t.Fatalf("Unable to parse line %q: %v", l, err)
+		}
+		if rec.ThreadID < 0 || rec.ThreadID > 1 || rec.Target != "test" || rec.StartTime.Before(res.StartTime) {
+			t.Errorf("Unexpected record %+v", rec)
+		}
+		if rec.Duration < time.Duration(10*rec.Code)*time.Millisecond {
+			t.Errorf("Record duration %v too short for code %d", rec.Duration, rec.Code)
+		}
+		codes[rec.Code] = true
+	}
+	if len(codes) != 20 {
+		t.Errorf("Expected the 20 distinct calls, got %v", codes)
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	o := RunnerOptions{
+		QPS:           -1,
+		NumThreads:    2,
+		Exactly:       20,
+		StatsDAddress: conn.LocalAddr().String(),
+		StatsDPrefix:  "test.run",
+	}
+	r := NewPeriodicRunner(&o)
+	for i := range r.Options().Runners {
+		r.Options().Runners[i] = &TestVariableDuration{count: &count, lock: &lock}
+	}
+	r.Run()
+	r.Options().ReleaseRunners()
+	codes := make(map[string]bool)
+	buf := make([]byte, 1024)
+	for i := 0; i < 20; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Only got %d statsd packets: %v", i, err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[0], "test.run.duration:") || !strings.HasSuffix(lines[0], "|ms") ||
+			!strings.HasPrefix(lines[1], "test.run.code.") || !strings.HasSuffix(lines[1], ":1|c") {
+			t.Errorf("Unexpected statsd packet %q", buf[:n])
+		}
+		codes[lines[len(lines)-1]] = true
+	}
+	if len(codes) != 20 {
+		t.Errorf("Expected the 20 distinct codes, got %v", codes)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)) // nolint: errcheck
+	if n, _, err := conn.ReadFrom(buf); err == nil {
+		t.Errorf("Unexpected extra statsd packet %q", buf[:n])
+	}
+}
+
+func TestLoadResults(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	o := RunnerOptions{
+		QPS:         -1,
+		NumThreads:  2,
+		Exactly:     20,
+		Percentiles: []float64{50, 90, 99},
+		RunType:     "load test",
+		Annotations: map[string]string{"git_sha": "abc123", "env": "ci"},
+	}
+	r := NewPeriodicRunner(&o)
+	for i := range r.Options().Runners {
+		r.Options().Runners[i] = &TestVariableDuration{count: &count, lock: &lock}
+	}
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	b, err := json.Marshal(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadResults(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Annotations, o.Annotations) {
+		t.Errorf("Loaded annotations %v don't match %v", loaded.Annotations, o.Annotations)
+	}
+	if !reflect.DeepEqual(loaded.DurationHistogram.Percentiles, res.DurationHistogram.Percentiles) {
+		t.Errorf("Loaded percentiles %v don't match %v", loaded.DurationHistogram.Percentiles, res.DurationHistogram.Percentiles)
+	}
+	for _, p := range res.DurationHistogram.Percentiles {
+		if v := loaded.DurationHistogram.CalcPercentile(p.Percentile); v != p.Value {
+			t.Errorf("Recalculated p%g %g doesn't match %g", p.Percentile, v, p.Value)
+		}
+	}
+	var out bytes.Buffer
+	loaded.Render(&out, []float64{75})
+	s := out.String()
+	if !strings.Contains(s, "load test") || !strings.Contains(s, "Ended after") || !strings.Contains(s, "# target 75% ") ||
+		strings.Contains(s, "# target 50% ") || !strings.Contains(s, "Annotations: env=ci git_sha=abc123\n") {
+		t.Errorf("Unexpected render %s", s)
+	}
+	out.Reset()
+	if err = loaded.WritePrometheus(&out, map[string]int64{"200": 20}, "fortio"); err != nil {
+		t.Fatal(err)
+	}
+	s = out.String()
+	if !strings.Contains(s, `fortio_duration_seconds_count{env="ci",git_sha="abc123"} 20`) ||
+		!strings.Contains(s, `fortio_requests_total{env="ci",git_sha="abc123",code="200"} 20`) {
+		t.Errorf("Expected the annotations as labels in the prometheus export, got %s", s)
+	}
+	out.Reset()
+	loaded.ErrorCount = 5
+	if err = loaded.WriteInfluxLine(&out, "fortio"); err != nil {
+		t.Fatal(err)
+	}
+	s = out.String()
+	if !strings.HasPrefix(s, "fortio,env=ci,git_sha=abc123") || !strings.Contains(s, " count=20i,") ||
+		!strings.Contains(s, ",error_rate=0.25,") || !strings.Contains(s, ",qps=") ||
+		!strings.HasSuffix(s, " "+strconv.FormatInt(loaded.EndTime.UnixNano(), 10)+"\n") {
+		t.Errorf("Unexpected influx line %q", s)
+	}
+	if len(loaded.DurationHistogram.Percentiles) != 3 {
+		t.Errorf("Render changed the loaded percentiles: %v", loaded.DurationHistogram.Percentiles)
+	}
+	if _, err = LoadResults(strings.NewReader(`{"RunType": "no histogram"}`)); err == nil {
+		t.Error("Expected an error loading a result without histogram")
+	}
+	if _, err = LoadResults(strings.NewReader(`not json`)); err == nil {
+		t.Error("Expected an error loading invalid json")
+	}
+}
+
+// compareResult returns a result with the durations (in ms), qps and errors.
+func compareResult(qps float64, errors int64, durations ...float64) *RunnerResults {
+	h := stats.NewHistogram(0, 0.0001)
+	for _, d := range durations {
+		h.Record(d / 1000.)
+	}
+	return &RunnerResults{ActualQPS: qps, ErrorCount: errors, DurationHistogram: h.Export()}
+}
+
+func TestCheckErrorRate(t *testing.T) {
+	durations := []float64{10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+	tests := []struct {
+		errors  int64
+		maxRate float64
+		fail    bool
+	}{
+		{0, 0.1, false},
+		{1, 0.1, false}, // at the threshold
+		{2, 0.1, true},
+		{5, 0, false}, // no check
+		{10, 0.99, true},
+	}
+	for _, tst := range tests {
+		err := compareResult(100, tst.errors, durations...).CheckErrorRate(tst.maxRate)
+		if (err != nil) != tst.fail {
+			t.Errorf("%d errors with max %g: unexpected result %v", tst.errors, tst.maxRate, err)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		rateErr, ok := err.(*ErrorRateError)
+		if !ok || rateErr.Rate != float64(tst.errors)/10. || rateErr.MaxRate != tst.maxRate {
+			t.Errorf("%d errors with max %g: unexpected error %#v", tst.errors, tst.maxRate, err)
+		}
+	}
+	if err := (&RunnerResults{DurationHistogram: &stats.HistogramData{}}).CheckErrorRate(0.1); err != nil {
+		t.Errorf("Unexpected error rate error without calls: %v", err)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	durations := []float64{10, 11, 12, 13, 14, 15, 16, 17, 18, 50}
+	baseline := compareResult(100, 1, durations...)
+	thresholds := CompareThresholds{MaxLatencyIncreasePct: 15, MaxQPSDecreasePct: 5, MaxErrorRateIncrease: 1}
+	slower := make([]float64, len(durations))
+	faster := make([]float64, len(durations))
+	noise := make([]float64, len(durations))
+	for i, d := range durations {
+		slower[i] = d * 1.5
+		faster[i] = d * 0.8
+		noise[i] = d * 1.02
+	}
+	tests := []struct {
+		name      string
+		current   *RunnerResults
+		regressed []string
+	}{
+		{"same", baseline, nil},
+		{"improvement", compareResult(120, 0, faster...), nil},
+		{"within noise", compareResult(98, 1, noise...), nil},
+		{"latency regression", compareResult(100, 1, slower...), []string{"p50", "p90", "p99"}},
+		{"qps regression", compareResult(90, 1, durations...), []string{"qps"}},
+		{"error rate regression", compareResult(100, 3, durations...), []string{"error rate"}},
+	}
+	for _, tst := range tests {
+		report := Compare(baseline, tst.current, thresholds)
+		var regressed []string
+		for _, m := range report.Metrics {
+			if m.Regressed {
+				regressed = append(regressed, m.Name)
+			}
+		}
+		if !reflect.DeepEqual(regressed, tst.regressed) || report.Regressed != (len(tst.regressed) > 0) {
+			t.Errorf("%s: unexpected regressions %v (%v), expected %v: %+v", tst.name, regressed, report.Regressed,
+				tst.regressed, report)
+		}
+		if _, err := json.Marshal(report); err != nil {
+			t.Errorf("%s: report not serializable: %v", tst.name, err)
+		}
+	}
+	report := Compare(baseline, compareResult(100, 1, slower...), CompareThresholds{})
+	p50 := report.Metrics[0]
+	if p50.Name != "p50" || p50.Delta <= 0 || p50.DeltaPct < 40 || p50.DeltaPct > 60 {
+		t.Errorf("Unexpected p50 delta %+v", p50)
+	}
+}
+
+func TestJitterHistogram(t *testing.T) {
+	o := RunnerOptions{
+		QPS:          100,
+		NumThreads:   2,
+		Exactly:      40,
+		RecordJitter: true,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	h := res.JitterHistogram
+	if h == nil || h.Count != 40 {
+		t.Fatalf("Expected jitter for the 40 calls, got %+v", h)
+	}
+	// unloaded: calls should start within a few ms of their schedule
+	if h.Avg > 0.005 || h.Min < 0 {
+		t.Errorf("Unexpected jitter avg %g min %g", h.Avg, h.Min)
+	}
+	// Not recorded by default nor in max qps mode
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 2, RecordJitter: true}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.JitterHistogram != nil {
+		t.Errorf("Unexpected jitter histogram in max qps mode %+v", res.JitterHistogram)
+	}
+}
+
+// TestSpike makes one slow call (single thread).
+type TestSpike struct {
+	count int
+}
+
+func (c *TestSpike) Run(i int) {
+	c.count++
+	if c.count == 50 {
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestCoordinatedOmission(t *testing.T) {
+	o := RunnerOptions{
+		QPS:                        200, // every 5ms
+		NumThreads:                 1,
+		Exactly:                    200,
+		Percentiles:                []float64{99},
+		CorrectCoordinatedOmission: true,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&TestSpike{})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	raw, corrected := res.DurationHistogram, res.CorrectedDurationHistogram
+	if corrected == nil {
+		t.Fatalf("Missing corrected histogram")
+	}
+	// the 200ms call delayed ~39 other calls
+	if raw.Count != 200 || corrected.Count < 230 || corrected.Count > 250 {
+		t.Errorf("Unexpected raw %d and corrected %d counts", raw.Count, corrected.Count)
+	}
+	rawP99, correctedP99 := raw.Percentiles[0].Value, corrected.Percentiles[0].Value
+	if correctedP99 < 0.1 || correctedP99 < 10*rawP99 {
+		t.Errorf("Corrected p99 %g not much higher than the raw one %g", correctedP99, rawP99)
+	}
+	// Not recorded by default nor in max qps mode
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 2, CorrectCoordinatedOmission: true}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.CorrectedDurationHistogram != nil {
+		t.Errorf("Unexpected corrected histogram in max qps mode %+v", res.CorrectedDurationHistogram)
+	}
+}
+
+// TestStartTimes records the start time of each call (single thread).
+type TestStartTimes struct {
+	starts []time.Time
+}
+
+func (c *TestStartTimes) Run(i int) {
+	c.starts = append(c.starts, time.Now())
+}
+
+// runSpacing returns the stats of the spacing between the calls of a 100 qps
+// single thread run of 300 calls.
+func runSpacing(t *testing.T, d Distribution, seed int64) *stats.Counter {
+	c := TestStartTimes{}
+	o := RunnerOptions{
+		QPS:          100,
+		NumThreads:   1,
+		Exactly:      300,
+		Distribution: d,
+		Seed:         seed,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 300 || len(c.starts) != 300 {
+		t.Fatalf("Expected 300 calls, got %d (%d)", res.DurationHistogram.Count, len(c.starts))
+	}
+	var spacing stats.Counter
+	for i := 1; i < len(c.starts); i++ {
+		spacing.Record(c.starts[i].Sub(c.starts[i-1]).Seconds())
+	}
+	return &spacing
+}
+
+func TestExponentialDistribution(t *testing.T) {
+	s := runSpacing(t, Exponential, 42)
+	// mean rate matches the target
+	if avg := s.Avg(); avg < 0.008 || avg > 0.012 {
+		t.Errorf("Average spacing %g too far from the 100 qps 10ms", avg)
+	}
+	// exponential: standard deviation is the mean
+	if cv := s.StdDev() / s.Avg(); cv < 0.7 || cv > 1.3 {
+		t.Errorf("Spacing coefficient of variation %g not exponential like (%g +/- %g)", cv, s.Avg(), s.StdDev())
+	}
+	if s.Min > 0.002 {
+		t.Errorf("Expected some calls close to each other, min spacing %g", s.Min)
+	}
+	// while uniform has evenly spaced calls
+	s = runSpacing(t, Uniform, 0)
+	if cv := s.StdDev() / s.Avg(); cv > 0.3 {
+		t.Errorf("Uniform spacing coefficient of variation %g too high (%g +/- %g)", cv, s.Avg(), s.StdDev())
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	o := RunnerOptions{QPS: 20, NumThreads: 2, Exactly: 20}
+	// Uninterrupted run for reference
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	full := r.Run()
+	r.Options().ReleaseRunners()
+	// Same run, stopped after ~0.4s
+	count = 0
+	o = RunnerOptions{QPS: 20, NumThreads: 2, Exactly: 20}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	go func() {
+		time.Sleep(400 * time.Millisecond)
+		r.Options().Abort()
+	}()
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.StopReason != StopInterrupted || count >= 20 {
+		t.Fatalf("Expected interrupted run, got %q after %d calls", res.StopReason, count)
+	}
+	data, err := json.Marshal(r.Checkpoint())
+	if err != nil {
+		t.Fatalf("Checkpoint serialization error %v", err)
+	}
+	var cp Checkpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		t.Fatalf("Checkpoint deserialization error %v", err)
+	}
+	if cp.Count != count || cp.DurationHistogram.Count != count {
+		t.Errorf("Checkpoint %+v doesn't match the %d calls", cp, count)
+	}
+	// Resume and complete the run
+	o = RunnerOptions{QPS: 20, NumThreads: 2, Exactly: 20}
+	if err = o.Resume(&cp); err != nil {
+		t.Fatalf("Unexpected resume error %v", err)
+	}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if count != full.DurationHistogram.Count || res.DurationHistogram.Count != full.DurationHistogram.Count {
+		t.Errorf("Resumed run made %d calls (%d) instead of %d", res.DurationHistogram.Count, count, full.DurationHistogram.Count)
+	}
+	if res.StopReason != StopExactly || res.Exactly != 20 || !res.StartTime.Equal(cp.StartTime) || res.ActualDuration <= cp.Elapsed {
+		t.Errorf("Unexpected resumed results %+v", res)
+	}
+	if cp.RunID == "" || res.RunID != cp.RunID {
+		t.Errorf("Resumed run id %q should be the checkpoint's %q", res.RunID, cp.RunID)
+	}
+	if !strings.Contains(res.RequestedDuration, "resumed after") {
+		t.Errorf("Requested duration %q should mention the resume", res.RequestedDuration)
+	}
+	// Mismatches and completed runs can't be resumed
+	o = RunnerOptions{QPS: 20, NumThreads: 2, Exactly: 20, Resolution: 0.0001}
+	if err = o.Resume(&cp); err == nil {
+		t.Errorf("Expected error for resolution mismatch")
+	}
+	o = RunnerOptions{QPS: 10, NumThreads: 2, Exactly: 20}
+	if err = o.Resume(&cp); err == nil {
+		t.Errorf("Expected error for qps mismatch")
+	}
+	o = RunnerOptions{QPS: 20, NumThreads: 2, Exactly: 20}
+	if err = o.Resume(r.Checkpoint()); err == nil {
+		t.Errorf("Expected error for completed run")
+	}
+}
+
+func TestFellBehind(t *testing.T) {
+	o := RunnerOptions{QPS: 100, NumThreads: 1, Exactly: 20}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.FellBehind || res.TargetQPS != 100 || res.QPSRatio < 0.8 || res.QPSRatio > 1.1 {
+		t.Errorf("Unexpected qps accuracy for noop run: behind %v target %g ratio %g", res.FellBehind, res.TargetQPS, res.QPSRatio)
+	}
+	// 50ms calls can't keep up with 100 qps on 1 thread
+	var count int64
+	var lock sync.Mutex
+	o = RunnerOptions{QPS: 100, NumThreads: 1, Exactly: 10}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&TestCount{&count, &lock})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if !res.FellBehind || res.QPSRatio > 0.5 {
+		t.Errorf("Expected slow run to fall behind: behind %v ratio %g", res.FellBehind, res.QPSRatio)
+	}
+	// Not applicable in max qps mode
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 2}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.FellBehind || res.TargetQPS != -1 || res.QPSRatio != 0 {
+		t.Errorf("Unexpected max qps accuracy: behind %v target %g ratio %g", res.FellBehind, res.TargetQPS, res.QPSRatio)
+	}
+}
+
+// TestInFlight is a slow Runnable tracking the max number of concurrent calls.
+type TestInFlight struct {
+	current *int64
+	max     *int64
+}
+
+func (c *TestInFlight) Run(i int) {
+	n := atomic.AddInt64(c.current, 1)
+	for {
+		m := atomic.LoadInt64(c.max)
+		if n <= m || atomic.CompareAndSwapInt64(c.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt64(c.current, -1)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	var current, max int64
+	o := RunnerOptions{QPS: -1, NumThreads: 8, Exactly: 40, MaxInFlight: 3}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&TestInFlight{&current, &max})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if max > 3 || max < 2 {
+		t.Errorf("Expected at most 3 (and more than 1) calls in flight, got %d", max)
+	}
+	if res.DurationHistogram.Count != 40 {
+		t.Errorf("Expected 40 calls, got %d", res.DurationHistogram.Count)
+	}
+	if res.BackpressureEvents == 0 {
+		t.Errorf("Expected backpressure events with 8 threads and max 3 in flight")
+	}
+	// the wait for a slot isn't part of the calls' duration
+	if res.DurationHistogram.Avg > 0.03 {
+		t.Errorf("Unexpected avg duration %g including the backpressure wait", res.DurationHistogram.Avg)
+	}
+	// No limit
+	current, max = 0, 0
+	o = RunnerOptions{QPS: -1, NumThreads: 4, Exactly: 8}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&TestInFlight{&current, &max})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if max != 4 || res.BackpressureEvents != 0 {
+		t.Errorf("Expected 4 calls in flight without backpressure, got %d and %d", max, res.BackpressureEvents)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	var progress []PartialResult
+	var progressLock sync.Mutex
+	o := RunnerOptions{
+		QPS:              40,
+		NumThreads:       2,
+		Duration:         2 * time.Second,
+		ProgressInterval: 500 * time.Millisecond,
+		ProgressCallback: func(p PartialResult) {
+			progressLock.Lock()
+			progress = append(progress, p)
+			progressLock.Unlock()
+		},
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	n := len(progress)
+	if n < 3 || n > 5 {
+		t.Errorf("Progress callback called %d times, expected ~4", n)
+	}
+	for i, p := range progress {
+		if p.Count <= 0 || p.ActualQPS <= 0 || p.DurationHistogram.Count != p.Count {
+			t.Errorf("Invalid progress %d: %+v", i, p)
+		}
+		if i > 0 && (p.Count <= progress[i-1].Count || p.Elapsed <= progress[i-1].Elapsed) {
+			t.Errorf("Progress %d count %d not increasing from %d", i, p.Count, progress[i-1].Count)
+		}
+		if p.Count > res.DurationHistogram.Count {
+			t.Errorf("Progress %d count %d more than final %d", i, p.Count, res.DurationHistogram.Count)
+		}
+	}
+}
+
+// TestColdStart's first calls are slow (e.g. connections setup).
+type TestColdStart struct {
+	calls int64
+	slow  int64
+}
+
+func (c *TestColdStart) Run(i int) {
+	if atomic.AddInt64(&c.calls, 1) <= c.slow {
+		time.Sleep(30 * time.Millisecond)
+	} else {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	for _, threads := range []int{1, 2} {
+		o := RunnerOptions{
+			QPS:            -1,
+			NumThreads:     threads,
+			Exactly:        50,
+			WarmupRequests: 4,
+		}
+		r := NewPeriodicRunner(&o)
+		c := TestColdStart{slow: 4}
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		if res.WarmupHistogram == nil || res.WarmupHistogram.Count != 4 || res.DurationHistogram.Count != 50-4 {
+			t.Fatalf("%d threads: expected 4 warmup calls out of 50, got %+v and %d", threads, res.WarmupHistogram,
+				res.DurationHistogram.Count)
+		}
+		if threads == 1 && (res.WarmupHistogram.Min < 0.03 || res.DurationHistogram.Max >= 0.03) {
+			t.Errorf("Slow first calls not the warmup ones: warmup min %g, max %g", res.WarmupHistogram.Min,
+				res.DurationHistogram.Max)
+		}
+	}
+	// By duration: the calls started in the first 100ms (~10 at 100 qps)
+	o := RunnerOptions{
+		QPS:            100,
+		NumThreads:     1,
+		Exactly:        30,
+		WarmupDuration: 95 * time.Millisecond,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if w := res.WarmupHistogram.Count; w < 8 || w > 11 || w+res.DurationHistogram.Count != 30 {
+		t.Errorf("Expected ~10 warmup calls out of 30, got %d and %d", w, res.DurationHistogram.Count)
+	}
+	// No warmup histogram by default
+	o = RunnerOptions{QPS: -1, Exactly: 10}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	if res = r.Run(); res.WarmupHistogram != nil || res.DurationHistogram.Count != 10 {
+		t.Errorf("Unexpected warmup %+v without warmup options", res.WarmupHistogram)
+	}
+	r.Options().ReleaseRunners()
+}
+
+// windowOf returns a window histogram of count calls all taking d.
+func windowOf(count int, d time.Duration) *stats.Histogram {
+	h := stats.NewHistogram(0, 0.001)
+	h.RecordN(d.Seconds(), count)
+	return h
+}
+
+func TestDegradationDetector(t *testing.T) {
+	d := &degradationDetector{factor: 1.5, size: 2}
+	tests := []struct {
+		window   *stats.Histogram
+		index    int     // expected Window
+		baseline float64 // expected Baseline
+		degraded bool
+	}{
+		{windowOf(100, 2*time.Millisecond), 0, 0, false},        // no baseline yet
+		{windowOf(100, 2*time.Millisecond), 1, 0.002, false},    // same
+		{stats.NewHistogram(0, 0.001), 2, 0.002, false},         // empty: skipped
+		{windowOf(100, 2900*time.Microsecond), 2, 0.002, false}, // below the factor
+		{windowOf(50, 20*time.Millisecond), 3, 0.00245, true},   // step
+		{windowOf(50, 20*time.Millisecond), 4, 0.01145, true},   // baseline only half moved
+		{windowOf(50, 20*time.Millisecond), 5, 0.02, false},     // new baseline
+		{windowOf(100, 2*time.Millisecond), 6, 0.02, false},     // improvement
+	}
+	for i, tst := range tests {
+		e, degraded := d.add(tst.window, time.Duration(i)*time.Second)
+		if degraded != tst.degraded {
+			t.Errorf("window %d: degraded %v instead of %v: %+v", i, degraded, tst.degraded, e)
+		}
+		if tst.window.Count == 0 {
+			continue
+		}
+		if e.Window != tst.index || math.Abs(e.Baseline-tst.baseline) > 1e-9 ||
+			e.Elapsed != time.Duration(i)*time.Second || e.Count != tst.window.Count {
+			t.Errorf("window %d: unexpected event %+v, expected index %d baseline %g", i, e, tst.index, tst.baseline)
+		}
+		if degraded && math.Abs(e.Factor-e.P99/e.Baseline) > 1e-9 {
+			t.Errorf("window %d: unexpected factor %+v", i, e)
+		}
+	}
+}
+
+// TestStepChange's calls take 1ms until the step, 100ms after it.
+type TestStepChange struct {
+	step time.Time
+}
+
+func (c *TestStepChange) Run(i int) {
+	if time.Now().Before(c.step) {
+		time.Sleep(1 * time.Millisecond)
+	} else {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestDegradationCallback(t *testing.T) {
+	var events []DegradationEvent
+	var eventsLock sync.Mutex
+	window := 300 * time.Millisecond
+	o := RunnerOptions{
+		QPS:            -1,
+		NumThreads:     2,
+		Duration:       2400 * time.Millisecond,
+		WindowDuration: window,
+		// far from the 100x step but also from the scheduling jitter of 1ms calls
+		DegradationFactor: 20,
+		DegradationCallback: func(e DegradationEvent) {
+			eventsLock.Lock()
+			events = append(events, e)
+			eventsLock.Unlock()
+		},
+	}
+	r := NewPeriodicRunner(&o)
+	c := TestStepChange{step: time.Now().Add(1200 * time.Millisecond)}
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if ro := r.Options(); ro.DegradationFactor != 20 ||
+		ro.DegradationBaselineWindows != DefaultDegradationBaselineWindows {
+		t.Errorf("Options not normalized: %g %d", ro.DegradationFactor, ro.DegradationBaselineWindows)
+	}
+	step := c.step.Sub(res.StartTime)
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	if len(events) == 0 {
+		t.Fatalf("Degradation callback not called for the latency step at %v", step)
+	}
+	for _, e := range events {
+		if e.Elapsed < step {
+			t.Errorf("Degradation before the step at %v: %+v", step, e)
+		}
+		if e.Factor <= 20 || e.Baseline < 0.001 || e.Count <= 0 {
+			t.Errorf("Unexpected degradation event %+v", e)
+		}
+	}
+}
+
+func TestConnectionRamp(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	var progress []PartialResult
+	var progressLock sync.Mutex
+	o := RunnerOptions{
+		QPS:                    -1,
+		NumThreads:             4,
+		Duration:               time.Second,
+		ConnectionRampDuration: 600 * time.Millisecond, // a thread every 200ms
+		ProgressInterval:       100 * time.Millisecond,
+		ProgressCallback: func(p PartialResult) {
+			progressLock.Lock()
+			progress = append(progress, p)
+			progressLock.Unlock()
+		},
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	if len(progress) < 5 {
+		t.Fatalf("Progress callback called %d times, expected ~9", len(progress))
+	}
+	if first, last := progress[0].ActiveThreads, progress[len(progress)-1].ActiveThreads; first != 1 || last != 4 {
+		t.Errorf("Expected 1 active thread early and 4 at the end, got %d and %d", first, last)
+	}
+	if len(res.ConnectionRamp) != 4 {
+		t.Fatalf("Expected 4 ramp steps, got %+v", res.ConnectionRamp)
+	}
+	for i, step := range res.ConnectionRamp {
+		expected := time.Duration(i) * 200 * time.Millisecond
+		if step.ActiveThreads != i+1 || step.Elapsed < expected || step.Elapsed > expected+100*time.Millisecond {
+			t.Errorf("Unexpected ramp step %d: %+v", i, step)
+		}
+	}
+	// Threads which would start after the end of the run don't:
+	o.Duration = 300 * time.Millisecond
+	o.ProgressCallback = nil
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if len(res.ConnectionRamp) != 2 || res.ActualDuration > 400*time.Millisecond {
+		t.Errorf("Expected 2 threads started in %v, got %+v in %v", o.Duration, res.ConnectionRamp, res.ActualDuration)
+	}
 }
 
 func TestSleepFallingBehind(t *testing.T) {
@@ -345,6 +1393,70 @@ func TestSleepFallingBehind(t *testing.T) {
 	}
 }
 
+type TestTimes struct {
+	times []time.Time
+}
+
+func (c *TestTimes) Run(i int) {
+	c.times = append(c.times, time.Now())
+}
+
+func TestRampUpCalls(t *testing.T) {
+	o := RunnerOptions{RampUpDuration: 2 * time.Second}
+	var tests = []struct {
+		d        float64 // input
+		expected float64 // expected calls
+	}{
+		{0, 0},
+		{1, 10 + 45./2},
+		{2, 110},
+		{3, 210},
+	}
+	for _, tst := range tests {
+		n := o.rampCalls(tst.d, 100, 10)
+		if n != tst.expected {
+			t.Errorf("rampCalls(%g) got %g instead of %g", tst.d, n, tst.expected)
+		}
+		if e := o.rampElapsed(n, 100, 10); e < tst.d-1e-9 || e > tst.d+1e-9 {
+			t.Errorf("rampElapsed(%g) got %g instead of %g", n, e, tst.d)
+		}
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	c := TestTimes{}
+	o := RunnerOptions{
+		QPS:            100,
+		NumThreads:     1,
+		Exactly:        60,
+		RampUpDuration: 500 * time.Millisecond,
+		RampUpStartQPS: 10,
+		ExcludeRampUp:  true,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if len(c.times) != 60 {
+		t.Fatalf("Ramp up executed unexpected number of times %d instead of 60", len(c.times))
+	}
+	first := c.times[1].Sub(c.times[0])
+	last := c.times[59].Sub(c.times[58])
+	// first gap ~75ms, steady state one is 10ms
+	if first < 3*last || first < 50*time.Millisecond {
+		t.Errorf("Ramp up spacing didn't widen at the start: first %v last %v", first, last)
+	}
+	for i := 2; i < 10; i++ {
+		if c.times[i].Sub(c.times[i-1]) > first+5*time.Millisecond {
+			t.Errorf("Ramp up spacing %d not decreasing: %v vs first %v", i, c.times[i].Sub(c.times[i-1]), first)
+		}
+	}
+	// 27.5 calls during the 500ms ramp up, excluded from the histogram
+	if res.DurationHistogram.Count < 30 || res.DurationHistogram.Count > 34 {
+		t.Errorf("Unexpected histogram count %d when excluding the ramp up", res.DurationHistogram.Count)
+	}
+}
+
 func Test2Watchers(t *testing.T) {
 	// Wait for previous test to cleanup watchers
 	time.Sleep(200 * time.Millisecond)
@@ -367,3 +1479,185 @@ func Test2Watchers(t *testing.T) {
 	}
 	gAbortMutex.Unlock()
 }
+
+// TestCapacity is a synthetic target whose latency degrades (from 1ms to
+// 50ms) past max calls per 250ms window, i.e. 4*max qps.
+type TestCapacity struct {
+	lock   sync.Mutex
+	window time.Time
+	calls  int
+	max    int
+}
+
+func (c *TestCapacity) Run(i int) {
+	now := time.Now().Truncate(250 * time.Millisecond)
+	c.lock.Lock()
+	if !now.Equal(c.window) {
+		c.window = now
+		c.calls = 0
+	}
+	c.calls++
+	over := c.calls > c.max
+	c.lock.Unlock()
+	if over {
+		time.Sleep(50 * time.Millisecond)
+	} else {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	target := TestCapacity{max: 25} // 100 qps
+	probe := func(qps float64, duration time.Duration) (*RunnerResults, error) {
+		o := RunnerOptions{QPS: qps, Duration: duration, NumThreads: 2}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&target)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		return &res, nil
+	}
+	co := CalibrationOptions{MinQPS: 10, MaxQPS: 400, ProbeDuration: 500 * time.Millisecond,
+		MaxP99: 20 * time.Millisecond, Precision: 0.1}
+	res, err := Calibrate(&co, probe)
+	if err != nil {
+		t.Fatalf("Unexpected calibration error %v", err)
+	}
+	if res.MaxQPS < 70 || res.MaxQPS > 115 {
+		t.Errorf("Discovered max qps %g not near the 100 capacity: %+v", res.MaxQPS, res.Probes)
+	}
+	if len(res.Probes) < 6 || len(res.Probes) > 20 {
+		t.Errorf("Unexpected number of probes %d", len(res.Probes))
+	}
+	// MaxQPS sustainable: no search past it
+	co = CalibrationOptions{MinQPS: 10, MaxQPS: 40, ProbeDuration: 500 * time.Millisecond, MaxP99: 20 * time.Millisecond}
+	if res, err = Calibrate(&co, probe); err != nil || res.MaxQPS != 40 || len(res.Probes) != 3 {
+		t.Errorf("Expected 40 qps after 3 probes, got %+v (%v)", res, err)
+	}
+	if _, err = Calibrate(&CalibrationOptions{MaxQPS: 10}, probe); err == nil {
+		t.Errorf("Expected error without max p99")
+	}
+	if _, err = Calibrate(&CalibrationOptions{MinQPS: 10, MaxP99: time.Second}, probe); err == nil {
+		t.Errorf("Expected error without max qps")
+	}
+}
+
+func TestCalibrateErrorRate(t *testing.T) {
+	c := Noop{}
+	// 20% of the calls fail above 100 qps
+	probe := func(qps float64, duration time.Duration) (*RunnerResults, error) {
+		o := RunnerOptions{QPS: qps, Duration: duration, NumThreads: 2, MaxErrorRate: 0.05}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		if qps > 100 {
+			res.ErrorCount = res.DurationHistogram.Count / 5
+		}
+		return &res, res.CheckErrorRate(o.MaxErrorRate)
+	}
+	co := CalibrationOptions{MinQPS: 25, MaxQPS: 400, ProbeDuration: 200 * time.Millisecond,
+		MaxP99: time.Second, MaxErrorRate: 0.05, Precision: 0.1}
+	res, err := Calibrate(&co, probe)
+	if err != nil {
+		t.Fatalf("Unexpected calibration error %v", err)
+	}
+	if res.MaxQPS < 90 || res.MaxQPS > 100 {
+		t.Errorf("Discovered max qps %g not near the 100 errors limit: %+v", res.MaxQPS, res.Probes)
+	}
+	for _, p := range res.Probes {
+		if p.Sustainable != (p.QPS <= 100) || (p.QPS > 100 && math.Abs(p.ErrorRate-0.2) > 0.05) {
+			t.Errorf("Unexpected probe %+v", p)
+		}
+	}
+	// Other errors still end the calibration
+	failing := func(qps float64, duration time.Duration) (*RunnerResults, error) {
+		return &RunnerResults{}, errors.New("probe failure")
+	}
+	if _, err = Calibrate(&co, failing); err == nil || err.Error() != "probe failure" {
+		t.Errorf("Expected the probe failure, got %v", err)
+	}
+}
+
+func TestChooseResolution(t *testing.T) {
+	tests := []struct {
+		min, max float64
+		expected float64
+	}{
+		{0.001, 0.05, 5e-5},   // max at the 1000 bucket, min at 20
+		{0.001, 0.009, 1e-5},  // rounded up
+		{0.0001, 0.1, 1e-5},   // 1000x range: max at 10000 for min at 10
+		{0.00001, 1, 1e-4},    // wider: max stays at 10000
+		{0, 0.002, 2e-6},      // 0 min doesn't matter
+		{0, 0, 0},             // no useful sample
+		{0.001, -1, 0},        // invalid
+		{0.002, 0.002, 2e-6},  // single value
+		{1.5, 12, 0.02},       // seconds
+		{1e-6, 4e-6, 5e-9},    // nanoseconds
+		{0.003, 0.0031, 5e-6}, // narrow
+	}
+	for _, tst := range tests {
+		res := ChooseResolution(tst.min, tst.max)
+		if math.Abs(res-tst.expected) > 1e-9*tst.expected {
+			t.Errorf("ChooseResolution(%g, %g) = %g, expected %g", tst.min, tst.max, res, tst.expected)
+		}
+		if res <= 0 {
+			continue
+		}
+		// the range is in the finer buckets (or max within the last ones for wide ranges)
+		if v := tst.max / res; v < 400 || v > 10000 {
+			t.Errorf("ChooseResolution(%g, %g) = %g maps max to %g", tst.min, tst.max, res, v)
+		}
+		if v := tst.min / res; tst.max/tst.min <= 100 && v < 4 {
+			t.Errorf("ChooseResolution(%g, %g) = %g maps min to %g", tst.min, tst.max, res, v)
+		}
+	}
+}
+
+// TestSteps sleeps 1 to 10ms (in turn).
+type TestSteps struct {
+	count int64
+}
+
+func (c *TestSteps) Run(i int) {
+	n := atomic.AddInt64(&c.count, 1)
+	time.Sleep(time.Duration(1+n%10) * time.Millisecond)
+}
+
+func TestAutoResolution(t *testing.T) {
+	for _, exactly := range []int64{200, 20} { // 20: run ends during the sampling
+		var c TestSteps
+		o := RunnerOptions{
+			QPS:            -1,
+			NumThreads:     4,
+			Exactly:        exactly,
+			AutoResolution: true,
+		}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		// 1 to 10ms (and some sleep overshoot): 2e-5 (max 20ms for 5e-5)
+		chosen := r.Options().Resolution
+		if chosen < 1e-5 || chosen > 5e-5 {
+			t.Errorf("%d calls: unexpected resolution %g for %g - %g", exactly, chosen, res.DurationHistogram.Min,
+				res.DurationHistogram.Max)
+		}
+		h := res.DurationHistogram
+		if h.Count != exactly || h.Min < 0.001 {
+			t.Errorf("%d calls: sampled calls lost or changed: %d calls, min %g", exactly, h.Count, h.Min)
+		}
+		if p50 := h.CalcPercentile(50); p50 < 0.004 || p50 > 0.008 {
+			t.Errorf("%d calls: unexpected p50 %g", exactly, p50)
+		}
+		if exactly < AutoResolutionSamples {
+			continue // all re-binned from the 1ms buckets
+		}
+		// The buckets are at most 25% of their values wide (vs 1ms at the
+		// default resolution), but the first one which starts at Min
+		for _, b := range h.Data[1:] {
+			if width := b.End - b.Start; width > 0.25*b.End {
+				t.Errorf("%d calls: %+v bucket too wide at resolution %g", exactly, b, chosen)
+			}
+		}
+	}
+}
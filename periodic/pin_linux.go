@@ -0,0 +1,86 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package periodic
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"istio.io/fortio/log"
+)
+
+// cpuSet is the kernel's cpu_set_t, for up to 1024 CPUs.
+type cpuSet [16]uint64
+
+func (s *cpuSet) add(cpu int) {
+	s[cpu/64] |= 1 << uint(cpu%64)
+}
+
+func (s *cpuSet) has(cpu int) bool {
+	return s[cpu/64]&(1<<uint(cpu%64)) != 0
+}
+
+// schedAffinity gets or sets (depending on trap) the affinity of the
+// calling OS thread.
+func schedAffinity(trap uintptr, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set))) // nolint: gas
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// allowedCPUs returns the CPUs the calling thread is allowed to run on.
+func allowedCPUs() ([]int, error) {
+	var set cpuSet
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &set); err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for cpu := 0; cpu < len(set)*64; cpu++ {
+		if set.has(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// pinThread locks the calling go routine to its OS thread and binds that
+// thread to cpu. The returned function restores the affinity to all of the
+// allowed CPUs and unlocks the thread; if that fails the go routine stays
+// locked so the pinned thread exits with it instead of being reused.
+func pinThread(cpu int, allowed []int) (func(), error) {
+	runtime.LockOSThread()
+	var set cpuSet
+	set.add(cpu)
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &set); err != nil {
+		runtime.UnlockOSThread()
+		return nil, err
+	}
+	return func() {
+		var all cpuSet
+		for _, c := range allowed {
+			all.add(c)
+		}
+		if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &all); err != nil {
+			log.Warnf("Unable to restore the cpu affinity after cpu %d: %v", cpu, err)
+			return
+		}
+		runtime.UnlockOSThread()
+	}, nil
+}
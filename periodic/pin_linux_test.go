@@ -0,0 +1,69 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package periodic
+
+import (
+	"sync"
+	"testing"
+)
+
+// pinChecker records the CPUs each thread is allowed to run on during its calls.
+type pinChecker struct {
+	lock *sync.Mutex
+	cpus map[int][]int // by thread id
+	t    *testing.T
+}
+
+func (p *pinChecker) Run(t int) {
+	cpus, err := allowedCPUs()
+	if err != nil {
+		p.t.Errorf("[%d] unexpected affinity error: %v", t, err)
+		return
+	}
+	p.lock.Lock()
+	p.cpus[t] = cpus
+	p.lock.Unlock()
+}
+
+func TestPinThreads(t *testing.T) {
+	allowed, err := allowedCPUs()
+	if err != nil || len(allowed) == 0 {
+		t.Fatalf("unexpected allowed cpus %v, %v", allowed, err)
+	}
+	numThreads := 3
+	lock := &sync.Mutex{}
+	seen := make(map[int][]int)
+	o := RunnerOptions{QPS: -1, NumThreads: numThreads, Exactly: 30, PinThreads: true}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&pinChecker{lock: lock, cpus: seen, t: t})
+	r.Run()
+	r.Options().ReleaseRunners()
+	if len(seen) != numThreads {
+		t.Errorf("expected calls from %d threads, got %v", numThreads, seen)
+	}
+	for id, cpus := range seen {
+		expected := allowed[id%len(allowed)]
+		if len(cpus) != 1 || cpus[0] != expected {
+			t.Errorf("thread %d: expected to be pinned to cpu %d, got %v", id, expected, cpus)
+		}
+	}
+	// The affinity is restored at the end of the run:
+	after, err := allowedCPUs()
+	if err != nil || len(after) != len(allowed) {
+		t.Errorf("expected affinity restored to %v, got %v, %v", allowed, after, err)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package periodic
+
+// allowedCPUs returns nil: pinning threads is only supported on linux.
+func allowedCPUs() ([]int, error) {
+	return nil, nil
+}
+
+// pinThread is a no-op outside of linux.
+func pinThread(cpu int, allowed []int) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"istio.io/fortio/stats"
+)
+
+// AutoResolutionSamples is the number of calls of the AutoResolution
+// sampling phase.
+const AutoResolutionSamples = 100
+
+// The histogram buckets (in resolution units) are 10 to 25% wide between 10
+// and 1000, coarser below and above (up to the last one, 100000).
+const (
+	autoResolutionMinValue = 10
+	autoResolutionMaxValue = 1000
+	autoResolutionLimit    = 10000 // highest value max is mapped to, to favor min
+)
+
+// ChooseResolution returns the histogram resolution (Divider) for durations
+// between min and max (in seconds): the one mapping max to the 1000 bucket,
+// so the range gets the finer buckets while up to 100 times max still fits.
+// When min would then be below the 10 bucket (a range over 100x) it is
+// lowered, for the precision of the lower durations, down to mapping max to
+// the 10000 bucket. It is rounded up to a 1, 2 or 5 multiple of a power of
+// 10. Returns 0 if max isn't > 0 (no useful sample).
+func ChooseResolution(min, max float64) float64 {
+	if max <= 0 || math.IsInf(max, 0) || math.IsNaN(max) {
+		return 0
+	}
+	target := max / autoResolutionMaxValue
+	if min > 0 && min/autoResolutionMinValue < target {
+		target = math.Max(min/autoResolutionMinValue, max/autoResolutionLimit)
+	}
+	e := math.Pow10(int(math.Floor(math.Log10(target))))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if m*e >= target*(1-1e-9) {
+			return m * e
+		}
+	}
+	return 10 * e // not reached
+}
+
+// resolutionSampler implements AutoResolution: the first AutoResolutionSamples
+// calls of the run (over all the threads) are recorded at the Resolution and
+// their min and max durations observed. The resolution is then chosen (see
+// ChooseResolution) and each thread re-records its histograms' data (at the
+// buckets mid points) in the new layout, on its next call, before continuing
+// with it. A run shorter than the sampling phase gets the resolution chosen
+// from all its calls at the end.
+type resolutionSampler struct {
+	mu       sync.Mutex
+	sampled  stats.Counter
+	chosen   uint64  // math.Float64bits of the chosen resolution, 0 until then
+	fallback float64 // resolution kept when there is no useful sample
+}
+
+// observe records a call duration (in seconds) during the sampling phase and
+// returns the chosen resolution, 0 until it is.
+func (s *resolutionSampler) observe(d float64) float64 {
+	if res := s.resolution(); res > 0 {
+		return res
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res := s.resolution(); res > 0 {
+		return res
+	}
+	s.sampled.Record(d)
+	if s.sampled.Count < AutoResolutionSamples {
+		return 0
+	}
+	return s.choose()
+}
+
+// finish chooses the resolution from the calls sampled so far if the run
+// ended during the sampling phase, and returns it (0 without any sample).
+func (s *resolutionSampler) finish() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if res := s.resolution(); res > 0 || s.sampled.Count == 0 {
+		return res
+	}
+	return s.choose()
+}
+
+// choose sets the resolution for the sampled durations, called with mu held.
+func (s *resolutionSampler) choose() float64 {
+	res := ChooseResolution(s.sampled.Min, s.sampled.Max)
+	if res <= 0 {
+		res = s.fallback
+	}
+	atomic.StoreUint64(&s.chosen, math.Float64bits(res))
+	return res
+}
+
+// resolution returns the chosen resolution, 0 until it is.
+func (s *resolutionSampler) resolution() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.chosen))
+}
+
+// rebucket re-records the data of h, if not nil and not already at that
+// resolution, in the layout of the resolution. Count, Min, Max and Sum stay
+// exact while the buckets' counts are moved at their mid point.
+func rebucket(h *stats.Histogram, resolution float64) {
+	if h == nil || h.Divider == resolution {
+		return
+	}
+	nh := stats.NewHistogram(h.Offset, resolution)
+	nh.PercentileMethod = h.PercentileMethod
+	nh.Transfer(h)
+	*h = *nh
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/fortio/log"
+	"istio.io/fortio/stats"
+)
+
+// Defaults of the sliding window regression detection.
+const (
+	DefaultWindowDuration             = 10 * time.Second
+	DefaultDegradationFactor          = 1.5
+	DefaultDegradationBaselineWindows = 5
+)
+
+// DegradationEvent is the window whose p99 exceeded DegradationFactor times
+// the baseline, passed to the DegradationCallback.
+type DegradationEvent struct {
+	Window   int           // index of the window in the run, from 0
+	Elapsed  time.Duration // since the start of the run, at the end of the window
+	Count    int64         // number of calls of the window
+	P99      float64       // of the window, in seconds
+	Baseline float64       // average p99 of the previous windows, in seconds
+	Factor   float64       // P99 / Baseline
+}
+
+// degradationDetector keeps the p99 of the last windows to compare the new
+// ones to.
+type degradationDetector struct {
+	factor  float64
+	size    int       // number of windows of the baseline
+	history []float64 // p99 of the last (up to size) windows, oldest first
+	windows int       // evaluated so far
+}
+
+// baseline returns the average p99 of the previous windows, 0 if none.
+func (d *degradationDetector) baseline() float64 {
+	if len(d.history) == 0 {
+		return 0
+	}
+	sum := 0.
+	for _, v := range d.history {
+		sum += v
+	}
+	return sum / float64(len(d.history))
+}
+
+// add evaluates the window ending at elapsed, returns whether its p99 exceeds
+// the baseline by more than the factor along with the event. Empty windows are
+// skipped. Each window then becomes part of the (moving) baseline, degraded or
+// not, so a lasting change only fires for the next size windows.
+func (d *degradationDetector) add(h *stats.Histogram, elapsed time.Duration) (DegradationEvent, bool) {
+	if h.Count == 0 {
+		return DegradationEvent{}, false
+	}
+	p99 := h.Export().CalcPercentile(99)
+	e := DegradationEvent{Window: d.windows, Elapsed: elapsed, Count: h.Count, P99: p99, Baseline: d.baseline()}
+	d.windows++
+	degraded := e.Baseline > 0 && p99 > e.Baseline*d.factor
+	if degraded {
+		e.Factor = p99 / e.Baseline
+	}
+	d.history = append(d.history, p99)
+	if len(d.history) > d.size {
+		d.history = d.history[1:]
+	}
+	return e, degraded
+}
+
+// startWindows starts the sliding window regression detection go routine,
+// if there is a DegradationCallback. Each thread also records its calls'
+// durations in its window histogram, under the thread lock (like for the
+// ProgressCallback). Every WindowDuration the windows are transferred (and
+// thus cleared) into the window's histogram whose p99 is compared to the
+// moving baseline of the previous windows. Returns the function to call to
+// stop it (once the threads are done): the last, partial, window isn't
+// evaluated.
+func (r *periodicRunner) startWindows(start time.Time, locks []sync.Mutex) func() {
+	if r.DegradationCallback == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d := &degradationDetector{factor: r.DegradationFactor, size: r.DegradationBaselineWindows}
+		ticker := time.NewTicker(r.WindowDuration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			window := stats.NewHistogram(0, r.windows[0].Divider)
+			for t, h := range r.windows {
+				locks[t].Lock()
+				window.Transfer(h)
+				locks[t].Unlock()
+			}
+			if e, degraded := d.add(window, time.Since(start)); degraded {
+				log.Warnf("Window %d p99 %g is %.2f times the baseline %g", e.Window, e.P99, e.Factor, e.Baseline)
+				r.DegradationCallback(e)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
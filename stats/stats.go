@@ -17,12 +17,15 @@ package stats // import "istio.io/fortio/stats"
 import (
 	"bufio"
 	"bytes"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"istio.io/fortio/log"
 )
@@ -34,7 +37,11 @@ type Counter struct {
 	Min          float64
 	Max          float64
 	Sum          float64
-	sumOfSquares float64
+	SumOfSquares float64
+	// Sum of the squared differences to the mean, updated incrementally
+	// (Welford) so the StdDev stays accurate for large values with a small
+	// spread, unlike SumOfSquares - Sum²/Count.
+	M2 float64
 }
 
 // Record records a data point.
@@ -45,6 +52,11 @@ func (c *Counter) Record(v float64) {
 // RecordN efficiently records the same value N times
 func (c *Counter) RecordN(v float64, n int) {
 	isFirst := (c.Count == 0)
+	if !isFirst {
+		// n times v is a counter of mean v and M2 0 to merge (see Merge)
+		delta := v - c.Avg()
+		c.M2 += delta * delta * float64(c.Count) * float64(n) / float64(c.Count+int64(n))
+	}
 	c.Count += int64(n)
 	if isFirst {
 		c.Min = v
@@ -54,26 +66,24 @@ func (c *Counter) RecordN(v float64, n int) {
 	} else if v > c.Max {
 		c.Max = v
 	}
-	s := v * float64(n)
-	c.Sum += s
-	c.sumOfSquares += (s * s)
+	c.Sum += v * float64(n)
+	c.SumOfSquares += v * v * float64(n)
 }
 
-// Avg returns the average.
+// Avg returns the average, 0 when there is no data.
 func (c *Counter) Avg() float64 {
+	if c.Count == 0 {
+		return 0
+	}
 	return c.Sum / float64(c.Count)
 }
 
-// StdDev returns the standard deviation.
+// StdDev returns the standard deviation, 0 when there is no data.
 func (c *Counter) StdDev() float64 {
-	fC := float64(c.Count)
-	sigma := (c.sumOfSquares - c.Sum*c.Sum/fC) / fC
-	// should never happen but it does
-	if sigma < 0 {
-		log.Warnf("Unexpected negative sigma for %+v: %g", c, sigma)
+	if c.Count == 0 {
 		return 0
 	}
-	return math.Sqrt(sigma)
+	return math.Sqrt(c.M2 / float64(c.Count))
 }
 
 // Print prints stats.
@@ -96,24 +106,57 @@ func (c *Counter) Reset() {
 
 // Transfer merges the data from src into this Counter and clears src.
 func (c *Counter) Transfer(src *Counter) {
-	if src.Count == 0 {
+	c.Merge(src)
+	src.Reset()
+}
+
+// Merge adds the data of other (left unchanged) to this Counter. The
+// resulting Avg and StdDev are the ones of all the recorded values: the M2
+// are combined using Chan et al.'s parallel algorithm.
+func (c *Counter) Merge(other *Counter) {
+	if other.Count == 0 {
 		return // nothing to do
 	}
 	if c.Count == 0 {
-		*c = *src // copy everything at once
-		src.Reset()
+		*c = *other // copy everything at once
 		return
 	}
-	c.Count += src.Count
-	if src.Min < c.Min {
-		c.Min = src.Min
+	nA, nB := float64(c.Count), float64(other.Count)
+	delta := other.Avg() - c.Avg()
+	c.M2 += other.M2 + delta*delta*nA*nB/(nA+nB)
+	c.Count += other.Count
+	if other.Min < c.Min {
+		c.Min = other.Min
 	}
-	if src.Max > c.Max {
-		c.Max = src.Max
+	if other.Max > c.Max {
+		c.Max = other.Max
 	}
-	c.Sum += src.Sum
-	c.sumOfSquares += src.sumOfSquares
-	src.Reset()
+	c.Sum += other.Sum
+	c.SumOfSquares += other.SumOfSquares
+}
+
+// ThreadCounters is for accumulating values from several go routines without
+// locking: each go routine i records in its own For(i) Counter and the
+// results are combined with Merged() once they are all done.
+type ThreadCounters []Counter
+
+// NewThreadCounters returns the ThreadCounters for n go routines.
+func NewThreadCounters(n int) ThreadCounters {
+	return make(ThreadCounters, n)
+}
+
+// For returns the Counter of go routine i.
+func (t ThreadCounters) For(i int) *Counter {
+	return &t[i]
+}
+
+// Merged returns the combination of all the go routines' counters.
+func (t ThreadCounters) Merged() Counter {
+	var res Counter
+	for i := range t {
+		res.Merge(&t[i])
+	}
+	return res
 }
 
 // Histogram - written in go with inspiration from https://github.com/facebook/wdt/blob/master/util/Stats.h
@@ -152,6 +195,13 @@ type Histogram struct {
 	Counter
 	Offset  float64 // offset applied to data before fitting into buckets
 	Divider float64 // divider applied to data before fitting into buckets
+	// Explicit bucket edges (from NewHistogramWithBuckets) used instead of
+	// the Offset and Divider scaled default ones when set.
+	Edges []float64 `json:",omitempty"`
+	// Whether the Edges are the log scale ones of NewLogHistogram.
+	LogScale bool `json:",omitempty"`
+	// How the exported percentiles are calculated (LinearInterpolation by default).
+	PercentileMethod PercentileMethod `json:",omitempty"`
 	// Don't access directly (outside of this package):
 	Hdata []int32 // numValues buckets (one more than values, for last one)
 }
@@ -174,6 +224,24 @@ type Bucket struct {
 	Count   int64   // How many in this bucket
 }
 
+// PercentileMethod is how a percentile is calculated from the buckets.
+type PercentileMethod int
+
+const (
+	// LinearInterpolation (the default) estimates the value by interpolating
+	// linearly within the bucket the percentile falls in, between its start
+	// and end, according to the percentages they correspond to: e.g. for 10,
+	// 20 and 30, p50 is 15.
+	LinearInterpolation PercentileMethod = iota
+	// NearestRank returns the value of rank ceil(percentile/100*Count), i.e.
+	// the smallest value such that at least percentile % of the values are
+	// less or equal to it, without interpolation: Min for the first rank and
+	// otherwise the end (upper bound) of that value's bucket, which is the
+	// exact value for a single value bucket and Max for the last one. e.g.
+	// for 10, 20 and 30, p50 is 20.
+	NearestRank
+)
+
 // Percentile value for the percentile
 type Percentile struct {
 	Percentile float64 // For this Percentile
@@ -191,6 +259,8 @@ type HistogramData struct {
 	StdDev      float64
 	Data        []Bucket
 	Percentiles []Percentile
+	// How the Percentiles are calculated (LinearInterpolation by default).
+	PercentileMethod PercentileMethod `json:",omitempty"`
 }
 
 // NewHistogram creates a new histogram (sets up the buckets).
@@ -206,6 +276,48 @@ func NewHistogram(Offset float64, Divider float64) *Histogram {
 	return h
 }
 
+// NewHistogramWithBuckets creates a new histogram using the explicit bucket
+// edges instead of the default ones: the intervals are ]prev edge, edge] with
+// a first bucket for the values <= edges[0] and a last one for the values >
+// the last edge. The edges must be strictly increasing, otherwise returns nil.
+func NewHistogramWithBuckets(edges []float64) *Histogram {
+	if len(edges) == 0 {
+		return nil
+	}
+	for i := 1; i < len(edges); i++ {
+		if edges[i] <= edges[i-1] {
+			return nil
+		}
+	}
+	h := new(Histogram)
+	h.Divider = 1
+	h.Edges = append([]float64{}, edges...)
+	h.Hdata = make([]int32, len(edges)+1)
+	return h
+}
+
+// NewLogHistogram creates a new histogram with log scale buckets: from min
+// to (at least) max, each bucket is 10^-significantFigures wider than the
+// previous one, so the relative error of the percentiles stays bounded by
+// about that ratio across a wide range (e.g. microseconds to seconds).
+// The values below min and above max are in the first and last bucket.
+// min must be > 0, max > min and significantFigures between 1 and 5,
+// otherwise returns nil.
+func NewLogHistogram(min, max float64, significantFigures int) *Histogram {
+	if min <= 0 || max <= min || significantFigures < 1 || significantFigures > 5 {
+		return nil
+	}
+	ratio := 1 + math.Pow(10, -float64(significantFigures))
+	n := int(math.Ceil(math.Log(max/min)/math.Log(ratio))) + 1
+	edges := make([]float64, n)
+	for i := range edges {
+		edges[i] = min * math.Pow(ratio, float64(i))
+	}
+	h := NewHistogramWithBuckets(edges)
+	h.LogScale = true
+	return h
+}
+
 // Val2Bucket values are kept in two different structure
 // val2Bucket allows you reach between 0 and 1000 in constant time
 func init() {
@@ -254,6 +366,19 @@ func (h *Histogram) Record(v float64) {
 	h.RecordN(v, 1)
 }
 
+// RecordCorrected records v and, to correct the coordinated omission of a
+// caller which was supposed to record a value every interval but was blocked
+// during v, the values v-interval, v-2*interval... down to interval.
+func (h *Histogram) RecordCorrected(v, interval float64) {
+	h.Record(v)
+	if interval <= 0 {
+		return
+	}
+	for missing := v - interval; missing >= interval; missing -= interval {
+		h.Record(missing)
+	}
+}
+
 // RecordN efficiently records a data point N times.
 func (h *Histogram) RecordN(v float64, n int) {
 	h.Counter.RecordN(v, n)
@@ -262,6 +387,11 @@ func (h *Histogram) RecordN(v float64, n int) {
 
 // Records v value to count times
 func (h *Histogram) record(v float64, count int) {
+	if h.Edges != nil {
+		// first edge >= v, or len(Edges) for the last bucket
+		h.Hdata[sort.SearchFloat64s(h.Edges, v)] += int32(count)
+		return
+	}
 	// Scaled value to bucketize - we subtract epsilon because the interval
 	// is open to the left ] start, end ] so when exactly on start it has
 	// to fall on the previous bucket. TODO add boundary tests
@@ -283,29 +413,67 @@ func (h *Histogram) record(v float64, count int) {
 // where 90.0% of the data is below said threshold.
 // with 3 data points 10, 20, 30; p0-p33.33 == 10, p 66.666 = 20, p100 = 30
 // p33.333 - p66.666 = linear between 10 and 20; so p50 = 15
+// (with the default LinearInterpolation PercentileMethod, p50 is 20 with NearestRank)
 // TODO: consider spreading the count of the bucket evenly from start to end
 // so the % grows by at least to 1/N on start of range, and for last range
 // when start == end we should get to that % faster
 func (e *HistogramData) CalcPercentile(percentile float64) float64 {
+	v, _, _ := e.CalcPercentileWithBounds(percentile)
+	return v
+}
+
+// CalcPercentileWithBounds returns CalcPercentile's estimate and the range
+// the actual value is in: the bounds of its bucket, or the exact value (in
+// all 3) for Min and Max. Wide bounds, e.g. for p99.9 of sparse data, mean
+// the estimate shouldn't be over interpreted.
+func (e *HistogramData) CalcPercentileWithBounds(percentile float64) (value, low, high float64) {
 	if len(e.Data) == 0 {
 		log.Errf("Unexpected call to CalcPercentile(%g) with no data", percentile)
-		return 0
+		return 0, 0, 0
 	}
 	if percentile >= 100 {
-		return e.Max
+		return e.Max, e.Max, e.Max
+	}
+	if e.PercentileMethod == NearestRank {
+		return e.nearestRank(percentile)
 	}
 	// We assume Min is at least a single point so at least covers 1/Count %
 	pp := 100. / float64(e.Count) // previous percentile
 	if percentile <= pp {
-		return e.Min
+		return e.Min, e.Min, e.Min
 	}
 	for _, cur := range e.Data {
 		if percentile <= cur.Percent {
-			return cur.Start + (percentile-pp)/(cur.Percent-pp)*(cur.End-cur.Start)
+			return cur.Start + (percentile-pp)/(cur.Percent-pp)*(cur.End-cur.Start), cur.Start, cur.End
 		}
 		pp = cur.Percent
 	}
-	return e.Max // not reached
+	return e.Max, e.Max, e.Max // not reached
+}
+
+// CalcPercentileWithMethod is CalcPercentile using the given method instead
+// of the PercentileMethod of the data.
+func (e *HistogramData) CalcPercentileWithMethod(percentile float64, method PercentileMethod) float64 {
+	c := *e
+	c.PercentileMethod = method
+	return c.CalcPercentile(percentile)
+}
+
+// nearestRank returns the NearestRank value for the percentile (< 100) and
+// its bounds like CalcPercentileWithBounds.
+func (e *HistogramData) nearestRank(percentile float64) (value, low, high float64) {
+	rank := int64(math.Ceil(percentile * float64(e.Count) / 100.))
+	if rank <= 1 {
+		return e.Min, e.Min, e.Min
+	}
+	var total int64
+	for _, cur := range e.Data {
+		total += cur.Count
+		if total >= rank {
+			return cur.End, cur.Start, cur.End
+		}
+	}
+	return e.Max, e.Max, e.Max // not reached
 }
 
 // Export translate the internal representation of the histogram data in
@@ -318,11 +486,11 @@ func (h *Histogram) Export() *HistogramData {
 	res.Sum = h.Counter.Sum
 	res.Avg = h.Counter.Avg()
 	res.StdDev = h.Counter.StdDev()
-	multiplier := h.Divider
-	offset := h.Offset
+	res.PercentileMethod = h.PercentileMethod
 	// calculate the last bucket index
 	lastIdx := -1
-	for i := numBuckets - 1; i >= 0; i-- {
+	nValues := len(h.Hdata) - 1
+	for i := nValues; i >= 0; i-- {
 		if h.Hdata[i] > 0 {
 			lastIdx = i
 			break
@@ -332,17 +500,11 @@ func (h *Histogram) Export() *HistogramData {
 		return &res
 	}
 
-	// previous bucket value:
-	prev := histogramBucketValues[0]
 	var total int64
 	ctrTotal := float64(h.Count)
 	// export the data of each bucket of the histogram
 	for i := 0; i <= lastIdx; i++ {
 		if h.Hdata[i] == 0 {
-			// empty bucket: skip it but update prev which is needed for next iter
-			if i < numValues {
-				prev = histogramBucketValues[i]
-			}
 			continue
 		}
 		var b Bucket
@@ -351,16 +513,14 @@ func (h *Histogram) Export() *HistogramData {
 			// First entry, start is min
 			b.Start = h.Min
 		} else {
-			b.Start = multiplier*float64(prev) + offset
+			b.Start = h.bucketEnd(i - 1)
 		}
 		b.Percent = 100. * float64(total) / ctrTotal
-		if i < numValues {
-			cur := histogramBucketValues[i]
-			b.End = multiplier*float64(cur) + offset
-			prev = cur
+		if i < nValues {
+			b.End = h.bucketEnd(i)
 		} else {
 			// Last Entry
-			b.Start = multiplier*float64(prev) + offset
+			b.Start = h.bucketEnd(i - 1)
 			b.End = h.Max
 		}
 		b.Count = int64(h.Hdata[i])
@@ -370,6 +530,27 @@ func (h *Histogram) Export() *HistogramData {
 	return &res
 }
 
+// bucketEnd returns the (unscaled) end value of bucket i (but the last one).
+func (h *Histogram) bucketEnd(i int) float64 {
+	if h.Edges != nil {
+		return h.Edges[i]
+	}
+	return h.Divider*float64(histogramBucketValues[i]) + h.Offset
+}
+
+// sameBuckets returns whether h and o have the same buckets layout.
+func (h *Histogram) sameBuckets(o *Histogram) bool {
+	if h.Divider != o.Divider || h.Offset != o.Offset || len(h.Hdata) != len(o.Hdata) || len(h.Edges) != len(o.Edges) {
+		return false
+	}
+	for i, e := range h.Edges {
+		if o.Edges[i] != e {
+			return false
+		}
+	}
+	return true
+}
+
 // CalcPercentiles calculates the requested percentile and add them to the
 // HistogramData. Potential TODO: sort or assume sorting and calculate all
 // the percentiles in 1 pass (greater and greater values).
@@ -416,6 +597,301 @@ func (h *Histogram) Print(out io.Writer, msg string, percentiles []float64) {
 	h.Export().CalcPercentiles(percentiles).Print(out, msg)
 }
 
+// ExportCSV writes the buckets as CSV: a header line and then one line per
+// (non empty) bucket with its start, end, count, cumulative count and
+// cumulative percentile. The last bucket ends at Max. Only the header is
+// written for an empty histogram.
+func (e *HistogramData) ExportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"start", "end", "count", "cumulative", "percentile"}); err != nil {
+		return err
+	}
+	var cumulative int64
+	for _, b := range e.Data {
+		cumulative += b.Count
+		err := cw.Write([]string{
+			strconv.FormatFloat(b.Start, 'g', -1, 64),
+			strconv.FormatFloat(b.End, 'g', -1, 64),
+			strconv.FormatInt(b.Count, 10),
+			strconv.FormatInt(cumulative, 10),
+			strconv.FormatFloat(b.Percent, 'g', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportCSV writes the histogram buckets as CSV, see HistogramData.ExportCSV.
+func (h *Histogram) ExportCSV(w io.Writer) error {
+	return h.Export().ExportCSV(w)
+}
+
+// ExportHGRM writes the histogram in the HdrHistogram percentile distribution
+// (.hgrm) text format: one line per bucket with the bucket end value, the
+// cumulative percentile (as a fraction), the cumulative count and the
+// 1/(1-Percentile) value (omitted for the 100% line, like HdrHistogram does).
+func (e *HistogramData) ExportHGRM(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount", "1/(1-Percentile)"); err != nil {
+		return err
+	}
+	var cumulative int64
+	for _, b := range e.Data {
+		cumulative += b.Count
+		p := b.Percent / 100.
+		var err error
+		if cumulative >= e.Count || p >= 1 {
+			_, err = fmt.Fprintf(w, "%12.6f %2.12f %10d\n", b.End, 1., cumulative)
+		} else {
+			_, err = fmt.Fprintf(w, "%12.6f %2.12f %10d %14.2f\n", b.End, p, cumulative, 1/(1-p))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "#[Mean    = %12.6f, StdDeviation   = %12.6f]\n#[Max     = %12.6f, Total count    = %12d]\n",
+		e.Avg, e.StdDev, e.Max, e.Count)
+	return err
+}
+
+// ExportHGRM writes the histogram in HdrHistogram's .hgrm format, see
+// HistogramData.ExportHGRM.
+func (h *Histogram) ExportHGRM(w io.Writer) error {
+	return h.Export().ExportHGRM(w)
+}
+
+// WritePrometheus writes the histogram h (of call durations in seconds) and
+// the optional count per result code in the Prometheus text exposition
+// format: a prefix_duration_seconds histogram, with 1 cumulative "le" bucket
+// per (non empty) bucket End and the "+Inf" one, and a prefix_requests_total
+// counter with a "code" label. prefix must be a valid metric name.
+func WritePrometheus(w io.Writer, h *HistogramData, codes map[string]int64, prefix string) error {
+	return writeMetrics(w, h, codes, prefix, nil, false, nil)
+}
+
+// WritePrometheusWithLabels is WritePrometheus with constant labels (e.g.
+// environment, git sha) added to all the samples. Returns an error for
+// invalid label names, including the reserved "le" and "code".
+func WritePrometheusWithLabels(w io.Writer, h *HistogramData, codes map[string]int64, prefix string,
+	labels map[string]string) error {
+	return writeMetrics(w, h, codes, prefix, labels, false, nil)
+}
+
+// Exemplar is an observed value, with its labels (e.g. a trace_id) and
+// optional timestamp, to attach to its bucket in the OpenMetrics export.
+type Exemplar struct {
+	Value     float64
+	Labels    map[string]string
+	Timestamp time.Time
+}
+
+// WriteOpenMetrics is WritePrometheus in the OpenMetrics text format. When
+// exemplars is true, the largest of the samples falling in each bucket is
+// attached to it as exemplar. The labels of each sample are limited to 128
+// characters in total by OpenMetrics.
+func WriteOpenMetrics(w io.Writer, h *HistogramData, codes map[string]int64, prefix string,
+	exemplars bool, samples []Exemplar) error {
+	return WriteOpenMetricsWithLabels(w, h, codes, prefix, nil, exemplars, samples)
+}
+
+// WriteOpenMetricsWithLabels is WriteOpenMetrics with constant labels, like
+// WritePrometheusWithLabels.
+func WriteOpenMetricsWithLabels(w io.Writer, h *HistogramData, codes map[string]int64, prefix string,
+	labels map[string]string, exemplars bool, samples []Exemplar) error {
+	if !exemplars {
+		samples = nil
+	}
+	return writeMetrics(w, h, codes, prefix, labels, true, samples)
+}
+
+// writeMetrics implements WritePrometheus and WriteOpenMetrics.
+func writeMetrics(w io.Writer, h *HistogramData, codes map[string]int64, prefix string,
+	labels map[string]string, openMetrics bool, samples []Exemplar) error {
+	constLabels, err := formatLabels(labels)
+	if err != nil {
+		return err
+	}
+	// exemplar for each bucket (the last one being +Inf)
+	bucketExemplars := make([]*Exemplar, len(h.Data)+1)
+	for i := range samples {
+		e := &samples[i]
+		b := sort.Search(len(h.Data), func(j int) bool { return e.Value <= h.Data[j].End })
+		if bucketExemplars[b] == nil || e.Value > bucketExemplars[b].Value {
+			bucketExemplars[b] = e
+		}
+	}
+	bw := bufio.NewWriter(w)
+	name := prefix + "_duration_seconds"
+	fmt.Fprintf(bw, "# HELP %s Duration of the calls.\n# TYPE %s histogram\n", name, name)
+	var cumulative int64
+	for i, b := range h.Data {
+		cumulative += b.Count
+		fmt.Fprintf(bw, "%s_bucket{%sle=\"%s\"} %d%s\n", name, constLabels, formatFloat(b.End), cumulative,
+			exemplarSuffix(bucketExemplars[i]))
+	}
+	fmt.Fprintf(bw, "%s_bucket{%sle=\"+Inf\"} %d%s\n", name, constLabels, h.Count, exemplarSuffix(bucketExemplars[len(h.Data)]))
+	sumCountLabels := ""
+	if constLabels != "" {
+		sumCountLabels = "{" + strings.TrimSuffix(constLabels, ",") + "}"
+	}
+	fmt.Fprintf(bw, "%s_sum%s %s\n%s_count%s %d\n", name, sumCountLabels, formatFloat(h.Sum), name, sumCountLabels, h.Count)
+	if len(codes) > 0 {
+		name = prefix + "_requests"
+		if !openMetrics {
+			name += "_total" // OpenMetrics counters are named without the sample's suffix
+		}
+		fmt.Fprintf(bw, "# HELP %s Number of calls by result code.\n# TYPE %s counter\n", name, name)
+		if openMetrics {
+			name += "_total"
+		}
+		keys := make([]string, 0, len(codes))
+		for k := range codes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(bw, "%s{%scode=%s} %d\n", name, constLabels, strconv.Quote(k), codes[k])
+		}
+	}
+	if openMetrics {
+		fmt.Fprintf(bw, "# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// formatLabels returns the labels, sorted by name, as name="value" pairs each
+// followed by a comma, or an error if a name isn't a valid (nor reserved)
+// label name.
+func formatLabels(labels map[string]string) (string, error) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if !validLabelName(k) || k == "le" || k == "code" {
+			return "", fmt.Errorf("invalid label name %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(k + "=" + strconv.Quote(labels[k]) + ",")
+	}
+	return b.String(), nil
+}
+
+// validLabelName returns true if name matches [a-zA-Z_][a-zA-Z0-9_]* and
+// isn't reserved (starting with __).
+func validLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// exemplarSuffix returns the OpenMetrics exemplar to append to a bucket
+// line, empty for nil.
+func exemplarSuffix(e *Exemplar) string {
+	if e == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(e.Labels))
+	for k := range e.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	labels := make([]string, len(keys))
+	for i, k := range keys {
+		labels[i] = k + "=" + strconv.Quote(e.Labels[k])
+	}
+	res := " # {" + strings.Join(labels, ",") + "} " + formatFloat(e.Value)
+	if !e.Timestamp.IsZero() {
+		res += " " + strconv.FormatFloat(float64(e.Timestamp.UnixNano())/1e9, 'f', -1, 64)
+	}
+	return res
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// InfluxPercentiles are the percentiles written by WriteInfluxLine, as the
+// p50, p75, p90, p99 and p99_9 fields.
+var InfluxPercentiles = []float64{50, 75, 90, 99, 99.9}
+
+// InfluxField returns the name of the WriteInfluxLine field of percentile,
+// e.g. "p99_9" for 99.9.
+func InfluxField(percentile float64) string {
+	return "p" + strings.Replace(formatFloat(percentile), ".", "_", 1)
+}
+
+var (
+	influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\ `)
+	influxKeyEscaper  = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `)
+)
+
+// WriteInfluxLine writes the histogram h (of call durations in seconds) as
+// one point of the measurement in the InfluxDB line protocol: the tags
+// (empty values are omitted) sorted by name, the count (integer), avg, min,
+// max and InfluxPercentiles fields (when h isn't empty), the extra fields
+// (e.g. qps) sorted by name and the timestamp in nanoseconds (omitted when
+// zero).
+func WriteInfluxLine(w io.Writer, measurement string, h *HistogramData, tags map[string]string,
+	fields map[string]float64, ts time.Time) error {
+	if measurement == "" {
+		return errors.New("empty influx measurement name")
+	}
+	var b bytes.Buffer
+	b.WriteString(influxNameEscaper.Replace(measurement))
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + influxKeyEscaper.Replace(k) + "=" + influxKeyEscaper.Replace(tags[k]))
+	}
+	fmt.Fprintf(&b, " count=%di", h.Count)
+	writeField := func(k string, v float64) {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return // not representable in the line protocol
+		}
+		b.WriteString("," + influxKeyEscaper.Replace(k) + "=" + formatFloat(v))
+	}
+	if h.Count > 0 {
+		writeField("avg", h.Avg)
+		writeField("min", h.Min)
+		writeField("max", h.Max)
+		for _, p := range InfluxPercentiles {
+			writeField(InfluxField(p), h.CalcPercentile(p))
+		}
+	}
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeField(k, fields[k])
+	}
+	if !ts.IsZero() {
+		fmt.Fprintf(&b, " %d", ts.UnixNano())
+	}
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
 // Log Logs the histogram to the counter.
 func (h *Histogram) Log(msg string, percentiles []float64) {
 	var b bytes.Buffer
@@ -428,7 +904,7 @@ func (h *Histogram) Log(msg string, percentiles []float64) {
 // Reset clears the data. Reset it to NewHistogram state.
 func (h *Histogram) Reset() {
 	h.Counter.Reset()
-	// Leave Offset and Divider alone
+	// Leave Offset, Divider and Edges alone
 	for i := 0; i < len(h.Hdata); i++ {
 		h.Hdata[i] = 0
 	}
@@ -436,7 +912,14 @@ func (h *Histogram) Reset() {
 
 // Clone returns a copy of the histogram.
 func (h *Histogram) Clone() *Histogram {
-	copy := NewHistogram(h.Offset, h.Divider)
+	var copy *Histogram
+	if h.Edges != nil {
+		copy = NewHistogramWithBuckets(h.Edges)
+		copy.LogScale = h.LogScale
+	} else {
+		copy = NewHistogram(h.Offset, h.Divider)
+	}
+	copy.PercentileMethod = h.PercentileMethod
 	copy.CopyFrom(h)
 	return copy
 }
@@ -449,9 +932,9 @@ func (h *Histogram) CopyFrom(src *Histogram) {
 
 // copyHDataFrom appends histogram data values to this object from the src.
 // Src histogram data values will be appended according to this object's
-// offset and divider
+// offset and divider (or edges)
 func (h *Histogram) copyHDataFrom(src *Histogram) {
-	if h.Divider == src.Divider && h.Offset == src.Offset {
+	if h.sameBuckets(src) {
 		for i := 0; i < len(h.Hdata); i++ {
 			h.Hdata[i] += src.Hdata[i]
 		}
@@ -466,19 +949,113 @@ func (h *Histogram) copyHDataFrom(src *Histogram) {
 
 // Merge two different histogram with different scale parameters
 // Lowest offset and highest divider value will be selected on new Histogram as scale parameters
+// (see MergeHistogramsWithOptions for the ones with explicit Edges). The data
+// is transferred: h1 and h2 are cleared.
 func Merge(h1 *Histogram, h2 *Histogram) *Histogram {
-	divider := h1.Divider
-	offset := h1.Offset
-	if h2.Divider > h1.Divider {
-		divider = h2.Divider
+	newH, _ := MergeHistogramsWithOptions(MergeOptions{Rebucket: true}, h1, h2) // can't fail when rebucketing
+	h1.Reset()
+	h2.Reset()
+	return newH
+}
+
+// MergeOptions are the options for MergeHistogramsWithOptions.
+type MergeOptions struct {
+	// Rebucket histograms whose Offset/Divider differ instead of returning an
+	// error: the data of each bucket is re-recorded at the bucket's mid point
+	// into the lowest Offset and TargetResolution (or highest Divider when 0)
+	// layout of the histograms without explicit Edges (or the union of the
+	// Edges when they all have some). Count, Min, Max, Sum and Avg stay exact but the buckets and thus
+	// the percentiles are approximate (by up to the source bucket widths).
+	Rebucket         bool
+	TargetResolution float64
+}
+
+// MergeHistograms returns a new histogram with the combined data of all the
+// hists, which are left unchanged. Unlike Merge, the histograms must all
+// have the same Offset and Divider (e.g. from shards of a distributed run)
+// or an error is returned.
+func MergeHistograms(hists ...*Histogram) (*Histogram, error) {
+	return MergeHistogramsWithOptions(MergeOptions{}, hists...)
+}
+
+// MergeHistogramsWithOptions is MergeHistograms with the option to rebucket
+// incompatible histograms (see MergeOptions for the accuracy tradeoff).
+func MergeHistogramsWithOptions(o MergeOptions, hists ...*Histogram) (*Histogram, error) {
+	if len(hists) == 0 {
+		return nil, errors.New("no histogram to merge")
 	}
-	if h2.Offset < h1.Offset {
-		offset = h2.Offset
+	// The Divider of the histograms with explicit Edges is always 1 and
+	// meaningless: only the scaled ones set the rebucketing Offset and Divider.
+	// If they all have (different) Edges, the union of the edges is used.
+	offset, divider := 0., 0.
+	scaled := false
+	var edges []float64
+	compatible := true
+	for i, h := range hists {
+		if h == nil {
+			return nil, fmt.Errorf("histogram %d is nil", i)
+		}
+		if !h.sameBuckets(hists[0]) {
+			if !o.Rebucket {
+				return nil, fmt.Errorf("incompatible histogram %d: offset %g divider %g (%d buckets) vs offset %g divider %g (%d buckets)",
+					i, h.Offset, h.Divider, len(h.Hdata), hists[0].Offset, hists[0].Divider, len(hists[0].Hdata))
+			}
+			compatible = false
+		}
+		if h.Edges != nil {
+			edges = append(edges, h.Edges...)
+			continue
+		}
+		if !scaled || h.Offset < offset {
+			offset = h.Offset
+		}
+		if h.Divider > divider {
+			divider = h.Divider
+		}
+		scaled = true
 	}
-	newH := NewHistogram(offset, divider)
-	newH.Transfer(h1)
-	newH.Transfer(h2)
-	return newH
+	if o.Rebucket && o.TargetResolution > 0 {
+		divider = o.TargetResolution
+	}
+	var res *Histogram
+	switch {
+	case divider > 0:
+		res = NewHistogram(offset, divider)
+	case compatible:
+		res = NewHistogramWithBuckets(hists[0].Edges)
+	default:
+		res = NewHistogramWithBuckets(uniqueSorted(edges))
+	}
+	// Keep the PercentileMethod, and the LogScale of the same edges, when all
+	// the histograms agree.
+	res.PercentileMethod = hists[0].PercentileMethod
+	res.LogScale = compatible && res.Edges != nil
+	for _, h := range hists {
+		if h.PercentileMethod != hists[0].PercentileMethod {
+			res.PercentileMethod = LinearInterpolation
+		}
+		res.LogScale = res.LogScale && h.LogScale
+	}
+	if !res.sameBuckets(hists[0]) {
+		log.Infof("Rebucketing %d histograms into offset %g divider %g (%d buckets), percentiles will be approximate",
+			len(hists), res.Offset, res.Divider, len(res.Hdata))
+	}
+	for _, h := range hists {
+		res.Transfer(h.Clone())
+	}
+	return res, nil
+}
+
+// uniqueSorted sorts values in place and returns them without duplicates.
+func uniqueSorted(values []float64) []float64 {
+	sort.Float64s(values)
+	res := values[:0]
+	for _, v := range values {
+		if len(res) == 0 || v != res[len(res)-1] {
+			res = append(res, v)
+		}
+	}
+	return res
 }
 
 // Transfer merges the data from src into this Histogram and clears src.
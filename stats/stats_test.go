@@ -19,12 +19,17 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"istio.io/fortio/log"
 )
@@ -34,7 +39,7 @@ func TestCounter(t *testing.T) {
 	var b bytes.Buffer
 	w := bufio.NewWriter(&b)
 	c.Counter.Print(w, "test1c")
-	expected := "test1c : count 0 avg NaN +/- NaN min 0 max 0 sum 0\n"
+	expected := "test1c : count 0 avg 0 +/- 0 min 0 max 0 sum 0\n"
 	c.Print(w, "test1h", []float64{50.0})
 	expected += "test1h : no data\n"
 	*log.LogFileAndLine = false
@@ -118,9 +123,9 @@ func TestTransferCounter(t *testing.T) {
 	expected := `c1 before merge : count 2 avg 15 +/- 5 min 10 max 20 sum 30
 c2 before merge : count 2 avg 85 +/- 5 min 80 max 90 sum 170
 mergedC1C2 : count 4 avg 50 +/- 35.36 min 10 max 90 sum 200
-c2 after merge : count 0 avg NaN +/- NaN min 0 max 0 sum 0
+c2 after merge : count 0 avg 0 +/- 0 min 0 max 0 sum 0
 mergedC2C1 : count 4 avg 50 +/- 35.36 min 10 max 90 sum 200
-c1 should now be empty : count 0 avg NaN +/- NaN min 0 max 0 sum 0
+c1 should now be empty : count 0 avg 0 +/- 0 min 0 max 0 sum 0
 c3 after merge - 1 : count 4 avg 50 +/- 35.36 min 10 max 90 sum 200
 c3 after merge - 2 : count 4 avg 50 +/- 35.36 min 10 max 90 sum 200
 `
@@ -219,6 +224,16 @@ func TestPercentiles1(t *testing.T) {
 	}
 }
 
+func TestRecordCorrected(t *testing.T) {
+	h := NewHistogram(0, 1)
+	h.RecordCorrected(3.5, 1) // 3.5, 2.5, 1.5
+	h.RecordCorrected(0.5, 1)
+	h.RecordCorrected(2, 0) // no correction without interval
+	if h.Count != 5 || h.Sum != 10 || h.Min != 0.5 || h.Max != 3.5 {
+		t.Errorf("Unexpected corrected histogram %+v", h.Counter)
+	}
+}
+
 func TestHistogramData(t *testing.T) {
 	h := NewHistogram(0, 1)
 	h.Record(-1)
@@ -301,6 +316,12 @@ func TestHistogramExport1(t *testing.T) {
 	e := h.Export()
 	CheckEquals(t, e.Count, int64(0), "empty is 0 count")
 	CheckEquals(t, len(e.Data), 0, "empty is no bucket data")
+	CheckEquals(t, e.Avg, 0., "empty is 0 avg")
+	CheckEquals(t, e.StdDev, 0., "empty is 0 stddev")
+	CheckEquals(t, len(e.CalcPercentiles([]float64{50, 99}).Percentiles), 0, "empty has no percentiles")
+	if _, err := json.Marshal(e); err != nil {
+		t.Errorf("Empty histogram should be serializable: %v", err)
+	}
 	h.Record(-137.4)
 	h.Record(251)
 	h.Record(501)
@@ -445,6 +466,648 @@ func TestHistogramLastBucket(t *testing.T) {
 	}
 }
 
+func TestHistogramExportCSV(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 10)
+	if err := h.ExportCSV(&b); err != nil {
+		t.Error(err)
+	}
+	CheckEquals(t, b.String(), "start,end,count,cumulative,percentile\n", "empty histogram csv")
+	b.Reset()
+	h.Record(-137.4)
+	h.Record(251)
+	h.Record(251)
+	h.Record(501)
+	h.Record(751)
+	h.Record(1001.67)
+	h.Record(2000000) // open ended last bucket
+	if err := h.ExportCSV(&b); err != nil {
+		t.Error(err)
+	}
+	expected := `start,end,count,cumulative,percentile
+-137.4,0,1,1,14.285714285714286
+250,300,2,3,42.857142857142854
+500,600,1,4,57.142857142857146
+700,800,1,5,71.42857142857143
+1000,1200,1,6,85.71428571428571
+1e+06,2e+06,1,7,100
+`
+	CheckEquals(t, b.String(), expected, "csv export")
+}
+
+func TestHistogramExportHGRM(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 0.001)
+	for i := 0; i < 4; i++ {
+		h.Record(0.0042)
+	}
+	h.Record(0.011)
+	h.Record(0.0255)
+	h.Record(0.15)
+	h.Record(0.15)
+	if err := h.ExportHGRM(&b); err != nil {
+		t.Error(err)
+	}
+	expected := `       Value     Percentile TotalCount 1/(1-Percentile)
+
+    0.005000 0.500000000000          4           2.00
+    0.011000 0.625000000000          5           2.67
+    0.030000 0.750000000000          6           4.00
+    0.150000 1.000000000000          8
+#[Mean    =     0.044162, StdDeviation   =     0.061481]
+#[Max     =     0.150000, Total count    =            8]
+`
+	CheckEquals(t, b.String(), expected, "hgrm export")
+	// single value
+	b.Reset()
+	h = NewHistogram(0, 1)
+	h.Record(3)
+	if err := h.ExportHGRM(&b); err != nil {
+		t.Error(err)
+	}
+	expected = `       Value     Percentile TotalCount 1/(1-Percentile)
+
+    3.000000 1.000000000000          1
+#[Mean    =     3.000000, StdDeviation   =     0.000000]
+#[Max     =     3.000000, Total count    =            1]
+`
+	CheckEquals(t, b.String(), expected, "single value hgrm export")
+	// large counts: the last bucket isn't 100% but close, no overflow/Inf
+	b.Reset()
+	h = NewHistogram(0, 1)
+	h.RecordN(1, 1<<30)
+	h.RecordN(1, 1<<30)
+	h.Record(2)
+	if err := h.ExportHGRM(&b); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(b.String(), "Inf") || strings.Contains(b.String(), "NaN") {
+		t.Errorf("Unexpected overflow in large count hgrm export: %s", b.String())
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 0.001)
+	for i := 0; i < 4; i++ {
+		h.Record(0.0042)
+	}
+	h.Record(0.011)
+	h.Record(0.0255)
+	h.Record(0.15)
+	h.Record(0.15)
+	codes := map[string]int64{"200": 7, "-1": 1}
+	if err := WritePrometheus(&b, h.Export(), codes, "fortio"); err != nil {
+		t.Error(err)
+	}
+	expected := `# HELP fortio_duration_seconds Duration of the calls.
+# TYPE fortio_duration_seconds histogram
+fortio_duration_seconds_bucket{le="0.005"} 4
+fortio_duration_seconds_bucket{le="0.011"} 5
+fortio_duration_seconds_bucket{le="0.03"} 6
+fortio_duration_seconds_bucket{le="0.15"} 8
+fortio_duration_seconds_bucket{le="+Inf"} 8
+fortio_duration_seconds_sum 0.35329999999999995
+fortio_duration_seconds_count 8
+# HELP fortio_requests_total Number of calls by result code.
+# TYPE fortio_requests_total counter
+fortio_requests_total{code="-1"} 1
+fortio_requests_total{code="200"} 7
+`
+	CheckEquals(t, b.String(), expected, "prometheus export")
+	// Text format: every sample line is name{labels} value, with cumulative
+	// (non decreasing) bucket counts and increasing le.
+	var prevCount int64
+	prevLe := -1.
+	for _, l := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		if strings.HasPrefix(l, "# ") {
+			continue
+		}
+		var le string
+		var count int64
+		if _, err := fmt.Sscanf(l, "fortio_duration_seconds_bucket{le=%q} %d", &le, &count); err != nil {
+			continue
+		}
+		v := math.Inf(1)
+		if le != "+Inf" {
+			var err error
+			if v, err = strconv.ParseFloat(le, 64); err != nil {
+				t.Errorf("Bad le in %q: %v", l, err)
+			}
+		}
+		if v <= prevLe || count < prevCount {
+			t.Errorf("Buckets not increasing/cumulative at %q", l)
+		}
+		prevLe, prevCount = v, count
+	}
+	if prevCount != 8 {
+		t.Errorf("Expected +Inf bucket of 8, got %d", prevCount)
+	}
+	// Empty histogram and no codes
+	b.Reset()
+	if err := WritePrometheus(&b, NewHistogram(0, 1).Export(), nil, "empty"); err != nil {
+		t.Error(err)
+	}
+	expected = `# HELP empty_duration_seconds Duration of the calls.
+# TYPE empty_duration_seconds histogram
+empty_duration_seconds_bucket{le="+Inf"} 0
+empty_duration_seconds_sum 0
+empty_duration_seconds_count 0
+`
+	CheckEquals(t, b.String(), expected, "empty prometheus export")
+}
+
+func TestWritePrometheusWithLabels(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 0.001)
+	h.Record(0.0042)
+	labels := map[string]string{"run": "r1", "env": "c\"i"}
+	if err := WritePrometheusWithLabels(&b, h.Export(), map[string]int64{"200": 1}, "fortio", labels); err != nil {
+		t.Error(err)
+	}
+	expected := `# HELP fortio_duration_seconds Duration of the calls.
+# TYPE fortio_duration_seconds histogram
+fortio_duration_seconds_bucket{env="c\"i",run="r1",le="0.0042"} 1
+fortio_duration_seconds_bucket{env="c\"i",run="r1",le="+Inf"} 1
+fortio_duration_seconds_sum{env="c\"i",run="r1"} 0.0042
+fortio_duration_seconds_count{env="c\"i",run="r1"} 1
+# HELP fortio_requests_total Number of calls by result code.
+# TYPE fortio_requests_total counter
+fortio_requests_total{env="c\"i",run="r1",code="200"} 1
+`
+	CheckEquals(t, b.String(), expected, "prometheus export with labels")
+	for _, name := range []string{"le", "code", "1x", "a-b", ""} {
+		if err := WritePrometheusWithLabels(&b, h.Export(), nil, "fortio", map[string]string{name: "v"}); err == nil {
+			t.Errorf("Expected an error for label name %q", name)
+		}
+	}
+}
+
+// splitInflux splits s on the sep not escaped by a backslash.
+func splitInflux(s string, sep byte) []string {
+	var res []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
+
+// parseInflux parses a line protocol line into its measurement, tags, fields
+// and timestamp (still escaped).
+func parseInflux(t *testing.T, line string) (string, map[string]string, map[string]string, string) {
+	parts := splitInflux(line, ' ')
+	if len(parts) != 2 && len(parts) != 3 {
+		t.Fatalf("expected measurement, fields and optional timestamp, got %q", line)
+	}
+	ts := ""
+	if len(parts) == 3 {
+		ts = parts[2]
+	}
+	pairs := func(s []string) map[string]string {
+		m := make(map[string]string)
+		for _, kv := range s {
+			p := splitInflux(kv, '=')
+			if len(p) != 2 || p[0] == "" || p[1] == "" {
+				t.Fatalf("invalid key=value %q in %q", kv, line)
+			}
+			m[p[0]] = p[1]
+		}
+		return m
+	}
+	series := splitInflux(parts[0], ',')
+	return series[0], pairs(series[1:]), pairs(splitInflux(parts[1], ',')), ts
+}
+
+func TestWriteInfluxLine(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 0.001)
+	for i := 0; i < 100; i++ {
+		h.Record(0.001 * float64(i))
+	}
+	ts := time.Unix(1525168800, 250)
+	tags := map[string]string{"labels": "my run, v2", "env": "ci", "empty": ""}
+	fields := map[string]float64{"qps": 99.5, "error_rate": 0.01, "bad": math.NaN()}
+	if err := WriteInfluxLine(&b, "fortio run", h.Export(), tags, fields, ts); err != nil {
+		t.Fatal(err)
+	}
+	line := b.String()
+	if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", line)
+	}
+	m, tg, f, tsStr := parseInflux(t, strings.TrimSuffix(line, "\n"))
+	if m != `fortio\ run` {
+		t.Errorf("unexpected measurement %q", m)
+	}
+	expectedTags := map[string]string{"env": "ci", "labels": `my\ run\,\ v2`}
+	if !reflect.DeepEqual(tg, expectedTags) {
+		t.Errorf("unexpected tags %v, expected %v", tg, expectedTags)
+	}
+	if tsStr != "1525168800000000250" {
+		t.Errorf("unexpected timestamp %q", tsStr)
+	}
+	if f["count"] != "100i" || f["qps"] != "99.5" || f["error_rate"] != "0.01" || f["max"] != "0.099" {
+		t.Errorf("unexpected fields %v", f)
+	}
+	if _, found := f["bad"]; found {
+		t.Errorf("NaN field shouldn't be written: %v", f)
+	}
+	for _, name := range []string{"p50", "p75", "p90", "p99", "p99_9", "avg", "min"} {
+		if _, err := strconv.ParseFloat(f[name], 64); err != nil {
+			t.Errorf("expected float field %s, got %v", name, f)
+		}
+	}
+	if v, _ := strconv.ParseFloat(f["p90"], 64); math.Abs(v-0.09) > 0.002 {
+		t.Errorf("unexpected p90 %g", v)
+	}
+	// Empty histogram, no timestamp:
+	b.Reset()
+	if err := WriteInfluxLine(&b, "m", NewHistogram(0, 1).Export(), nil, nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "m count=0i\n" {
+		t.Errorf("unexpected empty histogram line %q", b.String())
+	}
+	if err := WriteInfluxLine(&b, "", h.Export(), nil, nil, ts); err == nil {
+		t.Error("expected error for empty measurement")
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var b bytes.Buffer
+	h := NewHistogram(0, 0.001)
+	for i := 0; i < 4; i++ {
+		h.Record(0.0042)
+	}
+	h.Record(0.0255)
+	h.Record(0.15)
+	codes := map[string]int64{"200": 6}
+	ts := time.Unix(1500000000, 500000000)
+	samples := []Exemplar{
+		{Value: 0.15, Labels: map[string]string{"trace_id": "abc"}, Timestamp: ts},
+		{Value: 0.0042, Labels: map[string]string{"trace_id": "def", "code": "200"}},
+		{Value: 0.0255, Labels: map[string]string{"trace_id": "lower"}},
+		{Value: 0.0258, Labels: map[string]string{"trace_id": "higher"}},
+	}
+	if err := WriteOpenMetrics(&b, h.Export(), codes, "fortio", false, samples); err != nil {
+		t.Error(err)
+	}
+	expected := `# HELP fortio_duration_seconds Duration of the calls.
+# TYPE fortio_duration_seconds histogram
+fortio_duration_seconds_bucket{le="0.005"} 4
+fortio_duration_seconds_bucket{le="0.03"} 5
+fortio_duration_seconds_bucket{le="0.15"} 6
+fortio_duration_seconds_bucket{le="+Inf"} 6
+fortio_duration_seconds_sum 0.1923
+fortio_duration_seconds_count 6
+# HELP fortio_requests Number of calls by result code.
+# TYPE fortio_requests counter
+fortio_requests_total{code="200"} 6
+# EOF
+`
+	CheckEquals(t, b.String(), expected, "openmetrics export without exemplars")
+	b.Reset()
+	if err := WriteOpenMetrics(&b, h.Export(), codes, "fortio", true, samples); err != nil {
+		t.Error(err)
+	}
+	expected = `# HELP fortio_duration_seconds Duration of the calls.
+# TYPE fortio_duration_seconds histogram
+fortio_duration_seconds_bucket{le="0.005"} 4 # {code="200",trace_id="def"} 0.0042
+fortio_duration_seconds_bucket{le="0.03"} 5 # {trace_id="higher"} 0.0258
+fortio_duration_seconds_bucket{le="0.15"} 6 # {trace_id="abc"} 0.15 1500000000.5
+fortio_duration_seconds_bucket{le="+Inf"} 6
+fortio_duration_seconds_sum 0.1923
+fortio_duration_seconds_count 6
+# HELP fortio_requests Number of calls by result code.
+# TYPE fortio_requests counter
+fortio_requests_total{code="200"} 6
+# EOF
+`
+	CheckEquals(t, b.String(), expected, "openmetrics export with exemplars")
+	// Prometheus format never has exemplars
+	b.Reset()
+	if err := WritePrometheus(&b, h.Export(), codes, "fortio"); err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(b.String(), "# {") || strings.Contains(b.String(), "# EOF") {
+		t.Errorf("Unexpected OpenMetrics output in prometheus export: %s", b.String())
+	}
+}
+
+func TestHistogramWithBuckets(t *testing.T) {
+	// Same edges as the default ones for 0.001 divider: same buckets and percentiles
+	edges := make([]float64, len(histogramBucketValues))
+	for i, v := range histogramBucketValues {
+		edges[i] = 0.001 * float64(v)
+	}
+	h := NewHistogramWithBuckets(edges)
+	ref := NewHistogram(0, 0.001)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 1000; i++ {
+		v := r.ExpFloat64() * 0.02
+		h.Record(v)
+		ref.Record(v)
+	}
+	percentiles := []float64{10, 50, 75, 90, 99, 99.9}
+	e := h.Export().CalcPercentiles(percentiles)
+	eRef := ref.Export().CalcPercentiles(percentiles)
+	if len(e.Data) != len(eRef.Data) {
+		t.Fatalf("Mismatch in buckets %+v vs default %+v", e.Data, eRef.Data)
+	}
+	for i, b := range e.Data {
+		if math.Abs(b.Start-eRef.Data[i].Start) > 1e-9 || math.Abs(b.End-eRef.Data[i].End) > 1e-9 ||
+			b.Count != eRef.Data[i].Count {
+			t.Errorf("Bucket %d %+v doesn't match default %+v", i, b, eRef.Data[i])
+		}
+	}
+	for i, p := range e.Percentiles {
+		if math.Abs(p.Value-eRef.Percentiles[i].Value) > 1e-9 {
+			t.Errorf("Percentile %g: %g vs default %g", p.Percentile, p.Value, eRef.Percentiles[i].Value)
+		}
+	}
+	// SLO edges, with values below the first and above the last
+	h = NewHistogramWithBuckets([]float64{0.001, 0.005, 0.010, 0.050, 0.100})
+	for _, v := range []float64{0.0005, 0.001, 0.003, 0.005, 0.007, 0.2, 0.3} {
+		h.Record(v)
+	}
+	e = h.Export().CalcPercentiles([]float64{50, 100})
+	expected := []Bucket{
+		{Interval{0.0005, 0.001}, 100. * 2 / 7, 2},
+		{Interval{0.001, 0.005}, 100. * 4 / 7, 2},
+		{Interval{0.005, 0.010}, 100. * 5 / 7, 1},
+		{Interval{0.100, 0.3}, 100, 2},
+	}
+	if !reflect.DeepEqual(e.Data, expected) {
+		t.Errorf("Unexpected buckets %+v, expected %+v", e.Data, expected)
+	}
+	if e.Percentiles[1].Value != 0.3 {
+		t.Errorf("Unexpected p100 %g", e.Percentiles[1].Value)
+	}
+	if p50 := e.Percentiles[0].Value; p50 <= 0.001 || p50 > 0.005 {
+		t.Errorf("Unexpected p50 %g", p50)
+	}
+	// Clone and transfer keep the edges
+	c := h.Clone()
+	c.Transfer(h)
+	if !reflect.DeepEqual(c.Edges, []float64{0.001, 0.005, 0.010, 0.050, 0.100}) || c.Count != 14 || h.Count != 0 {
+		t.Errorf("Unexpected clone/transfer %+v", c)
+	}
+	// Invalid edges
+	if NewHistogramWithBuckets(nil) != nil || NewHistogramWithBuckets([]float64{1, 1}) != nil ||
+		NewHistogramWithBuckets([]float64{2, 1}) != nil {
+		t.Error("Expected nil histogram for invalid edges")
+	}
+}
+
+func TestLogHistogram(t *testing.T) {
+	h := NewLogHistogram(1e-6, 1, 2)
+	if h == nil || !h.LogScale {
+		t.Fatalf("Unexpected log histogram %+v", h)
+	}
+	if last := h.Edges[len(h.Edges)-1]; last < 1 || last > 1.01 {
+		t.Errorf("Unexpected last edge %g", last)
+	}
+	// log uniform values across the 1e6 range
+	r := rand.New(rand.NewSource(42))
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = math.Pow(10, -6*r.Float64())
+		h.Record(values[i])
+	}
+	sort.Float64s(values)
+	percentiles := []float64{0.1, 1, 10, 25, 50, 75, 90, 99, 99.9}
+	e := h.Export().CalcPercentiles(percentiles)
+	for _, p := range e.Percentiles {
+		exact := values[int(math.Ceil(p.Percentile/100*float64(len(values))))-1]
+		if relErr := math.Abs(p.Value-exact) / exact; relErr > 0.02 {
+			t.Errorf("p%g %g vs exact %g: relative error %g", p.Percentile, p.Value, exact, relErr)
+		}
+	}
+	if c := h.Clone(); !c.LogScale || c.Count != h.Count {
+		t.Errorf("Clone didn't keep the log scale histogram: %+v", c.Counter)
+	}
+	// Invalid parameters
+	if NewLogHistogram(0, 1, 2) != nil || NewLogHistogram(1, 1, 2) != nil ||
+		NewLogHistogram(1e-6, 1, 0) != nil || NewLogHistogram(1e-6, 1, 6) != nil {
+		t.Error("Expected nil histogram for invalid log scale parameters")
+	}
+}
+
+func TestCounterMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	var single Counter
+	tc := NewThreadCounters(4)
+	var wg sync.WaitGroup
+	values := make([][]float64, 4)
+	for i := range values {
+		for j := 0; j < 1000+100*i; j++ {
+			v := 1e6 + r.NormFloat64() // large mean vs stddev
+			values[i] = append(values[i], v)
+			single.Record(v)
+		}
+	}
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := tc.For(i)
+			for _, v := range values[i] {
+				c.Record(v)
+			}
+		}(i)
+	}
+	wg.Wait()
+	merged := tc.Merged()
+	if merged.Count != single.Count || merged.Min != single.Min || merged.Max != single.Max {
+		t.Errorf("Merged %+v doesn't match single counter %+v", merged, single)
+	}
+	if math.Abs(merged.Avg()-single.Avg()) > 1e-9*single.Avg() {
+		t.Errorf("Merged avg %g vs %g", merged.Avg(), single.Avg())
+	}
+	if math.Abs(merged.StdDev()-single.StdDev()) > 0.01 {
+		t.Errorf("Merged stddev %g vs %g", merged.StdDev(), single.StdDev())
+	}
+	// Merge leaves the other counter unchanged, including into an empty one
+	var empty Counter
+	empty.Merge(tc.For(1))
+	if empty != *tc.For(1) || tc.For(1).Count != 1100 {
+		t.Errorf("Unexpected merge into empty %+v of %+v", empty, *tc.For(1))
+	}
+	empty.Merge(&Counter{})
+	if empty.Count != 1100 {
+		t.Errorf("Merge of empty counter changed %+v", empty)
+	}
+}
+
+func TestCounterRecordN(t *testing.T) {
+	var c, single Counter
+	c.RecordN(2, 3)
+	c.RecordN(5, 2)
+	for _, v := range []float64{2, 2, 2, 5, 5} {
+		single.Record(v)
+	}
+	CheckEquals(t, c.SumOfSquares, 62., "sum of squares of 3x 2 and 2x 5")
+	CheckEquals(t, c.Sum, 16., "sum")
+	var merged Counter
+	merged.Merge(&c)
+	merged.Merge(&single)
+	CheckEquals(t, merged.SumOfSquares, 124., "merged sum of squares")
+	if math.Abs(c.StdDev()-single.StdDev()) > 1e-12 || math.Abs(merged.StdDev()-single.StdDev()) > 1e-12 {
+		t.Errorf("RecordN stddev %g and merged %g vs %g", c.StdDev(), merged.StdDev(), single.StdDev())
+	}
+}
+
+func TestCounterMergeLargeOffset(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	values := make([]float64, 10000)
+	sum := 0.
+	for i := range values {
+		values[i] = 1e9 + 0.5*r.NormFloat64() // stddev tiny compared to the values
+		sum += values[i] - 1e9
+	}
+	// reference computed on the values without the offset
+	mean := sum / float64(len(values))
+	m2 := 0.
+	for _, v := range values {
+		d := v - 1e9 - mean
+		m2 += d * d
+	}
+	expected := math.Sqrt(m2 / float64(len(values)))
+	var single Counter
+	tc := NewThreadCounters(3)
+	for i, v := range values {
+		single.Record(v)
+		tc.For(i % 3).Record(v)
+	}
+	merged := tc.Merged()
+	// the merged halves of 2 different sets too
+	var a, b Counter
+	for _, v := range values[:3000] {
+		a.Record(v)
+	}
+	for _, v := range values[3000:] {
+		b.Record(v + 2) // shifted, for a non zero delta of the means
+	}
+	var ref Counter
+	for _, v := range values[:3000] {
+		ref.Record(v)
+	}
+	for _, v := range values[3000:] {
+		ref.Record(v + 2)
+	}
+	a.Merge(&b)
+	for _, tst := range []struct {
+		name     string
+		actual   float64
+		expected float64
+	}{
+		{"single", single.StdDev(), expected},
+		{"merged", merged.StdDev(), expected},
+		{"shifted merge", a.StdDev(), ref.StdDev()},
+	} {
+		if math.Abs(tst.actual-tst.expected) > 1e-3*tst.expected {
+			t.Errorf("%s stddev %g vs expected %g", tst.name, tst.actual, tst.expected)
+		}
+	}
+	if math.Abs(ref.StdDev()-1.044) > 0.05 { // sqrt(0.5² + 0.3*0.7*2²)
+		t.Errorf("shifted stddev %g vs expected ~1.044", ref.StdDev())
+	}
+}
+
+func TestCalcPercentileWithBounds(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	distributions := map[string]func() float64{
+		"uniform":     func() float64 { return r.Float64() * 0.2 },
+		"exponential": func() float64 { return r.ExpFloat64() * 0.01 },
+		"sparse":      func() float64 { return float64(r.Intn(3)) * 0.05 },
+	}
+	for name, gen := range distributions {
+		for _, n := range []int{10, 1000} {
+			h := NewHistogram(0, 0.001)
+			values := make([]float64, n)
+			for i := range values {
+				values[i] = gen()
+				h.Record(values[i])
+			}
+			sort.Float64s(values)
+			e := h.Export()
+			for _, p := range []float64{1, 10, 50, 90, 99, 99.9, 100} {
+				v, low, high := e.CalcPercentileWithBounds(p)
+				if v != e.CalcPercentile(p) {
+					t.Errorf("%s/%d p%g: %g doesn't match CalcPercentile %g", name, n, p, v, e.CalcPercentile(p))
+				}
+				exact := values[int(math.Ceil(p*float64(n)/100-1e-9))-1] // nearest rank
+				if exact < low || exact > high || v < low || v > high {
+					t.Errorf("%s/%d p%g: exact %g or estimate %g not in [%g, %g]", name, n, p, exact, v, low, high)
+				}
+			}
+		}
+	}
+	v, low, high := NewHistogram(0, 1).Export().CalcPercentileWithBounds(50)
+	if v != 0 || low != 0 || high != 0 {
+		t.Errorf("Unexpected bounds for no data: %g %g %g", v, low, high)
+	}
+}
+
+func TestPercentileMethods(t *testing.T) {
+	// Buckets: [15], ]17.5, 20], ]30, 35], ]35, 40], ]45, 50]
+	h := NewHistogram(0, 0.5)
+	for _, v := range []float64{15, 20, 35, 40, 50} {
+		h.Record(v)
+	}
+	tests := []struct {
+		percentile float64
+		linear     float64
+		nearest    float64
+	}{
+		{5, 15, 15},
+		{20, 15, 15},
+		{30, 18.75, 20}, // rank 2
+		{40, 20, 20},
+		{50, 32.5, 35}, // rank 3
+		{75, 38.75, 40},
+		{90, 47.5, 50},
+		{100, 50, 50},
+	}
+	e := h.Export()
+	for _, tst := range tests {
+		if v := e.CalcPercentile(tst.percentile); v != tst.linear {
+			t.Errorf("Default p%g: %g instead of %g", tst.percentile, v, tst.linear)
+		}
+		if v := e.CalcPercentileWithMethod(tst.percentile, LinearInterpolation); v != tst.linear {
+			t.Errorf("Linear p%g: %g instead of %g", tst.percentile, v, tst.linear)
+		}
+		if v := e.CalcPercentileWithMethod(tst.percentile, NearestRank); v != tst.nearest {
+			t.Errorf("Nearest rank p%g: %g instead of %g", tst.percentile, v, tst.nearest)
+		}
+	}
+	if e.PercentileMethod != LinearInterpolation {
+		t.Errorf("CalcPercentileWithMethod changed the data's method to %v", e.PercentileMethod)
+	}
+	// Configured on the histogram:
+	h.PercentileMethod = NearestRank
+	c := h.Clone()
+	e = c.Export().CalcPercentiles([]float64{30, 50, 75})
+	if e.PercentileMethod != NearestRank {
+		t.Errorf("Method not exported/cloned: %v", e.PercentileMethod)
+	}
+	for i, expected := range []float64{20, 35, 40} {
+		if e.Percentiles[i].Value != expected {
+			t.Errorf("Nearest rank %+v instead of %g", e.Percentiles[i], expected)
+		}
+	}
+	if _, low, high := e.CalcPercentileWithBounds(50); low != 30 || high != 35 {
+		t.Errorf("Unexpected nearest rank bounds %g %g", low, high)
+	}
+}
+
 func TestHistogramNegativeNumbers(t *testing.T) {
 	h := NewHistogram( /* offset */ -10 /*scale */, 1)
 	h.Record(-10)
@@ -532,6 +1195,227 @@ func TestMergeHistogramsWithDifferentScales(t *testing.T) {
 	}
 }
 
+func TestMergeHistograms(t *testing.T) {
+	all := NewHistogram(0, 0.001)
+	h1 := NewHistogram(0, 0.001)
+	h2 := NewHistogram(0, 0.001)
+	for i := 0; i < 1000; i++ {
+		v := float64(i%97) * 0.00123
+		all.Record(v)
+		if i%3 == 0 {
+			h1.Record(v)
+		} else {
+			h2.Record(v)
+		}
+	}
+	m, err := MergeHistograms(h1, h2)
+	if err != nil {
+		t.Fatalf("unexpected merge error: %v", err)
+	}
+	percentiles := []float64{50, 75, 90, 99, 99.9}
+	var b1, b2 bytes.Buffer
+	m.Print(&b1, "hist", percentiles)
+	all.Print(&b2, "hist", percentiles)
+	CheckEquals(t, b1.String(), b2.String(), "merged histogram vs single one")
+	// inputs are left unchanged
+	CheckEquals(t, h1.Count+h2.Count, int64(1000), "merge inputs count")
+	m, err = MergeHistograms(h1)
+	if err != nil {
+		t.Errorf("unexpected merge error for 1 histogram: %v", err)
+	}
+	CheckEquals(t, m.Count, h1.Count, "merge of 1 histogram")
+}
+
+func TestMergeHistogramsErrors(t *testing.T) {
+	h := NewHistogram(0, 0.001)
+	var tests = []struct {
+		hists    []*Histogram
+		expected string
+	}{
+		{nil, "no histogram to merge"},
+		{[]*Histogram{h, nil}, "histogram 1 is nil"},
+		{[]*Histogram{h, NewHistogram(0, 0.01)}, "incompatible histogram 1: offset 0 divider 0.01"},
+		{[]*Histogram{h, h, NewHistogram(-1, 0.001)}, "incompatible histogram 2: offset -1 divider 0.001"},
+	}
+	for _, tst := range tests {
+		_, err := MergeHistograms(tst.hists...)
+		if err == nil || !strings.HasPrefix(err.Error(), tst.expected) {
+			t.Errorf("MergeHistograms got error %v, expected %q", err, tst.expected)
+		}
+	}
+}
+
+func TestMergeHistogramsRebucket(t *testing.T) {
+	all := NewHistogram(0, 0.001)
+	h1 := NewHistogram(0, 0.001)
+	h2 := NewHistogram(0, 0.01)
+	for i := 0; i < 1000; i++ {
+		v := float64(i%97) * 0.00123
+		all.Record(v)
+		if i%2 == 0 {
+			h1.Record(v)
+		} else {
+			h2.Record(v)
+		}
+	}
+	if _, err := MergeHistograms(h1, h2); err == nil {
+		t.Errorf("expected an error merging incompatible histograms without rebucketing")
+	}
+	m, err := MergeHistogramsWithOptions(MergeOptions{Rebucket: true}, h1, h2)
+	if err != nil {
+		t.Fatalf("unexpected rebucket merge error: %v", err)
+	}
+	CheckEquals(t, m.Divider, 0.01, "rebucket divider")
+	CheckEquals(t, m.Count, all.Count, "rebucket count is exact")
+	CheckEquals(t, m.Min, all.Min, "rebucket min")
+	CheckEquals(t, m.Max, all.Max, "rebucket max")
+	CheckEquals(t, Round(m.Sum), Round(all.Sum), "rebucket sum")
+	var total int64
+	for _, c := range m.Hdata {
+		total += int64(c)
+	}
+	CheckEquals(t, total, all.Count, "rebucket buckets total")
+	me := m.Export()
+	ae := all.Export()
+	for _, p := range []float64{50, 90, 99} {
+		mp := me.CalcPercentile(p)
+		ap := ae.CalcPercentile(p)
+		// approximate: within the coarsest bucket width
+		if mp < ap-0.02 || mp > ap+0.02 {
+			t.Errorf("p%g of rebucketed merge %g too far from %g", p, mp, ap)
+		}
+	}
+	m, err = MergeHistogramsWithOptions(MergeOptions{Rebucket: true, TargetResolution: 0.005}, h1, h2)
+	if err != nil {
+		t.Fatalf("unexpected rebucket merge error: %v", err)
+	}
+	CheckEquals(t, m.Divider, 0.005, "rebucket target resolution")
+	CheckEquals(t, m.Count, all.Count, "rebucket target resolution count")
+}
+
+func TestMergeHistogramsWithBuckets(t *testing.T) {
+	edges := []float64{0.001, 0.005, 0.010, 0.050, 0.100}
+	h1 := NewHistogramWithBuckets(edges)
+	h2 := NewHistogramWithBuckets(edges)
+	for _, v := range []float64{0.0005, 0.003, 0.004, 0.007} {
+		h1.Record(v)
+	}
+	for _, v := range []float64{0.008, 0.020, 0.070, 0.200} {
+		h2.Record(v)
+	}
+	newH := Merge(h1, h2)
+	if !reflect.DeepEqual(newH.Edges, edges) {
+		t.Errorf("merged edges %v, expected %v", newH.Edges, edges)
+	}
+	CheckEquals(t, newH.Count, int64(8), "merged count")
+	CheckEquals(t, h1.Count+h2.Count, int64(0), "merged histograms are cleared")
+	if !reflect.DeepEqual(newH.Hdata, []int32{1, 2, 2, 1, 1, 1}) {
+		t.Errorf("unexpected merged buckets %v", newH.Hdata)
+	}
+	// different edges are rebucketed in the union of the edges
+	h3 := NewHistogramWithBuckets([]float64{0.002, 0.020})
+	h3.Record(0.015)
+	h4 := NewHistogramWithBuckets(edges)
+	h4.Record(0.0005)
+	newH = Merge(h3, h4)
+	expected := []float64{0.001, 0.002, 0.005, 0.010, 0.020, 0.050, 0.100}
+	if !reflect.DeepEqual(newH.Edges, expected) || newH.Count != 2 {
+		t.Errorf("merged edges %v (count %d), expected %v", newH.Edges, newH.Count, expected)
+	}
+}
+
+func TestMergeHistogramsKeepsMethodAndScale(t *testing.T) {
+	h1 := NewLogHistogram(1e-6, 1, 2)
+	h2 := NewLogHistogram(1e-6, 1, 2)
+	h1.PercentileMethod = NearestRank
+	h2.PercentileMethod = NearestRank
+	h1.Record(0.01)
+	h2.Record(0.02)
+	m, err := MergeHistograms(h1, h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.PercentileMethod != NearestRank || !m.LogScale {
+		t.Errorf("merge lost the percentile method %v or log scale %v", m.PercentileMethod, m.LogScale)
+	}
+	if m.Export().PercentileMethod != NearestRank {
+		t.Errorf("merge export lost the percentile method")
+	}
+	// rebucketed into other buckets: not log scale anymore
+	linear := NewHistogram(0, 0.001)
+	linear.PercentileMethod = NearestRank
+	if m = Merge(h1.Clone(), linear); m.PercentileMethod != NearestRank || m.LogScale {
+		t.Errorf("rebucketed merge %v log scale %v", m.PercentileMethod, m.LogScale)
+	}
+	// disagreeing methods: back to the default
+	h3 := NewLogHistogram(1e-6, 1, 2)
+	h3.Record(0.03)
+	if m, err = MergeHistograms(h1, h2, h3); err != nil || m.PercentileMethod != LinearInterpolation || !m.LogScale {
+		t.Errorf("mixed methods merge %v log scale %v (%v)", m.PercentileMethod, m.LogScale, err)
+	}
+}
+
+func TestMergeHistogramsRebucketDividers(t *testing.T) {
+	all := NewHistogram(0, 0.001)
+	h1 := NewHistogram(0, 0.001)
+	h2 := NewHistogram(0.001, 0.002)
+	h3 := NewHistogramWithBuckets([]float64{0.001, 0.005, 0.010, 0.050, 0.100})
+	for i := 0; i < 999; i++ {
+		v := float64(i%97) * 0.00123
+		all.Record(v)
+		switch i % 3 {
+		case 0:
+			h1.Record(v)
+		case 1:
+			h2.Record(v)
+		default:
+			h3.Record(v)
+		}
+	}
+	m, err := MergeHistogramsWithOptions(MergeOptions{Rebucket: true}, h3, h1, h2)
+	if err != nil {
+		t.Fatalf("unexpected rebucket merge error: %v", err)
+	}
+	// the divider and offset of the scaled histograms, not the Edges' 1 and 0
+	CheckEquals(t, m.Divider, 0.002, "rebucket divider")
+	CheckEquals(t, m.Offset, 0., "rebucket offset")
+	if m.Edges != nil {
+		t.Errorf("rebucket into scaled buckets shouldn't have edges: %v", m.Edges)
+	}
+	CheckEquals(t, m.Count, all.Count, "rebucket count is exact")
+	CheckEquals(t, m.Min, all.Min, "rebucket min")
+	CheckEquals(t, m.Max, all.Max, "rebucket max")
+	me := m.Export()
+	ae := all.Export()
+	for _, p := range []float64{50, 90} {
+		mp := me.CalcPercentile(p)
+		ap := ae.CalcPercentile(p)
+		// approximate: within the coarsest (edges) bucket width
+		if mp < ap-0.05 || mp > ap+0.05 {
+			t.Errorf("p%g of rebucketed merge %g too far from %g", p, mp, ap)
+		}
+	}
+	m, err = MergeHistogramsWithOptions(MergeOptions{Rebucket: true, TargetResolution: 0.0005}, h3, h1)
+	if err != nil {
+		t.Fatalf("unexpected rebucket merge error: %v", err)
+	}
+	CheckEquals(t, m.Divider, 0.0005, "rebucket target resolution")
+	CheckEquals(t, m.Count, h1.Count+h3.Count, "rebucket target resolution count")
+	// only Edges histograms: union of the edges
+	h4 := NewHistogramWithBuckets([]float64{0.002, 0.005, 0.020})
+	h4.Record(0.004)
+	h4.Record(0.015)
+	m, err = MergeHistogramsWithOptions(MergeOptions{Rebucket: true}, h3, h4)
+	if err != nil {
+		t.Fatalf("unexpected rebucket merge error: %v", err)
+	}
+	expected := []float64{0.001, 0.002, 0.005, 0.010, 0.020, 0.050, 0.100}
+	if !reflect.DeepEqual(m.Edges, expected) {
+		t.Errorf("union edges %v, expected %v", m.Edges, expected)
+	}
+	CheckEquals(t, m.Count, h3.Count+h4.Count, "union edges count")
+}
+
 func TestTransferHistogramWithDifferentScales(t *testing.T) {
 	tP := []float64{75.}
 	var b bytes.Buffer
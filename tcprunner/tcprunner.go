@@ -0,0 +1,276 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tcprunner is a raw tcp (echo or line protocol) load runner.
+package tcprunner // import "istio.io/fortio/tcprunner"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+)
+
+const (
+	// TCPURLPrefix is the prefix of the destinations handled by this runner.
+	TCPURLPrefix = "tcp://"
+	// OK is the RetCodes key of the successful round trips.
+	OK = 0
+	// SocketError is the RetCodes key of the connect, write or read errors.
+	SocketError = -1
+	// ReqTimeOutDefaultValue is the default connect and round trip timeout.
+	ReqTimeOutDefaultValue = 3 * time.Second
+)
+
+// DefaultPayload is sent when no Payload is specified.
+var DefaultPayload = []byte("Fortio tcp echo payload\n")
+
+// TCPOptions are the options of a TCPClient.
+type TCPOptions struct {
+	Destination string // host:port, with or without the tcp:// prefix
+	// Payload sent for each request, defaults to DefaultPayload.
+	Payload []byte
+	// ReadBytes is how many bytes to read back for each request, defaults to
+	// len(Payload) (ie echo). Ignored when there is a Delimiter.
+	ReadBytes int
+	// Delimiter, when set, the response is read until it is found (e.g. "\n"
+	// for line protocols).
+	Delimiter []byte
+	// ReqTimeout is the connect and round trip timeout.
+	ReqTimeout time.Duration
+}
+
+// TCPClient sends the payload and reads the response on a connection that is
+// kept open between requests (and re-opened after errors).
+type TCPClient struct {
+	dest        string
+	payload     []byte
+	readBytes   int
+	delimiter   []byte
+	reqTimeout  time.Duration
+	conn        net.Conn
+	socketCount int
+	buffer      []byte
+}
+
+// NewTCPClient creates a client for the options, without connecting yet.
+func NewTCPClient(o *TCPOptions) (*TCPClient, error) {
+	dest := strings.TrimPrefix(o.Destination, TCPURLPrefix)
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return nil, fmt.Errorf("bad tcp destination %q: %v", o.Destination, err)
+	}
+	c := TCPClient{
+		dest:       dest,
+		payload:    o.Payload,
+		readBytes:  o.ReadBytes,
+		delimiter:  o.Delimiter,
+		reqTimeout: o.ReqTimeout,
+	}
+	if len(c.payload) == 0 {
+		c.payload = DefaultPayload
+	}
+	if c.readBytes <= 0 {
+		c.readBytes = len(c.payload)
+	}
+	if c.reqTimeout <= 0 {
+		c.reqTimeout = ReqTimeOutDefaultValue
+	}
+	size := c.readBytes
+	if len(c.delimiter) > 0 && size < 4096 {
+		size = 4096 // will grow if needed
+	}
+	c.buffer = make([]byte, size)
+	return &c, nil
+}
+
+// Fetch sends the payload and returns the response (which is only valid
+// until the next call).
+func (c *TCPClient) Fetch() ([]byte, error) {
+	reuse := c.conn != nil
+	if !reuse {
+		conn, err := net.DialTimeout("tcp", c.dest, c.reqTimeout)
+		c.socketCount++
+		if err != nil {
+			log.Errf("Unable to connect to %s : %v", c.dest, err)
+			return nil, err
+		}
+		c.conn = conn
+	}
+	data, err := c.roundTrip()
+	if err == nil {
+		return data, nil
+	}
+	c.closeConn()
+	if reuse && len(data) == 0 {
+		// ok for the (idle) reused socket to have been closed by the server once
+		log.Infof("Retrying on new connection after error on reused one to %s : %v", c.dest, err)
+		return c.Fetch()
+	}
+	log.Errf("Error talking to %s : %v", c.dest, err)
+	return data, err
+}
+
+// roundTrip writes the payload and reads the response on the current conn.
+func (c *TCPClient) roundTrip() ([]byte, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(c.payload); err != nil {
+		return nil, err
+	}
+	if len(c.delimiter) == 0 {
+		n, err := io.ReadFull(c.conn, c.buffer[:c.readBytes])
+		return c.buffer[:n], err
+	}
+	size := 0
+	for {
+		if size == len(c.buffer) {
+			c.buffer = append(c.buffer, make([]byte, len(c.buffer))...)
+		}
+		n, err := c.conn.Read(c.buffer[size:])
+		// only search the new data (and what could be the start of the delimiter)
+		start := size - len(c.delimiter) + 1
+		if start < 0 {
+			start = 0
+		}
+		size += n
+		if bytes.Contains(c.buffer[start:size], c.delimiter) {
+			return c.buffer[:size], nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("connection closed before delimiter")
+			}
+			return c.buffer[:size], err
+		}
+	}
+}
+
+func (c *TCPClient) closeConn() {
+	if c.conn == nil {
+		return
+	}
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("Error closing tcp connection to %s : %v", c.dest, err)
+	}
+	c.conn = nil
+}
+
+// Close closes the connection and returns how many sockets have been used.
+func (c *TCPClient) Close() int {
+	c.closeConn()
+	return c.socketCount
+}
+
+// TCPRunnerResults is the aggregated result of an TCP run.
+// Also is the internal type used per thread/goroutine.
+type TCPRunnerResults struct {
+	periodic.RunnerResults
+	client      *TCPClient
+	RetCodes    map[int]int64
+	Destination string
+	SocketCount int
+	// code of the last call, for LastCall()
+	lastCode int
+}
+
+// Run does one round trip. To be set as the Function in RunnerOptions.
+func (tcpstate *TCPRunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	code := OK
+	if _, err := tcpstate.client.Fetch(); err != nil {
+		code = SocketError
+	}
+	tcpstate.RetCodes[code]++
+	tcpstate.lastCode = code
+}
+
+// LastCall returns the code and destination of the last call (periodic.CallRecorder).
+func (tcpstate *TCPRunnerResults) LastCall() (int, string) {
+	return tcpstate.lastCode, tcpstate.Destination
+}
+
+// TCPRunnerOptions includes the base RunnerOptions plus tcp specific
+// options.
+type TCPRunnerOptions struct {
+	periodic.RunnerOptions
+	TCPOptions
+	AllowInitialErrors bool // whether initial errors don't cause an abort
+}
+
+// RunTCPTest runs a tcp test and returns the aggregated stats.
+func RunTCPTest(o *TCPRunnerOptions) (*TCPRunnerResults, error) {
+	o.RunType = "TCP"
+	log.Infof("Starting tcp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := TCPRunnerResults{
+		RetCodes:    make(map[int]int64),
+		Destination: o.Destination,
+	}
+	tcpstate := make([]TCPRunnerResults, numThreads)
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &tcpstate[i]
+		// Create a client and connect once for each 'thread'
+		var err error
+		if tcpstate[i].client, err = NewTCPClient(&o.TCPOptions); err != nil {
+			return nil, err
+		}
+		if o.Exactly <= 0 {
+			data, err := tcpstate[i].client.Fetch()
+			if !o.AllowInitialErrors && err != nil {
+				return nil, fmt.Errorf("error for %s: %v", o.Destination, err)
+			}
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
+			}
+		}
+		tcpstate[i].RetCodes = make(map[int]int64)
+		tcpstate[i].Destination = total.Destination
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones. We also must cleanup all the created clients.
+	keys := []int{}
+	for i := 0; i < numThreads; i++ {
+		total.SocketCount += tcpstate[i].client.Close()
+		for k := range tcpstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += tcpstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	sort.Ints(keys)
+	totalCount := float64(total.DurationHistogram.Count)
+	fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	for _, k := range keys {
+		fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+		if k != OK {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcprunner
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer starts a tcp server that echoes back the data line by line (so
+// responses can be split in several writes) and returns its tcp:// url.
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close() // nolint: errcheck
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadBytes('\n')
+					if len(line) > 0 {
+						conn.Write(line) // nolint: errcheck
+					}
+					if err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return TCPURLPrefix + listener.Addr().String()
+}
+
+func TestTCPRunner(t *testing.T) {
+	dest := echoServer(t)
+	tests := []TCPOptions{
+		{Destination: dest}, // default payload, read back its length
+		{Destination: dest, Payload: []byte("line1\nline2\nline3\n"), ReadBytes: 18},
+		{Destination: dest, Payload: []byte("hello\n"), Delimiter: []byte("\n")},
+	}
+	for _, tst := range tests {
+		opts := TCPRunnerOptions{TCPOptions: tst}
+		opts.QPS = 100
+		opts.NumThreads = 2
+		opts.Exactly = 20
+		res, err := RunTCPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[OK] != 20 || res.DurationHistogram.Count != 20 {
+			t.Errorf("%+v: expected 20 ok round trips, got %v (%d)", tst, res.RetCodes, res.DurationHistogram.Count)
+		}
+		if res.SocketCount != 2 {
+			t.Errorf("%+v: expected 1 socket per thread, got %d", tst, res.SocketCount)
+		}
+	}
+}
+
+func TestTCPClientErrors(t *testing.T) {
+	if _, err := NewTCPClient(&TCPOptions{Destination: "tcp://nocolon"}); err == nil {
+		t.Errorf("expected error for destination without port")
+	}
+	dest := echoServer(t)
+	// the payload has no delimiter so the server never answers the 2nd line
+	c, err := NewTCPClient(&TCPOptions{Destination: dest, Payload: []byte("x\ny"), ReqTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Fetch(); !isTimeout(err) {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if n := c.Close(); n != 1 {
+		t.Errorf("expected 1 socket, got %d", n)
+	}
+	// Errors are counted as SocketError by the runner:
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := TCPURLPrefix + listener.Addr().String()
+	listener.Close() // nolint: errcheck
+	opts := TCPRunnerOptions{TCPOptions: TCPOptions{Destination: closed}}
+	opts.QPS = -1
+	opts.Exactly = 5
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[SocketError] != 5 {
+		t.Errorf("expected 5 socket errors, got %v", res.RetCodes)
+	}
+	opts.Exactly = 0
+	opts.Duration = 10 * time.Millisecond
+	if _, err = RunTCPTest(&opts); err == nil {
+		t.Errorf("expected initial error without AllowInitialErrors")
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
@@ -0,0 +1,232 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package udprunner is a datagram request/response load runner.
+package udprunner // import "istio.io/fortio/udprunner"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+)
+
+const (
+	// UDPURLPrefix is the prefix of the destinations handled by this runner.
+	UDPURLPrefix = "udp://"
+	// OK is the RetCodes key of the requests which got a response.
+	OK = 0
+	// SocketError is the RetCodes key of the send or receive errors.
+	SocketError = -1
+	// Timeout is the RetCodes key of the requests without response within
+	// the ReqTimeout.
+	Timeout = -2
+	// ReqTimeOutDefaultValue is the default time to wait for a response.
+	ReqTimeOutDefaultValue = 1 * time.Second
+	// MaxDatagramSize is the size of the receive buffer.
+	MaxDatagramSize = 65536
+)
+
+// DefaultPayload is sent when no Payload is specified.
+var DefaultPayload = []byte("Fortio udp echo payload\n")
+
+// UDPOptions are the options of a UDPClient.
+type UDPOptions struct {
+	Destination string // host:port, with or without the udp:// prefix
+	// Payload is the datagram sent for each request, defaults to DefaultPayload.
+	Payload []byte
+	// ReqTimeout is how long to wait for the response datagram.
+	ReqTimeout time.Duration
+}
+
+// UDPClient sends a datagram and waits for one in response, on a
+// "connected" udp socket. The socket is replaced after a timeout so a late
+// response isn't taken as the response of the next request.
+type UDPClient struct {
+	dest       string
+	payload    []byte
+	reqTimeout time.Duration
+	conn       net.Conn
+	buffer     []byte
+}
+
+// NewUDPClient creates a client (and its socket) for the options.
+func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
+	dest := strings.TrimPrefix(o.Destination, UDPURLPrefix)
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return nil, fmt.Errorf("bad udp destination %q: %v", o.Destination, err)
+	}
+	c := UDPClient{
+		dest:       dest,
+		payload:    o.Payload,
+		reqTimeout: o.ReqTimeout,
+		buffer:     make([]byte, MaxDatagramSize),
+	}
+	if len(c.payload) == 0 {
+		c.payload = DefaultPayload
+	}
+	if c.reqTimeout <= 0 {
+		c.reqTimeout = ReqTimeOutDefaultValue
+	}
+	var err error
+	if c.conn, err = net.Dial("udp", dest); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Fetch sends the payload and returns the response datagram (only valid
+// until the next call) and the OK, Timeout or SocketError code.
+func (c *UDPClient) Fetch() (int, []byte) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		log.Errf("Unable to set deadline for %s : %v", c.dest, err)
+		return SocketError, nil
+	}
+	if _, err := c.conn.Write(c.payload); err != nil {
+		log.Errf("Unable to send to %s : %v", c.dest, err)
+		return SocketError, nil
+	}
+	n, err := c.conn.Read(c.buffer)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			log.Debugf("Timeout waiting for %s response", c.dest)
+			c.reconnect()
+			return Timeout, nil
+		}
+		// e.g. connection refused from an icmp port unreachable
+		log.Errf("Unable to receive from %s : %v", c.dest, err)
+		return SocketError, nil
+	}
+	return OK, c.buffer[:n]
+}
+
+// reconnect replaces the socket, dropping the response which timed out (and
+// any other pending datagram) along with the old one, whenever it arrives.
+func (c *UDPClient) reconnect() {
+	conn, err := net.Dial("udp", c.dest)
+	if err != nil {
+		log.Errf("Unable to reconnect to %s, keeping the socket : %v", c.dest, err)
+		return
+	}
+	c.Close()
+	c.conn = conn
+}
+
+// Close closes the socket.
+func (c *UDPClient) Close() {
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("Error closing udp socket to %s : %v", c.dest, err)
+	}
+}
+
+// UDPRunnerResults is the aggregated result of an UDP run.
+// Also is the internal type used per thread/goroutine.
+type UDPRunnerResults struct {
+	periodic.RunnerResults
+	client      *UDPClient
+	RetCodes    map[int]int64
+	Destination string
+	// code of the last call, for LastCall()
+	lastCode int
+}
+
+// Run does one request/response. To be set as the Function in RunnerOptions.
+func (udpstate *UDPRunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	code, _ := udpstate.client.Fetch()
+	udpstate.RetCodes[code]++
+	udpstate.lastCode = code
+}
+
+// LastCall returns the code and destination of the last call (periodic.CallRecorder).
+func (udpstate *UDPRunnerResults) LastCall() (int, string) {
+	return udpstate.lastCode, udpstate.Destination
+}
+
+// UDPRunnerOptions includes the base RunnerOptions plus udp specific
+// options.
+type UDPRunnerOptions struct {
+	periodic.RunnerOptions
+	UDPOptions
+	AllowInitialErrors bool // whether initial errors (and timeouts) don't cause an abort
+}
+
+// RunUDPTest runs an udp test and returns the aggregated stats.
+func RunUDPTest(o *UDPRunnerOptions) (*UDPRunnerResults, error) {
+	o.RunType = "UDP"
+	log.Infof("Starting udp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := UDPRunnerResults{
+		RetCodes:    make(map[int]int64),
+		Destination: o.Destination,
+	}
+	udpstate := make([]UDPRunnerResults, numThreads)
+	// Close the clients created so far in case of error
+	defer func() {
+		for i := range udpstate {
+			if udpstate[i].client != nil {
+				udpstate[i].client.Close()
+			}
+		}
+	}()
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &udpstate[i]
+		// Create a client for each 'thread'
+		var err error
+		if udpstate[i].client, err = NewUDPClient(&o.UDPOptions); err != nil {
+			return nil, err
+		}
+		if o.Exactly <= 0 {
+			code, data := udpstate[i].client.Fetch()
+			if !o.AllowInitialErrors && code != OK {
+				return nil, fmt.Errorf("error %d for %s", code, o.Destination)
+			}
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: code %d, received %d: %q", o.Destination, code, len(data), data)
+			}
+		}
+		udpstate[i].RetCodes = make(map[int]int64)
+		udpstate[i].Destination = total.Destination
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones.
+	keys := []int{}
+	for i := 0; i < numThreads; i++ {
+		for k := range udpstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += udpstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	sort.Ints(keys)
+	totalCount := float64(total.DurationHistogram.Count)
+	for _, k := range keys {
+		fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+		if k != OK {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udprunner
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer starts an udp server echoing back the datagrams, except the
+// ones starting with "drop", and returns its udp:// url.
+func echoServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if bytes.HasPrefix(buf[:n], []byte("drop")) {
+				continue
+			}
+			conn.WriteTo(buf[:n], addr) // nolint: errcheck
+		}
+	}()
+	return UDPURLPrefix + conn.LocalAddr().String()
+}
+
+func TestUDPRunner(t *testing.T) {
+	dest := echoServer(t)
+	opts := UDPRunnerOptions{UDPOptions: UDPOptions{Destination: dest}}
+	opts.QPS = 100
+	opts.NumThreads = 2
+	opts.Exactly = 20
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[OK] != 20 || res.DurationHistogram.Count != 20 {
+		t.Errorf("expected 20 ok round trips, got %v (%d)", res.RetCodes, res.DurationHistogram.Count)
+	}
+}
+
+func TestUDPRunnerTimeout(t *testing.T) {
+	dest := echoServer(t)
+	opts := UDPRunnerOptions{UDPOptions: UDPOptions{
+		Destination: dest,
+		Payload:     []byte("drop me"),
+		ReqTimeout:  50 * time.Millisecond,
+	}}
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 6
+	start := time.Now()
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[Timeout] != 6 {
+		t.Errorf("expected 6 timeouts, got %v", res.RetCodes)
+	}
+	// 3 sequential timeouts per thread
+	if d := time.Since(start); d > 1*time.Second {
+		t.Errorf("timeouts took too long: %v", d)
+	}
+	if avg := res.DurationHistogram.Avg; avg < 0.050 || avg > 0.5 {
+		t.Errorf("expected calls to take about the 50ms timeout, got %g", avg)
+	}
+	// Without AllowInitialErrors the warmup timeout aborts
+	opts.Exactly = 0
+	opts.Duration = 10 * time.Millisecond
+	if _, err = RunUDPTest(&opts); err == nil {
+		t.Errorf("expected initial timeout error")
+	}
+	if _, err = NewUDPClient(&UDPOptions{Destination: "udp://noport"}); err == nil {
+		t.Errorf("expected error for destination without port")
+	}
+}
+
+func TestUDPClientLateResponse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	// Responds "response N" to the Nth request, the first one just after the
+	// client's ReqTimeout.
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for i := 1; ; i++ {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if i == 1 {
+				time.Sleep(70 * time.Millisecond)
+			}
+			conn.WriteTo([]byte(fmt.Sprintf("response %d", i)), addr) // nolint: errcheck
+		}
+	}()
+	c, err := NewUDPClient(&UDPOptions{Destination: UDPURLPrefix + conn.LocalAddr().String(), ReqTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if code, _ := c.Fetch(); code != Timeout {
+		t.Errorf("expected a timeout for the first request, got %d", code)
+	}
+	time.Sleep(100 * time.Millisecond) // the late response arrives
+	for i := 2; i <= 3; i++ {
+		code, data := c.Fetch()
+		if expected := fmt.Sprintf("response %d", i); code != OK || string(data) != expected {
+			t.Errorf("expected %q, got %d %q", expected, code, data)
+		}
+	}
+}
@@ -180,6 +180,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		out = fhttp.NewHTMLEscapeWriter(w)
 	}
 	n, _ := strconv.ParseInt(r.FormValue("n"), 10, 64) // nolint: gas
+	if n > 0 {
+		dur = 0 // the form's exactly count is instead of the duration
+	}
 	if strings.TrimSpace(url) == "" {
 		url = "http://url.needed" // just because url validation doesn't like empty urls
 	}
@@ -0,0 +1,191 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+// Minimal RFC 6455 framing: what's needed for echo round trips (no
+// extensions, fragmented messages are reassembled, pings are answered).
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+)
+
+// Frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const (
+	closeNormal   = 1000
+	closeNoStatus = 1005 // close frame without status code
+	// maxMessageSize bounds the size of the messages read.
+	maxMessageSize = 16 << 20
+)
+
+// wsConn is a websocket connection.
+type wsConn struct {
+	net.Conn
+	br   *bufio.Reader
+	rand *rand.Rand // masking keys of the written frames, nil for none
+	rbuf []byte     // reused read frame buffer
+	wbuf []byte     // reused write frame buffer
+	msg  []byte     // reused message buffer
+}
+
+// closePayload is the payload of a close frame with the status code.
+func closePayload(code int) []byte {
+	return []byte{byte(code >> 8), byte(code)}
+}
+
+// writeFrame writes a final frame of the opcode with the payload.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFragment(true, opcode, payload)
+}
+
+// writeFragment writes a frame of the opcode with the payload, final or not.
+func (c *wsConn) writeFragment(fin bool, opcode byte, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	buf := append(c.wbuf[:0], first)
+	var maskBit byte
+	if c.rand != nil {
+		maskBit = 0x80
+	}
+	n := len(payload)
+	switch {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		buf = append(buf, l[:]...)
+	}
+	start := len(buf)
+	if c.rand != nil {
+		var mask [4]byte
+		binary.BigEndian.PutUint32(mask[:], c.rand.Uint32())
+		buf = append(buf, mask[:]...)
+		start += 4
+		buf = append(buf, payload...)
+		for i := start; i < len(buf); i++ {
+			buf[i] ^= mask[(i-start)%4]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	c.wbuf = buf
+	_, err := c.Write(buf)
+	return err
+}
+
+// readFrame reads the next frame, its payload is only valid until the next
+// call.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode, masked := h[0]&0x80 != 0, h[0]&0x0f, h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, h[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(h[:])
+	}
+	if n > maxMessageSize {
+		return false, 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", n)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	if uint64(cap(c.rbuf)) < n {
+		c.rbuf = make([]byte, n)
+	}
+	payload := c.rbuf[:n]
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// readMessage reads the next (text or binary) message, answering the pings.
+// Returns OK and the message (only valid until the next call), the status
+// code and an error for a close frame, or SocketError and the error.
+func (c *wsConn) readMessage() (int, []byte, error) {
+	c.msg = c.msg[:0]
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return SocketError, c.msg, err
+		}
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return SocketError, c.msg, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code, reason := closeNoStatus, ""
+			var echo []byte // 1005 must not be sent: empty close frame answer
+			if len(payload) >= 2 {
+				code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+				echo = closePayload(code)
+			}
+			c.writeFrame(opClose, echo) // nolint: errcheck,gas
+			return code, c.msg, fmt.Errorf("websocket closed with status %d %q", code, reason)
+		case opText, opBinary, opContinuation:
+			c.msg = append(c.msg, payload...)
+			if len(c.msg) > maxMessageSize {
+				return SocketError, c.msg, fmt.Errorf("websocket message of more than %d bytes", maxMessageSize)
+			}
+			if fin {
+				return OK, c.msg, nil
+			}
+		default:
+			return SocketError, c.msg, fmt.Errorf("unexpected websocket opcode %d", opcode)
+		}
+	}
+}
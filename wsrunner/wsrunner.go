@@ -0,0 +1,368 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wsrunner is a WebSocket (echo round trip) load runner.
+package wsrunner // import "istio.io/fortio/wsrunner"
+
+import (
+	"bufio"
+	cryptorand "crypto/rand"
+	"crypto/sha1" // nolint: gas
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"istio.io/fortio/fnet"
+	"istio.io/fortio/log"
+	"istio.io/fortio/periodic"
+	"istio.io/fortio/stats"
+	"istio.io/fortio/version"
+)
+
+const (
+	// WSURLPrefix and WSSURLPrefix are the prefixes of the urls handled by
+	// this runner.
+	WSURLPrefix  = "ws://"
+	WSSURLPrefix = "wss://"
+	// OK is the RetCodes key of the successful round trips. The close
+	// frames received instead of the echo are counted with their status
+	// code (e.g. 1001 for going away, 1005 when it has none).
+	OK = 0
+	// SocketError is the RetCodes key of the connect, write or read errors.
+	SocketError = -1
+	// HandshakeError is the RetCodes key of the connections which the server
+	// didn't upgrade to WebSocket.
+	HandshakeError = -2
+	// ReqTimeOutDefaultValue is the default connect and round trip timeout.
+	ReqTimeOutDefaultValue = 3 * time.Second
+)
+
+// DefaultMessage is sent when no Message is specified.
+var DefaultMessage = []byte("Fortio websocket echo message")
+
+var userAgent = "istio/fortio-" + version.Short()
+
+// WSOptions are the options of a WSClient.
+type WSOptions struct {
+	URL string // ws:// or wss:// url
+	// Message sent for each request, defaults to DefaultMessage.
+	Message []byte
+	// Binary sends the Message in binary frames instead of text ones.
+	Binary bool
+	// ReqTimeout is the connect (including the upgrade handshake) and round
+	// trip timeout.
+	ReqTimeout time.Duration
+	// Insecure doesn't verify the server certificate for wss:// urls.
+	Insecure bool
+	// TLS versions and cipher suites restrictions for wss:// urls.
+	fnet.TLSOptions
+	seed int64 // of the masking keys, set by RunWSTest, else from the time
+}
+
+// WSClient sends the message and reads the echoed one on a connection that
+// is kept open between requests (and re-opened after errors and closes).
+type WSClient struct {
+	url         string
+	addr        string // host:port
+	host        string // Host header
+	uri         string // path and query
+	tlsConfig   *tls.Config
+	message     []byte
+	opcode      byte
+	reqTimeout  time.Duration
+	conn        *wsConn
+	socketCount int
+	rand        *rand.Rand // masking keys
+	connects    *stats.Histogram
+}
+
+// NewWSClient creates a client for the options, without connecting yet.
+func NewWSClient(o *WSOptions) (*WSClient, error) {
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return nil, fmt.Errorf("bad websocket url %q: %v", o.URL, err)
+	}
+	seed := o.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := WSClient{
+		url:        o.URL,
+		host:       u.Host,
+		uri:        u.RequestURI(),
+		message:    o.Message,
+		opcode:     opText,
+		reqTimeout: o.ReqTimeout,
+		rand:       rand.New(rand.NewSource(seed)), // nolint: gas
+		connects:   stats.NewHistogram(0, 0.0001),
+	}
+	port := "80"
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		port = "443"
+		c.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: o.Insecure} // nolint: gas
+		c.tlsConfig = o.TLSOptions.Apply(c.tlsConfig)
+	default:
+		return nil, fmt.Errorf("bad websocket url %q: scheme must be ws or wss", o.URL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("bad websocket url %q: no host", o.URL)
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if len(c.message) == 0 {
+		c.message = DefaultMessage
+	}
+	if o.Binary {
+		c.opcode = opBinary
+	}
+	if c.reqTimeout <= 0 {
+		c.reqTimeout = ReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// connect opens the connection and does the upgrade handshake, returning
+// the failure code (SocketError or HandshakeError) and error if any.
+func (c *WSClient) connect() (int, error) {
+	start := time.Now()
+	d := &net.Dialer{Timeout: c.reqTimeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
+	c.socketCount++
+	if err != nil {
+		return SocketError, err
+	}
+	ws := newWSConn(conn, c.rand)
+	if err = conn.SetDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		conn.Close() // nolint: errcheck,gas
+		return SocketError, err
+	}
+	var key [16]byte
+	if _, err = cryptorand.Read(key[:]); err != nil {
+		conn.Close() // nolint: errcheck,gas
+		return SocketError, err
+	}
+	nonce := base64.StdEncoding.EncodeToString(key[:])
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", c.uri, c.host, userAgent, nonce)
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close() // nolint: errcheck,gas
+		return SocketError, err
+	}
+	resp, err := http.ReadResponse(ws.br, nil)
+	if err != nil {
+		conn.Close() // nolint: errcheck,gas
+		return SocketError, err
+	}
+	resp.Body.Close() // nolint: errcheck,gas
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(nonce) {
+		conn.Close() // nolint: errcheck,gas
+		return HandshakeError, fmt.Errorf("websocket upgrade of %s failed: %s", c.url, resp.Status)
+	}
+	c.connects.Record(time.Since(start).Seconds())
+	c.conn = ws
+	return OK, nil
+}
+
+// Fetch sends the message and returns the code (OK, SocketError,
+// HandshakeError or the status of the close frame received) and the echoed
+// message (which is only valid until the next call).
+func (c *WSClient) Fetch() (int, []byte) {
+	reuse := c.conn != nil
+	if !reuse {
+		if code, err := c.connect(); err != nil {
+			log.Errf("Unable to connect to %s : %v", c.url, err)
+			return code, nil
+		}
+	}
+	code, data, err := c.roundTrip()
+	if err == nil {
+		return code, data
+	}
+	c.closeConn()
+	if code != SocketError {
+		log.Warnf("Connection to %s closed by the server: %v", c.url, err)
+		return code, data
+	}
+	if reuse && len(data) == 0 {
+		// ok for the (idle) reused socket to have been closed by the server once
+		log.Infof("Retrying on new connection after error on reused one to %s : %v", c.url, err)
+		return c.Fetch()
+	}
+	log.Errf("Error talking to %s : %v", c.url, err)
+	return code, data
+}
+
+// roundTrip writes the message and reads the echo on the current conn.
+func (c *WSClient) roundTrip() (int, []byte, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		return SocketError, nil, err
+	}
+	if err := c.conn.writeFrame(c.opcode, c.message); err != nil {
+		return SocketError, nil, err
+	}
+	return c.conn.readMessage()
+}
+
+func (c *WSClient) closeConn() {
+	if c.conn == nil {
+		return
+	}
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("Error closing websocket connection to %s : %v", c.url, err)
+	}
+	c.conn = nil
+}
+
+// Close sends a close frame, closes the connection and returns how many
+// sockets have been used.
+func (c *WSClient) Close() int {
+	if c.conn != nil {
+		c.conn.SetDeadline(time.Now().Add(c.reqTimeout))      // nolint: errcheck,gas
+		c.conn.writeFrame(opClose, closePayload(closeNormal)) // nolint: errcheck,gas
+	}
+	c.closeConn()
+	return c.socketCount
+}
+
+// WSRunnerResults is the aggregated result of a WebSocket run.
+// Also is the internal type used per thread/goroutine.
+type WSRunnerResults struct {
+	periodic.RunnerResults
+	client      *WSClient
+	RetCodes    map[int]int64
+	URL         string
+	SocketCount int
+	// Durations of the successful connections' establishment (connect, TLS
+	// and upgrade handshakes), in seconds.
+	ConnectHistogram *stats.HistogramData
+	// code of the last call, for LastCall()
+	lastCode int
+}
+
+// Run does one round trip. To be set as the Function in RunnerOptions.
+func (wsstate *WSRunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	code, _ := wsstate.client.Fetch()
+	wsstate.RetCodes[code]++
+	wsstate.lastCode = code
+}
+
+// LastCall returns the code and url of the last call (periodic.CallRecorder).
+func (wsstate *WSRunnerResults) LastCall() (int, string) {
+	return wsstate.lastCode, wsstate.URL
+}
+
+// WSRunnerOptions includes the base RunnerOptions plus websocket specific
+// options.
+type WSRunnerOptions struct {
+	periodic.RunnerOptions
+	WSOptions
+	AllowInitialErrors bool // whether initial errors don't cause an abort
+}
+
+// RunWSTest runs a websocket test and returns the aggregated stats.
+func RunWSTest(o *WSRunnerOptions) (*WSRunnerResults, error) {
+	o.RunType = "WebSocket"
+	log.Infof("Starting websocket test for %s with %d threads at %.1f qps", o.URL, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := WSRunnerResults{
+		RetCodes: make(map[int]int64),
+		URL:      o.URL,
+	}
+	wsstate := make([]WSRunnerResults, numThreads)
+	for i := 0; i < numThreads; i++ {
+		r.Options().Runners[i] = &wsstate[i]
+		// Create a client and connect once for each 'thread'
+		var err error
+		wo := o.WSOptions
+		wo.seed = r.Options().SubSeed("masks", i)
+		if wsstate[i].client, err = NewWSClient(&wo); err != nil {
+			return nil, err
+		}
+		if o.Exactly <= 0 {
+			code, data := wsstate[i].client.Fetch()
+			if !o.AllowInitialErrors && code != OK {
+				return nil, fmt.Errorf("error %d for %s", code, o.URL)
+			}
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: code %d, received %d: %q", o.URL, code, len(data), data)
+			}
+		}
+		wsstate[i].RetCodes = make(map[int]int64)
+		wsstate[i].URL = total.URL
+	}
+	total.RunnerResults = r.Run()
+	// Numthreads may have reduced but it should be ok to accumulate 0s from
+	// unused ones. We also must cleanup all the created clients.
+	keys := []int{}
+	connects := stats.NewHistogram(0, 0.0001)
+	for i := 0; i < numThreads; i++ {
+		total.SocketCount += wsstate[i].client.Close()
+		connects.Transfer(wsstate[i].client.connects)
+		for k := range wsstate[i].RetCodes {
+			if _, exists := total.RetCodes[k]; !exists {
+				keys = append(keys, k)
+			}
+			total.RetCodes[k] += wsstate[i].RetCodes[k]
+		}
+	}
+	// Cleanup state:
+	r.Options().ReleaseRunners()
+	sort.Ints(keys)
+	totalCount := float64(total.DurationHistogram.Count)
+	fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	total.ConnectHistogram = connects.Export().CalcPercentiles(r.Options().Percentiles)
+	if log.Log(log.Warning) {
+		connects.Counter.Print(out, "Connection times")
+	}
+	for _, k := range keys {
+		fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+		if k != OK {
+			total.ErrorCount += total.RetCodes[k]
+		}
+	}
+	return &total, total.CheckErrorRate(r.Options().MaxErrorRate)
+}
+
+// acceptKey is the Sec-WebSocket-Accept value for the Sec-WebSocket-Key nonce.
+func acceptKey(nonce string) string {
+	h := sha1.New()                                                 // nolint: gas
+	h.Write([]byte(nonce + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11")) // nolint: errcheck,gas
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newWSConn wraps conn, masking the frames it writes when masks isn't nil
+// (client side).
+func newWSConn(conn net.Conn, masks *rand.Rand) *wsConn {
+	return &wsConn{Conn: conn, br: bufio.NewReader(conn), rand: masks}
+}
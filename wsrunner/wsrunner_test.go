@@ -0,0 +1,188 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoHandler upgrades the connection to websocket and echoes back the
+// messages, in 2 fragments and after a ping. On /close/ it answers each
+// message with a close frame of status 4000 instead.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "not a websocket upgrade", http.StatusNotFound)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()                                                                                    // nolint: errcheck
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" + // nolint: errcheck
+		"Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if brw.Flush() != nil {
+		return
+	}
+	ws := &wsConn{Conn: conn, br: brw.Reader}
+	for {
+		code, msg, err := ws.readMessage()
+		if err != nil || code != OK {
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/close/") {
+			ws.writeFrame(opClose, append(closePayload(4000), "bye"...)) // nolint: errcheck
+			return
+		}
+		msg = append([]byte{}, msg...)
+		half := len(msg) / 2
+		ws.writeFrame(opPing, []byte("ping"))       // nolint: errcheck
+		ws.writeFragment(false, opText, msg[:half]) // nolint: errcheck
+		ws.writeFrame(opContinuation, msg[half:])   // nolint: errcheck
+	}
+}
+
+func TestWSRunner(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(echoHandler))
+	defer tlsSrv.Close()
+	ws := "ws" + strings.TrimPrefix(srv.URL, "http")
+	wss := "wss" + strings.TrimPrefix(tlsSrv.URL, "https")
+	tests := []struct {
+		opts    WSOptions
+		code    int
+		sockets int
+	}{
+		{WSOptions{URL: ws + "/echo"}, OK, 2},
+		{WSOptions{URL: ws + "/echo?x=1", Message: []byte("hello"), Binary: true}, OK, 2},
+		{WSOptions{URL: wss + "/echo", Insecure: true}, OK, 2},
+		{WSOptions{URL: ws + "/close/"}, 4000, 20},       // reconnects after each close
+		{WSOptions{URL: wss + "/echo"}, SocketError, 20}, // self signed certificate
+	}
+	for _, tst := range tests {
+		opts := WSRunnerOptions{WSOptions: tst.opts}
+		opts.QPS = 100
+		opts.NumThreads = 2
+		opts.Exactly = 20
+		res, err := RunWSTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[tst.code] != 20 || res.DurationHistogram.Count != 20 {
+			t.Errorf("%s: expected 20 calls with code %d, got %v (%d)", tst.opts.URL, tst.code, res.RetCodes,
+				res.DurationHistogram.Count)
+		}
+		if res.SocketCount != tst.sockets {
+			t.Errorf("%s: expected %d sockets, got %d", tst.opts.URL, tst.sockets, res.SocketCount)
+		}
+		if tst.code != SocketError && res.ConnectHistogram.Count != int64(tst.sockets) {
+			t.Errorf("%s: expected %d connect times, got %d", tst.opts.URL, tst.sockets, res.ConnectHistogram.Count)
+		}
+	}
+}
+
+func TestWSClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(echoHandler))
+	defer srv.Close()
+	ws := "ws" + strings.TrimPrefix(srv.URL, "http")
+	for _, u := range []string{"http://localhost/", "ws://", "ws://[::1/"} {
+		if _, err := NewWSClient(&WSOptions{URL: u}); err == nil {
+			t.Errorf("expected error for bad url %q", u)
+		}
+	}
+	msg := bytes.Repeat([]byte("0123456789"), 7000) // > 64k: 8 bytes length frames
+	c, err := NewWSClient(&WSOptions{URL: ws + "/echo", Message: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, data := c.Fetch()
+	if code != OK || !bytes.Equal(data, msg) {
+		t.Errorf("expected echo of the %d bytes message, got %d %d bytes", len(msg), code, len(data))
+	}
+	if n := c.Close(); n != 1 {
+		t.Errorf("expected 1 socket, got %d", n)
+	}
+	// Not upgraded:
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	c, err = NewWSClient(&WSOptions{URL: "ws" + strings.TrimPrefix(plain.URL, "http") + "/echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = c.Fetch(); code != HandshakeError {
+		t.Errorf("expected handshake error, got %d", code)
+	}
+	// Closed port:
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := WSURLPrefix + listener.Addr().String()
+	listener.Close() // nolint: errcheck
+	opts := WSRunnerOptions{WSOptions: WSOptions{URL: closed, ReqTimeout: 100 * time.Millisecond}}
+	opts.QPS = -1
+	opts.Exactly = 5
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[SocketError] != 5 {
+		t.Errorf("expected 5 socket errors, got %v", res.RetCodes)
+	}
+	opts.Exactly = 0
+	opts.Duration = 10 * time.Millisecond
+	if _, err = RunWSTest(&opts); err == nil {
+		t.Errorf("expected initial error without AllowInitialErrors")
+	}
+}
+
+func TestCloseAnswer(t *testing.T) {
+	for _, tst := range []struct {
+		payload  []byte
+		code     int
+		expected []byte // payload of the answer
+	}{
+		{append(closePayload(4000), "bye"...), 4000, closePayload(4000)},
+		{nil, closeNoStatus, []byte{}}, // 1005 isn't sent back
+	} {
+		client, server := net.Pipe()
+		c := &wsConn{Conn: client, br: bufio.NewReader(client), rand: rand.New(rand.NewSource(1))}
+		s := &wsConn{Conn: server, br: bufio.NewReader(server)}
+		go s.writeFrame(opClose, tst.payload) // nolint: errcheck
+		codes := make(chan int, 1)
+		go func() {
+			code, _, _ := c.readMessage()
+			codes <- code
+		}()
+		_, opcode, payload, err := s.readFrame()
+		if err != nil || opcode != opClose || !bytes.Equal(payload, tst.expected) {
+			t.Errorf("close %q: unexpected answer %d %q (%v)", tst.payload, opcode, payload, err)
+		}
+		if code := <-codes; code != tst.code {
+			t.Errorf("close %q: got code %d instead of %d", tst.payload, code, tst.code)
+		}
+		client.Close() // nolint: errcheck
+		server.Close() // nolint: errcheck
+	}
+}